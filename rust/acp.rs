@@ -14,6 +14,10 @@
 //!
 //! You can use any bidirectional stream that implements `AsyncRead` and `AsyncWrite`.
 //!
+//! Messages are newline-delimited JSON. Once both sides set the `compression`
+//! capability during initialization, large messages are sent compressed, which
+//! helps with big embedded resources over slow links.
+//!
 //! ## Core Components
 //!
 //! - **Agent**: Programs that use generative AI to autonomously modify code
@@ -56,11 +60,18 @@ mod content;
 mod error;
 mod ext;
 mod plan;
+mod process;
+mod prompt_queue;
+mod proxy;
+mod redact;
 mod rpc;
 #[cfg(test)]
 mod rpc_tests;
+mod session_id;
+mod stderr;
 mod stream_broadcast;
 mod tool_call;
+mod transcript;
 mod version;
 
 pub use agent::*;
@@ -69,21 +80,51 @@ pub use content::*;
 pub use error::*;
 pub use ext::*;
 pub use plan::*;
+pub use process::*;
+pub use prompt_queue::*;
+pub use proxy::*;
+pub use redact::*;
+pub use rpc::{
+    CANCEL_REQUEST_METHOD_NAME, NotificationPriority, OutboundQueuePolicy, PendingRequest,
+    RequestId, inbound_request_id,
+};
 pub use serde_json::value::RawValue;
+pub use session_id::*;
+pub use stderr::*;
 pub use stream_broadcast::{
     StreamMessage, StreamMessageContent, StreamMessageDirection, StreamReceiver,
 };
 pub use tool_call::*;
+pub use transcript::*;
 pub use version::*;
 
 use anyhow::Result;
-use futures::{AsyncRead, AsyncWrite, Future, future::LocalBoxFuture};
+use futures::{
+    AsyncRead, AsyncReadExt as _, AsyncWrite, Future, FutureExt as _,
+    channel::oneshot,
+    future::{self, Either, LocalBoxFuture},
+};
+use parking_lot::Mutex;
 use schemars::JsonSchema;
-use serde::{Deserialize, Serialize};
-use std::{fmt, sync::Arc};
+use serde::{Deserialize, Serialize, de::DeserializeOwned};
+use std::{
+    collections::{HashMap, hash_map::Entry},
+    fmt,
+    path::{Path, PathBuf},
+    sync::{
+        Arc, LazyLock,
+        atomic::{AtomicBool, AtomicU64, Ordering},
+    },
+    time::{Duration, Instant},
+};
 
 use crate::rpc::{MessageHandler, RpcConnection, Side};
 
+/// The method name of session updates, shared so that streaming chunks
+/// doesn't allocate it for every one of them.
+static SESSION_UPDATE_METHOD: LazyLock<Arc<str>> =
+    LazyLock::new(|| SESSION_UPDATE_NOTIFICATION.into());
+
 /// A unique identifier for a conversation session between a client and agent.
 ///
 /// Sessions maintain their own context, conversation history, and state,
@@ -121,6 +162,15 @@ impl fmt::Display for SessionId {
 /// See protocol docs: [Client](https://agentclientprotocol.com/protocol/overview#client)
 pub struct ClientSideConnection {
     conn: RpcConnection<ClientSide, AgentSide>,
+    enforce_absolute_paths: Arc<AtomicBool>,
+    permission_policy: Arc<Mutex<Option<SharedPermissionPolicy>>>,
+    turn_policies: Arc<TurnPolicies>,
+    drains: Arc<DrainTracker>,
+    custom_methods: Arc<CustomMethods>,
+    compression: Arc<AtomicBool>,
+    agent_info: Mutex<Option<Implementation>>,
+    agent_capabilities: Mutex<Option<AgentCapabilities>>,
+    protocol_version: Mutex<Option<ProtocolVersion>>,
 }
 
 impl ClientSideConnection {
@@ -149,8 +199,198 @@ impl ClientSideConnection {
         incoming_bytes: impl Unpin + AsyncRead,
         spawn: impl Fn(LocalBoxFuture<'static, ()>) + 'static,
     ) -> (Self, impl Future<Output = Result<()>>) {
-        let (conn, io_task) = RpcConnection::new(client, outgoing_bytes, incoming_bytes, spawn);
-        (Self { conn }, io_task)
+        let enforce_absolute_paths = Arc::new(AtomicBool::new(false));
+        let permission_policy = Arc::new(Mutex::new(None));
+        let turn_policies = Arc::new(TurnPolicies::default());
+        let drains = Arc::new(DrainTracker::default());
+        let custom_methods = Arc::new(CustomMethods::new(CLIENT_METHOD_NAMES));
+        let compression = Arc::new(AtomicBool::new(false));
+        let handler = ClientHandler {
+            client,
+            enforce_absolute_paths: enforce_absolute_paths.clone(),
+            permission_policy: permission_policy.clone(),
+            turn_policies: turn_policies.clone(),
+            drains: drains.clone(),
+            custom_methods: custom_methods.clone(),
+        };
+        let (conn, io_task) = RpcConnection::new(
+            handler,
+            compression.clone(),
+            outgoing_bytes,
+            incoming_bytes,
+            spawn,
+        );
+        (
+            Self {
+                conn,
+                enforce_absolute_paths,
+                permission_policy,
+                turn_policies,
+                drains,
+                custom_methods,
+                compression,
+                agent_info: Mutex::new(None),
+                agent_capabilities: Mutex::new(None),
+                protocol_version: Mutex::new(None),
+            },
+            io_task,
+        )
+    }
+
+    /// Moves this connection onto a new pair of byte streams, e.g. after the
+    /// agent process was relaunched.
+    ///
+    /// Any request still awaiting a response from the previous agent fails
+    /// with [`Error::connection_reset`], so it can be retried once the new
+    /// agent is initialized, and the I/O future for the previous streams
+    /// completes. The client handler and stream subscribers are preserved,
+    /// but the new agent starts without any state: the client is expected to
+    /// call [`Agent::initialize`] again and create or load its sessions.
+    ///
+    /// Returns an I/O future that must be spawned to handle communication
+    /// over the new streams.
+    pub fn reattach<W, R>(
+        &self,
+        outgoing_bytes: W,
+        incoming_bytes: R,
+    ) -> impl Future<Output = Result<()>> + use<W, R>
+    where
+        W: Unpin + AsyncWrite,
+        R: Unpin + AsyncRead,
+    {
+        // The new agent has no turns left to drain, and only reads compressed
+        // messages once it was initialized again.
+        self.drains.clear();
+        self.compression.store(false, Ordering::Relaxed);
+        self.conn.reattach(outgoing_bytes, incoming_bytes)
+    }
+
+    /// Rejects `fs/read_text_file` and `fs/write_text_file` requests whose path
+    /// is not absolute with an `invalid_params` error, before they reach the client.
+    ///
+    /// Disabled by default.
+    ///
+    /// See protocol docs: [File System](https://agentclientprotocol.com/protocol/file-system)
+    pub fn set_enforce_absolute_paths(&self, enforce: bool) {
+        self.enforce_absolute_paths
+            .store(enforce, Ordering::Relaxed);
+    }
+
+    /// Answers `session/request_permission` requests with `policy` where it
+    /// makes a decision, before they reach the client.
+    ///
+    /// Requests the policy leaves undecided are passed on to
+    /// [`Client::request_permission`] as usual.
+    ///
+    /// See protocol docs: [Requesting Permission](https://agentclientprotocol.com/protocol/tool-calls#requesting-permission)
+    pub fn set_permission_policy(&self, policy: impl PermissionPolicy + Send + 'static) {
+        *self.permission_policy.lock() = Some(Arc::new(policy));
+    }
+
+    /// Sends a prompt and answers the agent's permission requests for its
+    /// turn with `policy` until the turn ends.
+    ///
+    /// This suits non-interactive runs, e.g. an agent driven from CI, without
+    /// approving requests of other sessions or later turns. For a prompt with
+    /// a [`PromptRequest::turn_id`], the policy only applies to permission
+    /// requests carrying the same [`RequestPermissionRequest::turn_id`], so
+    /// concurrent turns of a session can have policies of their own. The policy is
+    /// consulted before the one from
+    /// [`ClientSideConnection::set_permission_policy`], and requests it leaves
+    /// undecided fall back to that policy and then to
+    /// [`Client::request_permission`]. It is removed once the turn ends or
+    /// the returned future is dropped.
+    ///
+    /// See protocol docs: [Requesting Permission](https://agentclientprotocol.com/protocol/tool-calls#requesting-permission)
+    pub async fn prompt_with_policy(
+        &self,
+        request: PromptRequest,
+        policy: impl PermissionPolicy + Send + 'static,
+    ) -> Result<PromptResponse, Error> {
+        let _scope = self.turn_policies.install(
+            (request.session_id.clone(), request.turn_id.clone()),
+            Arc::new(policy),
+        );
+        self.prompt(request).await
+    }
+
+    /// Returns the name and version the agent reported in its `initialize` response.
+    ///
+    /// This is `None` until [`Agent::initialize`] succeeds, and for agents
+    /// that don't report this information.
+    ///
+    /// See protocol docs: [Implementation Information](https://agentclientprotocol.com/protocol/initialization#implementation-information)
+    pub fn peer_info(&self) -> Option<Implementation> {
+        self.agent_info.lock().clone()
+    }
+
+    /// Returns the protocol version the agent chose in its `initialize` response.
+    ///
+    /// This is `None` until [`Agent::initialize`] succeeds.
+    ///
+    /// See protocol docs: [Protocol version](https://agentclientprotocol.com/protocol/initialization#protocol-version)
+    pub fn negotiated_protocol_version(&self) -> Option<ProtocolVersion> {
+        self.protocol_version.lock().clone()
+    }
+
+    /// Waits until the agent reports that it sent its last update for the
+    /// session's latest turn with [`SessionUpdate::Drained`].
+    ///
+    /// Resolves immediately if the session's latest turn was already drained.
+    /// This is useful after cancelling a turn, to tear down UI only once no
+    /// more updates can arrive.
+    ///
+    /// Fails with [`Error::capability_not_supported`] unless the agent
+    /// advertised [`AgentCapabilities::drain_updates`], since the agent would
+    /// otherwise never report it.
+    pub fn wait_session_drained(
+        &self,
+        session_id: &SessionId,
+    ) -> impl Future<Output = Result<(), Error>> + use<> {
+        let waiter = if self.tracks_drains() {
+            Ok(self.drains.wait(session_id))
+        } else {
+            Err(Error::capability_not_supported("drainUpdates"))
+        };
+        async move {
+            if let Some(waiter) = waiter? {
+                waiter.await.ok();
+            }
+            Ok(())
+        }
+    }
+
+    /// Whether the agent reports drained turns, see [`AgentCapabilities::drain_updates`].
+    fn tracks_drains(&self) -> bool {
+        self.agent_capabilities
+            .lock()
+            .as_ref()
+            .is_some_and(|capabilities| capabilities.drain_updates)
+    }
+
+    /// Returns the capabilities the agent advertised in its `initialize` response.
+    ///
+    /// This is `None` until [`Agent::initialize`] succeeds.
+    ///
+    /// See protocol docs: [Agent Capabilities](https://agentclientprotocol.com/protocol/initialization#agent-capabilities)
+    pub fn agent_capabilities(&self) -> Option<AgentCapabilities> {
+        self.agent_capabilities.lock().clone()
+    }
+
+    /// Adapts a prompt to the content types the agent advertised, see
+    /// [`PromptCapabilities::downgrade`].
+    ///
+    /// Before initialization only the baseline content types, text and
+    /// resource links, are kept.
+    pub fn filter_prompt(&self, mut request: PromptRequest) -> PromptRequest {
+        let capabilities = self
+            .agent_capabilities
+            .lock()
+            .as_ref()
+            .map(|capabilities| capabilities.prompt_capabilities.clone())
+            .unwrap_or_default();
+        request.prompt = capabilities.downgrade(request.prompt);
+        request
     }
 
     /// Subscribe to receive stream updates from the agent.
@@ -164,17 +404,305 @@ impl ClientSideConnection {
     pub fn subscribe(&self) -> StreamReceiver {
         self.conn.subscribe()
     }
+
+    /// Returns the number of requests sent to the agent that are still
+    /// waiting for a response.
+    pub fn pending_request_count(&self) -> usize {
+        self.conn.pending_request_count()
+    }
+
+    /// Lists the requests sent to the agent that are still waiting for a
+    /// response, oldest first, with their method and how long ago they were
+    /// sent.
+    ///
+    /// This is meant for diagnosing a connection that seems stuck, e.g. by
+    /// logging what is in flight when a turn takes unusually long.
+    pub fn pending_requests(&self) -> Vec<PendingRequest> {
+        self.conn.pending_requests()
+    }
+
+    /// Fails every request to the agent that has been waiting for a response
+    /// for longer than `max_age` with [`Error::request_timeout`], returning
+    /// how many were failed.
+    ///
+    /// A peer that never answers would otherwise keep these requests pending
+    /// for the lifetime of the connection. Call this periodically from your
+    /// own timer, or spawn [`Self::sweep_pending_requests`] to do so.
+    pub fn expire_pending_requests(&self, max_age: Duration) -> usize {
+        self.conn.expire_pending_requests(max_age)
+    }
+
+    /// Returns a future that calls [`Self::expire_pending_requests`] with
+    /// `max_age` each time the future returned by `tick` resolves.
+    ///
+    /// Since the connection doesn't depend on a particular runtime, `tick`
+    /// provides the timer, e.g. `|| tokio::time::sleep(interval)`. The
+    /// returned future must be spawned, and completes once the connection
+    /// has been dropped.
+    pub fn sweep_pending_requests<T, F>(
+        &self,
+        max_age: Duration,
+        tick: T,
+    ) -> impl Future<Output = ()> + use<T, F>
+    where
+        T: FnMut() -> F,
+        F: Future<Output = ()>,
+    {
+        self.conn.sweep_pending_requests(max_age, tick)
+    }
+
+    /// Sets whether messages from the agent must declare `"jsonrpc": "2.0"`.
+    ///
+    /// Disabled by default, so that lenient peers keep working. When enabled,
+    /// requests with a missing or different version are rejected with an
+    /// `invalid_request` error and notifications are dropped with a warning.
+    pub fn set_strict_jsonrpc(&self, strict: bool) {
+        self.conn.set_strict_jsonrpc(strict)
+    }
+
+    /// Holds back outgoing notifications until `size` bytes are pending,
+    /// writing them in fewer, larger chunks.
+    ///
+    /// Requests and responses are never delayed, and flush any buffered
+    /// notifications ahead of them. Since the connection doesn't depend on a
+    /// particular runtime, call [`Self::flush`] from your own timer or at the
+    /// end of a burst to bound how long notifications wait. A size of 0, the
+    /// default, writes every message right away.
+    pub fn set_write_buffer(&self, size: usize) {
+        self.conn.set_write_buffer(size)
+    }
+
+    /// Writes any notifications held back by [`Self::set_write_buffer`].
+    pub fn flush(&self) {
+        self.conn.flush()
+    }
+
+    /// Replaces how messages are redacted before they are logged, e.g. to
+    /// mask additional fields.
+    ///
+    /// By default, secret-looking values are masked with [`redact_secrets`].
+    /// Only logs are affected: messages are always sent and delivered as is.
+    pub fn set_redactor(&self, redactor: impl Fn(&str) -> String + Send + 'static) {
+        self.conn.set_redactor(redactor)
+    }
+
+    /// Sets whether an error from a notification handler, e.g. [`Client::session_notification`], closes
+    /// the connection.
+    ///
+    /// Errors are only logged by default. When enabled, the I/O task returned
+    /// by `new` resolves with the handler's error instead, for clients that would
+    /// rather stop than silently miss a notification.
+    pub fn set_notification_error_fatal(&self, fatal: bool) {
+        self.conn.set_notification_error_fatal(fatal)
+    }
+
+    /// Sets whether messages from the agent are handled one at a time, in the
+    /// order they were received.
+    ///
+    /// By default, each request and notification from the agent is handled
+    /// concurrently with the others. In serial mode, a handler must finish
+    /// before the next message is dispatched, which makes tests reproducible
+    /// and suits clients that can't handle messages concurrently. Responses
+    /// to requests sent to the agent are still delivered meanwhile.
+    pub fn set_serial_dispatch(&self, serial: bool) {
+        self.conn.set_serial_dispatch(serial)
+    }
+
+    /// Stops handling messages from the agent until [`ClientSideConnection::resume`]
+    /// is called, e.g. while the UI repaints or runs a migration.
+    ///
+    /// Messages are buffered in order meanwhile, and responses to requests sent
+    /// to the agent are still delivered. Once the buffer is full, see
+    /// [`ClientSideConnection::set_pause_buffer_limit`], further requests from the
+    /// agent fail right away and further notifications are dropped with a
+    /// warning.
+    pub fn pause(&self) {
+        self.conn.pause()
+    }
+
+    /// Handles the messages buffered since [`ClientSideConnection::pause`], in
+    /// the order they arrived, and resumes handling new ones.
+    pub fn resume(&self) {
+        self.conn.resume()
+    }
+
+    /// Sets how many messages are buffered while paused. Defaults to 1024.
+    pub fn set_pause_buffer_limit(&self, limit: usize) {
+        self.conn.set_pause_buffer_limit(limit)
+    }
+
+    /// Replaces how ids are chosen for requests sent to the agent.
+    ///
+    /// Requests are numbered from zero by default. Install a generator to
+    /// use string ids instead, e.g. UUIDs. Every generated id must be unique
+    /// among the requests that are still pending.
+    pub fn set_id_generator(&self, generator: impl Fn() -> RequestId + Send + 'static) {
+        self.conn.set_id_generator(generator)
+    }
+
+    /// Sends the notification named `method` to the agent.
+    ///
+    /// `method` is one of [`AGENT_METHOD_NAMES`] or an extension method
+    /// starting with `_`. The params are checked against the notification's
+    /// type before sending, and methods that expect a response are rejected
+    /// with an `invalid_request` error rather than sent without an id.
+    pub async fn notify(&self, method: &str, params: impl Serialize) -> Result<(), Error> {
+        match decode_outgoing_notification::<AgentSide>(method, params)? {
+            ClientNotification::CancelNotification(args) => self.cancel(args).await,
+            #[cfg(feature = "unstable")]
+            ClientNotification::TerminalOutputUpdateNotification(args) => {
+                self.terminal_output_update(args).await
+            }
+            ClientNotification::ExtNotification(args) => self.ext_notification(args).await,
+        }
+    }
+
+    /// Handles requests from the agent for `method`, a method that isn't part
+    /// of the protocol, e.g. one being prototyped before it is standardized.
+    ///
+    /// The params are deserialized as `P` and the handler's result is sent
+    /// back as the response. Registering a method again replaces its handler.
+    /// Protocol methods and extension methods starting with `_` can't be
+    /// registered, and are rejected with an `invalid_params` error.
+    pub fn register_method<P, R, F>(
+        &self,
+        method: &str,
+        handler: impl Fn(P) -> F + Send + 'static,
+    ) -> Result<(), Error>
+    where
+        P: DeserializeOwned,
+        R: Serialize,
+        F: Future<Output = Result<R, Error>> + 'static,
+    {
+        self.custom_methods
+            .register::<ClientSide, _, _, _>(method, handler)
+    }
+
+    /// Handles requests from the agent for methods that aren't handled
+    /// otherwise, instead of failing them with `method_not_found`, e.g. to
+    /// forward them to another process or to experiment with new methods.
+    ///
+    /// Protocol methods and methods registered with `register_method` take
+    /// precedence, and extension methods starting with `_` still go to
+    /// `ext_method`. The handler gets the method name and raw params, and its
+    /// result is sent back as the response. Setting a fallback again replaces
+    /// it.
+    pub fn set_fallback_handler<F>(&self, handler: impl Fn(ExtRequest) -> F + Send + 'static)
+    where
+        F: Future<Output = Result<ExtResponse, Error>> + 'static,
+    {
+        self.custom_methods.set_fallback(handler);
+    }
+
+    /// Turns on answering [`DISCOVER_METHOD_NAME`] requests from the agent with
+    /// the methods this connection handles, see [`AgentSideConnection::list_peer_methods`].
+    ///
+    /// Discovery is off by default, in which case the request fails with
+    /// `method_not_found`.
+    pub fn set_method_discovery(&self, enabled: bool) {
+        self.custom_methods.set_discovery(enabled);
+    }
+
+    /// Asks the agent which methods it handles.
+    ///
+    /// This is meant for diagnostics and proxies. To decide which optional
+    /// features to use, prefer the capabilities exchanged during
+    /// initialization. Fails with `method_not_found` unless the agent turned on
+    /// method discovery.
+    pub async fn list_peer_methods(&self) -> Result<Vec<String>, Error> {
+        let response: DiscoverResponse = self
+            .send_request(DISCOVER_METHOD_NAME, serde_json::Value::Null)
+            .await?;
+        Ok(response.methods)
+    }
+
+    /// Initializes the connection, giving up if the agent doesn't respond
+    /// before `timeout` completes.
+    ///
+    /// `timeout` can be any future that resolves once the deadline has elapsed,
+    /// such as `tokio::time::sleep(duration)`. An agent that hangs while
+    /// starting up would otherwise leave [`Agent::initialize`] waiting forever,
+    /// so clients that launch agents are encouraged to use this instead, with
+    /// a generous deadline of several seconds.
+    ///
+    /// On timeout, this fails with [`Error::request_timeout`], the agent is
+    /// sent a [`CANCEL_REQUEST_METHOD_NAME`] extension notification, which
+    /// reaches [`Agent::ext_notification`], and a late response from it is
+    /// ignored.
+    ///
+    /// See protocol docs: [Initialization](https://agentclientprotocol.com/protocol/initialization)
+    pub async fn initialize_with_timeout(
+        &self,
+        args: InitializeRequest,
+        timeout: impl Future<Output = ()>,
+    ) -> Result<InitializeResponse, Error> {
+        let compression = args.client_capabilities.compression;
+        let response: InitializeResponse = self
+            .conn
+            .request_with_timeout(
+                INITIALIZE_METHOD_NAME,
+                Some(ClientRequest::InitializeRequest(args)),
+                timeout,
+                ClientNotification::ExtNotification,
+            )
+            .await?
+            .ok_or_else(|| {
+                Error::request_timeout()
+                    .with_data("the agent did not respond to initialize in time")
+            })?;
+        self.record_initialize_response(compression, &response);
+        Ok(response)
+    }
+
+    /// Remembers what the agent reported in its `initialize` response, and
+    /// starts compressing messages if both sides can read them.
+    fn record_initialize_response(&self, compression: bool, response: &InitializeResponse) {
+        *self.agent_info.lock() = response.agent_info.clone();
+        *self.agent_capabilities.lock() = Some(response.agent_capabilities.clone());
+        *self.protocol_version.lock() = Some(response.protocol_version.clone());
+        self.compression.store(
+            compression && response.agent_capabilities.compression,
+            Ordering::Relaxed,
+        );
+    }
+
+    /// Sends the request named `method` to the agent and deserializes its
+    /// response as `R`.
+    ///
+    /// This is meant for methods the agent registered with
+    /// [`AgentSideConnection::register_method`]. Prefer the [`Agent`] methods for
+    /// protocol methods and [`Agent::ext_method`] for extension methods.
+    pub async fn send_request<R: DeserializeOwned + Send + 'static>(
+        &self,
+        method: &str,
+        params: impl Serialize,
+    ) -> Result<R, Error> {
+        let params = serde_json::value::to_raw_value(&params)?;
+        self.conn
+            .request(
+                method,
+                Some(ClientRequest::CustomMethodRequest(ExtRequest {
+                    method: method.into(),
+                    params: params.into(),
+                })),
+            )
+            .await
+    }
 }
 
 #[async_trait::async_trait(?Send)]
 impl Agent for ClientSideConnection {
     async fn initialize(&self, args: InitializeRequest) -> Result<InitializeResponse, Error> {
-        self.conn
+        let compression = args.client_capabilities.compression;
+        let response: InitializeResponse = self
+            .conn
             .request(
                 INITIALIZE_METHOD_NAME,
                 Some(ClientRequest::InitializeRequest(args)),
             )
-            .await
+            .await?;
+        self.record_initialize_response(compression, &response);
+        Ok(response)
     }
 
     async fn authenticate(&self, args: AuthenticateRequest) -> Result<AuthenticateResponse, Error> {
@@ -197,6 +725,7 @@ impl Agent for ClientSideConnection {
     }
 
     async fn load_session(&self, args: LoadSessionRequest) -> Result<LoadSessionResponse, Error> {
+        self.drains.end(&args.session_id);
         self.conn
             .request::<Option<_>>(
                 SESSION_LOAD_METHOD_NAME,
@@ -219,6 +748,9 @@ impl Agent for ClientSideConnection {
     }
 
     async fn prompt(&self, args: PromptRequest) -> Result<PromptResponse, Error> {
+        if self.tracks_drains() {
+            self.drains.begin(&args.session_id, args.turn_id.clone());
+        }
         self.conn
             .request(
                 SESSION_PROMPT_METHOD_NAME,
@@ -247,6 +779,71 @@ impl Agent for ClientSideConnection {
             .await
     }
 
+    #[cfg(feature = "unstable")]
+    async fn cancel_tool_call(
+        &self,
+        args: CancelToolCallRequest,
+    ) -> Result<CancelToolCallResponse, Error> {
+        self.conn
+            .request::<Option<_>>(
+                SESSION_CANCEL_TOOL_CALL_METHOD_NAME,
+                Some(ClientRequest::CancelToolCallRequest(args)),
+            )
+            .await
+            .map(Option::unwrap_or_default)
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn terminal_output_update(
+        &self,
+        args: TerminalOutputUpdateNotification,
+    ) -> Result<(), Error> {
+        self.conn.notify(
+            TERMINAL_OUTPUT_UPDATE_METHOD_NAME,
+            Some(ClientNotification::TerminalOutputUpdateNotification(args)),
+        )
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn list_sessions(
+        &self,
+        args: ListSessionsRequest,
+    ) -> Result<ListSessionsResponse, Error> {
+        self.conn
+            .request(
+                SESSION_LIST_METHOD_NAME,
+                Some(ClientRequest::ListSessionsRequest(args)),
+            )
+            .await
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn list_session_flags(
+        &self,
+        args: ListSessionFlagsRequest,
+    ) -> Result<ListSessionFlagsResponse, Error> {
+        self.conn
+            .request(
+                SESSION_LIST_FLAGS_METHOD_NAME,
+                Some(ClientRequest::ListSessionFlagsRequest(args)),
+            )
+            .await
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn set_session_flag(
+        &self,
+        args: SetSessionFlagRequest,
+    ) -> Result<SetSessionFlagResponse, Error> {
+        self.conn
+            .request::<Option<_>>(
+                SESSION_SET_FLAG_METHOD_NAME,
+                Some(ClientRequest::SetSessionFlagRequest(args)),
+            )
+            .await
+            .map(Option::unwrap_or_default)
+    }
+
     async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
         self.conn
             .request(
@@ -306,6 +903,18 @@ impl Side for ClientSide {
             TERMINAL_WAIT_FOR_EXIT_METHOD_NAME => serde_json::from_str(params.get())
                 .map(AgentRequest::WaitForTerminalExitRequest)
                 .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            RESOURCE_READ_METHOD_NAME => serde_json::from_str(params.get())
+                .map(AgentRequest::ReadResourceRequest)
+                .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            CLIENT_OPEN_METHOD_NAME => serde_json::from_str(params.get())
+                .map(AgentRequest::OpenRequest)
+                .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            SESSION_REQUEST_INPUT_METHOD_NAME => serde_json::from_str(params.get())
+                .map(AgentRequest::RequestInputRequest)
+                .map_err(Into::into),
             _ => {
                 if let Some(custom_method) = method.strip_prefix('_') {
                     Ok(AgentRequest::ExtMethodRequest(ExtRequest {
@@ -319,6 +928,13 @@ impl Side for ClientSide {
         }
     }
 
+    fn decode_custom_request(method: &str, params: Option<&RawValue>) -> Option<AgentRequest> {
+        Some(AgentRequest::CustomMethodRequest(ExtRequest {
+            method: method.into(),
+            params: params.unwrap_or(RawValue::NULL).to_owned().into(),
+        }))
+    }
+
     fn decode_notification(
         method: &str,
         params: Option<&RawValue>,
@@ -343,77 +959,445 @@ impl Side for ClientSide {
     }
 }
 
-impl<T: Client> MessageHandler<ClientSide> for T {
-    async fn handle_request(&self, request: AgentRequest) -> Result<ClientResponse, Error> {
-        match request {
-            AgentRequest::RequestPermissionRequest(args) => {
-                let response = self.request_permission(args).await?;
-                Ok(ClientResponse::RequestPermissionResponse(response))
-            }
-            AgentRequest::WriteTextFileRequest(args) => {
-                let response = self.write_text_file(args).await?;
-                Ok(ClientResponse::WriteTextFileResponse(response))
-            }
-            AgentRequest::ReadTextFileRequest(args) => {
-                let response = self.read_text_file(args).await?;
-                Ok(ClientResponse::ReadTextFileResponse(response))
-            }
-            AgentRequest::CreateTerminalRequest(args) => {
-                let response = self.create_terminal(args).await?;
-                Ok(ClientResponse::CreateTerminalResponse(response))
-            }
-            AgentRequest::TerminalOutputRequest(args) => {
-                let response = self.terminal_output(args).await?;
-                Ok(ClientResponse::TerminalOutputResponse(response))
-            }
-            AgentRequest::ReleaseTerminalRequest(args) => {
-                let response = self.release_terminal(args).await?;
-                Ok(ClientResponse::ReleaseTerminalResponse(response))
-            }
-            AgentRequest::WaitForTerminalExitRequest(args) => {
-                let response = self.wait_for_terminal_exit(args).await?;
-                Ok(ClientResponse::WaitForTerminalExitResponse(response))
-            }
-            AgentRequest::KillTerminalCommandRequest(args) => {
-                let response = self.kill_terminal_command(args).await?;
-                Ok(ClientResponse::KillTerminalResponse(response))
-            }
-            AgentRequest::ExtMethodRequest(args) => {
-                let response = self.ext_method(args).await?;
-                Ok(ClientResponse::ExtMethodResponse(response))
-            }
-        }
-    }
+/// Decodes the raw JSON params of a `session/update` notification.
+///
+/// This and the other `parse_*` functions decode messages without a
+/// connection, for tools such as log viewers and trace analyzers that work
+/// with recorded messages. They take the `params` of a JSON-RPC message, not
+/// the whole message.
+pub fn parse_session_notification(params: &str) -> Result<SessionNotification, Error> {
+    serde_json::from_str(params).map_err(Into::into)
+}
 
-    async fn handle_notification(&self, notification: AgentNotification) -> Result<(), Error> {
-        match notification {
-            AgentNotification::SessionNotification(args) => {
-                self.session_notification(args).await?;
-            }
-            AgentNotification::ExtNotification(args) => {
-                self.ext_notification(args).await?;
-            }
+/// Decodes the raw JSON params of the request `method` sent by an agent to a
+/// client, such as `fs/read_text_file`.
+///
+/// Fails with `method_not_found` if `method` isn't an agent request.
+pub fn parse_agent_request(method: &str, params: &str) -> Result<AgentRequest, Error> {
+    ClientSide::decode_request(method, Some(serde_json::from_str(params)?))
+}
+
+/// Decodes the raw JSON params of the notification `method` sent by an agent to
+/// a client, such as `session/update`.
+///
+/// Fails with `method_not_found` if `method` isn't an agent notification.
+pub fn parse_agent_notification(method: &str, params: &str) -> Result<AgentNotification, Error> {
+    ClientSide::decode_notification(method, Some(serde_json::from_str(params)?))
+}
+
+/// Decodes the raw JSON params of the request `method` sent by a client to an
+/// agent, such as `session/prompt`.
+///
+/// Fails with `method_not_found` if `method` isn't a client request.
+pub fn parse_client_request(method: &str, params: &str) -> Result<ClientRequest, Error> {
+    AgentSide::decode_request(method, Some(serde_json::from_str(params)?))
+}
+
+/// Decodes the raw JSON params of the notification `method` sent by a client to
+/// an agent, such as `session/cancel`.
+///
+/// Fails with `method_not_found` if `method` isn't a client notification.
+pub fn parse_client_notification(method: &str, params: &str) -> Result<ClientNotification, Error> {
+    AgentSide::decode_notification(method, Some(serde_json::from_str(params)?))
+}
+
+/// Decodes `params` as the notification `method` received by `S`, so that it
+/// can be sent through the typed methods of the connection.
+fn decode_outgoing_notification<S: Side>(
+    method: &str,
+    params: impl Serialize,
+) -> Result<S::InNotification, Error> {
+    let params = serde_json::value::to_raw_value(&params)?;
+    match S::decode_notification(method, Some(&params)) {
+        Err(error)
+            if error.code == ErrorCode::METHOD_NOT_FOUND.code
+                && !matches!(
+                    S::decode_request(method, Some(&params)),
+                    Err(error) if error.code == ErrorCode::METHOD_NOT_FOUND.code
+                ) =>
+        {
+            Err(Error::invalid_request()
+                .with_data(format!("{method} is a request and expects a response")))
         }
-        Ok(())
+        result => result,
     }
 }
 
-// Agent to Client
+type CustomMethodHandler =
+    Box<dyn Fn(Arc<RawValue>) -> LocalBoxFuture<'static, Result<ExtResponse, Error>> + Send>;
 
-/// An agent-side connection to a client.
-///
-/// This struct provides the agent's view of an ACP connection, allowing
-/// agents to communicate with clients. It implements the [`Client`] trait
-/// to provide methods for requesting permissions, accessing the file system,
-/// and sending session updates.
+type FallbackHandler =
+    Box<dyn Fn(ExtRequest) -> LocalBoxFuture<'static, Result<ExtResponse, Error>> + Send>;
+
+/// Method name for listing the methods a peer handles.
 ///
-/// See protocol docs: [Agent](https://agentclientprotocol.com/protocol/overview#agent)
-pub struct AgentSideConnection {
-    conn: RpcConnection<AgentSide, ClientSide>,
+/// Peers only answer this request once method discovery has been turned on,
+/// e.g. with [`AgentSideConnection::set_method_discovery`].
+pub const DISCOVER_METHOD_NAME: &str = "rpc.discover";
+
+/// Response to a [`DISCOVER_METHOD_NAME`] request.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DiscoverResponse {
+    /// The protocol methods and notifications the peer handles, followed by
+    /// the methods registered with `register_method`.
+    pub methods: Vec<String>,
 }
 
-impl AgentSideConnection {
-    /// Creates a new agent-side connection to a client.
+/// Methods registered at runtime with `register_method`.
+struct CustomMethods {
+    /// The protocol methods handled by this side, reported by method discovery.
+    standard_methods: Vec<String>,
+    handlers: Mutex<HashMap<Arc<str>, CustomMethodHandler>>,
+    /// Handles requests for methods that nothing else handles.
+    fallback: Mutex<Option<FallbackHandler>>,
+    discovery: AtomicBool,
+}
+
+impl CustomMethods {
+    /// Creates an empty registry for the side whose method names are
+    /// `method_names`, e.g. [`AGENT_METHOD_NAMES`].
+    fn new(method_names: impl Serialize) -> Self {
+        // The method name constants serialize to an object of method names.
+        let standard_methods = match serde_json::to_value(method_names) {
+            Ok(serde_json::Value::Object(names)) => names
+                .into_iter()
+                .filter_map(|(_, name)| name.as_str().map(Into::into))
+                .collect(),
+            _ => Vec::new(),
+        };
+        Self {
+            standard_methods,
+            handlers: Mutex::default(),
+            fallback: Mutex::default(),
+            discovery: AtomicBool::new(false),
+        }
+    }
+
+    /// Registers `handler` for `method`, unless `S` already handles it as a
+    /// protocol or extension method.
+    fn register<S, P, R, F>(
+        &self,
+        method: &str,
+        handler: impl Fn(P) -> F + Send + 'static,
+    ) -> Result<(), Error>
+    where
+        S: Side,
+        P: DeserializeOwned,
+        R: Serialize,
+        F: Future<Output = Result<R, Error>> + 'static,
+    {
+        let empty_params = RawValue::from_string("{}".into())?;
+        if !matches!(
+            S::decode_request(method, Some(&empty_params)),
+            Err(error) if error.code == ErrorCode::METHOD_NOT_FOUND.code
+        ) {
+            return Err(Error::invalid_params()
+                .with_data(format!("{method} is a protocol or extension method")));
+        }
+
+        let handler: CustomMethodHandler = Box::new(move |params| {
+            let response = serde_json::from_str(params.get()).map(&handler);
+            async move {
+                let response = response?.await?;
+                serde_json::value::to_raw_value(&response)
+                    .map(Into::into)
+                    .map_err(Error::into_internal_error)
+            }
+            .boxed_local()
+        });
+        self.handlers.lock().insert(method.into(), handler);
+        Ok(())
+    }
+
+    fn set_fallback<F>(&self, handler: impl Fn(ExtRequest) -> F + Send + 'static)
+    where
+        F: Future<Output = Result<ExtResponse, Error>> + 'static,
+    {
+        let handler: FallbackHandler = Box::new(move |request| handler(request).boxed_local());
+        *self.fallback.lock() = Some(handler);
+    }
+
+    fn set_discovery(&self, enabled: bool) {
+        self.discovery.store(enabled, Ordering::Relaxed);
+    }
+
+    /// Lists the protocol methods followed by the registered methods, sorted.
+    fn discover(&self) -> DiscoverResponse {
+        let mut registered: Vec<String> = self
+            .handlers
+            .lock()
+            .keys()
+            .map(|method| method.to_string())
+            .collect();
+        registered.sort();
+        DiscoverResponse {
+            methods: self
+                .standard_methods
+                .iter()
+                .cloned()
+                .chain(registered)
+                .collect(),
+        }
+    }
+
+    async fn call(&self, request: ExtRequest) -> Result<ExtResponse, Error> {
+        if &*request.method == DISCOVER_METHOD_NAME && self.discovery.load(Ordering::Relaxed) {
+            return serde_json::value::to_raw_value(&self.discover())
+                .map(Into::into)
+                .map_err(Error::into_internal_error);
+        }
+        let handler = self
+            .handlers
+            .lock()
+            .get(&request.method)
+            .map(|handler| handler(request.params.clone()));
+        let response = match handler {
+            Some(response) => response,
+            None => self
+                .fallback
+                .lock()
+                .as_ref()
+                .map(|fallback| fallback(request))
+                .ok_or_else(Error::method_not_found)?,
+        };
+        response.await
+    }
+}
+
+/// Wraps the client handler to apply connection-level checks before dispatching.
+struct ClientHandler<H> {
+    client: H,
+    enforce_absolute_paths: Arc<AtomicBool>,
+    permission_policy: Arc<Mutex<Option<SharedPermissionPolicy>>>,
+    turn_policies: Arc<TurnPolicies>,
+    drains: Arc<DrainTracker>,
+    custom_methods: Arc<CustomMethods>,
+}
+
+/// A permission policy shared with the handler, so it can be consulted
+/// without holding the lock it is stored under.
+type SharedPermissionPolicy = Arc<dyn PermissionPolicy + Send>;
+
+impl<H: MessageHandler<ClientSide>> MessageHandler<ClientSide> for ClientHandler<H> {
+    async fn handle_request(&self, request: AgentRequest) -> Result<ClientResponse, Error> {
+        if let AgentRequest::CustomMethodRequest(args) = request {
+            return self
+                .custom_methods
+                .call(args)
+                .await
+                .map(ClientResponse::ExtMethodResponse);
+        }
+        if self.enforce_absolute_paths.load(Ordering::Relaxed) {
+            match &request {
+                AgentRequest::ReadTextFileRequest(ReadTextFileRequest { path, .. })
+                | AgentRequest::WriteTextFileRequest(WriteTextFileRequest { path, .. }) => {
+                    if !path.is_absolute() {
+                        return Err(Error::invalid_fields([ValidationErrorData::new(
+                            "path",
+                            format!("path must be absolute: {}", path.display()),
+                        )]));
+                    }
+                }
+                _ => {}
+            }
+        }
+        if let AgentRequest::RequestPermissionRequest(args) = &request
+            && let Some(option_id) = self.decide_permission(args)
+        {
+            return Ok(ClientResponse::RequestPermissionResponse(
+                RequestPermissionResponse::selected(option_id),
+            ));
+        }
+        self.client.handle_request(request).await
+    }
+
+    async fn handle_notification(&self, notification: AgentNotification) -> Result<(), Error> {
+        if let AgentNotification::SessionNotification(args) = &notification {
+            self.drains.record(args);
+        }
+        self.client.handle_notification(notification).await
+    }
+}
+
+impl<H> ClientHandler<H> {
+    fn decide_permission(&self, request: &RequestPermissionRequest) -> Option<PermissionOptionId> {
+        let option_id = self.turn_policies.decide(request).or_else(|| {
+            let policy = self.permission_policy.lock().clone()?;
+            policy.decide(request)
+        })?;
+        if request.options.iter().any(|option| option.id == option_id) {
+            Some(option_id)
+        } else {
+            log::warn!("permission policy selected unknown option {option_id}, asking the client");
+            None
+        }
+    }
+}
+
+/// Permission policies that apply to the running turns of a session, see
+/// [`ClientSideConnection::prompt_with_policy`].
+#[derive(Default)]
+struct TurnPolicies {
+    policies: Mutex<HashMap<TurnKey, (u64, SharedPermissionPolicy)>>,
+    next_generation: AtomicU64,
+}
+
+impl TurnPolicies {
+    /// Applies `policy` to `turn` until the returned scope is dropped.
+    fn install(&self, turn: TurnKey, policy: SharedPermissionPolicy) -> TurnPolicyScope<'_> {
+        let generation = self.next_generation.fetch_add(1, Ordering::Relaxed);
+        self.policies
+            .lock()
+            .insert(turn.clone(), (generation, policy));
+        TurnPolicyScope {
+            policies: self,
+            turn,
+            generation,
+        }
+    }
+
+    fn decide(&self, request: &RequestPermissionRequest) -> Option<PermissionOptionId> {
+        let turn = (request.session_id.clone(), request.turn_id.clone());
+        let (_, policy) = self.policies.lock().get(&turn)?.clone();
+        policy.decide(request)
+    }
+}
+
+/// Removes a turn's permission policy when the turn ends.
+struct TurnPolicyScope<'a> {
+    policies: &'a TurnPolicies,
+    turn: TurnKey,
+    generation: u64,
+}
+
+impl Drop for TurnPolicyScope<'_> {
+    fn drop(&mut self) {
+        let mut policies = self.policies.policies.lock();
+        // A later turn may have installed its own policy under the same key.
+        if policies
+            .get(&self.turn)
+            .is_some_and(|(generation, _)| *generation == self.generation)
+        {
+            policies.remove(&self.turn);
+        }
+    }
+}
+
+impl<T: Client> MessageHandler<ClientSide> for T {
+    async fn handle_request(&self, request: AgentRequest) -> Result<ClientResponse, Error> {
+        match request {
+            AgentRequest::RequestPermissionRequest(args) => {
+                let response = self.request_permission(args).await?;
+                Ok(ClientResponse::RequestPermissionResponse(response))
+            }
+            AgentRequest::WriteTextFileRequest(args) => {
+                let response = self.write_text_file(args).await?;
+                Ok(ClientResponse::WriteTextFileResponse(response))
+            }
+            AgentRequest::ReadTextFileRequest(args) => {
+                let response = self.read_text_file(args).await?;
+                Ok(ClientResponse::ReadTextFileResponse(response))
+            }
+            AgentRequest::CreateTerminalRequest(args) => {
+                let response = self.create_terminal(args).await?;
+                Ok(ClientResponse::CreateTerminalResponse(response))
+            }
+            AgentRequest::TerminalOutputRequest(args) => {
+                let response = self.terminal_output(args).await?;
+                Ok(ClientResponse::TerminalOutputResponse(response))
+            }
+            AgentRequest::ReleaseTerminalRequest(args) => {
+                let response = self.release_terminal(args).await?;
+                Ok(ClientResponse::ReleaseTerminalResponse(response))
+            }
+            AgentRequest::WaitForTerminalExitRequest(args) => {
+                let response = self.wait_for_terminal_exit(args).await?;
+                Ok(ClientResponse::WaitForTerminalExitResponse(response))
+            }
+            AgentRequest::KillTerminalCommandRequest(args) => {
+                let response = self.kill_terminal_command(args).await?;
+                Ok(ClientResponse::KillTerminalResponse(response))
+            }
+            #[cfg(feature = "unstable")]
+            AgentRequest::ReadResourceRequest(args) => {
+                let response = self.read_resource(args).await?;
+                Ok(ClientResponse::ReadResourceResponse(response))
+            }
+            #[cfg(feature = "unstable")]
+            AgentRequest::OpenRequest(args) => {
+                let response = self.open(args).await?;
+                Ok(ClientResponse::OpenResponse(response))
+            }
+            #[cfg(feature = "unstable")]
+            AgentRequest::RequestInputRequest(args) => {
+                let response = self.request_input(args).await?;
+                Ok(ClientResponse::RequestInputResponse(response))
+            }
+            AgentRequest::ExtMethodRequest(args) => {
+                let response = self.ext_method(args).await?;
+                Ok(ClientResponse::ExtMethodResponse(response))
+            }
+            AgentRequest::CustomMethodRequest(_) => Err(Error::method_not_found()),
+        }
+    }
+
+    async fn handle_notification(&self, notification: AgentNotification) -> Result<(), Error> {
+        match notification {
+            AgentNotification::SessionNotification(args) => {
+                self.session_notification(args).await?;
+            }
+            AgentNotification::ExtNotification(args) => {
+                self.ext_notification(args).await?;
+            }
+        }
+        Ok(())
+    }
+}
+
+// Agent to Client
+
+/// An agent-side connection to a client.
+///
+/// This struct provides the agent's view of an ACP connection, allowing
+/// agents to communicate with clients. It implements the [`Client`] trait
+/// to provide methods for requesting permissions, accessing the file system,
+/// and sending session updates.
+///
+/// # Ordering
+///
+/// Session updates are queued synchronously when [`Client::session_notification`]
+/// is called, so updates for a session are written in the order they were
+/// submitted, even when they are sent from multiple tasks. Updates for different
+/// sessions may be freely interleaved.
+///
+/// # Cancellation
+///
+/// Sending a notification never waits for the client to read it: it is handed
+/// to the I/O task and the call returns right away. Agents can therefore send
+/// final updates while cleaning up a cancelled turn without blocking on a
+/// client that is slow or has stopped reading. If the connection has already
+/// closed, the call fails instead. The only exception is an outbound queue
+/// limited with [`OutboundQueuePolicy::Block`], see
+/// [`AgentSideConnection::set_outbound_queue_limit`].
+///
+/// See protocol docs: [Agent](https://agentclientprotocol.com/protocol/overview#agent)
+pub struct AgentSideConnection {
+    conn: RpcConnection<AgentSide, ClientSide>,
+    turns: Arc<TurnTracker>,
+    deadlines: Arc<SessionDeadlines>,
+    cancellations: Arc<TurnCancellations>,
+    session_validator: Arc<Mutex<Option<SessionValidator>>>,
+    client_info: Arc<Mutex<Option<Implementation>>>,
+    protocol_version: Arc<Mutex<Option<ProtocolVersion>>>,
+    custom_methods: Arc<CustomMethods>,
+    events: Arc<ConnectionEvents>,
+    sequence_numbers: SequenceNumbers,
+}
+
+type SessionValidator = Box<dyn Fn(&SessionId) -> bool + Send>;
+
+impl AgentSideConnection {
+    /// Creates a new agent-side connection to a client.
     ///
     /// This establishes the communication channel from the agent's perspective
     /// following the ACP specification.
@@ -438,8 +1422,169 @@ impl AgentSideConnection {
         incoming_bytes: impl Unpin + AsyncRead,
         spawn: impl Fn(LocalBoxFuture<'static, ()>) + 'static,
     ) -> (Self, impl Future<Output = Result<()>>) {
-        let (conn, io_task) = RpcConnection::new(agent, outgoing_bytes, incoming_bytes, spawn);
-        (Self { conn }, io_task)
+        let turns = Arc::new(TurnTracker::default());
+        let deadlines = Arc::new(SessionDeadlines::default());
+        let cancellations = Arc::new(TurnCancellations::default());
+        let session_validator = Arc::new(Mutex::new(None));
+        let client_info = Arc::new(Mutex::new(None));
+        let protocol_version = Arc::new(Mutex::new(None));
+        let custom_methods = Arc::new(CustomMethods::new(AGENT_METHOD_NAMES));
+        let events = Arc::new(ConnectionEvents::default());
+        let compression = Arc::new(AtomicBool::new(false));
+        let handler = AgentHandler {
+            agent,
+            turns: turns.clone(),
+            deadlines: deadlines.clone(),
+            cancellations: cancellations.clone(),
+            session_validator: session_validator.clone(),
+            client_info: client_info.clone(),
+            protocol_version: protocol_version.clone(),
+            custom_methods: custom_methods.clone(),
+            events: events.clone(),
+            compression: compression.clone(),
+        };
+        let (conn, io_task) =
+            RpcConnection::new(handler, compression, outgoing_bytes, incoming_bytes, spawn);
+        let io_task = {
+            let events = events.clone();
+            async move {
+                let result = io_task.await;
+                events.emit(ConnectionEvent::Disconnected);
+                result
+            }
+        };
+        (
+            Self {
+                conn,
+                turns,
+                deadlines,
+                cancellations,
+                session_validator,
+                client_info,
+                protocol_version,
+                custom_methods,
+                events,
+                sequence_numbers: SequenceNumbers::default(),
+            },
+            io_task,
+        )
+    }
+
+    /// Returns the name and version the client reported in its `initialize` request.
+    ///
+    /// This is `None` until the client has sent `initialize`, and for clients
+    /// that don't report this information.
+    ///
+    /// See protocol docs: [Implementation Information](https://agentclientprotocol.com/protocol/initialization#implementation-information)
+    pub fn peer_info(&self) -> Option<Implementation> {
+        self.client_info.lock().clone()
+    }
+
+    /// Returns the protocol version the agent chose in its `initialize` response.
+    ///
+    /// This is `None` until the agent has successfully responded to `initialize`.
+    ///
+    /// See protocol docs: [Protocol version](https://agentclientprotocol.com/protocol/initialization#protocol-version)
+    pub fn negotiated_protocol_version(&self) -> Option<ProtocolVersion> {
+        self.protocol_version.lock().clone()
+    }
+
+    /// Registers a callback that is invoked with [`TurnStats`] whenever the
+    /// agent successfully responds to a `session/prompt` request.
+    ///
+    /// Replaces any previously registered callback.
+    ///
+    /// See protocol docs: [Prompt Turn](https://agentclientprotocol.com/protocol/prompt-turn)
+    pub fn on_turn_complete(&self, callback: impl Fn(TurnStats) + Send + 'static) {
+        *self.turns.on_complete.lock() = Some(Arc::new(callback));
+    }
+
+    /// Registers a callback that is invoked with every [`ConnectionEvent`],
+    /// such as a session being created or cancelled.
+    ///
+    /// Events are derived from the messages the connection dispatches, so
+    /// observing them doesn't require wrapping the agent. The callback runs on
+    /// the task handling the message and should return quickly. Replaces any
+    /// previously registered callback.
+    pub fn on_event(&self, callback: impl Fn(ConnectionEvent) + Send + 'static) {
+        *self.events.callback.lock() = Some(Arc::new(callback));
+    }
+
+    /// Checks the id of every `session/load` request with `is_known` before
+    /// passing it to the agent.
+    ///
+    /// Requests for sessions `is_known` doesn't recognize, e.g. ids missing
+    /// from the agent's [`SessionIdSet`], fail with [`Error::unknown_session`]
+    /// without reaching [`Agent::load_session`]. This lets clients tell an
+    /// expired session apart from other failures. Replaces any previously
+    /// registered check.
+    ///
+    /// See protocol docs: [Loading Sessions](https://agentclientprotocol.com/protocol/session-setup#loading-sessions)
+    pub fn validate_session_on_load(&self, is_known: impl Fn(&SessionId) -> bool + Send + 'static) {
+        *self.session_validator.lock() = Some(Box::new(is_known));
+    }
+
+    /// Sets a deadline for the whole lifetime of a session, across all of its
+    /// prompt turns.
+    ///
+    /// Once `deadline` resolves, the turn in progress is cancelled: the agent
+    /// is sent a [`CancelNotification`] with [`CancelReason::Timeout`], its
+    /// prompt future is dropped, and the client receives a
+    /// [`ErrorCode::REQUEST_TIMEOUT`] error. Later prompts for the session fail
+    /// with the same error right away.
+    ///
+    /// Since the connection doesn't depend on a particular runtime, the
+    /// deadline is any future that resolves when it has passed, e.g.
+    /// `tokio::time::sleep_until`. The returned future waits for it and must
+    /// be spawned. Setting a new deadline for the session replaces the
+    /// previous one.
+    ///
+    /// See protocol docs: [Prompt Turn](https://agentclientprotocol.com/protocol/prompt-turn)
+    pub fn set_session_deadline(
+        &self,
+        session_id: SessionId,
+        deadline: impl Future<Output = ()> + 'static,
+    ) -> impl Future<Output = ()> + 'static {
+        self.deadlines.set(session_id, deadline)
+    }
+
+    /// Removes the deadline of a session, see
+    /// [`AgentSideConnection::set_session_deadline`].
+    ///
+    /// This also lets an expired session accept prompts again.
+    pub fn clear_session_deadline(&self, session_id: &SessionId) {
+        self.deadlines.clear(session_id);
+    }
+
+    /// Starts tracking a prompt turn of `session_id` so that it can be
+    /// cancelled by the client.
+    ///
+    /// Agents call this at the start of [`Agent::prompt`] and keep the returned
+    /// [`PromptTurn`] until the turn ends. Once the client sends
+    /// `session/cancel` for the session, [`PromptTurn::cancelled`] resolves,
+    /// so the agent can stop its work without keeping track of cancellations
+    /// itself. [`Agent::cancel`] is still called as usual.
+    ///
+    /// Beginning another turn of the same session replaces this one, which
+    /// then counts as cancelled. Agents that support
+    /// [`AgentCapabilities::concurrent_turns`] use
+    /// [`AgentSideConnection::begin_turn_with_id`] for turns the client gave
+    /// an id instead.
+    ///
+    /// See protocol docs: [Cancellation](https://agentclientprotocol.com/protocol/prompt-turn#cancellation)
+    pub fn begin_turn(&self, session_id: SessionId) -> PromptTurn {
+        self.cancellations.begin((session_id, None))
+    }
+
+    /// Starts tracking one of several concurrent turns of `session_id`, see
+    /// [`AgentSideConnection::begin_turn`].
+    ///
+    /// The turn is cancelled by a `session/cancel` naming `turn_id`, or one
+    /// that names no turn at all. Other turns of the session keep running.
+    ///
+    /// See protocol docs: [Concurrent Turns](https://agentclientprotocol.com/protocol/prompt-turn#concurrent-turns)
+    pub fn begin_turn_with_id(&self, session_id: SessionId, turn_id: TurnId) -> PromptTurn {
+        self.cancellations.begin((session_id, Some(turn_id)))
     }
 
     /// Subscribe to receive stream updates from the client.
@@ -453,6 +1598,525 @@ impl AgentSideConnection {
     pub fn subscribe(&self) -> StreamReceiver {
         self.conn.subscribe()
     }
+
+    /// Returns the number of requests sent to the client that are still
+    /// waiting for a response.
+    pub fn pending_request_count(&self) -> usize {
+        self.conn.pending_request_count()
+    }
+
+    /// Lists the requests sent to the client that are still waiting for a
+    /// response, oldest first, with their method and how long ago they were
+    /// sent.
+    ///
+    /// This is meant for diagnosing a connection that seems stuck, e.g. by
+    /// logging what is in flight when a turn takes unusually long.
+    pub fn pending_requests(&self) -> Vec<PendingRequest> {
+        self.conn.pending_requests()
+    }
+
+    /// Fails every request to the client that has been waiting for a response
+    /// for longer than `max_age` with [`Error::request_timeout`], returning
+    /// how many were failed.
+    ///
+    /// A peer that never answers would otherwise keep these requests pending
+    /// for the lifetime of the connection. Call this periodically from your
+    /// own timer, or spawn [`Self::sweep_pending_requests`] to do so.
+    pub fn expire_pending_requests(&self, max_age: Duration) -> usize {
+        self.conn.expire_pending_requests(max_age)
+    }
+
+    /// Returns a future that calls [`Self::expire_pending_requests`] with
+    /// `max_age` each time the future returned by `tick` resolves.
+    ///
+    /// Since the connection doesn't depend on a particular runtime, `tick`
+    /// provides the timer, e.g. `|| tokio::time::sleep(interval)`. The
+    /// returned future must be spawned, and completes once the connection
+    /// has been dropped.
+    pub fn sweep_pending_requests<T, F>(
+        &self,
+        max_age: Duration,
+        tick: T,
+    ) -> impl Future<Output = ()> + use<T, F>
+    where
+        T: FnMut() -> F,
+        F: Future<Output = ()>,
+    {
+        self.conn.sweep_pending_requests(max_age, tick)
+    }
+
+    /// Sets whether messages from the client must declare `"jsonrpc": "2.0"`.
+    ///
+    /// Disabled by default, so that lenient peers keep working. When enabled,
+    /// requests with a missing or different version are rejected with an
+    /// `invalid_request` error and notifications are dropped with a warning.
+    pub fn set_strict_jsonrpc(&self, strict: bool) {
+        self.conn.set_strict_jsonrpc(strict)
+    }
+
+    /// Holds back outgoing notifications until `size` bytes are pending,
+    /// writing them in fewer, larger chunks.
+    ///
+    /// Useful for agents that stream many small `session/update`
+    /// notifications, which are otherwise written one by one.
+    ///
+    /// Requests and responses are never delayed, and flush any buffered
+    /// notifications ahead of them. Since the connection doesn't depend on a
+    /// particular runtime, call [`Self::flush`] from your own timer or at the
+    /// end of a burst to bound how long notifications wait. A size of 0, the
+    /// default, writes every message right away.
+    pub fn set_write_buffer(&self, size: usize) {
+        self.conn.set_write_buffer(size)
+    }
+
+    /// Writes any notifications held back by [`Self::set_write_buffer`].
+    pub fn flush(&self) {
+        self.conn.flush()
+    }
+
+    /// Replaces how messages are redacted before they are logged, e.g. to
+    /// mask additional fields.
+    ///
+    /// By default, secret-looking values are masked with [`redact_secrets`].
+    /// Only logs are affected: messages are always sent and delivered as is.
+    pub fn set_redactor(&self, redactor: impl Fn(&str) -> String + Send + 'static) {
+        self.conn.set_redactor(redactor)
+    }
+
+    /// Sets whether an error from a notification handler, e.g. [`Agent::cancel`], closes
+    /// the connection.
+    ///
+    /// Errors are only logged by default. When enabled, the I/O task returned
+    /// by `new` resolves with the handler's error instead, for agents that would
+    /// rather stop than silently miss a notification.
+    pub fn set_notification_error_fatal(&self, fatal: bool) {
+        self.conn.set_notification_error_fatal(fatal)
+    }
+
+    /// Sets whether messages from the client are handled one at a time, in
+    /// the order they were received.
+    ///
+    /// By default, each request and notification from the client is handled
+    /// concurrently with the others. In serial mode, a handler must finish
+    /// before the next message is dispatched, which makes tests reproducible
+    /// and suits single-threaded agents that don't want concurrency. Responses
+    /// to requests sent to the client are still delivered meanwhile.
+    ///
+    /// A `session/cancel` notification then waits for the prompt it cancels
+    /// to finish, so only enable this for agents that don't need to be
+    /// cancelled mid-turn.
+    pub fn set_serial_dispatch(&self, serial: bool) {
+        self.conn.set_serial_dispatch(serial)
+    }
+
+    /// Limits how many notifications to the client may be queued while it
+    /// reads slower than the agent sends them, or removes the limit with
+    /// `None`.
+    ///
+    /// Without a limit, a client that stops reading lets queued notifications
+    /// use memory without bound. Once `limit` notifications are queued,
+    /// [`OutboundQueuePolicy::Block`] makes [`Client::session_notification`],
+    /// [`AgentSideConnection::session_update_batch`] and
+    /// [`Client::ext_notification`] wait for room, and
+    /// [`OutboundQueuePolicy::DropOldest`] drops the oldest queued
+    /// notifications instead. Requests and responses are never affected.
+    pub fn set_outbound_queue_limit(&self, limit: Option<(usize, OutboundQueuePolicy)>) {
+        self.conn.set_outbound_queue_limit(limit)
+    }
+
+    /// Stops handling messages from the client until [`AgentSideConnection::resume`]
+    /// is called.
+    ///
+    /// Messages are buffered in order meanwhile, and responses to requests sent
+    /// to the client are still delivered. Once the buffer is full, see
+    /// [`AgentSideConnection::set_pause_buffer_limit`], further requests from the
+    /// client fail right away and further notifications are dropped with a
+    /// warning.
+    pub fn pause(&self) {
+        self.conn.pause()
+    }
+
+    /// Handles the messages buffered since [`AgentSideConnection::pause`], in
+    /// the order they arrived, and resumes handling new ones.
+    pub fn resume(&self) {
+        self.conn.resume()
+    }
+
+    /// Sets how many messages are buffered while paused. Defaults to 1024.
+    pub fn set_pause_buffer_limit(&self, limit: usize) {
+        self.conn.set_pause_buffer_limit(limit)
+    }
+
+    /// Replaces how ids are chosen for requests sent to the client.
+    ///
+    /// Requests are numbered from zero by default. Install a generator to
+    /// use string ids instead, e.g. UUIDs. Every generated id must be unique
+    /// among the requests that are still pending.
+    pub fn set_id_generator(&self, generator: impl Fn() -> RequestId + Send + 'static) {
+        self.conn.set_id_generator(generator)
+    }
+
+    /// Sends the notification named `method` to the client.
+    ///
+    /// `method` is one of [`CLIENT_METHOD_NAMES`] or an extension method
+    /// starting with `_`. The params are checked against the notification's
+    /// type before sending, and methods that expect a response are rejected
+    /// with an `invalid_request` error rather than sent without an id.
+    pub async fn notify(&self, method: &str, params: impl Serialize) -> Result<(), Error> {
+        match decode_outgoing_notification::<ClientSide>(method, params)? {
+            AgentNotification::SessionNotification(args) => self.session_notification(args).await,
+            AgentNotification::ExtNotification(args) => self.ext_notification(args).await,
+        }
+    }
+
+    /// Handles requests from the client for `method`, a method that isn't part
+    /// of the protocol, e.g. one being prototyped before it is standardized.
+    ///
+    /// The params are deserialized as `P` and the handler's result is sent
+    /// back as the response. Registering a method again replaces its handler.
+    /// Protocol methods and extension methods starting with `_` can't be
+    /// registered, and are rejected with an `invalid_params` error.
+    pub fn register_method<P, R, F>(
+        &self,
+        method: &str,
+        handler: impl Fn(P) -> F + Send + 'static,
+    ) -> Result<(), Error>
+    where
+        P: DeserializeOwned,
+        R: Serialize,
+        F: Future<Output = Result<R, Error>> + 'static,
+    {
+        self.custom_methods
+            .register::<AgentSide, _, _, _>(method, handler)
+    }
+
+    /// Handles requests from the client for methods that aren't handled
+    /// otherwise, instead of failing them with `method_not_found`, e.g. to
+    /// forward them to another process or to experiment with new methods.
+    ///
+    /// Protocol methods and methods registered with `register_method` take
+    /// precedence, and extension methods starting with `_` still go to
+    /// `ext_method`. The handler gets the method name and raw params, and its
+    /// result is sent back as the response. Setting a fallback again replaces
+    /// it.
+    pub fn set_fallback_handler<F>(&self, handler: impl Fn(ExtRequest) -> F + Send + 'static)
+    where
+        F: Future<Output = Result<ExtResponse, Error>> + 'static,
+    {
+        self.custom_methods.set_fallback(handler);
+    }
+
+    /// Turns on answering [`DISCOVER_METHOD_NAME`] requests from the client with
+    /// the methods this connection handles, see [`ClientSideConnection::list_peer_methods`].
+    ///
+    /// Discovery is off by default, in which case the request fails with
+    /// `method_not_found`.
+    pub fn set_method_discovery(&self, enabled: bool) {
+        self.custom_methods.set_discovery(enabled);
+    }
+
+    /// Asks the client which methods it handles.
+    ///
+    /// This is meant for diagnostics and proxies. To decide which optional
+    /// features to use, prefer the capabilities exchanged during
+    /// initialization. Fails with `method_not_found` unless the client turned on
+    /// method discovery.
+    pub async fn list_peer_methods(&self) -> Result<Vec<String>, Error> {
+        let response: DiscoverResponse = self
+            .send_request(DISCOVER_METHOD_NAME, serde_json::Value::Null)
+            .await?;
+        Ok(response.methods)
+    }
+
+    /// Sends the request named `method` to the client and deserializes its
+    /// response as `R`.
+    ///
+    /// This is meant for methods the client registered with
+    /// [`ClientSideConnection::register_method`]. Prefer the [`Client`] methods for
+    /// protocol methods and [`Client::ext_method`] for extension methods.
+    pub async fn send_request<R: DeserializeOwned + Send + 'static>(
+        &self,
+        method: &str,
+        params: impl Serialize,
+    ) -> Result<R, Error> {
+        let params = serde_json::value::to_raw_value(&params)?;
+        self.conn
+            .request(
+                method,
+                Some(AgentRequest::CustomMethodRequest(ExtRequest {
+                    method: method.into(),
+                    params: params.into(),
+                })),
+            )
+            .await
+    }
+
+    /// Sends several session updates for the same session at once.
+    ///
+    /// The updates are queued back to back, so they are delivered in order and
+    /// written to the transport with as few writes as possible. This is useful
+    /// when streaming a plan with many entries or several message chunks.
+    ///
+    /// Under [`OutboundQueuePolicy::Block`], this waits for room in the queue
+    /// before queuing each update, so a batch larger than the limit is queued
+    /// as the client reads.
+    ///
+    /// See protocol docs: [Agent Reports Output](https://agentclientprotocol.com/protocol/prompt-turn#3-agent-reports-output)
+    pub async fn session_update_batch(
+        &self,
+        session_id: SessionId,
+        updates: impl IntoIterator<Item = SessionUpdate>,
+    ) -> Result<(), Error> {
+        for update in updates {
+            // Number the update only once it can be queued, so that updates
+            // waiting for room keep their order.
+            self.conn.outbound_ready().await;
+            self.turns.record_update(&session_id, None);
+            let mut args = SessionNotification {
+                session_id: session_id.clone(),
+                update,
+                turn_id: None,
+                meta: None,
+            };
+            self.sequence_numbers.stamp(&mut args);
+            self.conn.notify(
+                SESSION_UPDATE_METHOD.clone(),
+                Some(AgentNotification::SessionNotification(args)),
+            )?;
+        }
+        Ok(())
+    }
+
+    /// Like [`Client::session_notification`], but lets the update overtake
+    /// queued messages of a lower `priority`.
+    ///
+    /// When the client reads slower than the agent sends, messages queue up
+    /// waiting to be written. Giving thought chunks
+    /// [`NotificationPriority::Low`] priority keeps a flood of them from
+    /// delaying more important messages, such as permission requests, and
+    /// [`NotificationPriority::High`] priority lets urgent updates skip the
+    /// queue.
+    ///
+    /// Updates of the same priority are always delivered in order, but an
+    /// update may overtake queued updates of a lower priority for the same
+    /// session. For example, the update that reports a tool call should have
+    /// at least the priority of the later updates to it.
+    ///
+    /// See protocol docs: [Agent Reports Output](https://agentclientprotocol.com/protocol/prompt-turn#3-agent-reports-output)
+    pub async fn session_notification_with_priority(
+        &self,
+        mut args: SessionNotification,
+        priority: NotificationPriority,
+    ) -> Result<(), Error> {
+        // Number the update only once it can be queued, so that updates
+        // waiting for room keep their order.
+        self.conn.outbound_ready().await;
+        self.turns
+            .record_update(&args.session_id, args.turn_id.as_ref());
+        self.sequence_numbers.stamp(&mut args);
+        self.conn.notify_with_priority(
+            SESSION_UPDATE_METHOD.clone(),
+            Some(AgentNotification::SessionNotification(args)),
+            priority,
+        )
+    }
+
+    /// Turns numbering session updates in `_meta.seq` on or off.
+    ///
+    /// While on, the updates of each session are numbered 1, 2, 3, and so on,
+    /// in the order they are sent, so that clients can detect dropped or
+    /// reordered updates with [`SessionNotification::sequence_number`]. Any
+    /// `seq` the agent put in `_meta` itself is replaced. Updates dropped by
+    /// [`OutboundQueuePolicy::DropOldest`], or overtaken by an update of a
+    /// higher priority, show up as gaps. Turning numbering off forgets the
+    /// counts, so every session starts over at 1 once it is turned on again.
+    ///
+    /// Numbering is off by default.
+    pub fn set_sequence_numbers(&self, enabled: bool) {
+        self.sequence_numbers.set_enabled(enabled);
+    }
+
+    /// Sends `text` as an agent message for the session, e.g. to greet the
+    /// user right after the session was created.
+    ///
+    /// See protocol docs: [Agent Reports Output](https://agentclientprotocol.com/protocol/prompt-turn#3-agent-reports-output)
+    pub async fn greet(&self, session_id: SessionId, text: impl Into<String>) -> Result<(), Error> {
+        self.session_update_batch(
+            session_id,
+            [SessionUpdate::AgentMessageChunk {
+                content: text.into().into(),
+            }],
+        )
+        .await
+    }
+
+    /// Sends the plan for the session, replacing any plan the client is
+    /// showing.
+    ///
+    /// See protocol docs: [Agent Plan](https://agentclientprotocol.com/protocol/agent-plan)
+    pub async fn announce_plan(
+        &self,
+        session_id: SessionId,
+        entries: impl IntoIterator<Item = PlanEntry>,
+    ) -> Result<(), Error> {
+        self.session_update_batch(
+            session_id,
+            [SessionUpdate::Plan(Plan {
+                entries: entries.into_iter().collect(),
+                meta: None,
+            })],
+        )
+        .await
+    }
+
+    /// Requests permission from the client, falling back to a default outcome
+    /// if the client doesn't respond before `timeout` completes.
+    ///
+    /// `timeout` can be any future that resolves once the deadline has elapsed,
+    /// such as `tokio::time::sleep(duration)`.
+    ///
+    /// On timeout, the outcome is [`RequestPermissionOutcome::Selected`] with the
+    /// given `default_option_id`, or [`RequestPermissionOutcome::Cancelled`] if none
+    /// was provided. The client is sent a [`CANCEL_REQUEST_METHOD_NAME`]
+    /// extension notification for the in-flight request, which reaches
+    /// [`Client::ext_notification`] so the client can close its permission
+    /// prompt, and a late response from it is ignored.
+    ///
+    /// See protocol docs: [Requesting Permission](https://agentclientprotocol.com/protocol/tool-calls#requesting-permission)
+    pub async fn request_permission_with_timeout(
+        &self,
+        args: RequestPermissionRequest,
+        timeout: impl Future<Output = ()>,
+        default_option_id: Option<PermissionOptionId>,
+    ) -> Result<RequestPermissionResponse, Error> {
+        let response = self
+            .conn
+            .request_with_timeout(
+                SESSION_REQUEST_PERMISSION_METHOD_NAME,
+                Some(AgentRequest::RequestPermissionRequest(args)),
+                timeout,
+                AgentNotification::ExtNotification,
+            )
+            .await?;
+        Ok(response.unwrap_or_else(|| {
+            default_option_id.map_or_else(
+                RequestPermissionResponse::cancelled,
+                RequestPermissionResponse::selected,
+            )
+        }))
+    }
+
+    /// Writes everything `reader` yields to a text file on the client, in
+    /// requests of at most `chunk_size` bytes of content.
+    ///
+    /// The first request replaces the file's content and the following ones
+    /// [`append`](WriteTextFileRequest::append) to it. Each request is sent
+    /// once the previous one has been answered, so chunks are written in
+    /// order, and the last one has [`eof`](WriteTextFileRequest::eof) set.
+    /// Chunks never split a UTF-8 character, so they may be a few bytes
+    /// shorter than `chunk_size`, and a character longer than `chunk_size`
+    /// gets a chunk of its own.
+    ///
+    /// Only use this if the client advertised the `fs.appendTextFile`
+    /// capability. Fails with an invalid params error if `chunk_size` is 0.
+    /// Fails if `reader` fails or yields invalid UTF-8, leaving the part of
+    /// the file written so far.
+    pub async fn write_text_file_chunked(
+        &self,
+        session_id: SessionId,
+        path: PathBuf,
+        reader: impl AsyncRead,
+        chunk_size: usize,
+    ) -> Result<(), Error> {
+        if chunk_size == 0 {
+            return Err(Error::invalid_params().with_data("chunk_size must be greater than 0"));
+        }
+        futures::pin_mut!(reader);
+        // Leave room for a UTF-8 character that doesn't fit into `chunk_size`.
+        let mut buffer = vec![0; chunk_size + 3];
+        let mut limit = chunk_size;
+        let mut filled = 0;
+        let mut pending: Option<String> = None;
+        let mut append = false;
+
+        loop {
+            let read = reader
+                .read(&mut buffer[filled..limit])
+                .await
+                .map_err(Error::into_internal_error)?;
+            filled += read;
+            let eof = read == 0;
+            if !eof && filled < limit {
+                continue;
+            }
+
+            let valid = match std::str::from_utf8(&buffer[..filled]) {
+                Ok(text) => text.len(),
+                // The rest of the character is still to be read.
+                Err(err) if !eof && err.error_len().is_none() => err.valid_up_to(),
+                Err(err) => return Err(Error::into_internal_error(err)),
+            };
+            if valid == 0 && !eof {
+                // The first character doesn't fit into `chunk_size`, so read
+                // just the rest of it.
+                limit = match buffer[0] {
+                    0xc0..=0xdf => 2,
+                    0xe0..=0xef => 3,
+                    _ => 4,
+                };
+                continue;
+            }
+            let chunk = String::from_utf8_lossy(&buffer[..valid]).into_owned();
+            buffer.copy_within(valid..filled, 0);
+            filled -= valid;
+            limit = chunk_size;
+
+            if !eof {
+                // Hold the chunk back until the next one is read, so that the
+                // last request can be marked with `eof`.
+                if let Some(previous) = pending.replace(chunk) {
+                    self.write_chunk(&session_id, &path, previous, append, false)
+                        .await?;
+                    append = true;
+                }
+                continue;
+            }
+
+            let last = match pending.take() {
+                Some(previous) if !chunk.is_empty() => {
+                    self.write_chunk(&session_id, &path, previous, append, false)
+                        .await?;
+                    append = true;
+                    chunk
+                }
+                Some(previous) => previous,
+                None => chunk,
+            };
+            return self
+                .write_chunk(&session_id, &path, last, append, true)
+                .await;
+        }
+    }
+
+    async fn write_chunk(
+        &self,
+        session_id: &SessionId,
+        path: &Path,
+        content: String,
+        append: bool,
+        eof: bool,
+    ) -> Result<(), Error> {
+        self.write_text_file(WriteTextFileRequest {
+            session_id: session_id.clone(),
+            path: path.to_path_buf(),
+            content,
+            append,
+            eof,
+            meta: None,
+        })
+        .await
+        .map(|_| ())
+    }
 }
 
 #[async_trait::async_trait(?Send)]
@@ -557,10 +2221,45 @@ impl Client for AgentSideConnection {
     }
 
     async fn session_notification(&self, args: SessionNotification) -> Result<(), Error> {
-        self.conn.notify(
-            SESSION_UPDATE_NOTIFICATION,
-            Some(AgentNotification::SessionNotification(args)),
-        )
+        self.session_notification_with_priority(args, NotificationPriority::Normal)
+            .await
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn read_resource(
+        &self,
+        args: ReadResourceRequest,
+    ) -> Result<ReadResourceResponse, Error> {
+        self.conn
+            .request(
+                RESOURCE_READ_METHOD_NAME,
+                Some(AgentRequest::ReadResourceRequest(args)),
+            )
+            .await
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn open(&self, args: OpenRequest) -> Result<OpenResponse, Error> {
+        self.conn
+            .request::<Option<_>>(
+                CLIENT_OPEN_METHOD_NAME,
+                Some(AgentRequest::OpenRequest(args)),
+            )
+            .await
+            .map(Option::unwrap_or_default)
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn request_input(
+        &self,
+        args: RequestInputRequest,
+    ) -> Result<RequestInputResponse, Error> {
+        self.conn
+            .request(
+                SESSION_REQUEST_INPUT_METHOD_NAME,
+                Some(AgentRequest::RequestInputRequest(args)),
+            )
+            .await
     }
 
     async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
@@ -573,10 +2272,13 @@ impl Client for AgentSideConnection {
     }
 
     async fn ext_notification(&self, args: ExtNotification) -> Result<(), Error> {
-        self.conn.notify(
-            format!("_{}", args.method),
-            Some(AgentNotification::ExtNotification(args)),
-        )
+        self.conn
+            .notify_when_ready(
+                format!("_{}", args.method),
+                Some(AgentNotification::ExtNotification(args)),
+                NotificationPriority::Normal,
+            )
+            .await
     }
 }
 
@@ -617,9 +2319,25 @@ impl Side for AgentSide {
             SESSION_SET_MODEL_METHOD_NAME => serde_json::from_str(params.get())
                 .map(ClientRequest::SetSessionModelRequest)
                 .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            SESSION_CANCEL_TOOL_CALL_METHOD_NAME => serde_json::from_str(params.get())
+                .map(ClientRequest::CancelToolCallRequest)
+                .map_err(Into::into),
             SESSION_PROMPT_METHOD_NAME => serde_json::from_str(params.get())
                 .map(ClientRequest::PromptRequest)
                 .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            SESSION_LIST_METHOD_NAME => serde_json::from_str(params.get())
+                .map(ClientRequest::ListSessionsRequest)
+                .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            SESSION_LIST_FLAGS_METHOD_NAME => serde_json::from_str(params.get())
+                .map(ClientRequest::ListSessionFlagsRequest)
+                .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            SESSION_SET_FLAG_METHOD_NAME => serde_json::from_str(params.get())
+                .map(ClientRequest::SetSessionFlagRequest)
+                .map_err(Into::into),
             _ => {
                 if let Some(custom_method) = method.strip_prefix('_') {
                     Ok(ClientRequest::ExtMethodRequest(ExtRequest {
@@ -633,6 +2351,13 @@ impl Side for AgentSide {
         }
     }
 
+    fn decode_custom_request(method: &str, params: Option<&RawValue>) -> Option<ClientRequest> {
+        Some(ClientRequest::CustomMethodRequest(ExtRequest {
+            method: method.into(),
+            params: params.unwrap_or(RawValue::NULL).to_owned().into(),
+        }))
+    }
+
     fn decode_notification(
         method: &str,
         params: Option<&RawValue>,
@@ -643,6 +2368,10 @@ impl Side for AgentSide {
             SESSION_CANCEL_METHOD_NAME => serde_json::from_str(params.get())
                 .map(ClientNotification::CancelNotification)
                 .map_err(Into::into),
+            #[cfg(feature = "unstable")]
+            TERMINAL_OUTPUT_UPDATE_METHOD_NAME => serde_json::from_str(params.get())
+                .map(ClientNotification::TerminalOutputUpdateNotification)
+                .map_err(Into::into),
             _ => {
                 if let Some(custom_method) = method.strip_prefix('_') {
                     Ok(ClientNotification::ExtNotification(ExtNotification {
@@ -657,6 +2386,537 @@ impl Side for AgentSide {
     }
 }
 
+/// Statistics about a completed prompt turn.
+///
+/// See [`AgentSideConnection::on_turn_complete`].
+#[derive(Debug, Clone)]
+pub struct TurnStats {
+    /// The session the turn belonged to.
+    pub session_id: SessionId,
+    /// The id the client gave the turn, if any.
+    pub turn_id: Option<TurnId>,
+    /// Time from receiving the `session/prompt` request until the agent responded.
+    pub duration: Duration,
+    /// Why the turn ended.
+    pub stop_reason: StopReason,
+    /// Number of `session/update` notifications sent for the turn.
+    pub update_count: usize,
+}
+
+/// A lifecycle event of an [`AgentSideConnection`].
+///
+/// See [`AgentSideConnection::on_event`].
+#[derive(Debug, Clone, PartialEq)]
+pub enum ConnectionEvent {
+    /// The agent successfully responded to `initialize`.
+    Initialized {
+        /// The protocol version the agent chose.
+        protocol_version: ProtocolVersion,
+    },
+    /// The agent created a session in response to `session/new`.
+    SessionCreated {
+        /// The id of the new session.
+        session_id: SessionId,
+    },
+    /// The agent loaded a session in response to `session/load`.
+    SessionLoaded {
+        /// The id of the loaded session.
+        session_id: SessionId,
+    },
+    /// A prompt turn was cancelled, either by a `session/cancel` notification
+    /// from the client or because the session's deadline expired.
+    SessionCancelled {
+        /// The session the turn belongs to.
+        session_id: SessionId,
+        /// The cancelled turn, or `None` for every turn of the session.
+        turn_id: Option<TurnId>,
+        /// Why the turn was cancelled, if known.
+        reason: Option<CancelReason>,
+    },
+    /// The connection to the client closed.
+    Disconnected,
+}
+
+/// Delivers [`ConnectionEvent`]s to the callback registered with
+/// [`AgentSideConnection::on_event`].
+#[derive(Default)]
+struct ConnectionEvents {
+    callback: Mutex<Option<Arc<dyn Fn(ConnectionEvent) + Send>>>,
+}
+
+impl ConnectionEvents {
+    fn emit(&self, event: ConnectionEvent) {
+        // Call outside the lock, so the callback can register a new one.
+        let callback = self.callback.lock().clone();
+        if let Some(callback) = callback {
+            callback(event);
+        }
+    }
+}
+
+/// Tracks in-progress prompt turns to report [`TurnStats`] once they complete.
+#[derive(Default)]
+struct TurnTracker {
+    update_counts: Mutex<HashMap<TurnKey, usize>>,
+    on_complete: Mutex<Option<Arc<dyn Fn(TurnStats) + Send>>>,
+}
+
+/// Identifies a running turn: concurrent turns of a session are told apart
+/// by their [`TurnId`], see [`AgentCapabilities::concurrent_turns`].
+type TurnKey = (SessionId, Option<TurnId>);
+
+impl TurnTracker {
+    fn begin(&self, turn: &TurnKey) {
+        self.update_counts.lock().insert(turn.clone(), 0);
+    }
+
+    fn record_update(&self, session_id: &SessionId, turn_id: Option<&TurnId>) {
+        let turn = (session_id.clone(), turn_id.cloned());
+        if let Some(count) = self.update_counts.lock().get_mut(&turn) {
+            *count += 1;
+        }
+    }
+
+    /// Ends `turn`, returning how many updates were sent during it.
+    fn finish(&self, turn: &TurnKey) -> usize {
+        self.update_counts.lock().remove(turn).unwrap_or_default()
+    }
+
+    fn report(&self, stats: TurnStats) {
+        // Call outside the lock, so the callback can register a new one.
+        let callback = self.on_complete.lock().clone();
+        if let Some(callback) = callback {
+            callback(stats);
+        }
+    }
+}
+
+/// Tracks the turns the agent has yet to drain, see [`SessionUpdate::Drained`].
+///
+/// A session is only tracked from the start of a turn until the agent drains
+/// it, so finished sessions don't accumulate.
+#[derive(Default)]
+struct DrainTracker {
+    turns: Mutex<HashMap<SessionId, PendingDrain>>,
+}
+
+/// The latest turn of a session, which the agent has yet to drain.
+struct PendingDrain {
+    turn_id: Option<TurnId>,
+    waiters: Vec<oneshot::Sender<()>>,
+}
+
+impl DrainTracker {
+    /// Starts tracking a new turn for `session_id`.
+    ///
+    /// Anyone still waiting on an earlier turn of the session is released.
+    fn begin(&self, session_id: &SessionId, turn_id: Option<TurnId>) {
+        self.turns.lock().insert(
+            session_id.clone(),
+            PendingDrain {
+                turn_id,
+                waiters: Vec::new(),
+            },
+        );
+    }
+
+    /// Stops tracking `session_id`, releasing anyone waiting on it.
+    fn end(&self, session_id: &SessionId) {
+        self.turns.lock().remove(session_id);
+    }
+
+    /// Stops tracking every session, releasing anyone waiting on them.
+    fn clear(&self) {
+        self.turns.lock().clear();
+    }
+
+    fn record(&self, notification: &SessionNotification) {
+        if !matches!(notification.update, SessionUpdate::Drained) {
+            return;
+        }
+        let mut turns = self.turns.lock();
+        // A late `drained` for an earlier turn must not end the latest one.
+        if let Entry::Occupied(turn) = turns.entry(notification.session_id.clone())
+            && turn.get().turn_id == notification.turn_id
+        {
+            for waiter in turn.remove().waiters {
+                waiter.send(()).ok();
+            }
+        }
+    }
+
+    /// Returns a receiver that fires once the session's latest turn drains,
+    /// or `None` if it already has.
+    fn wait(&self, session_id: &SessionId) -> Option<oneshot::Receiver<()>> {
+        let mut turns = self.turns.lock();
+        let turn = turns.get_mut(session_id)?;
+        let (tx, rx) = oneshot::channel();
+        turn.waiters.push(tx);
+        Some(rx)
+    }
+}
+
+/// Numbers session updates, see [`AgentSideConnection::set_sequence_numbers`].
+#[derive(Default)]
+struct SequenceNumbers {
+    /// The last number given to each session, or `None` while numbering is
+    /// off.
+    sessions: Mutex<Option<HashMap<SessionId, u64>>>,
+}
+
+impl SequenceNumbers {
+    fn set_enabled(&self, enabled: bool) {
+        let mut sessions = self.sessions.lock();
+        if enabled != sessions.is_some() {
+            *sessions = enabled.then(HashMap::default);
+        }
+    }
+
+    /// Gives the update the next number of its session, if numbering is on.
+    fn stamp(&self, args: &mut SessionNotification) {
+        let mut sessions = self.sessions.lock();
+        let Some(sessions) = sessions.as_mut() else {
+            return;
+        };
+        let meta = args
+            .meta
+            .get_or_insert_with(|| serde_json::Value::Object(Default::default()));
+        let Some(meta) = meta.as_object_mut() else {
+            log::warn!("not numbering session update with non-object _meta: {meta}");
+            return;
+        };
+        let seq = sessions.entry(args.session_id.clone()).or_default();
+        *seq += 1;
+        meta.insert(SEQUENCE_NUMBER_META_KEY.to_string(), (*seq).into());
+    }
+}
+
+/// Tracks session deadlines, see [`AgentSideConnection::set_session_deadline`].
+#[derive(Default)]
+struct SessionDeadlines {
+    sessions: Mutex<HashMap<SessionId, SessionDeadline>>,
+}
+
+#[derive(Default)]
+struct SessionDeadline {
+    /// Incremented whenever the deadline is replaced, so that timers of
+    /// earlier deadlines don't expire the session.
+    generation: u64,
+    expired: bool,
+    prompts: Vec<oneshot::Sender<()>>,
+}
+
+impl SessionDeadlines {
+    fn set(
+        self: &Arc<Self>,
+        session_id: SessionId,
+        deadline: impl Future<Output = ()> + 'static,
+    ) -> impl Future<Output = ()> + 'static {
+        let generation = {
+            let mut sessions = self.sessions.lock();
+            let state = sessions.entry(session_id.clone()).or_default();
+            state.generation += 1;
+            state.expired = false;
+            state.generation
+        };
+        let this = Arc::downgrade(self);
+        async move {
+            deadline.await;
+            if let Some(this) = this.upgrade() {
+                this.expire(&session_id, generation);
+            }
+        }
+    }
+
+    fn expire(&self, session_id: &SessionId, generation: u64) {
+        let mut sessions = self.sessions.lock();
+        if let Some(state) = sessions.get_mut(session_id)
+            && state.generation == generation
+        {
+            state.expired = true;
+            for prompt in state.prompts.drain(..) {
+                prompt.send(()).ok();
+            }
+        }
+    }
+
+    fn clear(&self, session_id: &SessionId) {
+        self.sessions.lock().remove(session_id);
+    }
+
+    /// Returns a receiver that fires when the session's deadline passes, or
+    /// an error if it already has.
+    ///
+    /// The receiver is cancelled instead if the deadline is cleared.
+    fn watch(&self, session_id: &SessionId) -> Result<Option<oneshot::Receiver<()>>, Error> {
+        let mut sessions = self.sessions.lock();
+        let Some(state) = sessions.get_mut(session_id) else {
+            return Ok(None);
+        };
+        if state.expired {
+            return Err(session_deadline_exceeded(session_id));
+        }
+        state.prompts.retain(|prompt| !prompt.is_canceled());
+        let (tx, rx) = oneshot::channel();
+        state.prompts.push(tx);
+        Ok(Some(rx))
+    }
+}
+
+/// A prompt turn started with [`AgentSideConnection::begin_turn`].
+///
+/// The turn ends when this is dropped.
+pub struct PromptTurn {
+    cancellations: Arc<TurnCancellations>,
+    turn: TurnKey,
+    generation: u64,
+}
+
+impl PromptTurn {
+    /// Returns the session the turn belongs to.
+    pub fn session_id(&self) -> &SessionId {
+        &self.turn.0
+    }
+
+    /// Returns the id the client gave the turn, if any.
+    pub fn turn_id(&self) -> Option<&TurnId> {
+        self.turn.1.as_ref()
+    }
+
+    /// Returns whether the client has cancelled the turn.
+    pub fn is_cancelled(&self) -> bool {
+        self.cancellations
+            .turns
+            .lock()
+            .get(&self.turn)
+            .is_none_or(|turn| turn.generation != self.generation || turn.cancelled)
+    }
+
+    /// Returns a future that resolves once the client cancels the turn, or
+    /// right away if it already has.
+    ///
+    /// The future doesn't borrow the turn, so it can be raced against the
+    /// agent's work with e.g. `futures::select!`. It also resolves if the
+    /// turn ends first.
+    pub fn cancelled(&self) -> impl Future<Output = ()> + 'static {
+        let receiver = {
+            let mut turns = self.cancellations.turns.lock();
+            match turns.get_mut(&self.turn) {
+                Some(turn) if turn.generation == self.generation && !turn.cancelled => {
+                    let (tx, rx) = oneshot::channel();
+                    turn.waiters.push(tx);
+                    Some(rx)
+                }
+                _ => None,
+            }
+        };
+        async move {
+            if let Some(receiver) = receiver {
+                receiver.await.ok();
+            }
+        }
+    }
+}
+
+impl Drop for PromptTurn {
+    fn drop(&mut self) {
+        let mut turns = self.cancellations.turns.lock();
+        // A later turn of the session may have replaced this one.
+        if turns
+            .get(&self.turn)
+            .is_some_and(|turn| turn.generation == self.generation)
+        {
+            turns.remove(&self.turn);
+        }
+    }
+}
+
+/// Tracks the prompt turns agents are running, see
+/// [`AgentSideConnection::begin_turn`].
+#[derive(Default)]
+struct TurnCancellations {
+    turns: Mutex<HashMap<TurnKey, ActiveTurn>>,
+    next_generation: AtomicU64,
+}
+
+struct ActiveTurn {
+    generation: u64,
+    cancelled: bool,
+    waiters: Vec<oneshot::Sender<()>>,
+}
+
+impl TurnCancellations {
+    fn begin(self: &Arc<Self>, turn: TurnKey) -> PromptTurn {
+        let generation = self.next_generation.fetch_add(1, Ordering::Relaxed);
+        // Dropping the waiters of a replaced turn resolves them.
+        self.turns.lock().insert(
+            turn.clone(),
+            ActiveTurn {
+                generation,
+                cancelled: false,
+                waiters: Vec::new(),
+            },
+        );
+        PromptTurn {
+            cancellations: self.clone(),
+            turn,
+            generation,
+        }
+    }
+
+    /// Cancels the turn with `turn_id`, or every turn of the session if
+    /// there is none.
+    fn cancel(&self, session_id: &SessionId, turn_id: Option<&TurnId>) {
+        let mut turns = self.turns.lock();
+        let cancelled = turns.iter_mut().filter(|((session, turn), _)| {
+            session == session_id && (turn_id.is_none() || turn.as_ref() == turn_id)
+        });
+        for (_, turn) in cancelled {
+            turn.cancelled = true;
+            for waiter in turn.waiters.drain(..) {
+                waiter.send(()).ok();
+            }
+        }
+    }
+}
+
+fn session_deadline_exceeded(session_id: &SessionId) -> Error {
+    Error::request_timeout().with_data(format!("session {session_id} exceeded its deadline"))
+}
+
+/// Wraps the agent handler to record connection-level statistics.
+struct AgentHandler<H> {
+    agent: H,
+    turns: Arc<TurnTracker>,
+    deadlines: Arc<SessionDeadlines>,
+    cancellations: Arc<TurnCancellations>,
+    session_validator: Arc<Mutex<Option<SessionValidator>>>,
+    client_info: Arc<Mutex<Option<Implementation>>>,
+    protocol_version: Arc<Mutex<Option<ProtocolVersion>>>,
+    custom_methods: Arc<CustomMethods>,
+    events: Arc<ConnectionEvents>,
+    compression: Arc<AtomicBool>,
+}
+
+impl<H: MessageHandler<AgentSide>> MessageHandler<AgentSide> for AgentHandler<H> {
+    async fn handle_request(&self, request: ClientRequest) -> Result<AgentResponse, Error> {
+        let turn = match &request {
+            ClientRequest::InitializeRequest(args) => {
+                *self.client_info.lock() = args.client_info.clone();
+                let compression = args.client_capabilities.compression;
+                let response = self.agent.handle_request(request).await;
+                if let Ok(AgentResponse::InitializeResponse(response)) = &response {
+                    *self.protocol_version.lock() = Some(response.protocol_version.clone());
+                    // Compress once both sides can read compressed messages.
+                    self.compression.store(
+                        compression && response.agent_capabilities.compression,
+                        Ordering::Relaxed,
+                    );
+                    self.events.emit(ConnectionEvent::Initialized {
+                        protocol_version: response.protocol_version.clone(),
+                    });
+                }
+                return response;
+            }
+            ClientRequest::NewSessionRequest(_) => {
+                let response = self.agent.handle_request(request).await;
+                if let Ok(AgentResponse::NewSessionResponse(response)) = &response {
+                    self.events.emit(ConnectionEvent::SessionCreated {
+                        session_id: response.session_id.clone(),
+                    });
+                }
+                return response;
+            }
+            ClientRequest::LoadSessionRequest(args) => {
+                let known = self
+                    .session_validator
+                    .lock()
+                    .as_ref()
+                    .is_none_or(|is_known| is_known(&args.session_id));
+                if !known {
+                    return Err(Error::unknown_session(&args.session_id));
+                }
+                let session_id = args.session_id.clone();
+                let response = self.agent.handle_request(request).await;
+                if response.is_ok() {
+                    self.events
+                        .emit(ConnectionEvent::SessionLoaded { session_id });
+                }
+                return response;
+            }
+            ClientRequest::PromptRequest(args) => (args.session_id.clone(), args.turn_id.clone()),
+            ClientRequest::CustomMethodRequest(args) => {
+                return self
+                    .custom_methods
+                    .call(args)
+                    .await
+                    .map(AgentResponse::ExtMethodResponse);
+            }
+            _ => return self.agent.handle_request(request).await,
+        };
+
+        let (session_id, _) = &turn;
+        let deadline = self.deadlines.watch(session_id)?;
+        let started_at = Instant::now();
+        self.turns.begin(&turn);
+        let response = match deadline {
+            Some(deadline) => {
+                let prompt = Box::pin(self.agent.handle_request(request));
+                match future::select(prompt, deadline).await {
+                    Either::Left((response, _)) => response,
+                    // The deadline was cleared.
+                    Either::Right((Err(_), prompt)) => prompt.await,
+                    Either::Right((Ok(()), prompt)) => {
+                        drop(prompt);
+                        self.cancellations.cancel(session_id, None);
+                        self.events.emit(ConnectionEvent::SessionCancelled {
+                            session_id: session_id.clone(),
+                            turn_id: None,
+                            reason: Some(CancelReason::Timeout),
+                        });
+                        let cancel = CancelNotification::with_reason(
+                            session_id.clone(),
+                            CancelReason::Timeout,
+                        );
+                        self.agent
+                            .handle_notification(ClientNotification::CancelNotification(cancel))
+                            .await
+                            .ok();
+                        Err(session_deadline_exceeded(session_id))
+                    }
+                }
+            }
+            None => self.agent.handle_request(request).await,
+        };
+        let update_count = self.turns.finish(&turn);
+
+        if let Ok(AgentResponse::PromptResponse(PromptResponse { stop_reason, .. })) = &response {
+            let (session_id, turn_id) = turn;
+            self.turns.report(TurnStats {
+                session_id,
+                turn_id,
+                duration: started_at.elapsed(),
+                stop_reason: *stop_reason,
+                update_count,
+            });
+        }
+        response
+    }
+
+    async fn handle_notification(&self, notification: ClientNotification) -> Result<(), Error> {
+        if let ClientNotification::CancelNotification(args) = &notification {
+            self.cancellations
+                .cancel(&args.session_id, args.turn_id.as_ref());
+            self.events.emit(ConnectionEvent::SessionCancelled {
+                session_id: args.session_id.clone(),
+                turn_id: args.turn_id.clone(),
+                reason: args.reason,
+            });
+        }
+        self.agent.handle_notification(notification).await
+    }
+}
+
 impl<T: Agent> MessageHandler<AgentSide> for T {
     async fn handle_request(&self, request: ClientRequest) -> Result<AgentResponse, Error> {
         match request {
@@ -689,10 +2949,31 @@ impl<T: Agent> MessageHandler<AgentSide> for T {
                 let response = self.set_session_model(args).await?;
                 Ok(AgentResponse::SetSessionModelResponse(response))
             }
+            #[cfg(feature = "unstable")]
+            ClientRequest::CancelToolCallRequest(args) => {
+                let response = self.cancel_tool_call(args).await?;
+                Ok(AgentResponse::CancelToolCallResponse(response))
+            }
+            #[cfg(feature = "unstable")]
+            ClientRequest::ListSessionsRequest(args) => {
+                let response = self.list_sessions(args).await?;
+                Ok(AgentResponse::ListSessionsResponse(response))
+            }
+            #[cfg(feature = "unstable")]
+            ClientRequest::ListSessionFlagsRequest(args) => {
+                let response = self.list_session_flags(args).await?;
+                Ok(AgentResponse::ListSessionFlagsResponse(response))
+            }
+            #[cfg(feature = "unstable")]
+            ClientRequest::SetSessionFlagRequest(args) => {
+                let response = self.set_session_flag(args).await?;
+                Ok(AgentResponse::SetSessionFlagResponse(response))
+            }
             ClientRequest::ExtMethodRequest(args) => {
                 let response = self.ext_method(args).await?;
                 Ok(AgentResponse::ExtMethodResponse(response))
             }
+            ClientRequest::CustomMethodRequest(_) => Err(Error::method_not_found()),
         }
     }
 
@@ -701,6 +2982,10 @@ impl<T: Agent> MessageHandler<AgentSide> for T {
             ClientNotification::CancelNotification(args) => {
                 self.cancel(args).await?;
             }
+            #[cfg(feature = "unstable")]
+            ClientNotification::TerminalOutputUpdateNotification(args) => {
+                self.terminal_output_update(args).await?;
+            }
             ClientNotification::ExtNotification(args) => {
                 self.ext_notification(args).await?;
             }
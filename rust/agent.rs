@@ -4,7 +4,11 @@
 //! an AI coding agent that follows the Agent Client Protocol (ACP).
 
 use std::rc::Rc;
-use std::{path::PathBuf, sync::Arc};
+use std::{
+    fmt,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
 
 use anyhow::Result;
 use schemars::JsonSchema;
@@ -13,14 +17,24 @@ use serde_json::value::RawValue;
 
 use crate::ext::ExtRequest;
 use crate::{
-    ClientCapabilities, ContentBlock, Error, ExtNotification, ExtResponse, ProtocolVersion,
-    SessionId,
+    AudioContent, ClientCapabilities, ContentBlock, EmbeddedResource, EmbeddedResourceResource,
+    Error, ExtNotification, ExtResponse, ImageContent, MAX_VERSION, ProtocolVersion, SessionId,
+    SessionNotification, SessionUpdate, TextResourceContents, ValidationErrorData,
 };
+#[cfg(feature = "unstable")]
+use crate::{TerminalId, ToolCallId};
 
 /// Defines the interface that all ACP-compliant agents must implement.
 ///
 /// Agents are programs that use generative AI to autonomously modify code. They handle
 /// requests from clients and execute tasks using language models and tools.
+///
+/// Methods with a default implementation are optional and answer with a
+/// `capability_not_supported` error naming their capability until they are
+/// implemented, or `method_not_found` if they don't belong to one, like
+/// [`Agent::set_session_mode`]. Implement the ones that match the
+/// [`AgentCapabilities`] you advertise in `initialize`, e.g.
+/// [`Agent::load_session`] when setting `loadSession` to `true`.
 #[async_trait::async_trait(?Send)]
 pub trait Agent {
     /// Establishes the connection with a client and negotiates protocol capabilities.
@@ -83,6 +97,9 @@ pub trait Agent {
     /// - Send any pending `session/update` notifications
     /// - Respond to the original `session/prompt` request with `StopReason::Cancelled`
     ///
+    /// The notification may say why the turn is being cancelled, see
+    /// [`CancelNotification::reason`].
+    ///
     /// See protocol docs: [Cancellation](https://agentclientprotocol.com/protocol/prompt-turn#cancellation)
     async fn cancel(&self, args: CancelNotification) -> Result<(), Error>;
 
@@ -95,9 +112,12 @@ pub trait Agent {
     /// - Connect to the specified MCP servers
     /// - Stream the entire conversation history back to the client via notifications
     ///
+    /// The history can be sent with [`AgentSideConnection::session_notification`](crate::AgentSideConnection::session_notification)
+    /// while this request is in flight. Respond only once the replay is complete.
+    ///
     /// See protocol docs: [Loading Sessions](https://agentclientprotocol.com/protocol/session-setup#loading-sessions)
     async fn load_session(&self, _args: LoadSessionRequest) -> Result<LoadSessionResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("loadSession"))
     }
 
     /// Sets the current mode for a session.
@@ -133,6 +153,98 @@ pub trait Agent {
         Err(Error::method_not_found())
     }
 
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Cancels a single tool call while letting the rest of the prompt turn continue.
+    ///
+    /// Only available if the Agent supports the `cancelToolCall` capability.
+    ///
+    /// The Agent SHOULD stop the operation as soon as possible and report it to the
+    /// Client with a `tool_call_update` whose status is `failed`.
+    #[cfg(feature = "unstable")]
+    async fn cancel_tool_call(
+        &self,
+        _args: CancelToolCallRequest,
+    ) -> Result<CancelToolCallResponse, Error> {
+        Err(Error::capability_not_supported("cancelToolCall"))
+    }
+
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Receives output produced by a terminal since the previous update.
+    ///
+    /// Only sent by the Client if the Agent supports the `terminalOutputUpdates` capability.
+    ///
+    /// This lets the Agent follow a running command live instead of polling `terminal/output`.
+    /// Updates are ignored by default.
+    #[cfg(feature = "unstable")]
+    async fn terminal_output_update(
+        &self,
+        _args: TerminalOutputUpdateNotification,
+    ) -> Result<(), Error> {
+        Ok(())
+    }
+
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Lists the sessions the Agent currently holds.
+    ///
+    /// Only available if the Agent supports the `listSessions` capability.
+    ///
+    /// Clients can use this to reattach to existing sessions, for example after
+    /// reconnecting or when opening another window, instead of always creating new ones.
+    #[cfg(feature = "unstable")]
+    async fn list_sessions(
+        &self,
+        _args: ListSessionsRequest,
+    ) -> Result<ListSessionsResponse, Error> {
+        Err(Error::capability_not_supported("listSessions"))
+    }
+
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Lists the quick toggles a session offers, such as a mode that skips
+    /// permission prompts.
+    ///
+    /// Only available if the Agent supports the `sessionFlags` capability.
+    ///
+    /// Unlike session modes, any number of flags can be enabled at once.
+    /// Clients use this to discover the flags they can offer in their UI.
+    #[cfg(feature = "unstable")]
+    async fn list_session_flags(
+        &self,
+        _args: ListSessionFlagsRequest,
+    ) -> Result<ListSessionFlagsResponse, Error> {
+        Err(Error::capability_not_supported("sessionFlags"))
+    }
+
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Turns one of the session's flags on or off.
+    ///
+    /// Only available if the Agent supports the `sessionFlags` capability.
+    ///
+    /// The flag must be one of those returned by `session/list_flags`. Like
+    /// `session/set_mode`, this can be called whether the Agent is idle or
+    /// actively generating a response.
+    #[cfg(feature = "unstable")]
+    async fn set_session_flag(
+        &self,
+        _args: SetSessionFlagRequest,
+    ) -> Result<SetSessionFlagResponse, Error> {
+        Err(Error::capability_not_supported("sessionFlags"))
+    }
+
     /// Handles extension method requests from the client.
     ///
     /// Extension methods provide a way to add custom functionality while maintaining
@@ -187,6 +299,41 @@ impl<T: Agent> Agent for Rc<T> {
     ) -> Result<SetSessionModelResponse, Error> {
         self.as_ref().set_session_model(args).await
     }
+    #[cfg(feature = "unstable")]
+    async fn cancel_tool_call(
+        &self,
+        args: CancelToolCallRequest,
+    ) -> Result<CancelToolCallResponse, Error> {
+        self.as_ref().cancel_tool_call(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn terminal_output_update(
+        &self,
+        args: TerminalOutputUpdateNotification,
+    ) -> Result<(), Error> {
+        self.as_ref().terminal_output_update(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn list_sessions(
+        &self,
+        args: ListSessionsRequest,
+    ) -> Result<ListSessionsResponse, Error> {
+        self.as_ref().list_sessions(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn list_session_flags(
+        &self,
+        args: ListSessionFlagsRequest,
+    ) -> Result<ListSessionFlagsResponse, Error> {
+        self.as_ref().list_session_flags(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn set_session_flag(
+        &self,
+        args: SetSessionFlagRequest,
+    ) -> Result<SetSessionFlagResponse, Error> {
+        self.as_ref().set_session_flag(args).await
+    }
     async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
         self.as_ref().ext_method(args).await
     }
@@ -228,6 +375,41 @@ impl<T: Agent> Agent for Arc<T> {
     ) -> Result<SetSessionModelResponse, Error> {
         self.as_ref().set_session_model(args).await
     }
+    #[cfg(feature = "unstable")]
+    async fn cancel_tool_call(
+        &self,
+        args: CancelToolCallRequest,
+    ) -> Result<CancelToolCallResponse, Error> {
+        self.as_ref().cancel_tool_call(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn terminal_output_update(
+        &self,
+        args: TerminalOutputUpdateNotification,
+    ) -> Result<(), Error> {
+        self.as_ref().terminal_output_update(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn list_sessions(
+        &self,
+        args: ListSessionsRequest,
+    ) -> Result<ListSessionsResponse, Error> {
+        self.as_ref().list_sessions(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn list_session_flags(
+        &self,
+        args: ListSessionFlagsRequest,
+    ) -> Result<ListSessionFlagsResponse, Error> {
+        self.as_ref().list_session_flags(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn set_session_flag(
+        &self,
+        args: SetSessionFlagRequest,
+    ) -> Result<SetSessionFlagResponse, Error> {
+        self.as_ref().set_session_flag(args).await
+    }
     async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
         self.as_ref().ext_method(args).await
     }
@@ -252,6 +434,11 @@ pub struct InitializeRequest {
     /// Capabilities supported by the client.
     #[serde(default)]
     pub client_capabilities: ClientCapabilities,
+    /// Information about the client's implementation.
+    ///
+    /// Older clients don't send this, so Agents should not rely on it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub client_info: Option<Implementation>,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
@@ -277,11 +464,86 @@ pub struct InitializeResponse {
     /// Authentication methods supported by the agent.
     #[serde(default)]
     pub auth_methods: Vec<AuthMethod>,
+    /// Information about the agent's implementation.
+    ///
+    /// Older agents don't send this, so Clients should not rely on it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub agent_info: Option<Implementation>,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+impl InitializeResponse {
+    /// Responds to `request` with the given capabilities.
+    ///
+    /// The protocol version is negotiated as the specification requires: the
+    /// version the client requested if this crate supports it, or else
+    /// [`MAX_VERSION`], the newest version this crate supports. A client that
+    /// requested a newer version gets the newest one the agent understands,
+    /// and a client that requested an older one is expected to disconnect.
+    ///
+    /// See protocol docs: [Protocol Version](https://agentclientprotocol.com/protocol/initialization#protocol-version)
+    #[must_use]
+    pub fn new(request: &InitializeRequest, agent_capabilities: AgentCapabilities) -> Self {
+        let protocol_version = if request.protocol_version.is_supported() {
+            request.protocol_version.clone()
+        } else {
+            MAX_VERSION
+        };
+        Self {
+            protocol_version,
+            agent_capabilities,
+            auth_methods: Vec::new(),
+            agent_info: None,
+            meta: None,
+        }
+    }
+
+    /// Sets the authentication methods supported by the agent.
+    #[must_use]
+    pub fn with_auth_methods(mut self, auth_methods: Vec<AuthMethod>) -> Self {
+        self.auth_methods = auth_methods;
+        self
+    }
+
+    /// Sets information about the agent's implementation.
+    #[must_use]
+    pub fn with_agent_info(mut self, agent_info: Implementation) -> Self {
+        self.agent_info = Some(agent_info);
+        self
+    }
+}
+
+/// The name and version of a Client or Agent implementation.
+///
+/// Exchanged during initialization so each side can identify its peer,
+/// e.g. for logging, telemetry, or working around issues in specific versions.
+///
+/// See protocol docs: [Implementation Information](https://agentclientprotocol.com/protocol/initialization#implementation-information)
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct Implementation {
+    /// The name of the implementation, e.g. `zed` or `claude-code`.
+    pub name: String,
+    /// The version of the implementation, e.g. `0.207.0`.
+    pub version: String,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+impl Implementation {
+    /// Creates a new [`Implementation`] with the given name and version.
+    pub fn new(name: impl Into<String>, version: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            version: version.into(),
+            meta: None,
+        }
+    }
+}
+
 // Authentication
 
 /// Request parameters for the authenticate method.
@@ -342,6 +604,13 @@ pub struct NewSessionRequest {
     pub cwd: PathBuf,
     /// List of MCP (Model Context Protocol) servers the agent should connect to.
     pub mcp_servers: Vec<McpServer>,
+    /// Instructions the Agent applies to every prompt turn of the session, like a system prompt.
+    ///
+    /// They are sent once instead of being prepended to each prompt. When a prompt conflicts with them, the prompt takes precedence for that turn. Instructions follow the same content rules as prompts, see [`PromptCapabilities`].
+    ///
+    /// See protocol docs: [Session Instructions](https://agentclientprotocol.com/protocol/session-setup#session-instructions)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub instructions: Vec<ContentBlock>,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
@@ -535,6 +804,200 @@ pub enum McpServer {
     },
 }
 
+impl McpServer {
+    /// Creates a server that the agent launches as a subprocess and talks to
+    /// over stdio.
+    pub fn stdio(
+        name: impl Into<String>,
+        command: impl Into<PathBuf>,
+        args: impl IntoIterator<Item = impl Into<String>>,
+        env: Vec<EnvVariable>,
+    ) -> Self {
+        McpServer::Stdio {
+            name: name.into(),
+            command: command.into(),
+            args: args.into_iter().map(Into::into).collect(),
+            env,
+        }
+    }
+
+    /// Creates a server that the agent connects to over HTTP.
+    ///
+    /// Only pass this to agents that advertise [`McpCapabilities::http`].
+    pub fn http(name: impl Into<String>, url: impl Into<String>, headers: Vec<HttpHeader>) -> Self {
+        McpServer::Http {
+            name: name.into(),
+            url: url.into(),
+            headers,
+        }
+    }
+
+    /// Checks that the server configuration can be used to connect.
+    ///
+    /// Stdio servers need a command, and their environment variables need
+    /// unique, non-empty names. HTTP and SSE servers need a URL, and their
+    /// headers need non-empty names.
+    ///
+    /// Returns an `invalid_params` error describing the first problem found,
+    /// see [`Error::validation_errors`]. Fields are named relative to the
+    /// server, e.g. `env[1].name`; use [`McpServer::validate_all`] to name
+    /// them as in the request, e.g. `mcpServers[0].env[1].name`.
+    pub fn validate(&self) -> Result<(), Error> {
+        match self {
+            McpServer::Stdio {
+                name, command, env, ..
+            } => {
+                if command.as_os_str().is_empty() {
+                    return Err(invalid_server(name, "command", "command must not be empty"));
+                }
+                let mut names = std::collections::HashSet::new();
+                for (index, variable) in env.iter().enumerate() {
+                    if variable.name.is_empty() {
+                        return Err(invalid_server(
+                            name,
+                            &format!("env[{index}].name"),
+                            "environment variable names must not be empty",
+                        ));
+                    }
+                    if !names.insert(&variable.name) {
+                        return Err(invalid_server(
+                            name,
+                            &format!("env[{index}].name"),
+                            &format!("duplicate environment variable {}", variable.name),
+                        ));
+                    }
+                }
+            }
+            McpServer::Http { name, url, headers } | McpServer::Sse { name, url, headers } => {
+                if url.is_empty() {
+                    return Err(invalid_server(name, "url", "url must not be empty"));
+                }
+                if let Some(index) = headers.iter().position(|header| header.name.is_empty()) {
+                    return Err(invalid_server(
+                        name,
+                        &format!("headers[{index}].name"),
+                        "header names must not be empty",
+                    ));
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Checks every server of a `session/new` or `session/load` request with
+    /// [`McpServer::validate`].
+    ///
+    /// Returns an `invalid_params` error listing the first problem of each
+    /// invalid server, with fields named as in the request, e.g.
+    /// `mcpServers[0].command`.
+    pub fn validate_all(servers: &[McpServer]) -> Result<(), Error> {
+        let errors: Vec<_> = servers
+            .iter()
+            .enumerate()
+            .filter_map(|(index, server)| {
+                let errors = server.validate().err()?.validation_errors()?;
+                Some(errors.into_iter().map(move |mut error| {
+                    error.field = format!("mcpServers[{index}].{}", error.field);
+                    error
+                }))
+            })
+            .flatten()
+            .collect();
+        if errors.is_empty() {
+            Ok(())
+        } else {
+            Err(Error::invalid_fields(errors))
+        }
+    }
+
+    /// Finds the executable a stdio server is launched with.
+    ///
+    /// Like a shell, bare commands such as `npx` are looked up in the
+    /// directories of the agent's `PATH`, while commands with a directory,
+    /// such as `/usr/bin/mcp-fs` or `./server`, must point at an executable
+    /// file and are made absolute. Agents can call this when a session is
+    /// created, to reject a misconfigured server before it is needed.
+    ///
+    /// Returns an `invalid_params` error if the command can't be found, or if
+    /// this isn't a stdio server, see [`Error::validation_errors`].
+    pub fn resolve_command(&self) -> Result<PathBuf, Error> {
+        let (name, command) = match self {
+            McpServer::Stdio { name, command, .. } => (name, command),
+            McpServer::Http { name, .. } | McpServer::Sse { name, .. } => {
+                return Err(invalid_server(
+                    name,
+                    "command",
+                    "only stdio servers have a command",
+                ));
+            }
+        };
+        if command.as_os_str().is_empty() {
+            return Err(invalid_server(name, "command", "command must not be empty"));
+        }
+
+        if command.components().count() > 1 || command.is_absolute() {
+            return executable(command)
+                .and_then(|command| std::path::absolute(command).ok())
+                .ok_or_else(|| {
+                    invalid_server(
+                        name,
+                        "command",
+                        &format!("{} is not an executable file", command.display()),
+                    )
+                });
+        }
+        std::env::var_os("PATH")
+            .iter()
+            .flat_map(std::env::split_paths)
+            .find_map(|dir| executable(&dir.join(command)))
+            .ok_or_else(|| {
+                invalid_server(
+                    name,
+                    "command",
+                    &format!("{} was not found in PATH", command.display()),
+                )
+            })
+    }
+}
+
+/// Returns `path` if it is an executable file.
+#[cfg(unix)]
+fn executable(path: &Path) -> Option<PathBuf> {
+    use std::os::unix::fs::PermissionsExt as _;
+
+    let metadata = path.metadata().ok()?;
+    (metadata.is_file() && metadata.permissions().mode() & 0o111 != 0).then(|| path.to_path_buf())
+}
+
+/// Returns `path` if it is a file, trying the extensions in `PATHEXT` if it
+/// has none.
+#[cfg(not(unix))]
+fn executable(path: &Path) -> Option<PathBuf> {
+    if path.is_file() {
+        return Some(path.to_path_buf());
+    }
+    if path.extension().is_some() {
+        return None;
+    }
+    let extensions = std::env::var("PATHEXT").unwrap_or_else(|_| ".COM;.EXE;.BAT;.CMD".to_string());
+    extensions
+        .split(';')
+        .filter(|extension| !extension.is_empty())
+        .map(|extension| {
+            let mut path = path.as_os_str().to_owned();
+            path.push(extension);
+            PathBuf::from(path)
+        })
+        .find(|path| path.is_file())
+}
+
+fn invalid_server(name: &str, field: &str, problem: &str) -> Error {
+    Error::invalid_fields([ValidationErrorData::new(
+        field,
+        format!("invalid MCP server {name:?}: {problem}"),
+    )])
+}
+
 /// An environment variable to set when launching an MCP server.
 #[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
@@ -548,6 +1011,41 @@ pub struct EnvVariable {
     pub meta: Option<serde_json::Value>,
 }
 
+impl EnvVariable {
+    /// Creates an environment variable with the given name and value.
+    pub fn new(name: impl Into<String>, value: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            value: value.into(),
+            meta: None,
+        }
+    }
+
+    /// Creates a list of environment variables from name/value pairs, such as
+    /// a `HashMap` or `BTreeMap`, in iteration order.
+    pub fn from_map(
+        variables: impl IntoIterator<Item = (impl Into<String>, impl Into<String>)>,
+    ) -> Vec<Self> {
+        variables
+            .into_iter()
+            .map(|(name, value)| Self::new(name, value))
+            .collect()
+    }
+
+    /// Copies the named variables from the current process environment.
+    ///
+    /// Variables that aren't set, or aren't valid Unicode, are skipped.
+    pub fn from_os(names: impl IntoIterator<Item = impl AsRef<str>>) -> Vec<Self> {
+        names
+            .into_iter()
+            .filter_map(|name| {
+                let value = std::env::var(name.as_ref()).ok()?;
+                Some(Self::new(name.as_ref(), value))
+            })
+            .collect()
+    }
+}
+
 /// An HTTP header to set when making requests to the MCP server.
 #[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
@@ -561,6 +1059,17 @@ pub struct HttpHeader {
     pub meta: Option<serde_json::Value>,
 }
 
+impl HttpHeader {
+    /// Creates a header with the given name and value.
+    pub fn new(name: impl Into<String>, value: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            value: value.into(),
+            meta: None,
+        }
+    }
+}
+
 // Prompt
 
 /// Request parameters for sending a user prompt to the agent.
@@ -588,11 +1097,210 @@ pub struct PromptRequest {
     /// as it avoids extra round-trips and allows the message to include
     /// pieces of context from sources the agent may not have access to.
     pub prompt: Vec<ContentBlock>,
+    /// Identifies this turn among the session's running turns.
+    ///
+    /// Only sent to agents that advertise [`AgentCapabilities::concurrent_turns`],
+    /// which then run the turn alongside the other turns of the session
+    /// instead of cancelling them. The id MUST be unique among the session's
+    /// running turns.
+    ///
+    /// See protocol docs: [Concurrent Turns](https://agentclientprotocol.com/protocol/prompt-turn#concurrent-turns)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub turn_id: Option<TurnId>,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+impl PromptRequest {
+    /// Creates a request sending `prompt` to the given session.
+    pub fn new(session_id: SessionId, prompt: Vec<ContentBlock>) -> Self {
+        Self {
+            session_id,
+            prompt,
+            turn_id: None,
+            meta: None,
+        }
+    }
+
+    /// Runs the prompt as the given turn, alongside the session's other turns.
+    ///
+    /// Only allowed if the agent supports [`AgentCapabilities::concurrent_turns`].
+    #[must_use]
+    pub fn with_turn_id(mut self, turn_id: TurnId) -> Self {
+        self.turn_id = Some(turn_id);
+        self
+    }
+
+    /// Echoes the user's message back as `user_message_chunk` updates, one per
+    /// content block, so clients can display it in the conversation.
+    ///
+    /// See protocol docs: [Agent Reports Output](https://agentclientprotocol.com/protocol/prompt-turn#3-agent-reports-output)
+    pub fn user_message_chunks(&self) -> impl Iterator<Item = SessionNotification> + '_ {
+        self.prompt.iter().map(|content| SessionNotification {
+            session_id: self.session_id.clone(),
+            update: SessionUpdate::UserMessageChunk {
+                content: content.clone(),
+            },
+            turn_id: self.turn_id.clone(),
+            meta: None,
+        })
+    }
+
+    /// Checks that the agent can handle every content block of the prompt,
+    /// given the [`PromptCapabilities`] it advertised.
+    ///
+    /// Clients can call this before sending the prompt to fail fast with a
+    /// clear message instead of relying on the agent to reject it. Returns an
+    /// `invalid_params` error listing each unsupported block, such as
+    /// `prompt[1]` for an image sent to an agent without the `image`
+    /// capability, see [`Error::validation_errors`]. Use
+    /// [`PromptCapabilities::downgrade`] to adapt the prompt instead.
+    pub fn check_compatible(&self, capabilities: &PromptCapabilities) -> Result<(), Error> {
+        let errors: Vec<_> = self
+            .prompt
+            .iter()
+            .enumerate()
+            .filter(|(_, block)| !capabilities.supports(block))
+            .map(|(index, block)| {
+                let capability = match block {
+                    ContentBlock::Resource(_) => "embeddedContext",
+                    ContentBlock::ResourceLink(_) => "mediaLinks",
+                    block => block.kind(),
+                };
+                ValidationErrorData::new(
+                    format!("prompt[{index}]"),
+                    format!(
+                        "{} content in prompts requires the `{capability}` prompt capability",
+                        block.kind()
+                    ),
+                )
+            })
+            .collect();
+        if errors.is_empty() {
+            Ok(())
+        } else {
+            Err(Error::invalid_fields(errors))
+        }
+    }
+}
+
+/// Identifies a prompt turn among the concurrent turns of a session.
+///
+/// Chosen by the client when sending `session/prompt`.
+///
+/// See protocol docs: [Concurrent Turns](https://agentclientprotocol.com/protocol/prompt-turn#concurrent-turns)
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema, PartialEq, Eq, Hash)]
+#[serde(transparent)]
+pub struct TurnId(pub Arc<str>);
+
+impl fmt::Display for TurnId {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.0)
+    }
+}
+
+/// Incrementally builds a [`PromptRequest`] from mixed content.
+///
+/// # Example
+///
+/// ```
+/// use agent_client_protocol::{PromptBuilder, PromptCapabilities, SessionId};
+///
+/// let request = PromptBuilder::new(SessionId("sess_abc123def456".into()))
+///     .text("Can you explain this function?")
+///     .file("/home/user/project/main.py", Some("text/x-python"), "def main(): ...")
+///     .build(&PromptCapabilities {
+///         embedded_context: true,
+///         ..Default::default()
+///     })
+///     .unwrap();
+/// ```
+#[derive(Debug, Clone)]
+pub struct PromptBuilder {
+    session_id: SessionId,
+    prompt: Vec<ContentBlock>,
+}
+
+impl PromptBuilder {
+    /// Starts an empty prompt for the given session.
+    #[must_use]
+    pub fn new(session_id: SessionId) -> Self {
+        Self {
+            session_id,
+            prompt: Vec::new(),
+        }
+    }
+
+    /// Appends an arbitrary content block.
+    #[must_use]
+    pub fn block(mut self, block: impl Into<ContentBlock>) -> Self {
+        self.prompt.push(block.into());
+        self
+    }
+
+    /// Appends a text block.
+    #[must_use]
+    pub fn text(self, text: impl Into<String>) -> Self {
+        self.block(text.into())
+    }
+
+    /// Appends the contents of a file as an embedded text resource.
+    #[must_use]
+    pub fn file(
+        self,
+        path: impl Into<PathBuf>,
+        mime_type: Option<&str>,
+        text: impl Into<String>,
+    ) -> Self {
+        let path: PathBuf = path.into();
+        self.block(ContentBlock::Resource(EmbeddedResource {
+            annotations: None,
+            resource: EmbeddedResourceResource::TextResourceContents(TextResourceContents {
+                mime_type: mime_type.map(ToOwned::to_owned),
+                text: text.into(),
+                uri: crate::content::file_uri(&path),
+                meta: None,
+            }),
+            meta: None,
+        }))
+    }
+
+    /// Appends a base64-encoded image.
+    #[must_use]
+    pub fn image(self, data: impl Into<String>, mime_type: impl Into<String>) -> Self {
+        self.block(ContentBlock::Image(ImageContent {
+            annotations: None,
+            data: data.into(),
+            mime_type: mime_type.into(),
+            uri: None,
+            meta: None,
+        }))
+    }
+
+    /// Appends base64-encoded audio.
+    #[must_use]
+    pub fn audio(self, data: impl Into<String>, mime_type: impl Into<String>) -> Self {
+        self.block(ContentBlock::Audio(AudioContent {
+            annotations: None,
+            data: data.into(),
+            mime_type: mime_type.into(),
+            meta: None,
+        }))
+    }
+
+    /// Builds the request, checking each block against the agent's advertised
+    /// [`PromptCapabilities`].
+    ///
+    /// Returns an `invalid_params` error if the prompt contains content the
+    /// agent hasn't opted in to, see [`PromptRequest::check_compatible`].
+    pub fn build(self, capabilities: &PromptCapabilities) -> Result<PromptRequest, Error> {
+        let request = PromptRequest::new(self.session_id, self.prompt);
+        request.check_compatible(capabilities)?;
+        Ok(request)
+    }
+}
+
 /// Response from processing a user prompt.
 ///
 /// See protocol docs: [Check for Completion](https://agentclientprotocol.com/protocol/prompt-turn#4-check-for-completion)
@@ -602,11 +1310,41 @@ pub struct PromptRequest {
 pub struct PromptResponse {
     /// Indicates why the agent stopped processing the turn.
     pub stop_reason: StopReason,
+    /// Tokens used during the turn, if the agent tracks them.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub usage: Option<TokenUsage>,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+/// Tokens used by the language model behind the agent.
+///
+/// See protocol docs: [Token Usage](https://agentclientprotocol.com/protocol/prompt-turn#token-usage)
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct TokenUsage {
+    /// Tokens sent to the model, including the prompt and any context.
+    pub input_tokens: u64,
+    /// Tokens generated by the model.
+    pub output_tokens: u64,
+    /// All tokens used. Usually the sum of input and output tokens, but may
+    /// include others the agent is billed for, such as reasoning tokens.
+    pub total_tokens: u64,
+}
+
+impl TokenUsage {
+    /// Creates a usage report whose total is the sum of `input_tokens` and
+    /// `output_tokens`.
+    pub fn new(input_tokens: u64, output_tokens: u64) -> Self {
+        Self {
+            input_tokens,
+            output_tokens,
+            total_tokens: input_tokens + output_tokens,
+        }
+    }
+}
+
 /// Reasons why an agent stops processing a prompt turn.
 ///
 /// See protocol docs: [Stop Reasons](https://agentclientprotocol.com/protocol/prompt-turn#stop-reasons)
@@ -725,31 +1463,331 @@ pub struct SetSessionModelResponse {
     pub meta: Option<serde_json::Value>,
 }
 
-// Capabilities
+// Cancel tool call
 
-/// Capabilities supported by the agent.
+/// **UNSTABLE**
 ///
-/// Advertised during initialization to inform the client about
-/// available features and content types.
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
 ///
-/// See protocol docs: [Agent Capabilities](https://agentclientprotocol.com/protocol/initialization#agent-capabilities)
-#[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
+/// Request parameters for cancelling a single tool call.
+///
+/// Only available if the Agent supports the `cancelToolCall` capability.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_CANCEL_TOOL_CALL_METHOD_NAME))]
 #[serde(rename_all = "camelCase")]
-pub struct AgentCapabilities {
-    /// Whether the agent supports `session/load`.
-    #[serde(default)]
-    pub load_session: bool,
-    /// Prompt capabilities supported by the agent.
-    #[serde(default)]
-    pub prompt_capabilities: PromptCapabilities,
-    /// MCP capabilities supported by the agent.
-    #[serde(default)]
-    pub mcp_capabilities: McpCapabilities,
+pub struct CancelToolCallRequest {
+    /// The ID of the session the tool call belongs to.
+    pub session_id: SessionId,
+    /// The ID of the tool call to cancel.
+    pub tool_call_id: ToolCallId,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Response to `session/cancel_tool_call` method.
+#[cfg(feature = "unstable")]
+#[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_CANCEL_TOOL_CALL_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct CancelToolCallResponse {
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+// List sessions
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Request parameters for listing the sessions an Agent holds.
+///
+/// Only available if the Agent supports the `listSessions` capability.
+#[cfg(feature = "unstable")]
+#[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_LIST_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct ListSessionsRequest {
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Response from listing sessions.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_LIST_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct ListSessionsResponse {
+    /// The IDs of the sessions the Agent currently holds.
+    pub sessions: Vec<SessionId>,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+// Session flags
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// A quick toggle offered by a session, such as a mode that skips permission
+/// prompts.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema, PartialEq)]
+#[serde(rename_all = "camelCase")]
+pub struct SessionFlag {
+    /// Identifies the flag in `session/set_flag` requests.
+    pub name: String,
+    /// Human-readable description of what the flag does.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub description: Option<String>,
+    /// Whether the flag is currently on.
+    pub enabled: bool,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Request parameters for listing the flags of a session.
+///
+/// Only available if the Agent supports the `sessionFlags` capability.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_LIST_FLAGS_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct ListSessionFlagsRequest {
+    /// The ID of the session to list the flags of.
+    pub session_id: SessionId,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Response from listing the flags of a session.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_LIST_FLAGS_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct ListSessionFlagsResponse {
+    /// The flags the session offers, with their current state.
+    pub flags: Vec<SessionFlag>,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Request parameters for turning a session flag on or off.
+///
+/// Only available if the Agent supports the `sessionFlags` capability.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_SET_FLAG_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct SetSessionFlagRequest {
+    /// The ID of the session to set the flag for.
+    pub session_id: SessionId,
+    /// The name of the flag, as returned by `session/list_flags`.
+    pub name: String,
+    /// Whether to turn the flag on or off.
+    pub enabled: bool,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Response to `session/set_flag` method.
+#[cfg(feature = "unstable")]
+#[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = SESSION_SET_FLAG_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct SetSessionFlagResponse {
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+// Capabilities
+
+/// Capabilities supported by the agent.
+///
+/// Advertised during initialization to inform the client about
+/// available features and content types.
+///
+/// See protocol docs: [Agent Capabilities](https://agentclientprotocol.com/protocol/initialization#agent-capabilities)
+#[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct AgentCapabilities {
+    /// Whether the agent supports `session/load`.
+    #[serde(default)]
+    pub load_session: bool,
+    /// Whether the agent can run several prompt turns of a session at once.
+    ///
+    /// When enabled, the Client may identify turns with
+    /// [`PromptRequest::turn_id`] and cancel them one at a time.
+    ///
+    /// See protocol docs: [Concurrent Turns](https://agentclientprotocol.com/protocol/prompt-turn#concurrent-turns)
+    #[serde(default)]
+    pub concurrent_turns: bool,
+    /// Whether the agent sends a `drained` session update once it has stopped
+    /// all work for a prompt turn.
+    ///
+    /// Clients can only wait for a turn to drain when this is `true`.
+    #[serde(default)]
+    pub drain_updates: bool,
+    /// Whether the agent can read compressed messages.
+    ///
+    /// Messages are only compressed once both sides advertise this.
+    ///
+    /// See protocol docs: [Compression](https://agentclientprotocol.com/protocol/initialization#compression)
+    #[serde(default)]
+    pub compression: bool,
+    /// Prompt capabilities supported by the agent.
+    #[serde(default)]
+    pub prompt_capabilities: PromptCapabilities,
+    /// MCP capabilities supported by the agent.
+    #[serde(default)]
+    pub mcp_capabilities: McpCapabilities,
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Whether the agent supports `session/cancel_tool_call`.
+    #[cfg(feature = "unstable")]
+    #[serde(default)]
+    pub cancel_tool_call: bool,
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Whether the agent wants to receive `terminal/output_update` notifications.
+    #[cfg(feature = "unstable")]
+    #[serde(default)]
+    pub terminal_output_updates: bool,
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Whether the agent supports `session/list`.
+    #[cfg(feature = "unstable")]
+    #[serde(default)]
+    pub list_sessions: bool,
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Whether the agent supports `session/list_flags` and `session/set_flag`.
+    #[cfg(feature = "unstable")]
+    #[serde(default)]
+    pub session_flags: bool,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+impl AgentCapabilities {
+    /// The capabilities every agent has: text and resource link prompts,
+    /// without `session/load` or MCP transports beyond stdio.
+    ///
+    /// This is the same as [`AgentCapabilities::default`], spelled out for
+    /// use with the `with_*` methods.
+    #[must_use]
+    pub fn baseline() -> Self {
+        Self::default()
+    }
+
+    /// Sets whether the agent supports `session/load`.
+    #[must_use]
+    pub fn with_load_session(mut self, supported: bool) -> Self {
+        self.load_session = supported;
+        self
+    }
+
+    /// Sets whether the agent can run several turns of a session at once.
+    #[must_use]
+    pub fn with_concurrent_turns(mut self, supported: bool) -> Self {
+        self.concurrent_turns = supported;
+        self
+    }
+
+    /// Sets whether the agent sends `drained` session updates.
+    #[must_use]
+    pub fn with_drain_updates(mut self, supported: bool) -> Self {
+        self.drain_updates = supported;
+        self
+    }
+
+    /// Sets whether the agent can read compressed messages.
+    #[must_use]
+    pub fn with_compression(mut self, supported: bool) -> Self {
+        self.compression = supported;
+        self
+    }
+
+    /// Sets whether the agent accepts [`ContentBlock::Image`] in prompts.
+    #[must_use]
+    pub fn with_image_prompts(mut self, supported: bool) -> Self {
+        self.prompt_capabilities.image = supported;
+        self
+    }
+
+    /// Sets whether the agent accepts [`ContentBlock::Audio`] in prompts.
+    #[must_use]
+    pub fn with_audio_prompts(mut self, supported: bool) -> Self {
+        self.prompt_capabilities.audio = supported;
+        self
+    }
+
+    /// Sets whether the agent accepts [`ContentBlock::Resource`] in prompts.
+    #[must_use]
+    pub fn with_embedded_context(mut self, supported: bool) -> Self {
+        self.prompt_capabilities.embedded_context = supported;
+        self
+    }
+
+    /// Sets whether the agent supports [`McpServer::Http`].
+    #[must_use]
+    pub fn with_mcp_http(mut self, supported: bool) -> Self {
+        self.mcp_capabilities.http = supported;
+        self
+    }
+
+    /// Sets whether the agent supports [`McpServer::Sse`].
+    #[must_use]
+    pub fn with_mcp_sse(mut self, supported: bool) -> Self {
+        self.mcp_capabilities.sse = supported;
+        self
+    }
+}
+
 /// Prompt capabilities supported by the agent in `session/prompt` requests.
 ///
 /// Baseline agent functionality requires support for [`ContentBlock::Text`]
@@ -777,11 +1815,73 @@ pub struct PromptCapabilities {
     /// in prompt requests for pieces of context that are referenced in the message.
     #[serde(default)]
     pub embedded_context: bool,
+    /// Agent can fetch images and audio referenced by URI.
+    ///
+    /// When enabled, the Client is allowed to send media as a
+    /// [`ContentBlock::ResourceLink`] with an `image/*` or `audio/*` MIME type
+    /// instead of embedding base64 data. Otherwise, the Client MUST inline the
+    /// media as [`ContentBlock::Image`] or [`ContentBlock::Audio`].
+    #[serde(default)]
+    pub media_links: bool,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+impl PromptCapabilities {
+    /// Whether the agent accepts the given content block in `session/prompt` requests.
+    ///
+    /// [`ContentBlock::Text`] and [`ContentBlock::ResourceLink`] are always
+    /// supported, except for links to images and audio, which require
+    /// `media_links`.
+    #[must_use]
+    pub fn supports(&self, block: &ContentBlock) -> bool {
+        match block {
+            ContentBlock::Text(_) => true,
+            ContentBlock::ResourceLink(link) => self.media_links || !link.is_media(),
+            ContentBlock::Image(_) => self.image,
+            ContentBlock::Audio(_) => self.audio,
+            ContentBlock::Resource(_) => self.embedded_context,
+        }
+    }
+
+    /// Adapts a prompt to what the agent supports, so that it isn't rejected
+    /// with an invalid params error.
+    ///
+    /// Unsupported embedded resources are replaced with a
+    /// [`ContentBlock::ResourceLink`] to the same URI, as are unsupported
+    /// images that have a URI when the agent supports `media_links`. Any other
+    /// unsupported block is dropped.
+    #[must_use]
+    pub fn downgrade(&self, prompt: Vec<ContentBlock>) -> Vec<ContentBlock> {
+        prompt
+            .into_iter()
+            .filter_map(|block| {
+                if self.supports(&block) {
+                    return Some(block);
+                }
+                match block {
+                    ContentBlock::Resource(resource) => {
+                        let (uri, mime_type) = match resource.resource {
+                            EmbeddedResourceResource::TextResourceContents(contents) => {
+                                (contents.uri, contents.mime_type)
+                            }
+                            EmbeddedResourceResource::BlobResourceContents(contents) => {
+                                (contents.uri, contents.mime_type)
+                            }
+                        };
+                        Some(ContentBlock::resource_link(uri, mime_type))
+                    }
+                    ContentBlock::Image(image) if self.media_links => image
+                        .uri
+                        .map(|uri| ContentBlock::resource_link(uri, Some(image.mime_type))),
+                    _ => None,
+                }
+            })
+            .collect()
+    }
+}
+
 /// MCP capabilities supported by the agent
 #[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
@@ -821,6 +1921,21 @@ pub struct AgentMethodNames {
     /// Method for selecting a model for a given session.
     #[cfg(feature = "unstable")]
     pub session_set_model: &'static str,
+    /// Method for cancelling a single tool call.
+    #[cfg(feature = "unstable")]
+    pub session_cancel_tool_call: &'static str,
+    /// Notification for streaming terminal output.
+    #[cfg(feature = "unstable")]
+    pub terminal_output_update: &'static str,
+    /// Method for listing active sessions.
+    #[cfg(feature = "unstable")]
+    pub session_list: &'static str,
+    /// Method for listing the flags of a session.
+    #[cfg(feature = "unstable")]
+    pub session_list_flags: &'static str,
+    /// Method for turning a session flag on or off.
+    #[cfg(feature = "unstable")]
+    pub session_set_flag: &'static str,
 }
 
 /// Constant containing all agent method names.
@@ -834,6 +1949,16 @@ pub const AGENT_METHOD_NAMES: AgentMethodNames = AgentMethodNames {
     session_cancel: SESSION_CANCEL_METHOD_NAME,
     #[cfg(feature = "unstable")]
     session_set_model: SESSION_SET_MODEL_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    session_cancel_tool_call: SESSION_CANCEL_TOOL_CALL_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    terminal_output_update: TERMINAL_OUTPUT_UPDATE_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    session_list: SESSION_LIST_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    session_list_flags: SESSION_LIST_FLAGS_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    session_set_flag: SESSION_SET_FLAG_METHOD_NAME,
 };
 
 /// Method name for the initialize request.
@@ -853,6 +1978,21 @@ pub(crate) const SESSION_CANCEL_METHOD_NAME: &str = "session/cancel";
 /// Method name for selecting a model for a given session.
 #[cfg(feature = "unstable")]
 pub(crate) const SESSION_SET_MODEL_METHOD_NAME: &str = "session/set_model";
+/// Method name for cancelling a single tool call.
+#[cfg(feature = "unstable")]
+pub(crate) const SESSION_CANCEL_TOOL_CALL_METHOD_NAME: &str = "session/cancel_tool_call";
+/// Notification name for streaming terminal output.
+#[cfg(feature = "unstable")]
+pub(crate) const TERMINAL_OUTPUT_UPDATE_METHOD_NAME: &str = "terminal/output_update";
+/// Method name for listing active sessions.
+#[cfg(feature = "unstable")]
+pub(crate) const SESSION_LIST_METHOD_NAME: &str = "session/list";
+/// Method name for listing the flags of a session.
+#[cfg(feature = "unstable")]
+pub(crate) const SESSION_LIST_FLAGS_METHOD_NAME: &str = "session/list_flags";
+/// Method name for turning a session flag on or off.
+#[cfg(feature = "unstable")]
+pub(crate) const SESSION_SET_FLAG_METHOD_NAME: &str = "session/set_flag";
 
 /// All possible requests that a client can send to an agent.
 ///
@@ -872,7 +2012,19 @@ pub enum ClientRequest {
     PromptRequest(PromptRequest),
     #[cfg(feature = "unstable")]
     SetSessionModelRequest(SetSessionModelRequest),
+    #[cfg(feature = "unstable")]
+    CancelToolCallRequest(CancelToolCallRequest),
+    #[cfg(feature = "unstable")]
+    ListSessionsRequest(ListSessionsRequest),
+    #[cfg(feature = "unstable")]
+    ListSessionFlagsRequest(ListSessionFlagsRequest),
+    #[cfg(feature = "unstable")]
+    SetSessionFlagRequest(SetSessionFlagRequest),
     ExtMethodRequest(ExtRequest),
+    /// A method registered with [`crate::AgentSideConnection::register_method`].
+    /// Not part of the protocol, so it is left out of the schema.
+    #[schemars(skip)]
+    CustomMethodRequest(ExtRequest),
 }
 
 /// All possible responses that an agent can send to a client.
@@ -893,6 +2045,14 @@ pub enum AgentResponse {
     PromptResponse(PromptResponse),
     #[cfg(feature = "unstable")]
     SetSessionModelResponse(SetSessionModelResponse),
+    #[cfg(feature = "unstable")]
+    CancelToolCallResponse(#[serde(default)] CancelToolCallResponse),
+    #[cfg(feature = "unstable")]
+    ListSessionsResponse(ListSessionsResponse),
+    #[cfg(feature = "unstable")]
+    ListSessionFlagsResponse(ListSessionFlagsResponse),
+    #[cfg(feature = "unstable")]
+    SetSessionFlagResponse(#[serde(default)] SetSessionFlagResponse),
     ExtMethodResponse(#[schemars(with = "serde_json::Value")] Arc<RawValue>),
 }
 
@@ -907,6 +2067,8 @@ pub enum AgentResponse {
 #[schemars(extend("x-docs-ignore" = true))]
 pub enum ClientNotification {
     CancelNotification(CancelNotification),
+    #[cfg(feature = "unstable")]
+    TerminalOutputUpdateNotification(TerminalOutputUpdateNotification),
     ExtNotification(ExtNotification),
 }
 
@@ -919,6 +2081,86 @@ pub enum ClientNotification {
 pub struct CancelNotification {
     /// The ID of the session to cancel operations for.
     pub session_id: SessionId,
+    /// Why the turn is being cancelled, if the client knows.
+    ///
+    /// Agents may use this for logging or to adapt their cleanup, but MUST handle
+    /// the cancellation the same way whether or not a reason is given.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub reason: Option<CancelReason>,
+    /// The turn to cancel, for agents that support
+    /// [`AgentCapabilities::concurrent_turns`].
+    ///
+    /// When omitted, every running turn of the session is cancelled.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub turn_id: Option<TurnId>,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+impl CancelNotification {
+    /// Creates a notification cancelling every running turn of a session.
+    pub fn new(session_id: SessionId) -> Self {
+        Self {
+            session_id,
+            reason: None,
+            turn_id: None,
+            meta: None,
+        }
+    }
+
+    /// Creates a notification cancelling the current turn of a session for
+    /// the given reason.
+    pub fn with_reason(session_id: SessionId, reason: CancelReason) -> Self {
+        Self {
+            session_id,
+            reason: Some(reason),
+            turn_id: None,
+            meta: None,
+        }
+    }
+
+    /// Limits the cancellation to a single turn of the session.
+    #[must_use]
+    pub fn for_turn(mut self, turn_id: TurnId) -> Self {
+        self.turn_id = Some(turn_id);
+        self
+    }
+}
+
+/// Why a client cancelled a prompt turn.
+///
+/// See protocol docs: [Cancellation](https://agentclientprotocol.com/protocol/prompt-turn#cancellation)
+#[derive(Debug, Clone, Copy, Serialize, Deserialize, JsonSchema, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum CancelReason {
+    /// The user asked to stop the turn, e.g. with a stop button.
+    UserRequested,
+    /// The client is shutting down or closing the session, e.g. because its
+    /// window was closed.
+    ClientClosing,
+    /// The turn ran longer than the client allows.
+    Timeout,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Notification carrying output a terminal produced since the previous update.
+///
+/// Only sent if the Agent supports the `terminalOutputUpdates` capability.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "agent", "x-method" = TERMINAL_OUTPUT_UPDATE_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct TerminalOutputUpdateNotification {
+    /// The session ID the terminal belongs to.
+    pub session_id: SessionId,
+    /// The ID of the terminal that produced the output.
+    pub terminal_id: TerminalId,
+    /// Output produced since the previous update, to be appended to it.
+    pub output: String,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
@@ -927,11 +2169,100 @@ pub struct CancelNotification {
 #[cfg(test)]
 mod test_serialization {
     use super::*;
+    use crate::{ErrorCode, ResourceLink};
     use serde_json::json;
 
     #[test]
-    fn test_mcp_server_stdio_serialization() {
-        let server = McpServer::Stdio {
+    fn test_initialize_response_negotiates_version() {
+        let request = |version: u16| InitializeRequest {
+            protocol_version: ProtocolVersion::new(version),
+            client_capabilities: ClientCapabilities::default(),
+            client_info: None,
+            meta: None,
+        };
+        let version = |response: InitializeResponse| response.protocol_version;
+
+        let capabilities = AgentCapabilities::baseline().with_load_session(true);
+        let response = InitializeResponse::new(&request(1), capabilities)
+            .with_agent_info(Implementation::new("test-agent", "1.0.0"));
+        assert_eq!(
+            serde_json::to_value(&response).unwrap()["agentCapabilities"]["loadSession"],
+            true
+        );
+        assert_eq!(version(response), crate::V1);
+
+        // Newer clients get the newest version the agent supports, and so do
+        // older ones, which are expected to disconnect.
+        for requested in [u16::MAX, 0] {
+            let response =
+                InitializeResponse::new(&request(requested), AgentCapabilities::baseline());
+            assert_eq!(version(response), MAX_VERSION);
+        }
+    }
+
+    #[test]
+    fn test_prompt_user_message_chunks() {
+        let request = PromptBuilder::new(SessionId("sess_abc123def456".into()))
+            .text("What's in this picture?")
+            .image("iVBORw0KGgo=", "image/png")
+            .file("/home/user/notes.md", Some("text/markdown"), "# Notes")
+            .build(&PromptCapabilities {
+                image: true,
+                embedded_context: true,
+                ..Default::default()
+            })
+            .unwrap();
+
+        let notifications = request
+            .user_message_chunks()
+            .map(|notification| serde_json::to_value(notification).unwrap())
+            .collect::<Vec<_>>();
+
+        assert_eq!(
+            notifications,
+            vec![
+                json!({
+                    "sessionId": "sess_abc123def456",
+                    "update": {
+                        "sessionUpdate": "user_message_chunk",
+                        "content": {
+                            "type": "text",
+                            "text": "What's in this picture?"
+                        }
+                    }
+                }),
+                json!({
+                    "sessionId": "sess_abc123def456",
+                    "update": {
+                        "sessionUpdate": "user_message_chunk",
+                        "content": {
+                            "type": "image",
+                            "data": "iVBORw0KGgo=",
+                            "mimeType": "image/png"
+                        }
+                    }
+                }),
+                json!({
+                    "sessionId": "sess_abc123def456",
+                    "update": {
+                        "sessionUpdate": "user_message_chunk",
+                        "content": {
+                            "type": "resource",
+                            "resource": {
+                                "uri": "file:///home/user/notes.md",
+                                "mimeType": "text/markdown",
+                                "text": "# Notes"
+                            }
+                        }
+                    }
+                }),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_mcp_server_stdio_serialization() {
+        let server = McpServer::Stdio {
             name: "test-server".to_string(),
             command: PathBuf::from("/usr/bin/server"),
             args: vec!["--port".to_string(), "3000".to_string()],
@@ -1071,4 +2402,772 @@ mod test_serialization {
             _ => panic!("Expected Sse variant"),
         }
     }
+
+    #[test]
+    fn test_prompt_builder() {
+        let request = PromptBuilder::new(SessionId("sess_1".into()))
+            .text("Describe this")
+            .file("/project/main.py", Some("text/x-python"), "print('hi')")
+            .image("iVBORw0KGgo=", "image/png")
+            .build(&PromptCapabilities {
+                image: true,
+                embedded_context: true,
+                ..Default::default()
+            })
+            .unwrap();
+
+        assert_eq!(
+            serde_json::to_value(&request).unwrap(),
+            json!({
+                "sessionId": "sess_1",
+                "prompt": [
+                    {
+                        "type": "text",
+                        "text": "Describe this"
+                    },
+                    {
+                        "type": "resource",
+                        "resource": {
+                            "mimeType": "text/x-python",
+                            "text": "print('hi')",
+                            "uri": "file:///project/main.py"
+                        }
+                    },
+                    {
+                        "type": "image",
+                        "data": "iVBORw0KGgo=",
+                        "mimeType": "image/png"
+                    }
+                ]
+            })
+        );
+    }
+
+    #[test]
+    fn test_prompt_builder_unsupported_content() {
+        let error = PromptBuilder::new(SessionId("sess_1".into()))
+            .text("Describe this")
+            .image("iVBORw0KGgo=", "image/png")
+            .build(&PromptCapabilities::default())
+            .unwrap_err();
+
+        assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+    }
+
+    #[test]
+    fn test_prompt_check_compatible() {
+        let request = PromptRequest {
+            session_id: SessionId("sess_1".into()),
+            prompt: PromptBuilder::new(SessionId("sess_1".into()))
+                .text("Compare these")
+                .image("iVBORw0KGgo=", "image/png")
+                .audio("UklGRg==", "audio/wav")
+                .file("/home/user/notes.md", Some("text/markdown"), "# Notes")
+                .prompt,
+            turn_id: None,
+            meta: None,
+        };
+
+        let fields = |capabilities: PromptCapabilities| {
+            request
+                .check_compatible(&capabilities)
+                .err()
+                .map(|error| {
+                    assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+                    error
+                        .validation_errors()
+                        .unwrap()
+                        .into_iter()
+                        .map(|error| error.field)
+                        .collect::<Vec<_>>()
+                })
+                .unwrap_or_default()
+        };
+
+        assert_eq!(
+            fields(PromptCapabilities::default()),
+            ["prompt[1]", "prompt[2]", "prompt[3]"]
+        );
+        assert_eq!(
+            fields(PromptCapabilities {
+                image: true,
+                embedded_context: true,
+                ..Default::default()
+            }),
+            ["prompt[2]"]
+        );
+        assert!(
+            fields(PromptCapabilities {
+                image: true,
+                audio: true,
+                embedded_context: true,
+                ..Default::default()
+            })
+            .is_empty()
+        );
+
+        let error = request
+            .check_compatible(&PromptCapabilities::default())
+            .unwrap_err();
+        assert!(
+            error.validation_errors().unwrap()[2]
+                .reason
+                .contains("`embeddedContext` prompt capability")
+        );
+    }
+
+    #[test]
+    fn test_media_links_require_capability() {
+        let image = ContentBlock::image_link("https://example.com/diagram.png", "image/png");
+        let audio = ContentBlock::audio_link("file:///home/user/recording.wav", "audio/wav");
+        let file = ContentBlock::ResourceLink(ResourceLink {
+            annotations: None,
+            description: None,
+            end_line: None,
+            mime_type: Some("text/markdown".into()),
+            name: "notes.md".into(),
+            size: None,
+            start_line: None,
+            title: None,
+            uri: "file:///home/user/notes.md".into(),
+            meta: None,
+        });
+
+        let capabilities = PromptCapabilities::default();
+        assert!(!capabilities.supports(&image));
+        assert!(!capabilities.supports(&audio));
+        assert!(capabilities.supports(&file));
+
+        let request = PromptRequest {
+            session_id: SessionId("sess_1".into()),
+            prompt: vec![file.clone(), image.clone()],
+            turn_id: None,
+            meta: None,
+        };
+        let errors = request
+            .check_compatible(&capabilities)
+            .unwrap_err()
+            .validation_errors()
+            .unwrap();
+        assert_eq!(errors.len(), 1);
+        assert_eq!(errors[0].field, "prompt[1]");
+        assert!(errors[0].reason.contains("`mediaLinks` prompt capability"));
+        assert_eq!(capabilities.downgrade(request.prompt), vec![file]);
+
+        let capabilities = PromptCapabilities {
+            media_links: true,
+            ..Default::default()
+        };
+        assert!(capabilities.supports(&image));
+        assert!(capabilities.supports(&audio));
+    }
+
+    #[test]
+    fn test_downgrade_prompt() {
+        let capabilities = PromptCapabilities::default();
+        let prompt = PromptBuilder::new(SessionId("sess_1".into()))
+            .text("Describe this")
+            .image("iVBORw0KGgo=", "image/png")
+            .block(ContentBlock::Resource(EmbeddedResource {
+                annotations: None,
+                resource: EmbeddedResourceResource::TextResourceContents(TextResourceContents {
+                    mime_type: Some("text/x-rust".into()),
+                    text: "fn main() {}".into(),
+                    uri: "file:///home/user/project/main.rs".into(),
+                    meta: None,
+                }),
+                meta: None,
+            }))
+            .build(&PromptCapabilities {
+                image: true,
+                embedded_context: true,
+                ..Default::default()
+            })
+            .unwrap()
+            .prompt;
+
+        assert_eq!(
+            serde_json::to_value(capabilities.downgrade(prompt)).unwrap(),
+            json!([
+                { "type": "text", "text": "Describe this" },
+                {
+                    "type": "resource_link",
+                    "mimeType": "text/x-rust",
+                    "name": "main.rs",
+                    "uri": "file:///home/user/project/main.rs"
+                }
+            ])
+        );
+    }
+
+    #[test]
+    fn test_cancel_notification_reason_serialization() {
+        let notification = CancelNotification::with_reason(
+            SessionId("sess_1".into()),
+            CancelReason::ClientClosing,
+        );
+        let json = json!({
+            "sessionId": "sess_1",
+            "reason": "client_closing"
+        });
+        assert_eq!(serde_json::to_value(&notification).unwrap(), json);
+        let decoded: CancelNotification = serde_json::from_value(json).unwrap();
+        assert_eq!(decoded.reason, Some(CancelReason::ClientClosing));
+
+        // The reason is optional, for clients that don't send one.
+        let decoded: CancelNotification =
+            serde_json::from_value(json!({ "sessionId": "sess_1" })).unwrap();
+        assert_eq!(decoded.reason, None);
+        assert_eq!(
+            serde_json::to_value(&decoded).unwrap(),
+            json!({ "sessionId": "sess_1" })
+        );
+    }
+
+    #[test]
+    fn test_turn_id_serialization() {
+        let turn_id = TurnId("turn_1".into());
+        let notification = CancelNotification::with_reason(
+            SessionId("sess_1".into()),
+            CancelReason::UserRequested,
+        )
+        .for_turn(turn_id.clone());
+        assert_eq!(
+            serde_json::to_value(&notification).unwrap(),
+            json!({
+                "sessionId": "sess_1",
+                "reason": "user_requested",
+                "turnId": "turn_1"
+            })
+        );
+
+        let request: PromptRequest = serde_json::from_value(json!({
+            "sessionId": "sess_1",
+            "turnId": "turn_1",
+            "prompt": [{ "type": "text", "text": "Hello" }]
+        }))
+        .unwrap();
+        assert_eq!(request.turn_id, Some(turn_id.clone()));
+        // Updates echoing the prompt belong to its turn.
+        let chunk = request.user_message_chunks().next().unwrap();
+        assert_eq!(chunk.turn_id, Some(turn_id));
+
+        // The turn id is omitted for turns without one.
+        let request: PromptRequest = serde_json::from_value(json!({
+            "sessionId": "sess_1",
+            "prompt": []
+        }))
+        .unwrap();
+        assert_eq!(request.turn_id, None);
+        assert_eq!(
+            serde_json::to_value(&request).unwrap(),
+            json!({ "sessionId": "sess_1", "prompt": [] })
+        );
+    }
+
+    #[cfg(feature = "unstable")]
+    #[test]
+    fn test_cancel_tool_call_serialization() {
+        let request = CancelToolCallRequest {
+            session_id: SessionId("sess_1".into()),
+            tool_call_id: ToolCallId("call_1".into()),
+            meta: None,
+        };
+
+        assert_eq!(
+            serde_json::to_value(&request).unwrap(),
+            json!({
+                "sessionId": "sess_1",
+                "toolCallId": "call_1"
+            })
+        );
+    }
+
+    #[cfg(feature = "unstable")]
+    #[test]
+    fn test_terminal_output_update_serialization() {
+        let notification = TerminalOutputUpdateNotification {
+            session_id: SessionId("sess_1".into()),
+            terminal_id: TerminalId("term_xyz789".into()),
+            output: "Compiling agent-client-protocol\n".to_string(),
+            meta: None,
+        };
+
+        assert_eq!(
+            serde_json::to_value(&notification).unwrap(),
+            json!({
+                "sessionId": "sess_1",
+                "terminalId": "term_xyz789",
+                "output": "Compiling agent-client-protocol\n"
+            })
+        );
+    }
+
+    #[cfg(feature = "unstable")]
+    #[test]
+    fn test_list_sessions_serialization() {
+        let response = ListSessionsResponse {
+            sessions: vec![SessionId("sess_1".into()), SessionId("sess_2".into())],
+            meta: None,
+        };
+
+        assert_eq!(
+            serde_json::to_value(&response).unwrap(),
+            json!({
+                "sessions": ["sess_1", "sess_2"]
+            })
+        );
+        assert_eq!(
+            serde_json::to_value(ListSessionsRequest::default()).unwrap(),
+            json!({})
+        );
+    }
+
+    #[cfg(feature = "unstable")]
+    #[test]
+    fn test_session_flags_serialization() {
+        let response = ListSessionFlagsResponse {
+            flags: vec![
+                SessionFlag {
+                    name: "yolo".into(),
+                    description: Some("Skip permission prompts".into()),
+                    enabled: false,
+                    meta: None,
+                },
+                SessionFlag {
+                    name: "corgi".into(),
+                    description: None,
+                    enabled: true,
+                    meta: None,
+                },
+            ],
+            meta: None,
+        };
+        assert_eq!(
+            serde_json::to_value(&response).unwrap(),
+            json!({
+                "flags": [
+                    {
+                        "name": "yolo",
+                        "description": "Skip permission prompts",
+                        "enabled": false
+                    },
+                    { "name": "corgi", "enabled": true }
+                ]
+            })
+        );
+
+        let request = SetSessionFlagRequest {
+            session_id: SessionId("sess_1".into()),
+            name: "yolo".into(),
+            enabled: true,
+            meta: None,
+        };
+        let json = json!({
+            "sessionId": "sess_1",
+            "name": "yolo",
+            "enabled": true
+        });
+        assert_eq!(serde_json::to_value(&request).unwrap(), json);
+        let decoded: SetSessionFlagRequest = serde_json::from_value(json).unwrap();
+        assert_eq!(decoded.name, "yolo");
+        assert!(decoded.enabled);
+
+        let capabilities: AgentCapabilities =
+            serde_json::from_value(json!({ "sessionFlags": true })).unwrap();
+        assert!(capabilities.session_flags);
+    }
+
+    #[test]
+    fn test_warning_update_serialization() {
+        let notification = SessionNotification {
+            session_id: SessionId("sess_1".into()),
+            update: SessionUpdate::warning("Falling back to a smaller model"),
+            turn_id: None,
+            meta: None,
+        };
+
+        let value = serde_json::to_value(&notification).unwrap();
+        assert_eq!(
+            value,
+            json!({
+                "sessionId": "sess_1",
+                "update": {
+                    "sessionUpdate": "warning",
+                    "message": "Falling back to a smaller model"
+                }
+            })
+        );
+        assert!(matches!(
+            serde_json::from_value::<SessionNotification>(value).unwrap().update,
+            SessionUpdate::Warning { message } if message == "Falling back to a smaller model"
+        ));
+    }
+
+    #[test]
+    fn test_turn_status_update_serialization() {
+        assert_eq!(
+            serde_json::to_value(SessionUpdate::turn_status(3)).unwrap(),
+            json!({
+                "sessionUpdate": "turn_status",
+                "toolCallsCompleted": 3
+            })
+        );
+    }
+
+    #[test]
+    fn test_usage_update_serialization() {
+        let value = serde_json::to_value(SessionUpdate::usage(TokenUsage::new(1200, 300))).unwrap();
+        assert_eq!(
+            value,
+            json!({
+                "sessionUpdate": "usage_update",
+                "inputTokens": 1200,
+                "outputTokens": 300,
+                "totalTokens": 1500
+            })
+        );
+        assert!(matches!(
+            serde_json::from_value::<SessionUpdate>(value).unwrap(),
+            SessionUpdate::UsageUpdate(usage) if usage == TokenUsage::new(1200, 300)
+        ));
+    }
+
+    #[test]
+    fn test_prompt_response_usage_serialization() {
+        let response = PromptResponse {
+            stop_reason: StopReason::EndTurn,
+            usage: Some(TokenUsage {
+                input_tokens: 1200,
+                output_tokens: 300,
+                total_tokens: 1700,
+            }),
+            meta: None,
+        };
+        let value = serde_json::to_value(&response).unwrap();
+        assert_eq!(
+            value,
+            json!({
+                "stopReason": "end_turn",
+                "usage": {
+                    "inputTokens": 1200,
+                    "outputTokens": 300,
+                    "totalTokens": 1700
+                }
+            })
+        );
+        assert_eq!(
+            serde_json::from_value::<PromptResponse>(value)
+                .unwrap()
+                .usage,
+            response.usage
+        );
+
+        // Usage is optional.
+        let response: PromptResponse =
+            serde_json::from_value(json!({ "stopReason": "end_turn" })).unwrap();
+        assert_eq!(response.usage, None);
+    }
+
+    #[test]
+    fn test_new_session_instructions_serialization() {
+        let request = NewSessionRequest {
+            cwd: "/home/user/project".into(),
+            mcp_servers: vec![],
+            instructions: vec!["Answer in British English.".into()],
+            meta: None,
+        };
+        let value = serde_json::to_value(&request).unwrap();
+        assert_eq!(
+            value,
+            json!({
+                "cwd": "/home/user/project",
+                "mcpServers": [],
+                "instructions": [
+                    { "type": "text", "text": "Answer in British English." }
+                ]
+            })
+        );
+        assert_eq!(
+            serde_json::from_value::<NewSessionRequest>(value)
+                .unwrap()
+                .instructions,
+            request.instructions
+        );
+
+        // Instructions are optional.
+        let request: NewSessionRequest = serde_json::from_value(json!({
+            "cwd": "/home/user/project",
+            "mcpServers": []
+        }))
+        .unwrap();
+        assert!(request.instructions.is_empty());
+    }
+
+    #[test]
+    fn test_capability_builders() {
+        assert_eq!(
+            serde_json::to_value(
+                ClientCapabilities::baseline()
+                    .with_read_text_file(true)
+                    .with_write_text_file(true)
+                    .with_terminal(true)
+            )
+            .unwrap(),
+            serde_json::to_value(ClientCapabilities {
+                fs: crate::FileSystemCapability {
+                    read_text_file: true,
+                    write_text_file: true,
+                    append_text_file: false,
+                    meta: None,
+                },
+                terminal: true,
+                ..Default::default()
+            })
+            .unwrap()
+        );
+
+        let capabilities = AgentCapabilities::baseline()
+            .with_load_session(true)
+            .with_concurrent_turns(true)
+            .with_image_prompts(true)
+            .with_mcp_http(true);
+        assert!(capabilities.load_session);
+        assert!(capabilities.concurrent_turns);
+        assert!(capabilities.prompt_capabilities.image);
+        assert!(!capabilities.prompt_capabilities.audio);
+        assert!(capabilities.mcp_capabilities.http);
+        assert!(!capabilities.mcp_capabilities.sse);
+    }
+
+    #[test]
+    fn test_permission_response_helpers() {
+        assert_eq!(
+            serde_json::to_value(crate::RequestPermissionResponse::selected(
+                crate::PermissionOptionId("allow-once".into())
+            ))
+            .unwrap(),
+            json!({
+                "outcome": {
+                    "outcome": "selected",
+                    "optionId": "allow-once"
+                }
+            })
+        );
+        assert_eq!(
+            serde_json::to_value(crate::RequestPermissionResponse::cancelled()).unwrap(),
+            json!({
+                "outcome": {
+                    "outcome": "cancelled"
+                }
+            })
+        );
+    }
+
+    #[test]
+    fn test_implementation_info_serialization() {
+        let request = InitializeRequest {
+            protocol_version: crate::V1,
+            client_capabilities: ClientCapabilities::default(),
+            client_info: Some(Implementation::new("zed", "0.207.0")),
+            meta: None,
+        };
+
+        assert_eq!(
+            serde_json::to_value(&request).unwrap()["clientInfo"],
+            json!({
+                "name": "zed",
+                "version": "0.207.0"
+            })
+        );
+    }
+
+    #[test]
+    fn test_implementation_info_absent() {
+        let request: InitializeRequest =
+            serde_json::from_value(json!({ "protocolVersion": 1 })).unwrap();
+        assert_eq!(request.client_info, None);
+
+        let response: InitializeResponse =
+            serde_json::from_value(json!({ "protocolVersion": 1 })).unwrap();
+        assert_eq!(response.agent_info, None);
+        assert!(
+            serde_json::to_value(&response)
+                .unwrap()
+                .get("agentInfo")
+                .is_none()
+        );
+    }
+
+    #[test]
+    fn test_mcp_server_constructors() {
+        let stdio = McpServer::stdio(
+            "filesystem",
+            "/usr/bin/mcp-fs",
+            ["--root", "/project"],
+            vec![EnvVariable::new("LOG_LEVEL", "debug")],
+        );
+        assert_eq!(
+            serde_json::to_value(&stdio).unwrap(),
+            json!({
+                "name": "filesystem",
+                "command": "/usr/bin/mcp-fs",
+                "args": ["--root", "/project"],
+                "env": [{ "name": "LOG_LEVEL", "value": "debug" }]
+            })
+        );
+
+        let http = McpServer::http(
+            "github",
+            "https://api.example.com/mcp",
+            vec![HttpHeader::new("Authorization", "Bearer token123")],
+        );
+        assert_eq!(
+            serde_json::to_value(&http).unwrap(),
+            json!({
+                "type": "http",
+                "name": "github",
+                "url": "https://api.example.com/mcp",
+                "headers": [{ "name": "Authorization", "value": "Bearer token123" }]
+            })
+        );
+
+        for server in [stdio, http] {
+            let json = serde_json::to_value(&server).unwrap();
+            let decoded: McpServer = serde_json::from_value(json.clone()).unwrap();
+            assert_eq!(serde_json::to_value(&decoded).unwrap(), json);
+        }
+    }
+
+    fn stdio_server(command: &str, env: Vec<EnvVariable>) -> McpServer {
+        McpServer::Stdio {
+            name: "filesystem".to_string(),
+            command: PathBuf::from(command),
+            args: vec![],
+            env,
+        }
+    }
+
+    #[test]
+    fn test_env_variables_from_map() {
+        let env = EnvVariable::from_map(std::collections::BTreeMap::from([
+            ("LOG_LEVEL", "debug"),
+            ("API_URL", "https://example.com"),
+        ]));
+        assert_eq!(
+            serde_json::to_value(&env).unwrap(),
+            json!([
+                { "name": "API_URL", "value": "https://example.com" },
+                { "name": "LOG_LEVEL", "value": "debug" }
+            ])
+        );
+    }
+
+    #[test]
+    fn test_env_variables_from_os() {
+        let env = EnvVariable::from_os(["PATH", "ACP_TEST_UNSET_VARIABLE"]);
+        assert_eq!(env.len(), 1);
+        assert_eq!(env[0].name, "PATH");
+        assert_eq!(env[0].value, std::env::var("PATH").unwrap());
+    }
+
+    #[test]
+    fn test_mcp_server_validate() {
+        let valid = stdio_server(
+            "/usr/bin/mcp-fs",
+            vec![EnvVariable::new("A", "1"), EnvVariable::new("B", "2")],
+        );
+        assert!(valid.validate().is_ok());
+
+        let invalid = [
+            stdio_server("", vec![]),
+            stdio_server("/usr/bin/mcp-fs", vec![EnvVariable::new("", "1")]),
+            stdio_server(
+                "/usr/bin/mcp-fs",
+                vec![EnvVariable::new("A", "1"), EnvVariable::new("A", "2")],
+            ),
+            McpServer::Http {
+                name: "remote".to_string(),
+                url: String::new(),
+                headers: vec![],
+            },
+        ];
+        for server in invalid {
+            let error = server.validate().unwrap_err();
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code, "{server:?}");
+        }
+
+        let error = stdio_server(
+            "/usr/bin/mcp-fs",
+            vec![EnvVariable::new("A", "1"), EnvVariable::new("A", "2")],
+        )
+        .validate()
+        .unwrap_err();
+        assert_eq!(
+            error.validation_errors(),
+            Some(vec![ValidationErrorData::new(
+                "env[1].name",
+                "invalid MCP server \"filesystem\": duplicate environment variable A"
+            )])
+        );
+
+        let servers = [
+            valid,
+            stdio_server("", vec![]),
+            McpServer::http("remote", "https://example.com/mcp", vec![]),
+        ];
+        let fields = McpServer::validate_all(&servers)
+            .unwrap_err()
+            .validation_errors()
+            .unwrap()
+            .into_iter()
+            .map(|error| error.field)
+            .collect::<Vec<_>>();
+        assert_eq!(fields, ["mcpServers[1].command"]);
+        assert!(McpServer::validate_all(&servers[2..]).is_ok());
+    }
+
+    #[test]
+    fn test_mcp_server_resolve_command() {
+        let present = std::env::current_exe().unwrap();
+        assert_eq!(
+            stdio_server(present.to_str().unwrap(), vec![])
+                .resolve_command()
+                .unwrap(),
+            present
+        );
+        #[cfg(unix)]
+        assert!(
+            stdio_server("sh", vec![])
+                .resolve_command()
+                .unwrap()
+                .is_absolute()
+        );
+
+        let error = stdio_server("/nonexistent/mcp-fs", vec![])
+            .resolve_command()
+            .unwrap_err();
+        assert_eq!(
+            error.validation_errors(),
+            Some(vec![ValidationErrorData::new(
+                "command",
+                "invalid MCP server \"filesystem\": /nonexistent/mcp-fs is not an executable file"
+            )])
+        );
+        let error = stdio_server("acp-missing-mcp-server", vec![])
+            .resolve_command()
+            .unwrap_err();
+        assert_eq!(
+            error.validation_errors(),
+            Some(vec![ValidationErrorData::new(
+                "command",
+                "invalid MCP server \"filesystem\": acp-missing-mcp-server was not found in PATH"
+            )])
+        );
+        assert!(
+            McpServer::http("remote", "https://example.com/mcp", vec![])
+                .resolve_command()
+                .is_err()
+        );
+    }
 }
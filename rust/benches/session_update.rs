@@ -0,0 +1,216 @@
+//! Measures the time and allocations of the hottest paths through a
+//! connection, over in-memory pipes so that no actual I/O is involved.
+//!
+//! Run with `cargo bench --bench session_update`. Each benchmark prints the
+//! average time and number of heap allocations per iteration, counted across
+//! both ends of the connection. To compare a change, run it before and after.
+
+use std::{
+    alloc::{GlobalAlloc, Layout, System},
+    cell::RefCell,
+    hint::black_box,
+    sync::atomic::{AtomicUsize, Ordering},
+    time::Instant,
+};
+
+use agent_client_protocol::{
+    Agent, AgentSideConnection, AuthenticateRequest, AuthenticateResponse, CancelNotification,
+    Client, ClientSideConnection, ContentBlock, Error, InitializeRequest, InitializeResponse,
+    NewSessionRequest, NewSessionResponse, PromptRequest, PromptResponse, RequestPermissionOutcome,
+    RequestPermissionRequest, RequestPermissionResponse, SessionId, SessionNotification,
+    SessionUpdate, StopReason,
+};
+use futures::{StreamExt as _, channel::mpsc};
+
+/// Counts every allocation, so that the benchmarks can report them.
+struct CountingAllocator;
+
+static ALLOCATIONS: AtomicUsize = AtomicUsize::new(0);
+
+unsafe impl GlobalAlloc for CountingAllocator {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        unsafe { System.alloc(layout) }
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        unsafe { System.dealloc(ptr, layout) }
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        unsafe { System.realloc(ptr, layout, new_size) }
+    }
+}
+
+#[global_allocator]
+static GLOBAL: CountingAllocator = CountingAllocator;
+
+const WARMUP_ITERATIONS: u32 = 1_000;
+const ITERATIONS: u32 = 20_000;
+
+/// A client that reports every session update it receives.
+struct BenchClient {
+    updates_tx: mpsc::UnboundedSender<()>,
+}
+
+#[async_trait::async_trait(?Send)]
+impl Client for BenchClient {
+    async fn request_permission(
+        &self,
+        _args: RequestPermissionRequest,
+    ) -> Result<RequestPermissionResponse, Error> {
+        Ok(RequestPermissionResponse {
+            outcome: RequestPermissionOutcome::Cancelled,
+            meta: None,
+        })
+    }
+
+    async fn session_notification(&self, args: SessionNotification) -> Result<(), Error> {
+        black_box(args);
+        self.updates_tx.unbounded_send(()).ok();
+        Ok(())
+    }
+}
+
+/// An agent that ends every turn right away.
+struct BenchAgent;
+
+#[async_trait::async_trait(?Send)]
+impl Agent for BenchAgent {
+    async fn initialize(&self, _args: InitializeRequest) -> Result<InitializeResponse, Error> {
+        Err(Error::method_not_found())
+    }
+
+    async fn authenticate(
+        &self,
+        _args: AuthenticateRequest,
+    ) -> Result<AuthenticateResponse, Error> {
+        Err(Error::method_not_found())
+    }
+
+    async fn new_session(&self, _args: NewSessionRequest) -> Result<NewSessionResponse, Error> {
+        Err(Error::method_not_found())
+    }
+
+    async fn prompt(&self, args: PromptRequest) -> Result<PromptResponse, Error> {
+        black_box(args);
+        Ok(PromptResponse {
+            stop_reason: StopReason::EndTurn,
+            usage: None,
+            meta: None,
+        })
+    }
+
+    async fn cancel(&self, _args: CancelNotification) -> Result<(), Error> {
+        Ok(())
+    }
+}
+
+/// Connects a client and an agent over in-memory pipes, returning the
+/// client's connection to the agent, the agent's connection to the client, and
+/// a stream of the session updates the client received.
+fn connect() -> (
+    ClientSideConnection,
+    AgentSideConnection,
+    mpsc::UnboundedReceiver<()>,
+) {
+    let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(64 * 1024);
+    let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(64 * 1024);
+    let (updates_tx, updates_rx) = mpsc::unbounded();
+
+    let (agent_conn, agent_io_task) = ClientSideConnection::new(
+        BenchClient { updates_tx },
+        client_to_agent_tx,
+        agent_to_client_rx,
+        |fut| {
+            tokio::task::spawn_local(fut);
+        },
+    );
+    let (client_conn, client_io_task) =
+        AgentSideConnection::new(BenchAgent, agent_to_client_tx, client_to_agent_rx, |fut| {
+            tokio::task::spawn_local(fut);
+        });
+    tokio::task::spawn_local(agent_io_task);
+    tokio::task::spawn_local(client_io_task);
+
+    (agent_conn, client_conn, updates_rx)
+}
+
+/// Runs `iteration` until enough samples are collected, then prints the
+/// average time and allocations of a single iteration.
+async fn bench<F: Future<Output = ()>>(name: &str, mut iteration: impl FnMut() -> F) {
+    for _ in 0..WARMUP_ITERATIONS {
+        iteration().await;
+    }
+
+    let allocations = ALLOCATIONS.load(Ordering::Relaxed);
+    let start = Instant::now();
+    for _ in 0..ITERATIONS {
+        iteration().await;
+    }
+    let elapsed = start.elapsed();
+    let allocations = ALLOCATIONS.load(Ordering::Relaxed) - allocations;
+
+    println!(
+        "{name:<24} {:>10} ns/iter {:>8.1} allocs/iter",
+        (elapsed / ITERATIONS).as_nanos(),
+        allocations as f64 / f64::from(ITERATIONS),
+    );
+}
+
+/// Streams text chunks from the agent, waiting for the client to receive
+/// each one.
+async fn bench_session_update_text() {
+    let (_agent_conn, client_conn, updates_rx) = connect();
+    let updates_rx = RefCell::new(updates_rx);
+    let session_id = SessionId("sess_bench".into());
+
+    bench("session_update_text", || async {
+        client_conn
+            .session_notification(SessionNotification {
+                session_id: session_id.clone(),
+                update: SessionUpdate::AgentMessageChunk {
+                    content: "The quick brown fox jumps over the lazy dog. ".into(),
+                },
+                turn_id: None,
+                meta: None,
+            })
+            .await
+            .unwrap();
+        updates_rx.borrow_mut().next().await.unwrap();
+    })
+    .await;
+}
+
+/// Sends a prompt to the agent and waits for the turn to end.
+async fn bench_prompt_round_trip() {
+    let (agent_conn, _client_conn, _updates_rx) = connect();
+    let session_id = SessionId("sess_bench".into());
+
+    bench("prompt_round_trip", || async {
+        let response = agent_conn
+            .prompt(PromptRequest {
+                session_id: session_id.clone(),
+                prompt: vec![ContentBlock::from("Summarize the README.")],
+                turn_id: None,
+                meta: None,
+            })
+            .await
+            .unwrap();
+        black_box(response);
+    })
+    .await;
+}
+
+fn main() {
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .unwrap();
+    let local_set = tokio::task::LocalSet::new();
+    local_set.block_on(&runtime, async {
+        bench_session_update_text().await;
+        bench_prompt_round_trip().await;
+    });
+}
@@ -1,6 +1,6 @@
 use agent_client_protocol::{
     AGENT_METHOD_NAMES, AgentNotification, AgentRequest, AgentResponse, CLIENT_METHOD_NAMES,
-    ClientNotification, ClientRequest, ClientResponse, VERSION,
+    ClientNotification, ClientRequest, ClientResponse, MIN_VERSION, VERSION,
 };
 use schemars::{JsonSchema, generate::SchemaSettings};
 use serde_json::Value;
@@ -53,6 +53,7 @@ fn main() {
     // Create a combined metadata object
     let metadata = serde_json::json!({
         "version": VERSION,
+        "minVersion": MIN_VERSION,
         "agentMethods": AGENT_METHOD_NAMES,
         "clientMethods": CLIENT_METHOD_NAMES,
     });
@@ -792,6 +793,13 @@ mod markdown_generator {
                 "session/prompt" => self.agent_methods.get("prompt").unwrap(),
                 "session/cancel" => self.agent_methods.get("cancel").unwrap(),
                 "session/set_model" => self.agent_methods.get("set_session_model").unwrap(),
+                "session/cancel_tool_call" => self.agent_methods.get("cancel_tool_call").unwrap(),
+                "terminal/output_update" => {
+                    self.agent_methods.get("terminal_output_update").unwrap()
+                }
+                "session/list" => self.agent_methods.get("list_sessions").unwrap(),
+                "session/list_flags" => self.agent_methods.get("list_session_flags").unwrap(),
+                "session/set_flag" => self.agent_methods.get("set_session_flag").unwrap(),
                 _ => panic!("Introduced a method? Add it here :)"),
             }
         }
@@ -811,6 +819,9 @@ mod markdown_generator {
                     self.client_methods.get("wait_for_terminal_exit").unwrap()
                 }
                 "terminal/kill" => self.client_methods.get("kill_terminal_command").unwrap(),
+                "resource/read" => self.client_methods.get("read_resource").unwrap(),
+                "client/open" => self.client_methods.get("open").unwrap(),
+                "session/request_input" => self.client_methods.get("request_input").unwrap(),
                 _ => panic!("Introduced a method? Add it here :)"),
             }
         }
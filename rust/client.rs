@@ -12,14 +12,25 @@ use serde::{Deserialize, Serialize};
 use serde_json::value::RawValue;
 
 use crate::ext::ExtRequest;
-use crate::{ContentBlock, Error, ExtNotification, Plan, SessionId, ToolCall, ToolCallUpdate};
-use crate::{ExtResponse, SessionModeId};
+use crate::{
+    ContentBlock, Error, ExtNotification, Plan, PlanEntryId, PlanEntryStatus, PlanEntryUpdate,
+    SessionId, TokenUsage, ToolCall, ToolCallId, ToolCallStatus, ToolCallUpdate,
+    ToolCallUpdateFields,
+};
+use crate::{ExtResponse, SessionModeId, TurnId};
 
 /// Defines the interface that ACP-compliant clients must implement.
 ///
 /// Clients are typically code editors (IDEs, text editors) that provide the interface
 /// between users and AI agents. They manage the environment, handle user interactions,
 /// and control access to resources.
+///
+/// Methods with a default implementation are optional and answer with a
+/// `capability_not_supported` error naming their capability until they are
+/// implemented. Implement the ones that match the [`ClientCapabilities`] you
+/// advertise in `initialize`, e.g. all `terminal/*` methods when setting
+/// `terminal` to `true`, since agents only call them based on those
+/// capabilities.
 #[async_trait::async_trait(?Send)]
 pub trait Client {
     /// Requests permission from the user for a tool call operation.
@@ -60,7 +71,7 @@ pub trait Client {
         &self,
         _args: WriteTextFileRequest,
     ) -> Result<WriteTextFileResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("fs.writeTextFile"))
     }
 
     /// Reads content from a text file in the client's file system.
@@ -73,7 +84,7 @@ pub trait Client {
         &self,
         _args: ReadTextFileRequest,
     ) -> Result<ReadTextFileResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("fs.readTextFile"))
     }
 
     /// Executes a command in a new terminal
@@ -94,7 +105,7 @@ pub trait Client {
         &self,
         _args: CreateTerminalRequest,
     ) -> Result<CreateTerminalResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("terminal"))
     }
 
     /// Gets the terminal output and exit status
@@ -107,7 +118,7 @@ pub trait Client {
         &self,
         _args: TerminalOutputRequest,
     ) -> Result<TerminalOutputResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("terminal"))
     }
 
     /// Releases a terminal
@@ -126,7 +137,7 @@ pub trait Client {
         &self,
         _args: ReleaseTerminalRequest,
     ) -> Result<ReleaseTerminalResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("terminal"))
     }
 
     /// Waits for the terminal command to exit and return its exit status
@@ -136,7 +147,7 @@ pub trait Client {
         &self,
         _args: WaitForTerminalExitRequest,
     ) -> Result<WaitForTerminalExitResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("terminal"))
     }
 
     /// Kills the terminal command without releasing the terminal
@@ -155,7 +166,62 @@ pub trait Client {
         &self,
         _args: KillTerminalCommandRequest,
     ) -> Result<KillTerminalCommandResponse, Error> {
-        Err(Error::method_not_found())
+        Err(Error::capability_not_supported("terminal"))
+    }
+
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Reads the contents of a resource by its URI.
+    ///
+    /// Only available if the Client supports the `readResource` capability.
+    ///
+    /// This allows the Agent to dereference `resource_link` content blocks, including
+    /// resources provided by MCP servers connected to the Client.
+    ///
+    /// Respond with [`Error::resource_not_found`] if the URI can't be resolved.
+    #[cfg(feature = "unstable")]
+    async fn read_resource(
+        &self,
+        _args: ReadResourceRequest,
+    ) -> Result<ReadResourceResponse, Error> {
+        Err(Error::capability_not_supported("readResource"))
+    }
+
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Opens a file or URI in the Client's editor, optionally at a given position.
+    ///
+    /// Only available if the Client supports the `open` capability.
+    ///
+    /// This lets the Agent direct the user's attention to a location it refers to,
+    /// such as the definition it just explained.
+    #[cfg(feature = "unstable")]
+    async fn open(&self, _args: OpenRequest) -> Result<OpenResponse, Error> {
+        Err(Error::capability_not_supported("open"))
+    }
+
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Asks the user a question and returns their free-form answer.
+    ///
+    /// Only available if the Client supports the `requestInput` capability.
+    ///
+    /// Unlike [`Client::request_permission`], the user answers with text rather
+    /// than by picking an option, e.g. to clarify an ambiguous request in the
+    /// middle of a prompt turn. If the turn is cancelled, the Client MUST
+    /// respond with [`RequestInputOutcome::Cancelled`].
+    #[cfg(feature = "unstable")]
+    async fn request_input(
+        &self,
+        _args: RequestInputRequest,
+    ) -> Result<RequestInputResponse, Error> {
+        Err(Error::capability_not_supported("requestInput"))
     }
 
     /// Handles extension method requests from the agent.
@@ -234,6 +300,24 @@ impl<T: Client> Client for Rc<T> {
     ) -> Result<KillTerminalCommandResponse, Error> {
         self.as_ref().kill_terminal_command(args).await
     }
+    #[cfg(feature = "unstable")]
+    async fn read_resource(
+        &self,
+        args: ReadResourceRequest,
+    ) -> Result<ReadResourceResponse, Error> {
+        self.as_ref().read_resource(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn open(&self, args: OpenRequest) -> Result<OpenResponse, Error> {
+        self.as_ref().open(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn request_input(
+        &self,
+        args: RequestInputRequest,
+    ) -> Result<RequestInputResponse, Error> {
+        self.as_ref().request_input(args).await
+    }
     async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
         self.as_ref().ext_method(args).await
     }
@@ -295,6 +379,24 @@ impl<T: Client> Client for Arc<T> {
     ) -> Result<KillTerminalCommandResponse, Error> {
         self.as_ref().kill_terminal_command(args).await
     }
+    #[cfg(feature = "unstable")]
+    async fn read_resource(
+        &self,
+        args: ReadResourceRequest,
+    ) -> Result<ReadResourceResponse, Error> {
+        self.as_ref().read_resource(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn open(&self, args: OpenRequest) -> Result<OpenResponse, Error> {
+        self.as_ref().open(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn request_input(
+        &self,
+        args: RequestInputRequest,
+    ) -> Result<RequestInputResponse, Error> {
+        self.as_ref().request_input(args).await
+    }
     async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
         self.as_ref().ext_method(args).await
     }
@@ -318,11 +420,51 @@ pub struct SessionNotification {
     pub session_id: SessionId,
     /// The actual update content.
     pub update: SessionUpdate,
+    /// The turn this update belongs to, if the turn was started with a
+    /// [`PromptRequest::turn_id`](crate::PromptRequest::turn_id).
+    ///
+    /// Agents running concurrent turns SHOULD set this so that clients can
+    /// tell the turns' output apart.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub turn_id: Option<TurnId>,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+/// The `_meta` key agents store sequence numbers under, see
+/// [`SessionNotification::sequence_number`].
+pub(crate) const SEQUENCE_NUMBER_META_KEY: &str = "seq";
+
+impl SessionNotification {
+    /// Creates an update for the given session that isn't tied to a turn.
+    pub fn new(session_id: SessionId, update: SessionUpdate) -> Self {
+        Self {
+            session_id,
+            update,
+            turn_id: None,
+            meta: None,
+        }
+    }
+
+    /// Marks the update as belonging to the given turn.
+    #[must_use]
+    pub fn with_turn_id(mut self, turn_id: TurnId) -> Self {
+        self.turn_id = Some(turn_id);
+        self
+    }
+
+    /// Returns the number the agent gave this update in `_meta.seq`, if any.
+    ///
+    /// Agents that enable [`AgentSideConnection::set_sequence_numbers`](crate::AgentSideConnection::set_sequence_numbers)
+    /// number the updates of each session 1, 2, 3, and so on, so a client
+    /// can tell that updates were dropped or reordered when a number is
+    /// skipped or goes backwards.
+    pub fn sequence_number(&self) -> Option<u64> {
+        self.meta.as_ref()?.get(SEQUENCE_NUMBER_META_KEY)?.as_u64()
+    }
+}
+
 /// Different types of updates that can be sent during session processing.
 ///
 /// These updates provide real-time feedback about the agent's progress.
@@ -344,6 +486,11 @@ pub enum SessionUpdate {
     /// The agent's execution plan for complex tasks.
     /// See protocol docs: [Agent Plan](https://agentclientprotocol.com/protocol/agent-plan)
     Plan(Plan),
+    /// A change to a single entry of the current plan.
+    ///
+    /// Only sent to clients that advertise the `planEntryUpdates` capability.
+    /// See protocol docs: [Updating Entries](https://agentclientprotocol.com/protocol/agent-plan#updating-entries)
+    PlanEntryUpdate(PlanEntryUpdate),
     /// Available commands are ready or have changed
     #[serde(rename_all = "camelCase")]
     AvailableCommandsUpdate {
@@ -354,6 +501,240 @@ pub enum SessionUpdate {
     /// See protocol docs: [Session Modes](https://agentclientprotocol.com/protocol/session-modes)
     #[serde(rename_all = "camelCase")]
     CurrentModeUpdate { current_mode_id: SessionModeId },
+    /// A non-fatal problem the user should know about, such as the agent
+    /// falling back to a different model.
+    ///
+    /// The turn continues after a warning. Failures that end the turn should
+    /// be reported as an error response to `session/prompt` instead.
+    ///
+    /// Only sent to clients that advertise the `warningUpdates` capability.
+    Warning {
+        /// Human-readable description of the problem.
+        message: String,
+    },
+    /// Progress of the turn as a whole, for showing that a long turn is still
+    /// working.
+    ///
+    /// Unlike tool call updates, this doesn't describe any single operation.
+    /// The turn ends only with the `session/prompt` response. Token counts
+    /// are reported separately with [`SessionUpdate::UsageUpdate`].
+    ///
+    /// Only sent to clients that advertise the `turnStatusUpdates` capability.
+    #[serde(rename_all = "camelCase")]
+    TurnStatus {
+        /// Number of tool calls completed so far in this turn.
+        tool_calls_completed: u32,
+    },
+    /// Tokens used so far in the current turn.
+    ///
+    /// Only sent to clients that advertise the `usageUpdates` capability.
+    /// See protocol docs: [Token Usage](https://agentclientprotocol.com/protocol/prompt-turn#token-usage)
+    UsageUpdate(TokenUsage),
+    /// The agent has sent its last update for the session's current turn.
+    ///
+    /// Typically sent after a cancelled turn, once the agent has stopped all work
+    /// for it, so the Client knows it can safely tear down the turn's UI. Updates
+    /// for the session received after this and before the next `session/prompt` or
+    /// `session/load` are a protocol violation.
+    ///
+    /// Only sent by agents that advertise the `drainUpdates` capability, which
+    /// must send it before responding to `session/prompt`.
+    Drained,
+}
+
+impl SessionUpdate {
+    /// Creates a [`SessionUpdate::PlanEntryUpdate`] that changes the status of
+    /// a single plan entry.
+    pub fn plan_entry_status(entry_id: impl Into<Arc<str>>, status: PlanEntryStatus) -> Self {
+        Self::PlanEntryUpdate(PlanEntryUpdate {
+            entry_id: PlanEntryId(entry_id.into()),
+            status,
+            meta: None,
+        })
+    }
+
+    /// Creates one [`SessionUpdate::AgentMessageChunk`] per block, to send an
+    /// agent message made of several content blocks.
+    ///
+    /// Each chunk carries a single block, so a message like text followed by a
+    /// resource link is sent as consecutive chunks in order. Pass the result to
+    /// [`crate::AgentSideConnection::session_update_batch`] to send them.
+    pub fn agent_message_chunks(blocks: impl IntoIterator<Item = ContentBlock>) -> Vec<Self> {
+        blocks
+            .into_iter()
+            .map(|content| Self::AgentMessageChunk { content })
+            .collect()
+    }
+
+    /// Creates a [`SessionUpdate::ToolCallUpdate`] that only changes the
+    /// status of a tool call.
+    pub fn tool_call_status(tool_call_id: impl Into<Arc<str>>, status: ToolCallStatus) -> Self {
+        Self::ToolCallUpdate(ToolCallUpdate {
+            id: ToolCallId(tool_call_id.into()),
+            fields: ToolCallUpdateFields {
+                status: Some(status),
+                ..Default::default()
+            },
+            meta: None,
+        })
+    }
+
+    /// Creates a [`SessionUpdate::AvailableCommandsUpdate`] with the commands
+    /// that are currently available.
+    ///
+    /// Agents can send this whenever the commands change, e.g. after switching
+    /// modes. The list replaces the one the client had before.
+    ///
+    /// See protocol docs: [Slash Commands](https://agentclientprotocol.com/protocol/slash-commands)
+    pub fn available_commands(commands: impl IntoIterator<Item = AvailableCommand>) -> Self {
+        Self::AvailableCommandsUpdate {
+            available_commands: commands.into_iter().collect(),
+        }
+    }
+
+    /// Creates a [`SessionUpdate::Warning`] with the given message.
+    ///
+    /// Only send it to clients that advertise
+    /// [`ClientCapabilities::warning_updates`].
+    pub fn warning(message: impl Into<String>) -> Self {
+        Self::Warning {
+            message: message.into(),
+        }
+    }
+
+    /// Creates a [`SessionUpdate::TurnStatus`] reporting the progress of the
+    /// current turn.
+    ///
+    /// Only send it to clients that advertise
+    /// [`ClientCapabilities::turn_status_updates`].
+    pub fn turn_status(tool_calls_completed: u32) -> Self {
+        Self::TurnStatus {
+            tool_calls_completed,
+        }
+    }
+
+    /// Creates a [`SessionUpdate::UsageUpdate`] reporting the tokens used so
+    /// far in the current turn.
+    pub fn usage(usage: TokenUsage) -> Self {
+        Self::UsageUpdate(usage)
+    }
+
+    /// Returns the id and final status of the tool call this update ends, if
+    /// any.
+    ///
+    /// This is the case for tool calls reported or updated with a
+    /// [`ToolCallStatus::Completed`] or [`ToolCallStatus::Failed`] status, after
+    /// which clients can stop tracking the tool call.
+    pub fn tool_call_finished(&self) -> Option<(&ToolCallId, ToolCallStatus)> {
+        let (id, status) = match self {
+            Self::ToolCall(tool_call) => (&tool_call.id, tool_call.status),
+            Self::ToolCallUpdate(update) => (&update.id, update.fields.status?),
+            _ => return None,
+        };
+        status.is_finished().then_some((id, status))
+    }
+}
+
+/// Collects the text an agent streams during a turn, keeping its response
+/// apart from its thoughts.
+///
+/// Message and thought chunks arrive interleaved. Clients that show the
+/// agent's reasoning separately, e.g. in a collapsible pane, can pass every
+/// update to [`MessageAccumulator::push`] and read each part on its own.
+#[derive(Debug, Default, Clone)]
+pub struct MessageAccumulator {
+    text: String,
+    thoughts: String,
+}
+
+impl MessageAccumulator {
+    /// Creates an empty accumulator.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Appends the text of an [`SessionUpdate::AgentMessageChunk`] or
+    /// [`SessionUpdate::AgentThoughtChunk`]. Other updates and chunks that
+    /// aren't text are ignored.
+    pub fn push(&mut self, update: &SessionUpdate) {
+        match update {
+            SessionUpdate::AgentMessageChunk {
+                content: ContentBlock::Text(text),
+            } => self.text.push_str(&text.text),
+            SessionUpdate::AgentThoughtChunk {
+                content: ContentBlock::Text(text),
+            } => self.thoughts.push_str(&text.text),
+            _ => {}
+        }
+    }
+
+    /// The agent's response so far.
+    pub fn text(&self) -> &str {
+        &self.text
+    }
+
+    /// The agent's thoughts so far.
+    pub fn thoughts(&self) -> &str {
+        &self.thoughts
+    }
+
+    /// Empties the accumulator, e.g. before the next turn.
+    pub fn clear(&mut self) {
+        self.text.clear();
+        self.thoughts.clear();
+    }
+}
+
+/// Folds the updates an agent streams for a tool call into a snapshot of the
+/// tool call.
+///
+/// Updates are merged like [`ToolCall::update`] does: fields that are set in
+/// an update replace the current ones, including the `content` and
+/// `locations` collections, and fields that aren't set are kept. A later
+/// [`SessionUpdate::ToolCall`] for the same tool call replaces it entirely.
+#[derive(Debug, Clone)]
+pub struct ToolCallState {
+    tool_call: ToolCall,
+}
+
+impl ToolCallState {
+    /// Starts from the tool call as the agent reported it.
+    pub fn new(tool_call: ToolCall) -> Self {
+        Self { tool_call }
+    }
+
+    /// Starts from a tool call that is only known through its updates, see
+    /// [`ToolCallUpdate::into_tool_call`].
+    pub fn from_update(update: ToolCallUpdate) -> Self {
+        Self::new(update.into_tool_call())
+    }
+
+    /// Merges `update` into the snapshot if it is a [`SessionUpdate::ToolCall`]
+    /// or [`SessionUpdate::ToolCallUpdate`] for this tool call, returning
+    /// whether it was. Other updates are ignored, so every update of a session
+    /// can be passed here.
+    pub fn apply(&mut self, update: &SessionUpdate) -> bool {
+        match update {
+            SessionUpdate::ToolCall(tool_call) if tool_call.id == self.tool_call.id => {
+                self.tool_call = tool_call.clone();
+            }
+            SessionUpdate::ToolCallUpdate(update) if update.id == self.tool_call.id => {
+                self.tool_call.update(update.fields.clone());
+            }
+            _ => return false,
+        }
+        true
+    }
+
+    /// The tool call with all updates so far applied.
+    pub fn snapshot(&self) -> &ToolCall {
+        &self.tool_call
+    }
+
+    /// Returns the final tool call, e.g. once it has finished.
+    pub fn into_tool_call(self) -> ToolCall {
+        self.tool_call
+    }
 }
 
 /// Information about a command.
@@ -371,6 +752,26 @@ pub struct AvailableCommand {
     pub meta: Option<serde_json::Value>,
 }
 
+impl AvailableCommand {
+    /// Creates a command that takes no input.
+    pub fn new(name: impl Into<String>, description: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            description: description.into(),
+            input: None,
+            meta: None,
+        }
+    }
+
+    /// Lets the command take free-form input, showing `hint` until the user
+    /// has typed some.
+    #[must_use]
+    pub fn with_input_hint(mut self, hint: impl Into<String>) -> Self {
+        self.input = Some(AvailableCommandInput::Unstructured { hint: hint.into() });
+        self
+    }
+}
+
 /// The input specification for a command.
 #[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(untagged, rename_all = "camelCase")]
@@ -398,13 +799,108 @@ pub struct RequestPermissionRequest {
     pub session_id: SessionId,
     /// Details about the tool call requiring permission.
     pub tool_call: ToolCallUpdate,
+    /// Further tool calls covered by the same request, e.g. when the agent
+    /// plans several file edits at once.
+    ///
+    /// The Client SHOULD present them together with `tool_call` as a
+    /// single prompt, and the selected option applies to all of them. Only
+    /// sent to clients that advertise the `permissionBatches` capability,
+    /// since other clients would only show the first tool call.
+    ///
+    /// See protocol docs: [Requesting Permission](https://agentclientprotocol.com/protocol/tool-calls#requesting-permission)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tool_calls: Vec<ToolCallUpdate>,
     /// Available permission options for the user to choose from.
     pub options: Vec<PermissionOption>,
+    /// The turn this request belongs to, if the turn was started with a
+    /// [`PromptRequest::turn_id`](crate::PromptRequest::turn_id).
+    ///
+    /// Agents running concurrent turns SHOULD set this so that clients can
+    /// tell which turn is asking.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub turn_id: Option<TurnId>,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+impl RequestPermissionRequest {
+    /// Builds a single permission request covering several tool calls.
+    ///
+    /// The first tool call becomes [`Self::tool_call`] and the rest
+    /// [`Self::tool_calls`]. A client that doesn't know about batches would
+    /// only show the first tool call, while its decision applies to all of
+    /// them, so several tool calls are refused with a `capability_not_supported`
+    /// error unless the client advertises
+    /// [`ClientCapabilities::permission_batches`]. Agents then ask for each
+    /// tool call separately. Fails with `invalid_params` if there are no tool
+    /// calls.
+    pub fn for_tool_calls(
+        session_id: SessionId,
+        tool_calls: impl IntoIterator<Item = ToolCallUpdate>,
+        options: Vec<PermissionOption>,
+        capabilities: &ClientCapabilities,
+    ) -> Result<Self, Error> {
+        let mut tool_calls = tool_calls.into_iter();
+        let tool_call = tool_calls
+            .next()
+            .ok_or_else(|| Error::invalid_params().with_data("no tool calls to ask about"))?;
+        let tool_calls: Vec<_> = tool_calls.collect();
+        if !tool_calls.is_empty() && !capabilities.permission_batches {
+            return Err(Error::capability_not_supported("permissionBatches"));
+        }
+        Ok(Self {
+            session_id,
+            tool_call,
+            tool_calls,
+            options,
+            turn_id: None,
+            meta: None,
+        })
+    }
+
+    /// Marks the request as coming from the given turn.
+    #[must_use]
+    pub fn for_turn(mut self, turn_id: TurnId) -> Self {
+        self.turn_id = Some(turn_id);
+        self
+    }
+
+    /// Returns every tool call the request covers, starting with
+    /// [`Self::tool_call`].
+    pub fn all_tool_calls(&self) -> impl Iterator<Item = &ToolCallUpdate> {
+        std::iter::once(&self.tool_call).chain(&self.tool_calls)
+    }
+}
+
+/// Decides permission requests without asking the user.
+///
+/// Install a policy with [`crate::ClientSideConnection::set_permission_policy`]
+/// to answer requests declaratively, e.g. to approve all reads or only tools on
+/// an allowlist, or limit it to a single prompt turn with
+/// [`crate::ClientSideConnection::prompt_with_policy`]. Requests the policy doesn't decide are passed on to
+/// [`Client::request_permission`], so interactive prompts remain the fallback.
+///
+/// Closures taking a `&RequestPermissionRequest` and returning an
+/// `Option<PermissionOptionId>` implement this trait.
+pub trait PermissionPolicy {
+    /// Returns the option to select, or `None` to ask the user.
+    ///
+    /// The returned id must be one of the request's options, otherwise the
+    /// request is passed on to the user. The decision applies to every tool
+    /// call in [`RequestPermissionRequest::all_tool_calls`].
+    fn decide(&self, request: &RequestPermissionRequest) -> Option<PermissionOptionId>;
+}
+
+impl<F> PermissionPolicy for F
+where
+    F: Fn(&RequestPermissionRequest) -> Option<PermissionOptionId>,
+{
+    fn decide(&self, request: &RequestPermissionRequest) -> Option<PermissionOptionId> {
+        self(request)
+    }
+}
+
 /// An option presented to the user when requesting permission.
 #[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 pub struct PermissionOption {
@@ -460,6 +956,28 @@ pub struct RequestPermissionResponse {
     pub meta: Option<serde_json::Value>,
 }
 
+impl RequestPermissionResponse {
+    /// A response selecting the option with the given ID.
+    #[must_use]
+    pub fn selected(option_id: PermissionOptionId) -> Self {
+        Self {
+            outcome: RequestPermissionOutcome::Selected { option_id },
+            meta: None,
+        }
+    }
+
+    /// A response for a permission request whose prompt turn was cancelled.
+    ///
+    /// See protocol docs: [Cancellation](https://agentclientprotocol.com/protocol/prompt-turn#cancellation)
+    #[must_use]
+    pub fn cancelled() -> Self {
+        Self {
+            outcome: RequestPermissionOutcome::Cancelled,
+            meta: None,
+        }
+    }
+}
+
 /// The outcome of a permission request.
 #[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(tag = "outcome", rename_all = "snake_case")]
@@ -495,11 +1013,58 @@ pub struct WriteTextFileRequest {
     pub path: PathBuf,
     /// The text content to write to the file.
     pub content: String,
+    /// Whether to append the content to the file instead of replacing it.
+    ///
+    /// Only allowed if the client supports the `fs.appendTextFile` capability.
+    #[serde(default)]
+    pub append: bool,
+    /// Whether this is the last chunk of a file written in several requests.
+    ///
+    /// Clients MAY wait for it before e.g. formatting or saving the file.
+    /// Only allowed if the client supports the `fs.appendTextFile` capability.
+    #[serde(default)]
+    pub eof: bool,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+impl WriteTextFileRequest {
+    /// Creates a request replacing the contents of the file at `path`.
+    pub fn new(
+        session_id: SessionId,
+        path: impl Into<PathBuf>,
+        content: impl Into<String>,
+    ) -> Self {
+        Self {
+            session_id,
+            path: path.into(),
+            content: content.into(),
+            append: false,
+            eof: false,
+            meta: None,
+        }
+    }
+
+    /// Appends the content to the file instead of replacing it.
+    ///
+    /// Only allowed if the client supports the `fs.appendTextFile` capability.
+    #[must_use]
+    pub fn with_append(mut self, append: bool) -> Self {
+        self.append = append;
+        self
+    }
+
+    /// Marks this as the last chunk of a file written in several requests.
+    ///
+    /// Only allowed if the client supports the `fs.appendTextFile` capability.
+    #[must_use]
+    pub fn with_eof(mut self, eof: bool) -> Self {
+        self.eof = eof;
+        self
+    }
+}
+
 /// Response to `fs/write_text_file`
 #[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
@@ -612,6 +1177,13 @@ pub struct TerminalOutputRequest {
     pub session_id: SessionId,
     /// The ID of the terminal to get output from.
     pub terminal_id: TerminalId,
+    /// Maximum number of output bytes to return.
+    ///
+    /// If the output is longer, the Client returns only its last bytes, truncated at a
+    /// character boundary, and sets `truncated`. This doesn't affect the output the
+    /// Client retains for later requests.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub output_byte_limit: Option<u64>,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
@@ -633,6 +1205,24 @@ pub struct TerminalOutputResponse {
     pub meta: Option<serde_json::Value>,
 }
 
+/// Truncates terminal output to at most `byte_limit` bytes, keeping its end.
+///
+/// Clients can use this to apply the `outputByteLimit` of `terminal/create`
+/// and `terminal/output`. Output is cut at a character boundary, so the result
+/// may be slightly shorter than the limit. Returns the retained output and
+/// whether anything was cut, to be reported as
+/// [`TerminalOutputResponse::truncated`].
+pub fn truncate_terminal_output(output: &str, byte_limit: usize) -> (&str, bool) {
+    if output.len() <= byte_limit {
+        return (output, false);
+    }
+    let mut start = output.len() - byte_limit;
+    while !output.is_char_boundary(start) {
+        start += 1;
+    }
+    (&output[start..], true)
+}
+
 /// Request to release a terminal and free its resources.
 #[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
@@ -721,6 +1311,171 @@ pub struct TerminalExitStatus {
     pub meta: Option<serde_json::Value>,
 }
 
+// Resources
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Request to read the contents of a resource.
+///
+/// Only available if the Client supports the `readResource` capability.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "client", "x-method" = RESOURCE_READ_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct ReadResourceRequest {
+    /// The session ID for this request.
+    pub session_id: SessionId,
+    /// The URI of the resource to read.
+    pub uri: String,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Response containing the contents of a resource.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "client", "x-method" = RESOURCE_READ_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct ReadResourceResponse {
+    /// The contents of the resource.
+    pub resource: EmbeddedResourceResource,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+// Open
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Request to open a location in the Client's editor.
+///
+/// Only available if the Client supports the `open` capability.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "client", "x-method" = CLIENT_OPEN_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct OpenRequest {
+    /// The session ID for this request.
+    pub session_id: SessionId,
+    /// The URI of the file or resource to open.
+    pub uri: String,
+    /// Line to reveal (1-based).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub line: Option<u32>,
+    /// Column to place the cursor at (1-based). Ignored without a `line`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub column: Option<u32>,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Response to `client/open`.
+#[cfg(feature = "unstable")]
+#[derive(Default, Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "client", "x-method" = CLIENT_OPEN_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct OpenResponse {
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+// Request input
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Request for a free-form answer from the user.
+///
+/// Only available if the Client supports the `requestInput` capability.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "client", "x-method" = SESSION_REQUEST_INPUT_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct RequestInputRequest {
+    /// The session ID for this request.
+    pub session_id: SessionId,
+    /// The question to show the user.
+    pub prompt: String,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// Response to `session/request_input`.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[schemars(extend("x-side" = "client", "x-method" = SESSION_REQUEST_INPUT_METHOD_NAME))]
+#[serde(rename_all = "camelCase")]
+pub struct RequestInputResponse {
+    /// The user's answer.
+    pub outcome: RequestInputOutcome,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
+#[cfg(feature = "unstable")]
+impl RequestInputResponse {
+    /// A response with the text the user entered.
+    #[must_use]
+    pub fn submitted(text: impl Into<String>) -> Self {
+        Self {
+            outcome: RequestInputOutcome::Submitted { text: text.into() },
+            meta: None,
+        }
+    }
+
+    /// A response for a request whose prompt turn was cancelled, or that the
+    /// user dismissed.
+    #[must_use]
+    pub fn cancelled() -> Self {
+        Self {
+            outcome: RequestInputOutcome::Cancelled,
+            meta: None,
+        }
+    }
+}
+
+/// **UNSTABLE**
+///
+/// This capability is not part of the spec yet, and may be removed or changed at any point.
+///
+/// The outcome of a `session/request_input` request.
+#[cfg(feature = "unstable")]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema, PartialEq, Eq)]
+#[serde(tag = "outcome", rename_all = "snake_case")]
+pub enum RequestInputOutcome {
+    /// The prompt turn was cancelled, or the user dismissed the question
+    /// without answering.
+    Cancelled,
+    /// The user answered the question.
+    Submitted {
+        /// The text the user entered.
+        text: String,
+    },
+}
+
 // Capabilities
 
 /// Capabilities supported by the client.
@@ -739,11 +1494,154 @@ pub struct ClientCapabilities {
     /// Whether the Client support all `terminal/*` methods.
     #[serde(default)]
     pub terminal: bool,
+    /// Whether the Client can apply `plan_entry_update` session updates.
+    ///
+    /// Agents must fall back to sending the full plan when this is `false`.
+    #[serde(default)]
+    pub plan_entry_updates: bool,
+    /// Whether the Client can display `usage_update` session updates.
+    ///
+    /// Agents must not send them when this is `false`. Usage reported in the
+    /// `session/prompt` response is optional and may always be sent.
+    #[serde(default)]
+    pub usage_updates: bool,
+    /// Whether the Client shows every tool call of a `session/request_permission`
+    /// request that lists further calls in `toolCalls`.
+    ///
+    /// Agents must ask for permission for each tool call separately when this is
+    /// `false`, since the user would only see the first one.
+    #[serde(default)]
+    pub permission_batches: bool,
+    /// Whether the Client can display `warning` session updates.
+    ///
+    /// Agents must not send them when this is `false`.
+    #[serde(default)]
+    pub warning_updates: bool,
+    /// Whether the Client can display `turn_status` session updates.
+    ///
+    /// Agents must not send them when this is `false`.
+    #[serde(default)]
+    pub turn_status_updates: bool,
+    /// Whether the Client can read compressed messages.
+    ///
+    /// Messages are only compressed once both sides advertise this.
+    ///
+    /// See protocol docs: [Compression](https://agentclientprotocol.com/protocol/initialization#compression)
+    #[serde(default)]
+    pub compression: bool,
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Whether the Client supports `resource/read`.
+    #[cfg(feature = "unstable")]
+    #[serde(default)]
+    pub read_resource: bool,
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Whether the Client supports `client/open`.
+    #[cfg(feature = "unstable")]
+    #[serde(default)]
+    pub open: bool,
+    /// **UNSTABLE**
+    ///
+    /// This capability is not part of the spec yet, and may be removed or changed at any point.
+    ///
+    /// Whether the Client supports `session/request_input`.
+    #[cfg(feature = "unstable")]
+    #[serde(default)]
+    pub request_input: bool,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
 
+impl ClientCapabilities {
+    /// The capabilities every client has: none of the optional `fs/*` and
+    /// `terminal/*` methods or session updates.
+    ///
+    /// This is the same as [`ClientCapabilities::default`], spelled out for
+    /// use with the `with_*` methods.
+    #[must_use]
+    pub fn baseline() -> Self {
+        Self::default()
+    }
+
+    /// Sets whether the Client supports `fs/read_text_file` requests.
+    #[must_use]
+    pub fn with_read_text_file(mut self, supported: bool) -> Self {
+        self.fs.read_text_file = supported;
+        self
+    }
+
+    /// Sets whether the Client supports `fs/write_text_file` requests.
+    #[must_use]
+    pub fn with_write_text_file(mut self, supported: bool) -> Self {
+        self.fs.write_text_file = supported;
+        self
+    }
+
+    /// Sets whether the Client supports appending to files with
+    /// `fs/write_text_file`.
+    #[must_use]
+    pub fn with_append_text_file(mut self, supported: bool) -> Self {
+        self.fs.append_text_file = supported;
+        self
+    }
+
+    /// Sets whether the Client supports all `terminal/*` methods.
+    #[must_use]
+    pub fn with_terminal(mut self, supported: bool) -> Self {
+        self.terminal = supported;
+        self
+    }
+
+    /// Sets whether the Client can apply `plan_entry_update` session updates.
+    #[must_use]
+    pub fn with_plan_entry_updates(mut self, supported: bool) -> Self {
+        self.plan_entry_updates = supported;
+        self
+    }
+
+    /// Sets whether the Client can display `usage_update` session updates.
+    #[must_use]
+    pub fn with_usage_updates(mut self, supported: bool) -> Self {
+        self.usage_updates = supported;
+        self
+    }
+
+    /// Sets whether the Client shows every tool call of a batched
+    /// `session/request_permission` request.
+    #[must_use]
+    pub fn with_permission_batches(mut self, supported: bool) -> Self {
+        self.permission_batches = supported;
+        self
+    }
+
+    /// Sets whether the Client can display `warning` session updates.
+    #[must_use]
+    pub fn with_warning_updates(mut self, supported: bool) -> Self {
+        self.warning_updates = supported;
+        self
+    }
+
+    /// Sets whether the Client can display `turn_status` session updates.
+    #[must_use]
+    pub fn with_turn_status_updates(mut self, supported: bool) -> Self {
+        self.turn_status_updates = supported;
+        self
+    }
+
+    /// Sets whether the Client can read compressed messages.
+    #[must_use]
+    pub fn with_compression(mut self, supported: bool) -> Self {
+        self.compression = supported;
+        self
+    }
+}
+
 /// File system capabilities that a client may support.
 ///
 /// See protocol docs: [FileSystem](https://agentclientprotocol.com/protocol/initialization#filesystem)
@@ -756,6 +1654,10 @@ pub struct FileSystemCapability {
     /// Whether the Client supports `fs/write_text_file` requests.
     #[serde(default)]
     pub write_text_file: bool,
+    /// Whether the Client supports the `append` and `eof` fields of
+    /// `fs/write_text_file`, letting agents write large files in chunks.
+    #[serde(default)]
+    pub append_text_file: bool,
     /// Extension point for implementations
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
@@ -786,6 +1688,15 @@ pub struct ClientMethodNames {
     pub terminal_wait_for_exit: &'static str,
     /// Method for killing a terminal.
     pub terminal_kill: &'static str,
+    /// Method for reading a resource.
+    #[cfg(feature = "unstable")]
+    pub resource_read: &'static str,
+    /// Method for opening a location in the editor.
+    #[cfg(feature = "unstable")]
+    pub client_open: &'static str,
+    /// Method for asking the user for free-form input.
+    #[cfg(feature = "unstable")]
+    pub session_request_input: &'static str,
 }
 
 /// Constant containing all client method names.
@@ -799,6 +1710,12 @@ pub const CLIENT_METHOD_NAMES: ClientMethodNames = ClientMethodNames {
     terminal_release: TERMINAL_RELEASE_METHOD_NAME,
     terminal_wait_for_exit: TERMINAL_WAIT_FOR_EXIT_METHOD_NAME,
     terminal_kill: TERMINAL_KILL_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    resource_read: RESOURCE_READ_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    client_open: CLIENT_OPEN_METHOD_NAME,
+    #[cfg(feature = "unstable")]
+    session_request_input: SESSION_REQUEST_INPUT_METHOD_NAME,
 };
 
 /// Notification name for session updates.
@@ -819,6 +1736,15 @@ pub(crate) const TERMINAL_RELEASE_METHOD_NAME: &str = "terminal/release";
 pub(crate) const TERMINAL_WAIT_FOR_EXIT_METHOD_NAME: &str = "terminal/wait_for_exit";
 /// Method for killing a terminal.
 pub(crate) const TERMINAL_KILL_METHOD_NAME: &str = "terminal/kill";
+/// Method name for reading a resource.
+#[cfg(feature = "unstable")]
+pub(crate) const RESOURCE_READ_METHOD_NAME: &str = "resource/read";
+/// Method name for opening a location in the editor.
+#[cfg(feature = "unstable")]
+pub(crate) const CLIENT_OPEN_METHOD_NAME: &str = "client/open";
+/// Method name for asking the user for free-form input.
+#[cfg(feature = "unstable")]
+pub(crate) const SESSION_REQUEST_INPUT_METHOD_NAME: &str = "session/request_input";
 
 /// All possible requests that an agent can send to a client.
 ///
@@ -838,7 +1764,17 @@ pub enum AgentRequest {
     ReleaseTerminalRequest(ReleaseTerminalRequest),
     WaitForTerminalExitRequest(WaitForTerminalExitRequest),
     KillTerminalCommandRequest(KillTerminalCommandRequest),
+    #[cfg(feature = "unstable")]
+    ReadResourceRequest(ReadResourceRequest),
+    #[cfg(feature = "unstable")]
+    OpenRequest(OpenRequest),
+    #[cfg(feature = "unstable")]
+    RequestInputRequest(RequestInputRequest),
     ExtMethodRequest(ExtRequest),
+    /// A method registered with [`crate::ClientSideConnection::register_method`].
+    /// Not part of the protocol, so it is left out of the schema.
+    #[schemars(skip)]
+    CustomMethodRequest(ExtRequest),
 }
 
 /// All possible responses that a client can send to an agent.
@@ -859,6 +1795,12 @@ pub enum ClientResponse {
     ReleaseTerminalResponse(#[serde(default)] ReleaseTerminalResponse),
     WaitForTerminalExitResponse(WaitForTerminalExitResponse),
     KillTerminalResponse(#[serde(default)] KillTerminalCommandResponse),
+    #[cfg(feature = "unstable")]
+    ReadResourceResponse(ReadResourceResponse),
+    #[cfg(feature = "unstable")]
+    OpenResponse(#[serde(default)] OpenResponse),
+    #[cfg(feature = "unstable")]
+    RequestInputResponse(RequestInputResponse),
     ExtMethodResponse(#[schemars(with = "serde_json::Value")] Arc<RawValue>),
 }
 
@@ -876,3 +1818,320 @@ pub enum AgentNotification {
     SessionNotification(SessionNotification),
     ExtNotification(ExtNotification),
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_agent_message_chunks() {
+        let updates = SessionUpdate::agent_message_chunks([
+            ContentBlock::from("See the config in "),
+            ContentBlock::ResourceLink(crate::ResourceLink {
+                annotations: None,
+                description: None,
+                end_line: None,
+                mime_type: None,
+                name: "settings.json".to_string(),
+                size: None,
+                start_line: None,
+                title: None,
+                uri: "file:///project/settings.json".to_string(),
+                meta: None,
+            }),
+        ]);
+        assert_eq!(
+            serde_json::to_value(&updates).unwrap(),
+            serde_json::json!([
+                {
+                    "sessionUpdate": "agent_message_chunk",
+                    "content": { "type": "text", "text": "See the config in " }
+                },
+                {
+                    "sessionUpdate": "agent_message_chunk",
+                    "content": {
+                        "type": "resource_link",
+                        "name": "settings.json",
+                        "uri": "file:///project/settings.json"
+                    }
+                }
+            ])
+        );
+    }
+
+    #[test]
+    fn test_tool_call_finished() {
+        let running = SessionUpdate::tool_call_status("call_1", ToolCallStatus::InProgress);
+        assert_eq!(running.tool_call_finished(), None);
+
+        let completed = SessionUpdate::tool_call_status("call_1", ToolCallStatus::Completed);
+        assert_eq!(
+            completed.tool_call_finished(),
+            Some((&ToolCallId("call_1".into()), ToolCallStatus::Completed))
+        );
+
+        let failed = SessionUpdate::tool_call_status("call_2", ToolCallStatus::Failed);
+        assert_eq!(
+            failed.tool_call_finished(),
+            Some((&ToolCallId("call_2".into()), ToolCallStatus::Failed))
+        );
+
+        // Updates that don't change the status don't end the tool call.
+        let retitled = SessionUpdate::ToolCallUpdate(ToolCallUpdate {
+            id: ToolCallId("call_1".into()),
+            fields: ToolCallUpdateFields {
+                title: Some("Reading file".into()),
+                ..Default::default()
+            },
+            meta: None,
+        });
+        assert_eq!(retitled.tool_call_finished(), None);
+        assert_eq!(SessionUpdate::warning("slow").tool_call_finished(), None);
+    }
+
+    #[test]
+    fn test_permission_request_for_tool_calls() {
+        let tool_call = |id: &str| ToolCallUpdate {
+            id: ToolCallId(id.into()),
+            fields: ToolCallUpdateFields::default(),
+            meta: None,
+        };
+        let options = vec![PermissionOption {
+            id: PermissionOptionId("allow".into()),
+            name: "Allow".into(),
+            kind: PermissionOptionKind::AllowOnce,
+            meta: None,
+        }];
+
+        let batches = ClientCapabilities::default().with_permission_batches(true);
+
+        let error = RequestPermissionRequest::for_tool_calls(
+            SessionId("sess".into()),
+            [],
+            options.clone(),
+            &batches,
+        )
+        .unwrap_err();
+        assert_eq!(error.code, crate::ErrorCode::INVALID_PARAMS.code);
+
+        let request = RequestPermissionRequest::for_tool_calls(
+            SessionId("sess".into()),
+            [tool_call("call_1"), tool_call("call_2")],
+            options.clone(),
+            &batches,
+        )
+        .unwrap();
+        assert_eq!(
+            serde_json::to_value(&request).unwrap(),
+            serde_json::json!({
+                "sessionId": "sess",
+                "toolCall": { "toolCallId": "call_1" },
+                "toolCalls": [{ "toolCallId": "call_2" }],
+                "options": [{ "optionId": "allow", "name": "Allow", "kind": "allow_once" }]
+            })
+        );
+        let ids: Vec<_> = request
+            .all_tool_calls()
+            .map(|call| call.id.clone())
+            .collect();
+        assert_eq!(
+            ids,
+            [ToolCallId("call_1".into()), ToolCallId("call_2".into())]
+        );
+
+        // Clients that don't show batches only get asked about one tool call
+        // at a time.
+        let error = RequestPermissionRequest::for_tool_calls(
+            SessionId("sess".into()),
+            [tool_call("call_1"), tool_call("call_2")],
+            options.clone(),
+            &ClientCapabilities::default(),
+        )
+        .unwrap_err();
+        assert_eq!(error.code, crate::ErrorCode::CAPABILITY_NOT_SUPPORTED.code);
+        let request = RequestPermissionRequest::for_tool_calls(
+            SessionId("sess".into()),
+            [tool_call("call_1")],
+            options.clone(),
+            &ClientCapabilities::default(),
+        )
+        .unwrap();
+        assert!(request.tool_calls.is_empty());
+
+        // Requests for a single tool call look the same as before.
+        let single: RequestPermissionRequest = serde_json::from_value(serde_json::json!({
+            "sessionId": "sess",
+            "toolCall": { "toolCallId": "call_1" },
+            "options": []
+        }))
+        .unwrap();
+        assert!(single.tool_calls.is_empty());
+        assert_eq!(single.all_tool_calls().count(), 1);
+        assert!(
+            !serde_json::to_value(&single)
+                .unwrap()
+                .as_object()
+                .unwrap()
+                .contains_key("toolCalls")
+        );
+    }
+
+    #[test]
+    fn test_message_accumulator_separates_thoughts() {
+        let mut accumulator = MessageAccumulator::new();
+        for update in [
+            SessionUpdate::AgentThoughtChunk {
+                content: "The user wants ".into(),
+            },
+            SessionUpdate::AgentMessageChunk {
+                content: "Sure, ".into(),
+            },
+            SessionUpdate::AgentThoughtChunk {
+                content: "a summary.".into(),
+            },
+            SessionUpdate::warning("slow"),
+            SessionUpdate::AgentMessageChunk {
+                content: "here it is.".into(),
+            },
+        ] {
+            accumulator.push(&update);
+        }
+
+        assert_eq!(accumulator.text(), "Sure, here it is.");
+        assert_eq!(accumulator.thoughts(), "The user wants a summary.");
+
+        accumulator.clear();
+        assert_eq!(accumulator.text(), "");
+        assert_eq!(accumulator.thoughts(), "");
+    }
+
+    #[test]
+    fn test_available_commands_serialization() {
+        let update = SessionUpdate::available_commands([
+            AvailableCommand::new("web", "Search the web for information")
+                .with_input_hint("query to search for"),
+            AvailableCommand::new("test", "Run tests for the current project"),
+        ]);
+
+        assert_eq!(
+            serde_json::to_value(&update).unwrap(),
+            serde_json::json!({
+                "sessionUpdate": "available_commands_update",
+                "availableCommands": [
+                    {
+                        "name": "web",
+                        "description": "Search the web for information",
+                        "input": { "hint": "query to search for" }
+                    },
+                    {
+                        "name": "test",
+                        "description": "Run tests for the current project",
+                        "input": null
+                    }
+                ]
+            })
+        );
+    }
+
+    #[test]
+    fn test_write_text_file_request_serialization() {
+        let request =
+            WriteTextFileRequest::new(SessionId("sess".into()), "/project/notes.md", "## Done\n")
+                .with_append(true)
+                .with_eof(true);
+
+        assert_eq!(
+            serde_json::to_value(&request).unwrap(),
+            serde_json::json!({
+                "sessionId": "sess",
+                "path": "/project/notes.md",
+                "content": "## Done\n",
+                "append": true,
+                "eof": true
+            })
+        );
+    }
+
+    #[test]
+    fn test_tool_call_state_merges_updates() {
+        let id = ToolCallId("call_001".into());
+        let update = |fields: ToolCallUpdateFields| {
+            SessionUpdate::ToolCallUpdate(ToolCallUpdate {
+                id: id.clone(),
+                fields,
+                meta: None,
+            })
+        };
+        let mut state = ToolCallState::from_update(ToolCallUpdate {
+            id: id.clone(),
+            fields: ToolCallUpdateFields {
+                title: Some("Reading files".into()),
+                kind: Some(crate::ToolKind::Read),
+                ..Default::default()
+            },
+            meta: None,
+        });
+
+        for (update, applies) in [
+            (
+                update(ToolCallUpdateFields {
+                    status: Some(ToolCallStatus::InProgress),
+                    content: Some(vec!["Found 1 file".into()]),
+                    ..Default::default()
+                }),
+                true,
+            ),
+            (
+                SessionUpdate::ToolCallUpdate(ToolCallUpdate {
+                    id: ToolCallId("call_002".into()),
+                    fields: ToolCallUpdateFields {
+                        status: Some(ToolCallStatus::Failed),
+                        ..Default::default()
+                    },
+                    meta: None,
+                }),
+                false,
+            ),
+            (
+                SessionUpdate::AgentMessageChunk {
+                    content: "Done".into(),
+                },
+                false,
+            ),
+            (
+                update(ToolCallUpdateFields {
+                    title: Some("Read 2 files".into()),
+                    status: Some(ToolCallStatus::Completed),
+                    content: Some(vec!["Found 2 files".into()]),
+                    ..Default::default()
+                }),
+                true,
+            ),
+        ] {
+            assert_eq!(state.apply(&update), applies);
+        }
+
+        let tool_call = state.into_tool_call();
+        assert_eq!(tool_call.title, "Read 2 files");
+        assert_eq!(tool_call.kind, crate::ToolKind::Read);
+        assert_eq!(tool_call.status, ToolCallStatus::Completed);
+        // Content is replaced, not appended.
+        assert_eq!(
+            tool_call.content,
+            vec![crate::ToolCallContent::from("Found 2 files")]
+        );
+    }
+
+    #[test]
+    fn test_truncate_terminal_output() {
+        assert_eq!(truncate_terminal_output("hello", 5), ("hello", false));
+        assert_eq!(truncate_terminal_output("hello", 3), ("llo", true));
+        assert_eq!(truncate_terminal_output("hello", 0), ("", true));
+
+        // "é" and "✓" take 2 and 3 bytes, and are dropped rather than split.
+        assert_eq!(truncate_terminal_output("café", 2), ("é", true));
+        assert_eq!(truncate_terminal_output("café", 1), ("", true));
+        assert_eq!(truncate_terminal_output("a✓b", 3), ("b", true));
+        assert_eq!(truncate_terminal_output("a✓b", 4), ("✓b", true));
+    }
+}
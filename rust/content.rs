@@ -9,6 +9,8 @@
 //!
 //! See: [Content](https://agentclientprotocol.com/protocol/content)
 
+use std::{borrow::Cow, io, path::Path};
+
 use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
 
@@ -74,6 +76,147 @@ impl<T: Into<String>> From<T> for ContentBlock {
     }
 }
 
+impl ContentBlock {
+    /// Creates a [`ContentBlock::ResourceLink`] that references an image by URI
+    /// instead of embedding it as base64 data.
+    ///
+    /// The `mime_type` should be an `image/*` type, which tells the receiver
+    /// that the linked resource is an image. It isn't checked, and links with
+    /// other types aren't treated as media, see [`ResourceLink::is_media`].
+    /// Agents only accept these in prompts when they advertise the
+    /// `mediaLinks` prompt capability. Otherwise, clients should fall back to
+    /// an inline [`ContentBlock::Image`].
+    pub fn image_link(uri: impl Into<String>, mime_type: impl Into<String>) -> Self {
+        Self::resource_link(uri.into(), Some(mime_type.into()))
+    }
+
+    /// Creates a [`ContentBlock::ResourceLink`] that references audio by URI
+    /// instead of embedding it as base64 data.
+    ///
+    /// The `mime_type` should be an `audio/*` type. See
+    /// [`ContentBlock::image_link`] for how it's used and for fallback
+    /// behavior.
+    pub fn audio_link(uri: impl Into<String>, mime_type: impl Into<String>) -> Self {
+        Self::resource_link(uri.into(), Some(mime_type.into()))
+    }
+
+    /// Splits `text` into text blocks of at most `max_bytes` bytes each, for
+    /// agents that limit the size of a single content block.
+    ///
+    /// Blocks end after a newline where possible, then after other whitespace,
+    /// so lines and words are kept together. A block never ends inside a UTF-8
+    /// character; if `max_bytes` is smaller than a single character, that
+    /// character gets a block of its own. Joining the blocks gives back `text`.
+    pub fn split_text(text: &str, max_bytes: usize) -> Vec<Self> {
+        let mut blocks = Vec::new();
+        let mut rest = text;
+        while rest.len() > max_bytes {
+            let mut limit = max_bytes;
+            while !rest.is_char_boundary(limit) {
+                limit -= 1;
+            }
+            let head = &rest[..limit];
+            let end = head
+                .rfind('\n')
+                .or_else(|| head.rfind(char::is_whitespace))
+                .map(|index| index + head[index..].chars().next().map_or(0, char::len_utf8))
+                .unwrap_or(limit)
+                .max(rest.chars().next().map_or(0, char::len_utf8));
+            let (block, tail) = rest.split_at(end);
+            blocks.push(block.into());
+            rest = tail;
+        }
+        if !rest.is_empty() {
+            blocks.push(rest.into());
+        }
+        blocks
+    }
+
+    /// The `type` tag of this block, such as `"text"` or `"resource_link"`.
+    #[must_use]
+    pub fn kind(&self) -> &'static str {
+        match self {
+            ContentBlock::Text(_) => "text",
+            ContentBlock::Image(_) => "image",
+            ContentBlock::Audio(_) => "audio",
+            ContentBlock::ResourceLink(_) => "resource_link",
+            ContentBlock::Resource(_) => "resource",
+        }
+    }
+
+    /// Flattens this block into text, for clients that can only display text.
+    ///
+    /// Text blocks are returned as is. Other blocks are replaced by a
+    /// placeholder: `[image]`, `[audio]`, `[resource: name]` for resource
+    /// links, using their title if they have one, and `[resource: uri]` for
+    /// embedded resources.
+    #[must_use]
+    pub fn plain_text(&self) -> Cow<'_, str> {
+        match self {
+            ContentBlock::Text(text) => Cow::Borrowed(&text.text),
+            ContentBlock::Image(_) => Cow::Borrowed("[image]"),
+            ContentBlock::Audio(_) => Cow::Borrowed("[audio]"),
+            ContentBlock::ResourceLink(link) => {
+                let name = link.title.as_deref().unwrap_or(&link.name);
+                Cow::Owned(format!("[resource: {name}]"))
+            }
+            ContentBlock::Resource(resource) => {
+                let uri = match &resource.resource {
+                    EmbeddedResourceResource::TextResourceContents(contents) => &contents.uri,
+                    EmbeddedResourceResource::BlobResourceContents(contents) => &contents.uri,
+                };
+                Cow::Owned(format!("[resource: {uri}]"))
+            }
+        }
+    }
+
+    /// Creates a [`ContentBlock::ResourceLink`] that references the lines
+    /// `start_line..=end_line` of a resource, 1-based.
+    ///
+    /// Clients can use the range to highlight that part of the resource or open
+    /// it at that location.
+    pub fn resource_link_range(
+        name: impl Into<String>,
+        uri: impl Into<String>,
+        start_line: u32,
+        end_line: u32,
+    ) -> Self {
+        Self::ResourceLink(ResourceLink {
+            annotations: None,
+            description: None,
+            end_line: Some(end_line),
+            mime_type: None,
+            name: name.into(),
+            size: None,
+            start_line: Some(start_line),
+            title: None,
+            uri: uri.into(),
+            meta: None,
+        })
+    }
+
+    /// Links to `uri`, named after its last path segment.
+    pub(crate) fn resource_link(uri: String, mime_type: Option<String>) -> Self {
+        let name = uri
+            .rsplit('/')
+            .find(|segment| !segment.is_empty())
+            .unwrap_or(&uri)
+            .to_string();
+        Self::ResourceLink(ResourceLink {
+            annotations: None,
+            description: None,
+            end_line: None,
+            mime_type,
+            name,
+            size: None,
+            start_line: None,
+            title: None,
+            uri,
+            meta: None,
+        })
+    }
+}
+
 /// An image provided to or from an LLM.
 #[derive(Debug, Clone, PartialEq, Deserialize, Serialize, JsonSchema)]
 pub struct ImageContent {
@@ -102,6 +245,42 @@ pub struct AudioContent {
     pub meta: Option<serde_json::Value>,
 }
 
+impl AudioContent {
+    /// Reads the audio file at `path` and embeds it as base64 data.
+    ///
+    /// The MIME type is taken from the extension, e.g. `audio/wav` for `.wav`
+    /// and `audio/mpeg` for `.mp3`, falling back to the file's signature.
+    /// Agents only accept audio in prompts when they advertise the `audio`
+    /// prompt capability, see [`crate::PromptCapabilities`]. That isn't checked
+    /// here.
+    ///
+    /// Returns an error naming the path if the file can't be read or isn't
+    /// audio.
+    pub fn from_file(path: impl AsRef<Path>) -> io::Result<Self> {
+        let path = path.as_ref();
+        let bytes = std::fs::read(path).map_err(|error| {
+            io::Error::new(
+                error.kind(),
+                format!("failed to read {}: {error}", path.display()),
+            )
+        })?;
+        let mime_type = guess_mime_type(path, &bytes);
+        if !mime_type.starts_with("audio/") {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                format!("{} is not an audio file ({mime_type})", path.display()),
+            ));
+        }
+
+        Ok(Self {
+            annotations: None,
+            data: base64_encode(&bytes),
+            mime_type: mime_type.to_string(),
+            meta: None,
+        })
+    }
+}
+
 /// The contents of a resource, embedded into a prompt or tool call result.
 #[derive(Debug, Clone, PartialEq, Deserialize, Serialize, JsonSchema)]
 pub struct EmbeddedResource {
@@ -113,6 +292,212 @@ pub struct EmbeddedResource {
     pub meta: Option<serde_json::Value>,
 }
 
+impl EmbeddedResource {
+    /// Reads the file at `path` and embeds its contents.
+    ///
+    /// Files that are valid UTF-8 are embedded as [`TextResourceContents`], and
+    /// anything else as base64-encoded [`BlobResourceContents`]. The URI is the
+    /// percent-encoded `file://` URI of the absolute path, and the MIME type is
+    /// guessed with [`guess_mime_type`].
+    ///
+    /// Returns an error naming the path if the file can't be read.
+    pub fn from_file(path: impl AsRef<Path>) -> io::Result<Self> {
+        let path = std::path::absolute(path.as_ref())?;
+        let bytes = std::fs::read(&path).map_err(|error| {
+            io::Error::new(
+                error.kind(),
+                format!("failed to read {}: {error}", path.display()),
+            )
+        })?;
+        let uri = file_uri(&path);
+        let mime_type = Some(guess_mime_type(&path, &bytes).to_string());
+
+        let resource = match String::from_utf8(bytes) {
+            Ok(text) if !text.contains('\0') => {
+                EmbeddedResourceResource::TextResourceContents(TextResourceContents {
+                    mime_type,
+                    text,
+                    uri,
+                    meta: None,
+                })
+            }
+            Ok(text) => blob_resource(text.as_bytes(), mime_type, uri),
+            Err(error) => blob_resource(error.as_bytes(), mime_type, uri),
+        };
+
+        Ok(Self {
+            annotations: None,
+            resource,
+            meta: None,
+        })
+    }
+}
+
+fn blob_resource(bytes: &[u8], mime_type: Option<String>, uri: String) -> EmbeddedResourceResource {
+    EmbeddedResourceResource::BlobResourceContents(BlobResourceContents {
+        blob: base64_encode(bytes),
+        mime_type,
+        uri,
+        meta: None,
+    })
+}
+
+/// Guesses the MIME type of a file from its path and contents.
+///
+/// The file extension is checked first. For unknown extensions, the type is
+/// sniffed from well-known signatures at the start of `data`, so agents and
+/// clients label the same bytes the same way. Data that is UTF-8 without NUL
+/// bytes is `text/plain`, and anything else is `application/octet-stream`.
+pub fn guess_mime_type(path: impl AsRef<Path>, data: &[u8]) -> &'static str {
+    mime_type_from_extension(path.as_ref())
+        .or_else(|| sniff_mime_type(data))
+        .unwrap_or_else(|| match std::str::from_utf8(data) {
+            Ok(text) if !text.contains('\0') => "text/plain",
+            _ => "application/octet-stream",
+        })
+}
+
+fn mime_type_from_extension(path: &Path) -> Option<&'static str> {
+    let extension = path.extension()?.to_str()?.to_ascii_lowercase();
+    Some(match extension.as_str() {
+        "txt" => "text/plain",
+        "md" | "markdown" => "text/markdown",
+        "html" | "htm" => "text/html",
+        "css" => "text/css",
+        "csv" => "text/csv",
+        "js" | "mjs" => "text/javascript",
+        "ts" | "tsx" => "text/x-typescript",
+        "py" => "text/x-python",
+        "rs" => "text/x-rust",
+        "json" => "application/json",
+        "xml" => "application/xml",
+        "yaml" | "yml" => "application/yaml",
+        "toml" => "application/toml",
+        "pdf" => "application/pdf",
+        "zip" => "application/zip",
+        "png" => "image/png",
+        "jpg" | "jpeg" => "image/jpeg",
+        "gif" => "image/gif",
+        "webp" => "image/webp",
+        "svg" => "image/svg+xml",
+        "wav" => "audio/wav",
+        "mp3" => "audio/mpeg",
+        "ogg" => "audio/ogg",
+        "flac" => "audio/flac",
+        _ => return None,
+    })
+}
+
+fn sniff_mime_type(data: &[u8]) -> Option<&'static str> {
+    const SIGNATURES: &[(&[u8], &str)] = &[
+        (b"%PDF-", "application/pdf"),
+        (b"PK\x03\x04", "application/zip"),
+        (b"\x89PNG\r\n\x1a\n", "image/png"),
+        (b"\xff\xd8\xff", "image/jpeg"),
+        (b"GIF87a", "image/gif"),
+        (b"GIF89a", "image/gif"),
+        (b"ID3", "audio/mpeg"),
+        (b"OggS", "audio/ogg"),
+        (b"fLaC", "audio/flac"),
+    ];
+
+    if let Some(&(_, mime_type)) = SIGNATURES
+        .iter()
+        .find(|(signature, _)| data.starts_with(signature))
+    {
+        return Some(mime_type);
+    }
+    // RIFF containers name their format after the chunk size.
+    match (data.get(..4), data.get(8..12)) {
+        (Some(b"RIFF"), Some(b"WEBP")) => Some("image/webp"),
+        (Some(b"RIFF"), Some(b"WAVE")) => Some("audio/wav"),
+        _ => None,
+    }
+}
+
+/// The `file://` URI of the absolute `path`.
+pub(crate) fn file_uri(path: &Path) -> String {
+    let path = path.to_string_lossy();
+    if cfg!(windows) {
+        file_uri_from_slashes(&path.replace('\\', "/"))
+    } else {
+        file_uri_from_slashes(&path)
+    }
+}
+
+/// Percent-encodes a path separated by `/` into a `file://` URI.
+///
+/// Windows paths like `C:/notes.md` get a leading `/`, giving
+/// `file:///C:/notes.md`.
+fn file_uri_from_slashes(path: &str) -> String {
+    const HEX: &[u8; 16] = b"0123456789ABCDEF";
+
+    let mut uri = String::with_capacity(path.len() + 8);
+    uri.push_str("file://");
+    if !path.starts_with('/') {
+        uri.push('/');
+    }
+    for byte in path.bytes() {
+        match byte {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'.' | b'_' | b'~' | b'/' | b':' => {
+                uri.push(byte as char)
+            }
+            _ => {
+                uri.push('%');
+                uri.push(HEX[(byte >> 4) as usize] as char);
+                uri.push(HEX[(byte & 0xf) as usize] as char);
+            }
+        }
+    }
+    uri
+}
+
+const BASE64_ALPHABET: &[u8; 64] =
+    b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+/// Encodes `bytes` as standard, padded base64.
+pub(crate) fn base64_encode(bytes: &[u8]) -> String {
+    let mut encoded = String::with_capacity(bytes.len().div_ceil(3) * 4);
+    for chunk in bytes.chunks(3) {
+        let group = (chunk[0] as u32) << 16
+            | (chunk.get(1).copied().unwrap_or(0) as u32) << 8
+            | chunk.get(2).copied().unwrap_or(0) as u32;
+        for i in 0..4 {
+            if i <= chunk.len() {
+                encoded.push(BASE64_ALPHABET[((group >> (18 - 6 * i)) & 0x3f) as usize] as char);
+            } else {
+                encoded.push('=');
+            }
+        }
+    }
+    encoded
+}
+
+/// Decodes standard, padded base64, returning `None` if `encoded` isn't valid.
+pub(crate) fn base64_decode(encoded: &str) -> Option<Vec<u8>> {
+    let encoded = encoded.as_bytes();
+    if encoded.len() % 4 != 0 {
+        return None;
+    }
+
+    let mut decoded = Vec::with_capacity(encoded.len() / 4 * 3);
+    for (index, chunk) in encoded.chunks(4).enumerate() {
+        let last = index == encoded.len() / 4 - 1;
+        let padding = chunk.iter().rev().take_while(|&&byte| byte == b'=').count();
+        if padding > 2 || (padding > 0 && !last) {
+            return None;
+        }
+        let mut group = 0u32;
+        for &byte in &chunk[..4 - padding] {
+            let value = BASE64_ALPHABET.iter().position(|&c| c == byte)?;
+            group = group << 6 | value as u32;
+        }
+        group <<= 6 * padding;
+        decoded.extend_from_slice(&group.to_be_bytes()[1..4 - padding]);
+    }
+    Some(decoded)
+}
+
 /// Resource content that can be embedded in a message.
 #[derive(Debug, Clone, PartialEq, Deserialize, Serialize, JsonSchema)]
 #[serde(untagged)]
@@ -152,11 +537,20 @@ pub struct ResourceLink {
     pub annotations: Option<Annotations>,
     #[serde(default, skip_serializing_if = "Option::is_none")]
     pub description: Option<String>,
+    /// The last line of the referenced range, 1-based and inclusive.
+    #[serde(rename = "endLine", default, skip_serializing_if = "Option::is_none")]
+    pub end_line: Option<u32>,
     #[serde(rename = "mimeType", default, skip_serializing_if = "Option::is_none")]
     pub mime_type: Option<String>,
     pub name: String,
     #[serde(default, skip_serializing_if = "Option::is_none")]
     pub size: Option<i64>,
+    /// The first line of the referenced range, 1-based.
+    ///
+    /// Lets clients highlight the part of the resource the link refers to,
+    /// or open it at that location.
+    #[serde(rename = "startLine", default, skip_serializing_if = "Option::is_none")]
+    pub start_line: Option<u32>,
     #[serde(default, skip_serializing_if = "Option::is_none")]
     pub title: Option<String>,
     pub uri: String,
@@ -165,6 +559,17 @@ pub struct ResourceLink {
     pub meta: Option<serde_json::Value>,
 }
 
+impl ResourceLink {
+    /// Whether this links to an image or audio, going by its `image/*` or
+    /// `audio/*` MIME type.
+    #[must_use]
+    pub fn is_media(&self) -> bool {
+        self.mime_type.as_deref().is_some_and(|mime_type| {
+            mime_type.starts_with("image/") || mime_type.starts_with("audio/")
+        })
+    }
+}
+
 /// Optional annotations for the client. The client can use annotations to inform how objects are used or displayed
 #[derive(Debug, Clone, PartialEq, Deserialize, Serialize, JsonSchema)]
 pub struct Annotations {
@@ -191,3 +596,338 @@ pub enum Role {
     #[serde(rename = "user")]
     User,
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_image_link_serialization() {
+        let block = ContentBlock::image_link("https://example.com/assets/diagram.png", "image/png");
+        assert_eq!(
+            serde_json::to_value(&block).unwrap(),
+            json!({
+                "type": "resource_link",
+                "name": "diagram.png",
+                "mimeType": "image/png",
+                "uri": "https://example.com/assets/diagram.png"
+            })
+        );
+    }
+
+    #[test]
+    fn test_audio_link_serialization() {
+        let block = ContentBlock::audio_link("file:///home/user/recording.wav", "audio/wav");
+        assert_eq!(
+            serde_json::to_value(&block).unwrap(),
+            json!({
+                "type": "resource_link",
+                "name": "recording.wav",
+                "mimeType": "audio/wav",
+                "uri": "file:///home/user/recording.wav"
+            })
+        );
+    }
+
+    #[test]
+    fn test_resource_link_range_serialization() {
+        let block =
+            ContentBlock::resource_link_range("main.rs", "file:///project/src/main.rs", 10, 24);
+        let json = json!({
+            "type": "resource_link",
+            "name": "main.rs",
+            "uri": "file:///project/src/main.rs",
+            "startLine": 10,
+            "endLine": 24
+        });
+        assert_eq!(serde_json::to_value(&block).unwrap(), json);
+        assert_eq!(serde_json::from_value::<ContentBlock>(json).unwrap(), block);
+    }
+
+    #[test]
+    fn test_content_block_requires_type() {
+        let error = serde_json::from_value::<ContentBlock>(json!({ "text": "Hello" }));
+        assert!(error.is_err());
+    }
+
+    #[test]
+    fn test_content_block_type_must_match_fields() {
+        let error = serde_json::from_value::<ContentBlock>(json!({
+            "type": "image",
+            "text": "Hello"
+        }));
+        assert!(error.is_err());
+    }
+
+    #[test]
+    fn test_content_block_fields_of_other_variants_are_ignored() {
+        let block = serde_json::from_value::<ContentBlock>(json!({
+            "type": "text",
+            "text": "Hello",
+            "data": "iVBORw0KGgo=",
+            "mimeType": "image/png"
+        }))
+        .unwrap();
+        assert_eq!(block, ContentBlock::from("Hello"));
+    }
+
+    fn temp_file(name: &str, contents: &[u8]) -> std::path::PathBuf {
+        let path = std::env::temp_dir().join(format!("acp-{}-{name}", std::process::id()));
+        std::fs::write(&path, contents).unwrap();
+        path
+    }
+
+    #[test]
+    fn test_embedded_resource_from_text_file() {
+        let path = temp_file("notes.md", b"# Notes\n");
+        let resource = EmbeddedResource::from_file(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        assert_eq!(
+            serde_json::to_value(&resource).unwrap(),
+            json!({
+                "resource": {
+                    "uri": file_uri(&path),
+                    "mimeType": "text/markdown",
+                    "text": "# Notes\n"
+                }
+            })
+        );
+    }
+
+    #[test]
+    fn test_embedded_resource_from_binary_file() {
+        let path = temp_file("pixel.png", &[0x89, b'P', b'N', b'G', 0x00, 0xff]);
+        let resource = EmbeddedResource::from_file(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        assert_eq!(
+            serde_json::to_value(&resource).unwrap(),
+            json!({
+                "resource": {
+                    "uri": file_uri(&path),
+                    "mimeType": "image/png",
+                    "blob": "iVBORwD/"
+                }
+            })
+        );
+    }
+
+    #[test]
+    fn test_embedded_resource_from_file_with_space() {
+        let path = temp_file("my notes.md", b"# Notes\n");
+        let resource = EmbeddedResource::from_file(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        let EmbeddedResourceResource::TextResourceContents(contents) = resource.resource else {
+            panic!("expected a text resource");
+        };
+        assert!(contents.uri.starts_with("file:///"));
+        assert!(
+            contents
+                .uri
+                .ends_with(&format!("acp-{}-my%20notes.md", std::process::id())),
+            "{}",
+            contents.uri
+        );
+    }
+
+    #[test]
+    fn test_file_uri_encoding() {
+        assert_eq!(
+            file_uri_from_slashes("/home/user/my notes#1.md"),
+            "file:///home/user/my%20notes%231.md"
+        );
+        assert_eq!(
+            file_uri_from_slashes("C:/Users/me/notes.md"),
+            "file:///C:/Users/me/notes.md"
+        );
+        assert_eq!(
+            file_uri_from_slashes("/tmp/caf\u{e9}.txt"),
+            "file:///tmp/caf%C3%A9.txt"
+        );
+    }
+
+    #[test]
+    fn test_audio_content_from_wav_file() {
+        let path = temp_file("voice.wav", b"RIFF\0\0\0\0WAVE");
+        let audio = AudioContent::from_file(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        assert_eq!(audio.mime_type, "audio/wav");
+        assert_eq!(audio.data, "UklGRgAAAABXQVZF");
+    }
+
+    #[test]
+    fn test_audio_content_from_mp3_file() {
+        let path = temp_file("voice.mp3", b"ID3\x04");
+        let audio = AudioContent::from_file(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        assert_eq!(audio.mime_type, "audio/mpeg");
+        assert_eq!(audio.data, "SUQzBA==");
+    }
+
+    #[test]
+    fn test_audio_content_from_non_audio_file() {
+        let path = temp_file("voice.txt", b"not audio");
+        let error = AudioContent::from_file(&path).unwrap_err();
+        std::fs::remove_file(&path).unwrap();
+
+        assert_eq!(error.kind(), std::io::ErrorKind::InvalidData);
+    }
+
+    fn texts(blocks: &[ContentBlock]) -> Vec<&str> {
+        blocks
+            .iter()
+            .map(|block| match block {
+                ContentBlock::Text(text) => text.text.as_str(),
+                other => panic!("expected a text block, got {}", other.kind()),
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_plain_text() {
+        let text: ContentBlock = "Hello".into();
+        assert_eq!(text.plain_text(), "Hello");
+
+        let image = ContentBlock::Image(ImageContent {
+            annotations: None,
+            data: "aGVsbG8=".into(),
+            mime_type: "image/png".into(),
+            uri: None,
+            meta: None,
+        });
+        assert_eq!(image.plain_text(), "[image]");
+
+        let audio = ContentBlock::Audio(AudioContent {
+            annotations: None,
+            data: "aGVsbG8=".into(),
+            mime_type: "audio/wav".into(),
+            meta: None,
+        });
+        assert_eq!(audio.plain_text(), "[audio]");
+
+        let ContentBlock::ResourceLink(mut link) =
+            ContentBlock::image_link("https://example.com/cat.png", "image/png")
+        else {
+            unreachable!()
+        };
+        assert_eq!(
+            ContentBlock::ResourceLink(link.clone()).plain_text(),
+            "[resource: cat.png]"
+        );
+        // The title is preferred over the name when there is one.
+        link.title = Some("A cat".into());
+        assert_eq!(
+            ContentBlock::ResourceLink(link).plain_text(),
+            "[resource: A cat]"
+        );
+
+        let resource = ContentBlock::Resource(EmbeddedResource {
+            annotations: None,
+            resource: EmbeddedResourceResource::TextResourceContents(TextResourceContents {
+                mime_type: None,
+                text: "fn main() {}".into(),
+                uri: "file:///project/main.rs".into(),
+                meta: None,
+            }),
+            meta: None,
+        });
+        assert_eq!(resource.plain_text(), "[resource: file:///project/main.rs]");
+    }
+
+    #[test]
+    fn test_split_text_on_lines_and_words() {
+        let blocks = ContentBlock::split_text("first line\nsecond line\n", 16);
+        assert_eq!(texts(&blocks), ["first line\n", "second line\n"]);
+
+        let blocks = ContentBlock::split_text("one two three", 8);
+        assert_eq!(texts(&blocks), ["one two ", "three"]);
+
+        let blocks = ContentBlock::split_text("abcdefghij", 4);
+        assert_eq!(texts(&blocks), ["abcd", "efgh", "ij"]);
+    }
+
+    #[test]
+    fn test_split_text_exact_boundary() {
+        let blocks = ContentBlock::split_text("abcd", 4);
+        assert_eq!(texts(&blocks), ["abcd"]);
+
+        let blocks = ContentBlock::split_text("abcd\n", 5);
+        assert_eq!(texts(&blocks), ["abcd\n"]);
+
+        assert!(ContentBlock::split_text("", 4).is_empty());
+    }
+
+    #[test]
+    fn test_split_text_multibyte() {
+        // Each of these characters is three bytes long.
+        let blocks = ContentBlock::split_text("日本語テキスト", 7);
+        assert_eq!(texts(&blocks), ["日本", "語テ", "キス", "ト"]);
+
+        // A limit below the width of a character still makes progress.
+        let blocks = ContentBlock::split_text("é🦀", 1);
+        assert_eq!(texts(&blocks), ["é", "🦀"]);
+
+        let text = "naïve café ünïcödé\n".repeat(20);
+        let blocks = ContentBlock::split_text(&text, 25);
+        assert!(blocks.len() > 1);
+        assert_eq!(texts(&blocks).concat(), text);
+    }
+
+    #[test]
+    fn test_guess_mime_type() {
+        assert_eq!(guess_mime_type("main.py", b"print()\n"), "text/x-python");
+        assert_eq!(guess_mime_type("REPORT.PDF", b""), "application/pdf");
+        assert_eq!(guess_mime_type("report", b"%PDF-1.7\n"), "application/pdf");
+        assert_eq!(
+            guess_mime_type("photo", b"\x89PNG\r\n\x1a\n\0\0"),
+            "image/png"
+        );
+        assert_eq!(
+            guess_mime_type("clip", b"RIFF\0\0\0\0WAVEfmt "),
+            "audio/wav"
+        );
+        assert_eq!(guess_mime_type("LICENSE", b"MIT License\n"), "text/plain");
+        assert_eq!(
+            guess_mime_type("data.bin", &[0x00, 0x9f, 0x92, 0x96]),
+            "application/octet-stream"
+        );
+    }
+
+    #[test]
+    fn test_embedded_resource_from_missing_file() {
+        let path = std::env::temp_dir().join("acp-does-not-exist.txt");
+        let error = EmbeddedResource::from_file(&path).unwrap_err();
+
+        assert_eq!(error.kind(), std::io::ErrorKind::NotFound);
+        assert!(error.to_string().contains("acp-does-not-exist.txt"));
+    }
+
+    #[test]
+    fn test_base64_encode() {
+        assert_eq!(base64_encode(b""), "");
+        assert_eq!(base64_encode(b"f"), "Zg==");
+        assert_eq!(base64_encode(b"fo"), "Zm8=");
+        assert_eq!(base64_encode(b"foo"), "Zm9v");
+        assert_eq!(base64_encode(b"foobar"), "Zm9vYmFy");
+    }
+
+    #[test]
+    fn test_base64_decode() {
+        assert_eq!(base64_decode("").unwrap(), b"");
+        assert_eq!(base64_decode("Zg==").unwrap(), b"f");
+        assert_eq!(base64_decode("Zm8=").unwrap(), b"fo");
+        assert_eq!(base64_decode("Zm9vYmFy").unwrap(), b"foobar");
+
+        let bytes = (0..=255).collect::<Vec<u8>>();
+        assert_eq!(base64_decode(&base64_encode(&bytes)).unwrap(), bytes);
+
+        assert_eq!(base64_decode("Zm9"), None);
+        assert_eq!(base64_decode("Zg==Zm9v"), None);
+        assert_eq!(base64_decode("Zm9*"), None);
+    }
+}
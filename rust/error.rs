@@ -10,11 +10,13 @@
 //!
 //! See: [Error Handling](https://agentclientprotocol.com/protocol/overview#error-handling)
 
-use std::fmt::Display;
+use std::{fmt::Display, sync::Arc};
 
 use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
 
+use crate::SessionId;
+
 /// JSON-RPC error object.
 ///
 /// Represents an error that occurred during method execution, following the
@@ -82,6 +84,26 @@ impl Error {
         Error::new(ErrorCode::INVALID_PARAMS)
     }
 
+    /// Invalid method parameters, with details about each rejected field.
+    ///
+    /// The details are sent as `{ "errors": [...] }` in the error's data, and
+    /// can be read back with [`Error::validation_errors`].
+    #[must_use]
+    pub fn invalid_fields(errors: impl IntoIterator<Item = ValidationErrorData>) -> Self {
+        let errors: Vec<_> = errors.into_iter().collect();
+        Error::invalid_params().with_data(serde_json::json!({ "errors": errors }))
+    }
+
+    /// Returns the rejected fields of an error created with
+    /// [`Error::invalid_fields`], or `None` if the error doesn't carry them.
+    pub fn validation_errors(&self) -> Option<Vec<ValidationErrorData>> {
+        if self.code != ErrorCode::INVALID_PARAMS.code {
+            return None;
+        }
+        let errors = self.data.as_ref()?.get("errors")?;
+        serde_json::from_value(errors.clone()).ok()
+    }
+
     /// Internal JSON-RPC error.
     #[must_use]
     pub fn internal_error() -> Self {
@@ -105,12 +127,215 @@ impl Error {
         }
     }
 
+    /// The session doesn't exist, e.g. because it expired or was never
+    /// created.
+    ///
+    /// Clients can check for this code to tell the user that a session can't
+    /// be restored, rather than reporting a generic failure.
+    #[must_use]
+    pub fn unknown_session(session_id: &SessionId) -> Self {
+        Error::new(ErrorCode::UNKNOWN_SESSION)
+            .with_data(serde_json::json!({ "sessionId": session_id }))
+    }
+
+    /// The peer recognizes the method, but doesn't support the optional
+    /// `capability` it belongs to, e.g. `terminal` for `terminal/create`.
+    ///
+    /// Unlike [`Error::method_not_found`], this tells the caller that the
+    /// method name is right and the capability simply wasn't negotiated.
+    #[must_use]
+    pub fn capability_not_supported(capability: &str) -> Self {
+        Error::new(ErrorCode::CAPABILITY_NOT_SUPPORTED)
+            .with_data(serde_json::json!({ "capability": capability }))
+    }
+
+    /// The peer didn't respond to a request in time.
+    ///
+    /// Returned locally by methods that give up waiting for a response, such
+    /// as [`crate::ClientSideConnection::initialize_with_timeout`].
+    #[must_use]
+    pub fn request_timeout() -> Self {
+        Error::new(ErrorCode::REQUEST_TIMEOUT)
+    }
+
+    /// The connection moved to a new peer before the request was answered.
+    ///
+    /// Returned locally for requests that were pending when the connection
+    /// was reattached, e.g. with [`crate::ClientSideConnection::reattach`].
+    /// The new peer never saw the request, so callers can retry it once the
+    /// new peer is ready.
+    #[must_use]
+    pub fn connection_reset() -> Self {
+        Error::new(ErrorCode::CONNECTION_RESET)
+    }
+
+    /// The HTTP status code that best matches this error, for gateways that
+    /// expose an agent over HTTP.
+    ///
+    /// | Error code                        | HTTP status               |
+    /// |-----------------------------------|---------------------------|
+    /// | `-32700` parse error              | 400 Bad Request           |
+    /// | `-32600` invalid request          | 400 Bad Request           |
+    /// | `-32602` invalid params           | 400 Bad Request           |
+    /// | `-32000` auth required            | 401 Unauthorized          |
+    /// | `-32601` method not found         | 404 Not Found             |
+    /// | `-32002` resource not found       | 404 Not Found             |
+    /// | `-32003` unknown session          | 404 Not Found             |
+    /// | `-32603` internal error           | 500 Internal Server Error |
+    /// | `-32004` capability not supported | 501 Not Implemented       |
+    /// | `-32005` connection reset         | 503 Service Unavailable   |
+    /// | `-32001` request timeout          | 504 Gateway Timeout       |
+    /// | anything else                     | 500 Internal Server Error |
+    #[must_use]
+    pub fn http_status(&self) -> u16 {
+        match self.code {
+            // Parse error, invalid request, invalid params
+            -32700 | -32600 | -32602 => 400,
+            // Auth required
+            -32000 => 401,
+            // Method not found, resource not found, unknown session
+            -32601 | -32002 | -32003 => 404,
+            // Capability not supported
+            -32004 => 501,
+            // Connection reset
+            -32005 => 503,
+            // Request timeout
+            -32001 => 504,
+            _ => 500,
+        }
+    }
+
+    /// Creates an error from an HTTP status code, the inverse of
+    /// [`Error::http_status`].
+    ///
+    /// | HTTP status         | Error code                        |
+    /// |---------------------|-----------------------------------|
+    /// | 401 Unauthorized    | `-32000` auth required            |
+    /// | 404 Not Found       | `-32601` method not found         |
+    /// | 408 Request Timeout | `-32001` request timeout          |
+    /// | 501 Not Implemented | `-32004` capability not supported |
+    /// | 504 Gateway Timeout | `-32001` request timeout          |
+    /// | any other 4xx       | `-32600` invalid request          |
+    /// | anything else       | `-32603` internal error           |
+    ///
+    /// The error uses `message` if it isn't empty, and the standard message
+    /// for its code otherwise.
+    pub fn from_http_status(status: u16, message: impl Into<String>) -> Self {
+        let code = match status {
+            401 => ErrorCode::AUTH_REQUIRED,
+            404 => ErrorCode::METHOD_NOT_FOUND,
+            408 | 504 => ErrorCode::REQUEST_TIMEOUT,
+            501 => ErrorCode::CAPABILITY_NOT_SUPPORTED,
+            400..=499 => ErrorCode::INVALID_REQUEST,
+            _ => ErrorCode::INTERNAL_ERROR,
+        };
+        let message = message.into();
+        if message.is_empty() {
+            Error::new(code)
+        } else {
+            Error::new((code.code, message))
+        }
+    }
+
     /// Converts a standard error into an internal JSON-RPC error.
     ///
     /// The error's string representation is included as additional data.
     pub fn into_internal_error(err: impl std::error::Error) -> Self {
         Error::internal_error().with_data(err.to_string())
     }
+
+    /// Converts a standard error into a JSON-RPC error with the given code,
+    /// e.g. to fail a request with `invalid_params` because one of its
+    /// fields couldn't be parsed.
+    ///
+    /// Like [`Error::into_internal_error`], the error's string representation
+    /// is included as additional data. The returned [`WrappedError`] keeps the
+    /// error itself as its [`source`](std::error::Error::source), so callers
+    /// can still downcast to it, and converts into an [`Error`] with `?` once
+    /// it is returned to the peer.
+    pub fn wrap(
+        code: impl Into<(i32, String)>,
+        err: impl std::error::Error + Send + Sync + 'static,
+    ) -> WrappedError {
+        WrappedError {
+            error: Error::new(code).with_data(err.to_string()),
+            source: Arc::new(err),
+        }
+    }
+}
+
+/// An [`Error`] created from another error with [`Error::wrap`], which is
+/// kept as its [`source`](std::error::Error::source).
+///
+/// Only the [`Error`] is sent to the peer, so converting into one drops the
+/// source.
+#[derive(Debug, Clone)]
+pub struct WrappedError {
+    error: Error,
+    source: Arc<dyn std::error::Error + Send + Sync>,
+}
+
+impl WrappedError {
+    /// The error that is sent to the peer.
+    pub fn error(&self) -> &Error {
+        &self.error
+    }
+
+    /// Returns the error that is sent to the peer, dropping the source.
+    pub fn into_error(self) -> Error {
+        self.error
+    }
+}
+
+impl From<WrappedError> for Error {
+    fn from(error: WrappedError) -> Self {
+        error.error
+    }
+}
+
+impl std::error::Error for WrappedError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        Some(&*self.source)
+    }
+}
+
+impl Display for WrappedError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        Display::fmt(&self.error, f)
+    }
+}
+
+/// Describes a parameter that failed validation, as part of an
+/// `invalid_params` error created with [`Error::invalid_fields`].
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, JsonSchema)]
+pub struct ValidationErrorData {
+    /// The path to the rejected field, e.g. `mcpServers[0].command`.
+    ///
+    /// Empty if the problem isn't tied to a single field.
+    pub field: String,
+    /// Why the field was rejected.
+    pub reason: String,
+    /// The rejected value, if it helps to show it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub got: Option<serde_json::Value>,
+}
+
+impl ValidationErrorData {
+    /// Describes why `field` was rejected.
+    pub fn new(field: impl Into<String>, reason: impl Into<String>) -> Self {
+        Self {
+            field: field.into(),
+            reason: reason.into(),
+            got: None,
+        }
+    }
+
+    /// Includes the rejected value.
+    #[must_use]
+    pub fn with_got(mut self, got: impl Into<serde_json::Value>) -> Self {
+        self.got = Some(got.into());
+        self
+    }
 }
 
 /// Predefined error codes for common JSON-RPC and ACP-specific errors.
@@ -165,12 +390,40 @@ impl ErrorCode {
         message: "Authentication required",
     };
 
+    /// The peer didn't respond to a request in time.
+    /// This is an ACP-specific error code in the reserved range.
+    pub const REQUEST_TIMEOUT: ErrorCode = ErrorCode {
+        code: -32001,
+        message: "Request timed out",
+    };
+
     /// A given resource, such as a file, was not found.
     /// This is an ACP-specific error code in the reserved range.
     pub const RESOURCE_NOT_FOUND: ErrorCode = ErrorCode {
         code: -32002,
         message: "Resource not found",
     };
+
+    /// The session doesn't exist, e.g. because it expired.
+    /// This is an ACP-specific error code in the reserved range.
+    pub const UNKNOWN_SESSION: ErrorCode = ErrorCode {
+        code: -32003,
+        message: "Unknown session",
+    };
+
+    /// The method belongs to an optional capability the peer doesn't support.
+    /// This is an ACP-specific error code in the reserved range.
+    pub const CAPABILITY_NOT_SUPPORTED: ErrorCode = ErrorCode {
+        code: -32004,
+        message: "Capability not supported",
+    };
+
+    /// The connection moved to a new peer before the request was answered.
+    /// This is an ACP-specific error code in the reserved range.
+    pub const CONNECTION_RESET: ErrorCode = ErrorCode {
+        code: -32005,
+        message: "Connection reset",
+    };
 }
 
 impl From<ErrorCode> for (i32, String) {
@@ -196,7 +449,9 @@ impl Display for Error {
         }
 
         if let Some(data) = &self.data {
-            let pretty = serde_json::to_string_pretty(data).unwrap_or_else(|_| data.to_string());
+            let mut data = data.clone();
+            crate::redact::redact_value(&mut data);
+            let pretty = serde_json::to_string_pretty(&data).unwrap_or_else(|_| data.to_string());
             write!(f, ": {pretty}")?;
         }
 
@@ -218,3 +473,117 @@ impl From<serde_json::Error> for Error {
         Error::invalid_params().with_data(error.to_string())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_validation_errors() {
+        // Deserialization errors keep their message as the data.
+        let error: Error = serde_json::from_str::<crate::NewSessionRequest>(r#"{"cwd":"/"}"#)
+            .unwrap_err()
+            .into();
+        assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+        assert!(
+            error
+                .data
+                .as_ref()
+                .and_then(|data| data.as_str())
+                .is_some_and(|data| data.starts_with("missing field `mcpServers`"))
+        );
+        assert_eq!(error.validation_errors(), None);
+
+        let error = Error::invalid_fields([
+            ValidationErrorData::new("cwd", "must be absolute").with_got("project")
+        ]);
+        assert_eq!(
+            error.data,
+            Some(serde_json::json!({
+                "errors": [{ "field": "cwd", "reason": "must be absolute", "got": "project" }]
+            }))
+        );
+        assert_eq!(Error::invalid_params().validation_errors(), None);
+    }
+
+    #[test]
+    fn test_wrap() {
+        use std::error::Error as _;
+
+        let wrapped = Error::wrap(
+            ErrorCode::INVALID_PARAMS,
+            std::io::Error::new(std::io::ErrorKind::NotFound, "no such file"),
+        );
+        let source = wrapped
+            .source()
+            .unwrap()
+            .downcast_ref::<std::io::Error>()
+            .unwrap();
+        assert_eq!(source.kind(), std::io::ErrorKind::NotFound);
+        assert_eq!(wrapped.to_string(), wrapped.error().to_string());
+
+        let error: Error = wrapped.into();
+        assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+        assert_eq!(error.message, ErrorCode::INVALID_PARAMS.message);
+        assert_eq!(error.data, Some(serde_json::json!("no such file")));
+        assert_eq!(
+            serde_json::to_value(&error).unwrap(),
+            serde_json::json!({ "code": -32602, "message": "Invalid params", "data": "no such file" })
+        );
+
+        // Handlers can return it with `?`.
+        fn handler() -> Result<(), Error> {
+            Err(Error::wrap(ErrorCode::INVALID_PARAMS, std::fmt::Error))?
+        }
+        assert_eq!(handler().unwrap_err().code, ErrorCode::INVALID_PARAMS.code);
+    }
+
+    #[test]
+    fn test_http_status() {
+        let cases = [
+            (Error::parse_error(), 400),
+            (Error::invalid_request(), 400),
+            (Error::invalid_params(), 400),
+            (Error::auth_required(), 401),
+            (Error::method_not_found(), 404),
+            (Error::resource_not_found(None), 404),
+            (Error::unknown_session(&SessionId("sess_1".into())), 404),
+            (Error::capability_not_supported("terminal"), 501),
+            (Error::connection_reset(), 503),
+            (Error::internal_error(), 500),
+            (Error::request_timeout(), 504),
+            (Error::new((-32099, "Custom".to_string())), 500),
+        ];
+        for (error, status) in cases {
+            assert_eq!(error.http_status(), status, "{error}");
+        }
+    }
+
+    #[test]
+    fn test_from_http_status() {
+        let cases = [
+            (400, ErrorCode::INVALID_REQUEST),
+            (401, ErrorCode::AUTH_REQUIRED),
+            (404, ErrorCode::METHOD_NOT_FOUND),
+            (408, ErrorCode::REQUEST_TIMEOUT),
+            (422, ErrorCode::INVALID_REQUEST),
+            (500, ErrorCode::INTERNAL_ERROR),
+            (501, ErrorCode::CAPABILITY_NOT_SUPPORTED),
+            (503, ErrorCode::INTERNAL_ERROR),
+            (504, ErrorCode::REQUEST_TIMEOUT),
+        ];
+        for (status, code) in cases {
+            let error = Error::from_http_status(status, "");
+            assert_eq!(error.code, code.code, "{status}");
+            assert_eq!(error.message, code.message);
+            assert_eq!(
+                Error::from_http_status(error.http_status(), "").code,
+                code.code
+            );
+        }
+
+        let error = Error::from_http_status(401, "Token expired");
+        assert_eq!(error.code, ErrorCode::AUTH_REQUIRED.code);
+        assert_eq!(error.message, "Token expired");
+    }
+}
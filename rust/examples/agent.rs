@@ -6,13 +6,20 @@
 //! RUST_LOG=info cargo run --example agent
 //! ```
 //!
+//! Pass `--listen ADDR` to serve the same line-delimited protocol over TCP
+//! instead, with one connection per client:
+//!
+//! ```bash
+//! RUST_LOG=info cargo run --example agent -- --listen 127.0.0.1:4000
+//! ```
+//!
 //! To connect it to the example client from this crate:
 //!
 //! ```bash
 //! cargo build --example agent && cargo run --example client -- target/debug/examples/agent
 //! ```
 
-use std::cell::Cell;
+use std::cell::RefCell;
 
 use agent_client_protocol::{
     self as acp, AuthenticateResponse, Client, ExtNotification, ExtRequest, ExtResponse,
@@ -24,7 +31,7 @@ use tokio_util::compat::{TokioAsyncReadCompatExt as _, TokioAsyncWriteCompatExt
 
 struct ExampleAgent {
     session_update_tx: mpsc::UnboundedSender<(acp::SessionNotification, oneshot::Sender<()>)>,
-    next_session_id: Cell<u64>,
+    session_ids: RefCell<acp::SessionIdSet>,
 }
 
 impl ExampleAgent {
@@ -33,7 +40,7 @@ impl ExampleAgent {
     ) -> Self {
         Self {
             session_update_tx,
-            next_session_id: Cell::new(0),
+            session_ids: RefCell::default(),
         }
     }
 }
@@ -45,12 +52,13 @@ impl acp::Agent for ExampleAgent {
         arguments: acp::InitializeRequest,
     ) -> Result<acp::InitializeResponse, acp::Error> {
         log::info!("Received initialize request {arguments:?}");
-        Ok(acp::InitializeResponse {
-            protocol_version: acp::V1,
-            agent_capabilities: acp::AgentCapabilities::default(),
-            auth_methods: Vec::new(),
-            meta: None,
-        })
+        Ok(
+            acp::InitializeResponse::new(&arguments, acp::AgentCapabilities::baseline())
+                .with_agent_info(acp::Implementation::new(
+                    "example-agent",
+                    env!("CARGO_PKG_VERSION"),
+                )),
+        )
     }
 
     async fn authenticate(
@@ -66,10 +74,8 @@ impl acp::Agent for ExampleAgent {
         arguments: acp::NewSessionRequest,
     ) -> Result<acp::NewSessionResponse, acp::Error> {
         log::info!("Received new session request {arguments:?}");
-        let session_id = self.next_session_id.get();
-        self.next_session_id.set(session_id + 1);
         Ok(acp::NewSessionResponse {
-            session_id: acp::SessionId(session_id.to_string().into()),
+            session_id: self.session_ids.borrow_mut().generate("sess_"),
             modes: None,
             #[cfg(feature = "unstable")]
             models: None,
@@ -99,11 +105,10 @@ impl acp::Agent for ExampleAgent {
             let (tx, rx) = oneshot::channel();
             self.session_update_tx
                 .send((
-                    SessionNotification {
-                        session_id: arguments.session_id.clone(),
-                        update: acp::SessionUpdate::AgentMessageChunk { content },
-                        meta: None,
-                    },
+                    SessionNotification::new(
+                        arguments.session_id.clone(),
+                        acp::SessionUpdate::AgentMessageChunk { content },
+                    ),
                     tx,
                 ))
                 .map_err(|_| acp::Error::internal_error())?;
@@ -111,6 +116,7 @@ impl acp::Agent for ExampleAgent {
         }
         Ok(acp::PromptResponse {
             stop_reason: acp::StopReason::EndTurn,
+            usage: None,
             meta: None,
         })
     }
@@ -156,12 +162,37 @@ impl acp::Agent for ExampleAgent {
     }
 }
 
+/// Serves a single client over the given streams until they are closed.
+async fn serve(
+    outgoing: impl Unpin + futures::AsyncWrite,
+    incoming: impl Unpin + futures::AsyncRead,
+) -> anyhow::Result<()> {
+    let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
+    // Start up the ExampleAgent connected to the streams.
+    let (conn, handle_io) =
+        acp::AgentSideConnection::new(ExampleAgent::new(tx), outgoing, incoming, |fut| {
+            tokio::task::spawn_local(fut);
+        });
+    // Kick off a background task to send the ExampleAgent's session notifications to the client.
+    tokio::task::spawn_local(async move {
+        while let Some((session_notification, tx)) = rx.recv().await {
+            let result = conn.session_notification(session_notification).await;
+            if let Err(e) = result {
+                log::error!("{e}");
+                break;
+            }
+            tx.send(()).ok();
+        }
+    });
+    // Run until the streams are closed.
+    handle_io.await
+}
+
 #[tokio::main(flavor = "current_thread")]
 async fn main() -> anyhow::Result<()> {
     env_logger::init();
 
-    let outgoing = tokio::io::stdout().compat_write();
-    let incoming = tokio::io::stdin().compat();
+    let args = std::env::args().collect::<Vec<_>>();
 
     // The AgentSideConnection will spawn futures onto our Tokio runtime.
     // LocalSet and spawn_local are used because the futures from the
@@ -169,25 +200,31 @@ async fn main() -> anyhow::Result<()> {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async move {
-            let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
-            // Start up the ExampleAgent connected to stdio.
-            let (conn, handle_io) =
-                acp::AgentSideConnection::new(ExampleAgent::new(tx), outgoing, incoming, |fut| {
-                    tokio::task::spawn_local(fut);
-                });
-            // Kick off a background task to send the ExampleAgent's session notifications to the client.
-            tokio::task::spawn_local(async move {
-                while let Some((session_notification, tx)) = rx.recv().await {
-                    let result = conn.session_notification(session_notification).await;
-                    if let Err(e) = result {
-                        log::error!("{e}");
-                        break;
+            match args.as_slice() {
+                [_] => {
+                    serve(
+                        tokio::io::stdout().compat_write(),
+                        tokio::io::stdin().compat(),
+                    )
+                    .await
+                }
+                [_, flag, addr] if flag == "--listen" => {
+                    let listener = tokio::net::TcpListener::bind(addr).await?;
+                    log::info!("listening on {}", listener.local_addr()?);
+                    loop {
+                        let (stream, peer) = listener.accept().await?;
+                        log::info!("client connected from {peer}");
+                        let (read, write) = stream.into_split();
+                        tokio::task::spawn_local(async move {
+                            if let Err(e) = serve(write.compat_write(), read.compat()).await {
+                                log::error!("{e}");
+                            }
+                            log::info!("client {peer} disconnected");
+                        });
                     }
-                    tx.send(()).ok();
                 }
-            });
-            // Run until stdin/stdout are closed.
-            handle_io.await
+                _ => anyhow::bail!("Usage: agent [--listen ADDR]"),
+            }
         })
         .await
 }
@@ -11,6 +11,13 @@
 //! ```bash
 //! cargo build --example agent && cargo run --example client -- target/debug/examples/agent
 //! ```
+//!
+//! Or to connect to an agent that is already listening on a TCP socket:
+//!
+//! ```bash
+//! cargo run --example agent -- --listen 127.0.0.1:4000
+//! cargo run --example client -- --connect 127.0.0.1:4000
+//! ```
 
 use agent_client_protocol::{
     self as acp, Agent, ExtNotification, ExtRequest, ExtResponse, KillTerminalCommandResponse,
@@ -84,22 +91,32 @@ impl acp::Client for ExampleClient {
     ) -> anyhow::Result<(), acp::Error> {
         match args.update {
             acp::SessionUpdate::AgentMessageChunk { content } => {
-                let text = match content {
-                    acp::ContentBlock::Text(text_content) => text_content.text,
-                    acp::ContentBlock::Image(_) => "<image>".into(),
-                    acp::ContentBlock::Audio(_) => "<audio>".into(),
-                    acp::ContentBlock::ResourceLink(resource_link) => resource_link.uri,
-                    acp::ContentBlock::Resource(_) => "<resource>".into(),
-                };
-                println!("| Agent: {text}");
+                println!("| Agent: {}", content.plain_text());
+            }
+            acp::SessionUpdate::Warning { message } => {
+                println!("| Warning: {message}");
+            }
+            acp::SessionUpdate::UsageUpdate(usage) => {
+                println!("| Tokens so far: {}", usage.total_tokens);
+            }
+            acp::SessionUpdate::AvailableCommandsUpdate { available_commands } => {
+                // The agent sends the whole list whenever it changes, e.g.
+                // after switching modes.
+                let names: Vec<_> = available_commands
+                    .iter()
+                    .map(|command| format!("/{}", command.name))
+                    .collect();
+                println!("| Commands: {}", names.join(", "));
             }
             acp::SessionUpdate::UserMessageChunk { .. }
             | acp::SessionUpdate::AgentThoughtChunk { .. }
             | acp::SessionUpdate::ToolCall(_)
             | acp::SessionUpdate::ToolCallUpdate(_)
             | acp::SessionUpdate::Plan(_)
+            | acp::SessionUpdate::PlanEntryUpdate(_)
             | acp::SessionUpdate::CurrentModeUpdate { .. }
-            | acp::SessionUpdate::AvailableCommandsUpdate { .. } => {}
+            | acp::SessionUpdate::TurnStatus { .. }
+            | acp::SessionUpdate::Drained => {}
         }
         Ok(())
     }
@@ -118,7 +135,19 @@ async fn main() -> anyhow::Result<()> {
     env_logger::init();
 
     let command = std::env::args().collect::<Vec<_>>();
-    let (outgoing, incoming, child) = match command.as_slice() {
+    let (outgoing, incoming, child): (
+        Box<dyn futures::AsyncWrite + Unpin>,
+        Box<dyn futures::AsyncRead + Unpin>,
+        _,
+    ) = match command.as_slice() {
+        [_, flag, addr] if flag == "--connect" => {
+            let (read, write) = tokio::net::TcpStream::connect(addr).await?.into_split();
+            (
+                Box::new(write.compat_write()),
+                Box::new(read.compat()),
+                None,
+            )
+        }
         [_, program, args @ ..] => {
             let mut child = tokio::process::Command::new(program)
                 .args(args.iter())
@@ -127,12 +156,12 @@ async fn main() -> anyhow::Result<()> {
                 .kill_on_drop(true)
                 .spawn()?;
             (
-                child.stdin.take().unwrap().compat_write(),
-                child.stdout.take().unwrap().compat(),
-                child,
+                Box::new(child.stdin.take().unwrap().compat_write()),
+                Box::new(child.stdout.take().unwrap().compat()),
+                Some(child),
             )
         }
-        _ => bail!("Usage: client AGENT_PROGRAM AGENT_ARG..."),
+        _ => bail!("Usage: client AGENT_PROGRAM AGENT_ARG... | client --connect ADDR"),
     };
 
     // The ClientSideConnection will spawn futures onto our Tokio runtime.
@@ -141,7 +170,7 @@ async fn main() -> anyhow::Result<()> {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async move {
-            // Set up the ExampleClient connected to the agent's stdio.
+            // Set up the ExampleClient connected to the agent's stdio or socket.
             let (conn, handle_io) =
                 acp::ClientSideConnection::new(ExampleClient {}, outgoing, incoming, |fut| {
                     tokio::task::spawn_local(fut);
@@ -150,16 +179,27 @@ async fn main() -> anyhow::Result<()> {
             // Handle I/O in the background.
             tokio::task::spawn_local(handle_io);
 
-            // Connect to the agent and set up a session.
-            conn.initialize(acp::InitializeRequest {
-                protocol_version: acp::V1,
-                client_capabilities: acp::ClientCapabilities::default(),
-                meta: None,
-            })
+            // Connect to the agent and set up a session, without hanging
+            // forever if the agent gets stuck while starting up.
+            conn.initialize_with_timeout(
+                acp::InitializeRequest {
+                    protocol_version: acp::V1,
+                    client_capabilities: acp::ClientCapabilities::baseline()
+                        .with_usage_updates(true)
+                        .with_warning_updates(true),
+                    client_info: Some(acp::Implementation::new(
+                        "example-client",
+                        env!("CARGO_PKG_VERSION"),
+                    )),
+                    meta: None,
+                },
+                tokio::time::sleep(std::time::Duration::from_secs(30)),
+            )
             .await?;
             let response = conn
                 .new_session(acp::NewSessionRequest {
                     mcp_servers: Vec::new(),
+                    instructions: Vec::new(),
                     cwd: std::env::current_dir()?,
                     meta: None,
                 })
@@ -169,14 +209,20 @@ async fn main() -> anyhow::Result<()> {
             let mut rl = rustyline::DefaultEditor::new()?;
             while let Ok(line) = rl.readline("> ") {
                 let result = conn
-                    .prompt(acp::PromptRequest {
-                        session_id: response.session_id.clone(),
-                        prompt: vec![line.into()],
-                        meta: None,
-                    })
+                    .prompt(acp::PromptRequest::new(
+                        response.session_id.clone(),
+                        vec![line.into()],
+                    ))
                     .await;
-                if let Err(e) = result {
-                    log::error!("{e}");
+                match result {
+                    Ok(acp::PromptResponse {
+                        usage: Some(usage), ..
+                    }) => println!(
+                        "| Used {} tokens ({} input, {} output)",
+                        usage.total_tokens, usage.input_tokens, usage.output_tokens
+                    ),
+                    Ok(_) => {}
+                    Err(e) => log::error!("{e}"),
                 }
             }
 
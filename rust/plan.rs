@@ -5,6 +5,8 @@
 //!
 //! See: [Agent Plan](https://agentclientprotocol.com/protocol/agent-plan)
 
+use std::{fmt, sync::Arc};
+
 use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
 
@@ -28,6 +30,24 @@ pub struct Plan {
     pub meta: Option<serde_json::Value>,
 }
 
+impl Plan {
+    /// Applies an incremental [`PlanEntryUpdate`] to this plan.
+    ///
+    /// Returns `false` if no entry with a matching id exists, in which case
+    /// the plan is left unchanged.
+    pub fn apply_entry_update(&mut self, update: &PlanEntryUpdate) -> bool {
+        let Some(entry) = self
+            .entries
+            .iter_mut()
+            .find(|entry| entry.id.as_ref() == Some(&update.entry_id))
+        else {
+            return false;
+        };
+        entry.status = update.status;
+        true
+    }
+}
+
 /// A single entry in the execution plan.
 ///
 /// Represents a task or goal that the assistant intends to accomplish
@@ -36,6 +56,11 @@ pub struct Plan {
 #[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct PlanEntry {
+    /// Stable identifier for this entry within the plan.
+    ///
+    /// Required for the entry to be targeted by a [`PlanEntryUpdate`].
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub id: Option<PlanEntryId>,
     /// Human-readable description of what this task aims to accomplish.
     pub content: String,
     /// The relative importance of this task.
@@ -48,6 +73,35 @@ pub struct PlanEntry {
     pub meta: Option<serde_json::Value>,
 }
 
+/// Unique identifier for an entry within a plan.
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema, PartialEq, Eq, Hash)]
+#[serde(transparent)]
+pub struct PlanEntryId(pub Arc<str>);
+
+impl fmt::Display for PlanEntryId {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.0)
+    }
+}
+
+/// An incremental change to a single entry of the current plan.
+///
+/// Lets agents report progress on one task without resending the whole plan.
+/// Only entries that were sent with an `id` can be updated this way.
+///
+/// See protocol docs: [Updating Entries](https://agentclientprotocol.com/protocol/agent-plan#updating-entries)
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct PlanEntryUpdate {
+    /// The id of the plan entry being updated.
+    pub entry_id: PlanEntryId,
+    /// The new execution status of the entry.
+    pub status: PlanEntryStatus,
+    /// Extension point for implementations
+    #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
+    pub meta: Option<serde_json::Value>,
+}
+
 /// Priority levels for plan entries.
 ///
 /// Used to indicate the relative importance or urgency of different
@@ -68,7 +122,7 @@ pub enum PlanEntryPriority {
 ///
 /// Tracks the lifecycle of each task from planning through completion.
 /// See protocol docs: [Plan Entries](https://agentclientprotocol.com/protocol/agent-plan#plan-entries)
-#[derive(Deserialize, Serialize, JsonSchema, Debug, Clone)]
+#[derive(Deserialize, Serialize, JsonSchema, Debug, Clone, Copy, PartialEq, Eq)]
 #[serde(rename_all = "snake_case")]
 pub enum PlanEntryStatus {
     /// The task has not started yet.
@@ -78,3 +132,71 @@ pub enum PlanEntryStatus {
     /// The task has been successfully completed.
     Completed,
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::SessionUpdate;
+
+    #[test]
+    fn test_plan_entry_update_serialization() {
+        let update = SessionUpdate::plan_entry_status("step-2", PlanEntryStatus::Completed);
+
+        assert_eq!(
+            serde_json::to_value(&update).unwrap(),
+            serde_json::json!({
+                "sessionUpdate": "plan_entry_update",
+                "entryId": "step-2",
+                "status": "completed"
+            })
+        );
+    }
+
+    #[test]
+    fn test_plan_entry_without_id() {
+        let entry: PlanEntry = serde_json::from_value(serde_json::json!({
+            "content": "Analyze the existing codebase structure",
+            "priority": "high",
+            "status": "pending"
+        }))
+        .unwrap();
+
+        assert!(entry.id.is_none());
+        assert_eq!(
+            serde_json::to_value(&entry).unwrap(),
+            serde_json::json!({
+                "content": "Analyze the existing codebase structure",
+                "priority": "high",
+                "status": "pending"
+            })
+        );
+    }
+
+    #[test]
+    fn test_apply_entry_update() {
+        let mut plan: Plan = serde_json::from_value(serde_json::json!({
+            "entries": [
+                { "id": "step-1", "content": "Read", "priority": "high", "status": "completed" },
+                { "id": "step-2", "content": "Write", "priority": "high", "status": "in_progress" },
+                { "content": "Review", "priority": "low", "status": "pending" }
+            ]
+        }))
+        .unwrap();
+
+        let update = PlanEntryUpdate {
+            entry_id: PlanEntryId("step-2".into()),
+            status: PlanEntryStatus::Completed,
+            meta: None,
+        };
+        assert!(plan.apply_entry_update(&update));
+        assert_eq!(plan.entries[1].status, PlanEntryStatus::Completed);
+
+        let missing = PlanEntryUpdate {
+            entry_id: PlanEntryId("step-3".into()),
+            status: PlanEntryStatus::Completed,
+            meta: None,
+        };
+        assert!(!plan.apply_entry_update(&missing));
+        assert_eq!(plan.entries[2].status, PlanEntryStatus::Pending);
+    }
+}
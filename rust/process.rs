@@ -0,0 +1,125 @@
+//! Shutting down agent subprocesses.
+//!
+//! Killing an agent outright gives it no chance to save its state, and a
+//! process that is killed but never waited for lingers as a zombie until its
+//! parent exits. Clients that start agents as subprocesses can stop them with
+//! [`shutdown_agent_process`] instead, which escalates from asking the agent to
+//! exit to killing it.
+
+use std::{io, process::ExitStatus};
+
+use futures::{
+    AsyncWrite, AsyncWriteExt as _,
+    future::{self, Either},
+};
+
+/// Stops an agent subprocess and waits for it to exit, returning its exit
+/// status.
+///
+/// The agent is asked to exit more and more forcefully, moving on to the next
+/// step whenever the future returned by `grace_period` completes first:
+///
+/// 1. `stdin` is closed, which lets an agent reading messages from it finish
+///    its work and exit cleanly.
+/// 2. `kill(false)` is called to ask the process to terminate, e.g. by sending
+///    it `SIGTERM`.
+/// 3. `kill(true)` is called to kill the process, e.g. by sending it
+///    `SIGKILL`, and the process is waited for until it exits.
+///
+/// `exited` must resolve once the process has exited, such as
+/// `tokio::process::Child::wait`. Without `kill`, this waits for `exited`
+/// after closing `stdin`. `kill` must not block, and is typically built from
+/// the process ID: the ID can't be reused by another process until `exited`
+/// reaps the agent, so it's safe to signal until then. `grace_period` returns
+/// any future that resolves once the grace period has elapsed, such as
+/// `|| tokio::time::sleep(duration)`.
+///
+/// An error from `kill(false)` is ignored since the process may have exited in
+/// the meantime, but an error from `kill(true)` is returned because waiting
+/// for the process could hang forever. Also returns an error if waiting fails.
+pub async fn shutdown_agent_process<F: Future<Output = ()>>(
+    stdin: Option<impl AsyncWrite + Unpin>,
+    kill: Option<impl FnMut(bool) -> io::Result<()>>,
+    exited: impl Future<Output = io::Result<ExitStatus>>,
+    mut grace_period: impl FnMut() -> F,
+) -> io::Result<ExitStatus> {
+    if let Some(mut stdin) = stdin {
+        // The agent may already have exited and closed its end of the pipe.
+        stdin.close().await.ok();
+    }
+    futures::pin_mut!(exited);
+
+    let Some(mut kill) = kill else {
+        return exited.await;
+    };
+    for force in [false, true] {
+        let timeout = grace_period();
+        futures::pin_mut!(timeout);
+        match future::select(exited.as_mut(), timeout).await {
+            Either::Left((status, _)) => return status,
+            Either::Right(((), _)) => match kill(force) {
+                Err(error) if force => return Err(error),
+                _ => {}
+            },
+        }
+    }
+    exited.await
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use std::{os::unix::process::ExitStatusExt as _, process::Stdio, time::Duration};
+    use tokio::io::AsyncBufReadExt as _;
+    use tokio_util::compat::TokioAsyncWriteCompatExt as _;
+
+    /// Spawns `sh -c script` with piped stdio, waiting until it prints a line
+    /// so that any traps are in place.
+    async fn spawn(script: &str) -> tokio::process::Child {
+        let mut child = tokio::process::Command::new("sh")
+            .args(["-c", script])
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .spawn()
+            .unwrap();
+        let mut stdout = tokio::io::BufReader::new(child.stdout.take().unwrap());
+        stdout.read_line(&mut String::new()).await.unwrap();
+        child
+    }
+
+    async fn shutdown(mut child: tokio::process::Child) -> ExitStatus {
+        let stdin = child.stdin.take().map(|stdin| stdin.compat_write());
+        let pid = child.id().unwrap();
+        // Spawn `kill` without waiting for it, so the hook doesn't block.
+        let kill = move |force: bool| {
+            tokio::process::Command::new("kill")
+                .arg(if force { "-KILL" } else { "-TERM" })
+                .arg(pid.to_string())
+                .spawn()
+                .map(drop)
+        };
+        shutdown_agent_process(stdin, Some(kill), child.wait(), || {
+            tokio::time::sleep(Duration::from_millis(200))
+        })
+        .await
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_shutdown_closes_stdin() {
+        let child = spawn("echo ready; cat > /dev/null").await;
+        assert!(shutdown(child).await.success());
+    }
+
+    #[tokio::test]
+    async fn test_shutdown_terminates() {
+        let child = spawn("echo ready; exec sleep 30").await;
+        assert_eq!(shutdown(child).await.signal(), Some(15));
+    }
+
+    #[tokio::test]
+    async fn test_shutdown_kills() {
+        let child = spawn("trap '' TERM; echo ready; exec sleep 30").await;
+        assert_eq!(shutdown(child).await.signal(), Some(9));
+    }
+}
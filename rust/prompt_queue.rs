@@ -0,0 +1,110 @@
+//! Queuing prompts on the client side.
+//!
+//! A [`PromptQueue`] holds back a prompt until the session's previous turn has
+//! ended, so that users can keep typing while the agent is still working.
+
+use std::{cell::RefCell, collections::HashMap};
+
+use futures::{Future, channel::oneshot};
+
+use crate::{Agent, Error, PromptRequest, PromptResponse, SessionId};
+
+/// Sends prompts to an agent one turn at a time per session.
+///
+/// A prompt sent while an earlier turn of the same session is still running
+/// waits for that turn to end instead of being sent right away, like messages
+/// queued in a chat UI. Prompts run in the order [`PromptQueue::prompt`] was
+/// called, and prompts to different sessions don't wait for each other.
+///
+/// The queue is opt-in: wrap the connection to the agent, e.g. an
+/// `Rc<ClientSideConnection>`, and send prompts through the queue.
+///
+/// See protocol docs: [Prompt Turn](https://agentclientprotocol.com/protocol/prompt-turn)
+pub struct PromptQueue<A> {
+    agent: A,
+    sessions: RefCell<HashMap<SessionId, SessionQueue>>,
+}
+
+#[derive(Default)]
+struct SessionQueue {
+    /// Prompts that are running or waiting to run.
+    depth: usize,
+    /// Resolves once the most recently queued prompt has finished.
+    tail: Option<oneshot::Receiver<()>>,
+}
+
+impl<A: Agent> PromptQueue<A> {
+    /// Creates a queue that sends prompts to `agent`.
+    pub fn new(agent: A) -> Self {
+        Self {
+            agent,
+            sessions: RefCell::new(HashMap::new()),
+        }
+    }
+
+    /// Returns the agent prompts are sent to.
+    pub fn agent(&self) -> &A {
+        &self.agent
+    }
+
+    /// Queues a prompt and returns its response once its turn has ended.
+    ///
+    /// The prompt takes its place in the queue when this is called, not when
+    /// the returned future is first polled. Dropping the future removes the
+    /// prompt from the queue, or stops waiting for its response if it was
+    /// already sent.
+    pub fn prompt(
+        &self,
+        request: PromptRequest,
+    ) -> impl Future<Output = Result<PromptResponse, Error>> + '_ {
+        let (done_tx, done_rx) = oneshot::channel();
+        let previous = {
+            let mut sessions = self.sessions.borrow_mut();
+            let queue = sessions.entry(request.session_id.clone()).or_default();
+            queue.depth += 1;
+            queue.tail.replace(done_rx)
+        };
+        let queued = QueuedPrompt {
+            queue: self,
+            session_id: request.session_id.clone(),
+            _done: done_tx,
+        };
+
+        async move {
+            let _queued = queued;
+            if let Some(previous) = previous {
+                // The previous prompt is done whether it completed or was dropped.
+                previous.await.ok();
+            }
+            self.agent.prompt(request).await
+        }
+    }
+
+    /// Returns how many prompts for the session are running or waiting to run.
+    pub fn depth(&self, session_id: &SessionId) -> usize {
+        self.sessions
+            .borrow()
+            .get(session_id)
+            .map_or(0, |queue| queue.depth)
+    }
+}
+
+/// Leaves the queue when the prompt finishes or is dropped, letting the next
+/// prompt of the session run.
+struct QueuedPrompt<'a, A> {
+    queue: &'a PromptQueue<A>,
+    session_id: SessionId,
+    _done: oneshot::Sender<()>,
+}
+
+impl<A> Drop for QueuedPrompt<'_, A> {
+    fn drop(&mut self) {
+        let mut sessions = self.queue.sessions.borrow_mut();
+        if let Some(queue) = sessions.get_mut(&self.session_id) {
+            queue.depth -= 1;
+            if queue.depth == 0 {
+                sessions.remove(&self.session_id);
+            }
+        }
+    }
+}
@@ -0,0 +1,163 @@
+//! Proxies that sit between a client and an agent.
+//!
+//! A proxy serves [`Agent`] methods to a downstream client while acting as a
+//! [`Client`] of an upstream agent. Since [`ClientSideConnection`] implements
+//! [`Agent`] and [`AgentSideConnection`] implements [`Client`], forwarding a
+//! message is just calling the same method on the connection to the other side.
+//! Middleware overrides the methods it cares about and delegates the rest.
+
+use std::{cell::OnceCell, rc::Rc};
+
+use anyhow::Result;
+use futures::{
+    AsyncRead, AsyncWrite, Future,
+    future::{self, Either, LocalBoxFuture},
+};
+
+use crate::{
+    Agent, AgentSideConnection, Client, ClientSideConnection, Error,
+    rpc::{MessageHandler, Side},
+};
+
+/// A pair of connections that forwards messages between a downstream client
+/// and an upstream agent.
+///
+/// # Example
+///
+/// ```no_run
+/// # use agent_client_protocol::ProxyConnection;
+/// # async fn run(
+/// #     agent_stdin: impl Unpin + futures::AsyncWrite + 'static,
+/// #     agent_stdout: impl Unpin + futures::AsyncRead + 'static,
+/// #     stdout: impl Unpin + futures::AsyncWrite + 'static,
+/// #     stdin: impl Unpin + futures::AsyncRead + 'static,
+/// # ) -> anyhow::Result<()> {
+/// let (_proxy, io_task) = ProxyConnection::new(
+///     |upstream| upstream,
+///     |downstream| downstream,
+///     agent_stdin,
+///     agent_stdout,
+///     stdout,
+///     stdin,
+///     |fut| {
+///         tokio::task::spawn_local(fut);
+///     },
+/// );
+/// io_task.await
+/// # }
+/// ```
+pub struct ProxyConnection {
+    upstream: Rc<ClientSideConnection>,
+    downstream: Rc<AgentSideConnection>,
+}
+
+impl ProxyConnection {
+    /// Creates a proxy between a downstream client and an upstream agent.
+    ///
+    /// The handlers of the two connections refer to each other, so they are
+    /// kept alive for as long as the proxy's process runs.
+    ///
+    /// # Arguments
+    ///
+    /// * `agent` - Builds the handler for requests from the downstream client, given the
+    ///   connection to the upstream agent. Pass `|upstream| upstream` to forward everything.
+    /// * `client` - Builds the handler for requests from the upstream agent, given the
+    ///   connection to the downstream client. Pass `|downstream| downstream` to forward everything.
+    /// * `upstream_outgoing_bytes` - The stream for sending data to the agent (typically its stdin)
+    /// * `upstream_incoming_bytes` - The stream for receiving data from the agent (typically its stdout)
+    /// * `downstream_outgoing_bytes` - The stream for sending data to the client (typically stdout)
+    /// * `downstream_incoming_bytes` - The stream for receiving data from the client (typically stdin)
+    /// * `spawn` - A function to spawn async tasks (e.g., `tokio::spawn`)
+    ///
+    /// # Returns
+    ///
+    /// Returns a tuple containing:
+    /// - The proxy, for sending messages of its own to either side
+    /// - An I/O future that must be spawned, and completes once either side closes its stream
+    #[allow(clippy::too_many_arguments)]
+    pub fn new<A, C>(
+        agent: impl FnOnce(Rc<ClientSideConnection>) -> A,
+        client: impl FnOnce(Rc<AgentSideConnection>) -> C,
+        upstream_outgoing_bytes: impl Unpin + AsyncWrite,
+        upstream_incoming_bytes: impl Unpin + AsyncRead,
+        downstream_outgoing_bytes: impl Unpin + AsyncWrite,
+        downstream_incoming_bytes: impl Unpin + AsyncRead,
+        spawn: impl Fn(LocalBoxFuture<'static, ()>) + 'static,
+    ) -> (Self, impl Future<Output = Result<()>>)
+    where
+        A: Agent + 'static,
+        C: Client + 'static,
+    {
+        let agent_handler = Rc::new(OnceCell::new());
+        let client_handler = Rc::new(OnceCell::new());
+        let spawn = Rc::new(spawn);
+
+        let (upstream, upstream_io_task) = ClientSideConnection::new(
+            Deferred(client_handler.clone()),
+            upstream_outgoing_bytes,
+            upstream_incoming_bytes,
+            {
+                let spawn = spawn.clone();
+                move |fut| spawn(fut)
+            },
+        );
+        let (downstream, downstream_io_task) = AgentSideConnection::new(
+            Deferred(agent_handler.clone()),
+            downstream_outgoing_bytes,
+            downstream_incoming_bytes,
+            move |fut| spawn(fut),
+        );
+
+        let upstream = Rc::new(upstream);
+        let downstream = Rc::new(downstream);
+        agent_handler.set(agent(upstream.clone())).ok();
+        client_handler.set(client(downstream.clone())).ok();
+
+        let io_task = async move {
+            futures::pin_mut!(upstream_io_task, downstream_io_task);
+            match future::select(upstream_io_task, downstream_io_task).await {
+                Either::Left((result, _)) | Either::Right((result, _)) => result,
+            }
+        };
+
+        (
+            Self {
+                upstream,
+                downstream,
+            },
+            io_task,
+        )
+    }
+
+    /// The connection to the upstream agent.
+    pub fn upstream(&self) -> &Rc<ClientSideConnection> {
+        &self.upstream
+    }
+
+    /// The connection to the downstream client.
+    pub fn downstream(&self) -> &Rc<AgentSideConnection> {
+        &self.downstream
+    }
+}
+
+/// A handler that is installed after its connection has been created, so that
+/// the two connections of a proxy can refer to each other.
+struct Deferred<H>(Rc<OnceCell<H>>);
+
+impl<S: Side, H: MessageHandler<S>> MessageHandler<S> for Deferred<H> {
+    async fn handle_request(&self, request: S::InRequest) -> Result<S::OutResponse, Error> {
+        self.handler()?.handle_request(request).await
+    }
+
+    async fn handle_notification(&self, notification: S::InNotification) -> Result<(), Error> {
+        self.handler()?.handle_notification(notification).await
+    }
+}
+
+impl<H> Deferred<H> {
+    fn handler(&self) -> Result<&H, Error> {
+        self.0
+            .get()
+            .ok_or_else(|| Error::internal_error().with_data("proxy is not ready"))
+    }
+}
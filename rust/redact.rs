@@ -0,0 +1,120 @@
+//! Masking secrets before messages are logged.
+//!
+//! Messages can carry credentials, e.g. API keys passed to MCP servers through
+//! [`crate::EnvVariable`]s or [`crate::HttpHeader`]s. Connections redact the
+//! JSON they log with [`redact_secrets`] by default. Redaction only applies to
+//! logs: messages are always sent and delivered unchanged.
+
+use serde_json::Value;
+
+/// The text that replaces redacted values.
+pub const REDACTED: &str = "[REDACTED]";
+
+/// Masks secret-looking values in a JSON message.
+///
+/// A value is masked if its key looks like it names a secret, such as
+/// `token`, `password` or `apiKey`, or if it is the `value` of a
+/// `{ "name": ..., "value": ... }` pair whose name does, like an environment
+/// variable named `GITHUB_TOKEN`. Numbers are kept, so that fields like token
+/// counts stay readable. Text that isn't valid JSON is returned as is.
+pub fn redact_secrets(json: &str) -> String {
+    match serde_json::from_str::<Value>(json) {
+        Ok(mut value) => {
+            redact_value(&mut value);
+            value.to_string()
+        }
+        Err(_) => json.to_string(),
+    }
+}
+
+/// Masks secret-looking values in `value` in place, see [`redact_secrets`].
+pub(crate) fn redact_value(value: &mut Value) {
+    match value {
+        Value::Object(object) => {
+            let secret_pair =
+                matches!(object.get("name"), Some(Value::String(name)) if is_secret_name(name));
+            if secret_pair && let Some(value) = object.get_mut("value") {
+                *value = REDACTED.into();
+            }
+            for (key, value) in object.iter_mut() {
+                if is_secret_name(key)
+                    && matches!(value, Value::String(_) | Value::Array(_) | Value::Object(_))
+                {
+                    *value = REDACTED.into();
+                } else {
+                    redact_value(value);
+                }
+            }
+        }
+        Value::Array(values) => values.iter_mut().for_each(redact_value),
+        _ => {}
+    }
+}
+
+fn is_secret_name(name: &str) -> bool {
+    const SECRET_WORDS: &[&str] = &[
+        "token",
+        "password",
+        "passwd",
+        "secret",
+        "apikey",
+        "api_key",
+        "authorization",
+        "credential",
+    ];
+
+    let name = name.to_ascii_lowercase();
+    SECRET_WORDS.iter().any(|word| name.contains(word))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_redact_secrets() {
+        let message = json!({
+            "jsonrpc": "2.0",
+            "id": 1,
+            "method": "session/new",
+            "params": {
+                "cwd": "/project",
+                "mcpServers": [{
+                    "name": "github",
+                    "command": "/usr/bin/github-mcp",
+                    "args": ["--password", "hunter2"],
+                    "env": [
+                        { "name": "GITHUB_TOKEN", "value": "ghp_secret" },
+                        { "name": "LOG_LEVEL", "value": "debug" }
+                    ]
+                }],
+                "_meta": { "apiKey": "sk-secret", "tokensUsed": 42 }
+            }
+        });
+
+        let redacted: Value = serde_json::from_str(&redact_secrets(&message.to_string())).unwrap();
+        assert_eq!(
+            redacted["params"]["mcpServers"][0]["env"],
+            json!([
+                { "name": "GITHUB_TOKEN", "value": REDACTED },
+                { "name": "LOG_LEVEL", "value": "debug" }
+            ])
+        );
+        assert_eq!(
+            redacted["params"]["_meta"],
+            json!({ "apiKey": REDACTED, "tokensUsed": 42 })
+        );
+        // Only values under secret-looking keys are masked.
+        assert_eq!(
+            redacted["params"]["mcpServers"][0]["args"],
+            json!(["--password", "hunter2"])
+        );
+        assert_eq!(redacted["params"]["cwd"], "/project");
+    }
+
+    #[test]
+    fn test_redact_secrets_keeps_invalid_json() {
+        assert_eq!(redact_secrets("not json"), "not json");
+    }
+}
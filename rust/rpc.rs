@@ -1,11 +1,14 @@
 use std::{
     any::Any,
-    collections::HashMap,
+    cell::RefCell,
+    collections::{HashMap, VecDeque},
+    fmt,
     rc::Rc,
     sync::{
         Arc,
-        atomic::{AtomicI32, Ordering},
+        atomic::{AtomicBool, AtomicI64, AtomicUsize, Ordering},
     },
+    time::{Duration, Instant},
 };
 
 use anyhow::Result;
@@ -16,7 +19,7 @@ use futures::{
         mpsc::{self, UnboundedReceiver, UnboundedSender},
         oneshot,
     },
-    future::LocalBoxFuture,
+    future::{self, Either, LocalBoxFuture},
     io::BufReader,
     select_biased,
 };
@@ -24,28 +27,298 @@ use parking_lot::Mutex;
 use serde::{Deserialize, Serialize, de::DeserializeOwned};
 use serde_json::value::RawValue;
 
+use crate::content::{base64_decode, base64_encode};
 use crate::stream_broadcast::{StreamBroadcast, StreamSender};
-use crate::{Error, StreamReceiver};
+use crate::{Error, ErrorCode, ExtNotification, StreamReceiver, redact_secrets};
 
 pub struct RpcConnection<Local: Side, Remote: Side> {
     outgoing_tx: UnboundedSender<OutgoingMessage<Local, Remote>>,
-    pending_responses: Arc<Mutex<HashMap<i32, PendingResponse>>>,
-    next_id: AtomicI32,
+    pending_responses: Arc<Mutex<HashMap<RequestId, PendingResponse>>>,
+    next_id: AtomicI64,
+    id_generator: Mutex<Option<IdGenerator>>,
     broadcast: StreamBroadcast,
+    transport: Arc<Transport<Local, Remote>>,
+}
+
+type IdGenerator = Box<dyn Fn() -> RequestId + Send>;
+
+/// The id of a JSON-RPC request.
+///
+/// Requests sent by this crate are numbered unless a different generator is
+/// installed, e.g. with [`crate::ClientSideConnection::set_id_generator`], but
+/// peers may use either numbers or strings.
+#[derive(Debug, Clone, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(untagged)]
+pub enum RequestId {
+    /// A numeric id.
+    Number(i64),
+    /// A string id.
+    Str(Arc<str>),
+}
+
+impl fmt::Display for RequestId {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            RequestId::Number(id) => write!(f, "{id}"),
+            RequestId::Str(id) => write!(f, "{id:?}"),
+        }
+    }
+}
+
+impl From<i64> for RequestId {
+    fn from(id: i64) -> Self {
+        RequestId::Number(id)
+    }
+}
+
+impl From<&str> for RequestId {
+    fn from(id: &str) -> Self {
+        RequestId::Str(id.into())
+    }
+}
+
+impl From<String> for RequestId {
+    fn from(id: String) -> Self {
+        RequestId::Str(id.into())
+    }
+}
+
+/// State shared between the connection and whichever I/O task is currently
+/// attached to the underlying byte streams.
+struct Transport<Local: Side, Remote: Side> {
+    incoming_tx: UnboundedSender<IncomingMessage<Local>>,
+    /// Held by the attached I/O task for as long as it runs, so that a task
+    /// created by [`RpcConnection::reattach`] only starts once the previous one
+    /// has stopped.
+    outgoing_rx: futures::lock::Mutex<UnboundedReceiver<OutgoingMessage<Local, Remote>>>,
+    detach_tx: Mutex<Option<oneshot::Sender<()>>>,
+    broadcast_tx: StreamSender,
+    strict_jsonrpc: AtomicBool,
+    /// Bytes of notifications to hold back before writing, or 0 to write
+    /// every message right away.
+    write_buffer: AtomicUsize,
+    flush_tx: UnboundedSender<()>,
+    flush_rx: futures::lock::Mutex<UnboundedReceiver<()>>,
+    redactor: Mutex<Redactor>,
+    /// Whether large outgoing messages are compressed, which is turned on
+    /// once both sides advertised that they can read compressed messages.
+    compression: Arc<AtomicBool>,
+    dispatch: Arc<DispatchControl>,
+    outbound: OutboundQueue,
+    /// Errors of notification handlers that close the connection.
+    fatal_rx: futures::lock::Mutex<UnboundedReceiver<Error>>,
+}
+
+/// What happens once the outbound queue is full, see
+/// [`RpcConnection::set_outbound_queue_limit`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum OutboundQueuePolicy {
+    /// Senders that can wait, such as
+    /// [`crate::Client::session_notification`] and
+    /// [`crate::AgentSideConnection::session_update_batch`], wait until the
+    /// queue has room.
+    Block,
+    /// The oldest queued notifications are dropped with a warning, so that
+    /// only the most recent ones are written.
+    DropOldest,
+}
+
+/// How urgently an outgoing notification should be written, see
+/// [`RpcConnection::notify_with_priority`].
+///
+/// Messages that are waiting to be written because the peer reads slower
+/// than they are sent are written in order of priority. Messages of the same
+/// priority are always written in the order they were sent. Requests and
+/// responses have [`NotificationPriority::Normal`] priority.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub enum NotificationPriority {
+    /// For updates that can wait, such as thought chunks.
+    Low,
+    /// The priority of all other messages.
+    #[default]
+    Normal,
+    /// For updates the user is waiting for, such as a tool call completing.
+    High,
+}
+
+/// Outgoing notifications that haven't been taken up by the I/O task yet.
+#[derive(Default)]
+struct OutboundQueue {
+    len: AtomicUsize,
+    limit: Mutex<Option<(usize, OutboundQueuePolicy)>>,
+    /// Senders waiting for the queue to have room.
+    waiters: Mutex<Vec<oneshot::Sender<()>>>,
+}
+
+impl OutboundQueue {
+    /// Records that the I/O task took a notification off the queue, and
+    /// returns whether it should still be written.
+    fn dequeue(&self) -> bool {
+        let remaining = self.len.fetch_sub(1, Ordering::AcqRel) - 1;
+        match *self.limit.lock() {
+            Some((limit, OutboundQueuePolicy::DropOldest)) => remaining < limit,
+            Some((limit, OutboundQueuePolicy::Block)) => {
+                if remaining < limit {
+                    self.wake();
+                }
+                true
+            }
+            None => true,
+        }
+    }
+
+    /// Waits until the queue has room for another notification.
+    async fn ready(&self) {
+        loop {
+            let Some((limit, OutboundQueuePolicy::Block)) = *self.limit.lock() else {
+                return;
+            };
+            if self.len.load(Ordering::Acquire) < limit {
+                return;
+            }
+            let (tx, rx) = oneshot::channel();
+            self.waiters.lock().push(tx);
+            // The queue may have drained before the waiter was registered.
+            if self.len.load(Ordering::Acquire) < limit {
+                return;
+            }
+            rx.await.ok();
+        }
+    }
+
+    fn wake(&self) {
+        for waiter in self.waiters.lock().drain(..) {
+            waiter.send(()).ok();
+        }
+    }
+}
+
+/// Settings shared with the task that dispatches incoming messages to the
+/// handler.
+struct DispatchControl {
+    /// Whether a failed notification handler closes the connection.
+    notification_error_fatal: AtomicBool,
+    /// Whether incoming messages are buffered instead of dispatched.
+    paused: AtomicBool,
+    /// How many messages may be buffered while dispatch is paused.
+    pause_buffer_limit: AtomicUsize,
+    /// Whether each message is handled to completion before the next one.
+    serial: AtomicBool,
+}
+
+/// The default for [`RpcConnection::set_pause_buffer_limit`].
+const DEFAULT_PAUSE_BUFFER_LIMIT: usize = 1024;
+
+/// The extension notification that tells the peer a request to it was
+/// abandoned, see [`RpcConnection::request_with_timeout`].
+///
+/// It is sent as `_acp/cancel_request` with the request's id in `requestId`,
+/// and reaches the peer's `ext_notification` handler with this method name.
+pub const CANCEL_REQUEST_METHOD_NAME: &str = "acp/cancel_request";
+
+/// Marks a line holding a compressed message, see [`RpcConnection::new`].
+const COMPRESSED_MESSAGE_PREFIX: u8 = b'~';
+
+/// Messages shorter than this many bytes are never compressed, since they
+/// would hardly get any smaller.
+const COMPRESSION_THRESHOLD: usize = 1024;
+
+/// Trades speed for size, from 0 (no compression) to 10.
+const COMPRESSION_LEVEL: u8 = 6;
+
+/// The largest compressed message accepted, once decompressed.
+const MAX_DECOMPRESSED_MESSAGE_SIZE: usize = 256 * 1024 * 1024;
+
+/// Rewrites a JSON message before it is logged.
+type Redactor = Box<dyn Fn(&str) -> String + Send>;
+
+/// Why an I/O task stopped.
+enum IoExit {
+    /// The byte streams were closed, or the connection was dropped.
+    Closed,
+    /// The connection was attached to new byte streams.
+    Detached,
+    /// A notification handler failed while such errors were fatal.
+    Failed(Error),
+}
+
+/// A request that is still waiting for a response, see
+/// [`crate::ClientSideConnection::pending_requests`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PendingRequest {
+    /// The id the request was sent with.
+    pub id: RequestId,
+    /// The method of the request.
+    pub method: Arc<str>,
+    /// How long ago the request was sent.
+    pub age: Duration,
 }
 
 struct PendingResponse {
+    method: Arc<str>,
+    sent_at: Instant,
     deserialize: fn(&serde_json::value::RawValue) -> Result<Box<dyn Any + Send>, Error>,
     respond: oneshot::Sender<Result<Box<dyn Any + Send>, Error>>,
 }
 
+/// Fails every pending response older than `max_age`, see
+/// [`RpcConnection::expire_pending_requests`].
+fn expire_pending_responses(
+    pending_responses: &Mutex<HashMap<RequestId, PendingResponse>>,
+    max_age: Duration,
+) -> usize {
+    let expired = {
+        let mut pending_responses = pending_responses.lock();
+        let expired_ids = pending_responses
+            .iter()
+            .filter(|(_, pending_response)| pending_response.sent_at.elapsed() > max_age)
+            .map(|(id, _)| id.clone())
+            .collect::<Vec<_>>();
+        expired_ids
+            .into_iter()
+            .filter_map(|id| pending_responses.remove(&id))
+            .collect::<Vec<_>>()
+    };
+
+    let count = expired.len();
+    for pending_response in expired {
+        pending_response
+            .respond
+            .send(Err(
+                Error::request_timeout().with_data("request timed out waiting for a response")
+            ))
+            .ok();
+    }
+    count
+}
+
+/// Removes a pending response when its request future is dropped, so that
+/// abandoned requests don't linger and late responses are ignored.
+struct PendingResponseGuard {
+    id: RequestId,
+    pending_responses: Arc<Mutex<HashMap<RequestId, PendingResponse>>>,
+}
+
+impl Drop for PendingResponseGuard {
+    fn drop(&mut self) {
+        self.pending_responses.lock().remove(&self.id);
+    }
+}
+
 impl<Local, Remote> RpcConnection<Local, Remote>
 where
     Local: Side + 'static,
     Remote: Side + 'static,
 {
+    /// Creates a connection dispatching incoming messages to `handler`.
+    ///
+    /// While `compression` is set, outgoing messages of at least
+    /// [`COMPRESSION_THRESHOLD`] bytes are written as a `~` followed by their
+    /// deflated and base64 encoded JSON, whenever that is shorter. Incoming
+    /// messages are accepted in either form.
     pub fn new<Handler>(
         handler: Handler,
+        compression: Arc<AtomicBool>,
         outgoing_bytes: impl Unpin + AsyncWrite,
         incoming_bytes: impl Unpin + AsyncRead,
         spawn: impl Fn(LocalBoxFuture<'static, ()>) + 'static,
@@ -55,66 +328,443 @@ where
     {
         let (incoming_tx, incoming_rx) = mpsc::unbounded();
         let (outgoing_tx, outgoing_rx) = mpsc::unbounded();
+        let (flush_tx, flush_rx) = mpsc::unbounded();
+        let (fatal_tx, fatal_rx) = mpsc::unbounded();
+        let dispatch = Arc::new(DispatchControl {
+            notification_error_fatal: AtomicBool::new(false),
+            paused: AtomicBool::new(false),
+            pause_buffer_limit: AtomicUsize::new(DEFAULT_PAUSE_BUFFER_LIMIT),
+            serial: AtomicBool::new(false),
+        });
 
         let pending_responses = Arc::new(Mutex::new(HashMap::default()));
         let (broadcast_tx, broadcast) = StreamBroadcast::new();
 
-        let io_task = {
-            let pending_responses = pending_responses.clone();
-            async move {
-                let result = Self::handle_io(
-                    incoming_tx,
-                    outgoing_rx,
-                    outgoing_bytes,
-                    incoming_bytes,
-                    pending_responses.clone(),
-                    broadcast_tx,
-                )
-                .await;
-                pending_responses.lock().clear();
-                result
-            }
-        };
+        let transport = Arc::new(Transport {
+            incoming_tx,
+            outgoing_rx: futures::lock::Mutex::new(outgoing_rx),
+            detach_tx: Mutex::new(None),
+            broadcast_tx,
+            strict_jsonrpc: AtomicBool::new(false),
+            write_buffer: AtomicUsize::new(0),
+            flush_tx,
+            flush_rx: futures::lock::Mutex::new(flush_rx),
+            redactor: Mutex::new(Box::new(redact_secrets)),
+            compression,
+            dispatch: dispatch.clone(),
+            outbound: OutboundQueue::default(),
+            fatal_rx: futures::lock::Mutex::new(fatal_rx),
+        });
+        let io_task = Self::attach(
+            transport.clone(),
+            pending_responses.clone(),
+            outgoing_bytes,
+            incoming_bytes,
+        );
 
-        Self::handle_incoming(outgoing_tx.clone(), incoming_rx, handler, spawn);
+        Self::handle_incoming(
+            outgoing_tx.clone(),
+            incoming_rx,
+            dispatch,
+            fatal_tx,
+            handler,
+            spawn,
+        );
 
         let this = Self {
             outgoing_tx,
             pending_responses,
-            next_id: AtomicI32::new(0),
+            next_id: AtomicI64::new(0),
+            id_generator: Mutex::new(None),
             broadcast,
+            transport,
         };
 
         (this, io_task)
     }
 
+    /// Moves the connection onto a new pair of byte streams.
+    ///
+    /// The I/O task attached to the previous streams stops at its next poll
+    /// and every request still waiting for a response fails, since the peer
+    /// that would have answered it is gone. Handlers, subscribers and request
+    /// ids carry over to the new streams.
+    ///
+    /// Returns the I/O future for the new streams, which must be spawned just
+    /// like the one returned by [`RpcConnection::new`].
+    pub fn reattach<W, R>(
+        &self,
+        outgoing_bytes: W,
+        incoming_bytes: R,
+    ) -> impl futures::Future<Output = Result<()>> + use<Local, Remote, W, R>
+    where
+        W: Unpin + AsyncWrite,
+        R: Unpin + AsyncRead,
+    {
+        let io_task = Self::attach(
+            self.transport.clone(),
+            self.pending_responses.clone(),
+            outgoing_bytes,
+            incoming_bytes,
+        );
+
+        let pending_responses = std::mem::take(&mut *self.pending_responses.lock());
+        for (_, pending_response) in pending_responses {
+            pending_response
+                .respond
+                .send(Err(Error::connection_reset().with_data(
+                    "connection was reattached before a response arrived",
+                )))
+                .ok();
+        }
+
+        io_task
+    }
+
+    /// Detaches any I/O task currently running for `transport` and returns a
+    /// new one driving the given byte streams.
+    fn attach(
+        transport: Arc<Transport<Local, Remote>>,
+        pending_responses: Arc<Mutex<HashMap<RequestId, PendingResponse>>>,
+        outgoing_bytes: impl Unpin + AsyncWrite,
+        incoming_bytes: impl Unpin + AsyncRead,
+    ) -> impl futures::Future<Output = Result<()>> {
+        let (detach_tx, mut detach_rx) = oneshot::channel();
+        if let Some(previous) = transport.detach_tx.lock().replace(detach_tx) {
+            previous.send(()).ok();
+        }
+
+        async move {
+            let mut outgoing_rx = transport.outgoing_rx.lock().await;
+            let mut flush_rx = transport.flush_rx.lock().await;
+            let mut fatal_rx = transport.fatal_rx.lock().await;
+            let result = Self::handle_io(
+                &transport,
+                &mut outgoing_rx,
+                &mut flush_rx,
+                &mut fatal_rx,
+                &mut detach_rx,
+                outgoing_bytes,
+                incoming_bytes,
+                pending_responses.clone(),
+            )
+            .await;
+            // Once detached, pending requests belong to the newly attached streams.
+            if !matches!(result, Ok(IoExit::Detached)) {
+                pending_responses.lock().clear();
+            }
+            match result {
+                Ok(IoExit::Failed(error)) => Err(error.into()),
+                result => result.map(|_| ()),
+            }
+        }
+    }
+
     pub fn subscribe(&self) -> StreamReceiver {
         self.broadcast.receiver()
     }
 
+    /// Sets whether incoming messages must declare `"jsonrpc": "2.0"`.
+    ///
+    /// When enabled, requests with a missing or different version are
+    /// answered with an `invalid_request` error and notifications are dropped
+    /// with a warning. Responses are still delivered, so that a peer with an
+    /// outdated version field can't leave requests pending forever.
+    pub fn set_strict_jsonrpc(&self, strict: bool) {
+        self.transport
+            .strict_jsonrpc
+            .store(strict, Ordering::Relaxed);
+    }
+
+    /// Buffers outgoing notifications until `size` bytes are pending.
+    ///
+    /// Agents that stream many small notifications can use this to write them
+    /// in fewer, larger chunks. Requests and responses are never held back:
+    /// sending one writes it together with any buffered notifications before
+    /// it, so message order is preserved. Call [`RpcConnection::flush`] to
+    /// write buffered notifications sooner, e.g. from a timer or at the end of
+    /// a burst. A size of 0, the default, writes every message right away.
+    pub fn set_write_buffer(&self, size: usize) {
+        self.transport.write_buffer.store(size, Ordering::Relaxed);
+    }
+
+    /// Writes any notifications held back by [`RpcConnection::set_write_buffer`].
+    ///
+    /// Messages sent before calling this are written first.
+    pub fn flush(&self) {
+        self.transport.flush_tx.unbounded_send(()).ok();
+    }
+
+    /// Sets whether a failed notification handler closes the connection.
+    ///
+    /// By default, errors returned by notification handlers are logged and
+    /// the connection keeps going, since there is no response to report them
+    /// in. Clients that can't tolerate a dropped session update can enable
+    /// this to stop the I/O task instead: it then resolves with the handler's
+    /// error, and every pending request fails.
+    pub fn set_notification_error_fatal(&self, fatal: bool) {
+        self.transport
+            .dispatch
+            .notification_error_fatal
+            .store(fatal, Ordering::Relaxed);
+    }
+
+    /// Stops dispatching incoming messages to the handler until
+    /// [`RpcConnection::resume`] is called.
+    ///
+    /// Messages received in the meantime are buffered in order, and
+    /// responses to requests sent by this side are still delivered. Once
+    /// [`RpcConnection::set_pause_buffer_limit`] messages are buffered, further
+    /// requests are answered with an error right away and further
+    /// notifications are dropped with a warning.
+    pub fn pause(&self) {
+        self.transport
+            .dispatch
+            .paused
+            .store(true, Ordering::Relaxed);
+    }
+
+    /// Dispatches the messages buffered since [`RpcConnection::pause`], in
+    /// order, and then resumes dispatching as they arrive.
+    pub fn resume(&self) {
+        self.transport
+            .dispatch
+            .paused
+            .store(false, Ordering::Relaxed);
+        self.transport
+            .incoming_tx
+            .unbounded_send(IncomingMessage::Resume)
+            .ok();
+    }
+
+    /// Sets whether incoming messages are handled one at a time.
+    ///
+    /// By default, every request and notification is handled in its own
+    /// spawned task, so a slow handler doesn't hold up the ones after it. In
+    /// serial mode, each message is handled to completion before the next one
+    /// is dispatched, strictly in the order they were received. Responses to
+    /// requests sent by this side are still delivered while a handler runs.
+    pub fn set_serial_dispatch(&self, serial: bool) {
+        self.transport
+            .dispatch
+            .serial
+            .store(serial, Ordering::Relaxed);
+    }
+
+    /// Sets how many incoming messages are buffered while dispatch is paused,
+    /// see [`RpcConnection::pause`]. Defaults to 1024.
+    pub fn set_pause_buffer_limit(&self, limit: usize) {
+        self.transport
+            .dispatch
+            .pause_buffer_limit
+            .store(limit, Ordering::Relaxed);
+    }
+
+    /// Replaces how messages are redacted before they are logged.
+    ///
+    /// The default is [`redact_secrets`]. Messages on the wire are never
+    /// changed.
+    pub fn set_redactor(&self, redactor: impl Fn(&str) -> String + Send + 'static) {
+        *self.transport.redactor.lock() = Box::new(redactor);
+    }
+
+    pub fn pending_request_count(&self) -> usize {
+        self.pending_responses.lock().len()
+    }
+
+    /// Lists the requests that are still waiting for a response, oldest
+    /// first.
+    pub fn pending_requests(&self) -> Vec<PendingRequest> {
+        let mut pending_requests = self
+            .pending_responses
+            .lock()
+            .iter()
+            .map(|(id, pending_response)| PendingRequest {
+                id: id.clone(),
+                method: pending_response.method.clone(),
+                age: pending_response.sent_at.elapsed(),
+            })
+            .collect::<Vec<_>>();
+        pending_requests.sort_by(|a, b| b.age.cmp(&a.age));
+        pending_requests
+    }
+
+    /// Fails every request that has been waiting for a response for longer
+    /// than `max_age`, returning how many were failed.
+    ///
+    /// Entries are removed under the same lock used to deliver responses, so
+    /// each request is resolved exactly once: by its response or by expiry.
+    pub fn expire_pending_requests(&self, max_age: Duration) -> usize {
+        expire_pending_responses(&self.pending_responses, max_age)
+    }
+
+    /// Returns a future that expires requests older than `max_age` each time
+    /// the future returned by `tick` resolves, see
+    /// [`RpcConnection::expire_pending_requests`].
+    ///
+    /// The future completes once the connection has been dropped.
+    pub fn sweep_pending_requests<T, F>(
+        &self,
+        max_age: Duration,
+        mut tick: T,
+    ) -> impl futures::Future<Output = ()> + use<Local, Remote, T, F>
+    where
+        T: FnMut() -> F,
+        F: futures::Future<Output = ()>,
+    {
+        let pending_responses = Arc::downgrade(&self.pending_responses);
+        async move {
+            loop {
+                tick().await;
+                let Some(pending_responses) = pending_responses.upgrade() else {
+                    break;
+                };
+                expire_pending_responses(&pending_responses, max_age);
+            }
+        }
+    }
+
+    /// Replaces how ids are chosen for outgoing requests.
+    ///
+    /// By default requests are numbered from zero. Some peers expect string
+    /// ids, e.g. UUIDs, and a proxy may want to reuse the ids of the requests
+    /// it forwards. Every generated id must be unique among the requests that
+    /// are still pending.
+    pub fn set_id_generator(&self, generator: impl Fn() -> RequestId + Send + 'static) {
+        *self.id_generator.lock() = Some(Box::new(generator));
+    }
+
+    fn next_request_id(&self) -> RequestId {
+        match &*self.id_generator.lock() {
+            Some(generator) => generator(),
+            None => RequestId::Number(self.next_id.fetch_add(1, Ordering::SeqCst)),
+        }
+    }
+
     pub fn notify(
         &self,
         method: impl Into<Arc<str>>,
         params: Option<Remote::InNotification>,
     ) -> Result<(), Error> {
+        self.notify_with_priority(method, params, NotificationPriority::Normal)
+    }
+
+    /// Like [`RpcConnection::notify`], but lets the notification overtake
+    /// queued messages of a lower `priority`.
+    ///
+    /// Only messages that haven't been written yet are overtaken, including
+    /// ones for the same session, so a notification should only be given a
+    /// different priority if it doesn't depend on the messages sent before it.
+    pub fn notify_with_priority(
+        &self,
+        method: impl Into<Arc<str>>,
+        params: Option<Remote::InNotification>,
+        priority: NotificationPriority,
+    ) -> Result<(), Error> {
+        let outbound = &self.transport.outbound;
+        outbound.len.fetch_add(1, Ordering::AcqRel);
         self.outgoing_tx
             .unbounded_send(OutgoingMessage::Notification {
                 method: method.into(),
                 params,
+                priority,
+            })
+            .map_err(|_| {
+                outbound.len.fetch_sub(1, Ordering::AcqRel);
+                Error::internal_error().with_data("failed to send notification")
             })
-            .map_err(|_| Error::internal_error().with_data("failed to send notification"))
+    }
+
+    /// Like [`RpcConnection::notify`], but first waits for the outbound
+    /// queue to have room if it is limited with [`OutboundQueuePolicy::Block`].
+    pub async fn notify_when_ready(
+        &self,
+        method: impl Into<Arc<str>>,
+        params: Option<Remote::InNotification>,
+        priority: NotificationPriority,
+    ) -> Result<(), Error> {
+        self.outbound_ready().await;
+        self.notify_with_priority(method, params, priority)
+    }
+
+    /// Waits for the outbound queue to have room for a notification if it is
+    /// limited with [`OutboundQueuePolicy::Block`].
+    pub async fn outbound_ready(&self) {
+        self.transport.outbound.ready().await
+    }
+
+    /// Limits how many outgoing notifications may be queued while the peer
+    /// reads slower than they are sent, or removes the limit with `None`.
+    ///
+    /// Notifications are queued until the I/O task writes them, so without a
+    /// limit a peer that stops reading lets the queue grow without bound.
+    /// `policy` decides what happens once `limit` notifications are queued.
+    /// Requests and responses are never held back or dropped.
+    pub fn set_outbound_queue_limit(&self, limit: Option<(usize, OutboundQueuePolicy)>) {
+        let outbound = &self.transport.outbound;
+        *outbound.limit.lock() = limit.map(|(limit, policy)| (limit.max(1), policy));
+        // Let waiting senders check the new limit.
+        outbound.wake();
     }
 
     pub fn request<Out: DeserializeOwned + Send + 'static>(
         &self,
         method: impl Into<Arc<str>>,
         params: Option<Remote::InRequest>,
+    ) -> impl Future<Output = Result<Out, Error>> {
+        self.request_with_id(self.next_request_id(), method, params)
+    }
+
+    /// Like [`RpcConnection::request`], but stops waiting for the response
+    /// once `timeout` completes, returning `Ok(None)`.
+    ///
+    /// On timeout, the peer is sent a [`CANCEL_REQUEST_METHOD_NAME`] extension
+    /// notification with the request's id so it can stop working on it, and
+    /// a late response is ignored. `cancel` wraps the notification in the
+    /// peer's notification type.
+    pub async fn request_with_timeout<Out: DeserializeOwned + Send + 'static>(
+        &self,
+        method: impl Into<Arc<str>>,
+        params: Option<Remote::InRequest>,
+        timeout: impl Future<Output = ()>,
+        cancel: impl FnOnce(ExtNotification) -> Remote::InNotification,
+    ) -> Result<Option<Out>, Error> {
+        let id = self.next_request_id();
+        let request = self.request_with_id(id.clone(), method, params);
+        futures::pin_mut!(request, timeout);
+
+        match future::select(request, timeout).await {
+            Either::Left((response, _)) => response.map(Some),
+            Either::Right(((), _)) => {
+                self.pending_responses.lock().remove(&id);
+                let params = serde_json::json!({ "requestId": id });
+                self.notify(
+                    format!("_{CANCEL_REQUEST_METHOD_NAME}"),
+                    Some(cancel(ExtNotification {
+                        method: CANCEL_REQUEST_METHOD_NAME.into(),
+                        params: serde_json::value::to_raw_value(&params)
+                            .map_err(Error::into_internal_error)?
+                            .into(),
+                    })),
+                )?;
+                Ok(None)
+            }
+        }
+    }
+
+    fn request_with_id<Out: DeserializeOwned + Send + 'static>(
+        &self,
+        id: RequestId,
+        method: impl Into<Arc<str>>,
+        params: Option<Remote::InRequest>,
     ) -> impl Future<Output = Result<Out, Error>> {
         let (tx, rx) = oneshot::channel();
-        let id = self.next_id.fetch_add(1, Ordering::SeqCst);
+        let method = method.into();
         self.pending_responses.lock().insert(
-            id,
+            id.clone(),
             PendingResponse {
+                method: method.clone(),
+                sent_at: Instant::now(),
                 deserialize: |value| {
                     serde_json::from_str::<Out>(value.get())
                         .map(|out| Box::new(out) as _)
@@ -129,15 +779,20 @@ where
         if self
             .outgoing_tx
             .unbounded_send(OutgoingMessage::Request {
-                id,
-                method: method.into(),
+                id: id.clone(),
+                method,
                 params,
             })
             .is_err()
         {
             self.pending_responses.lock().remove(&id);
         }
+        let guard = PendingResponseGuard {
+            id,
+            pending_responses: self.pending_responses.clone(),
+        };
         async move {
+            let _guard = guard;
             let result = rx
                 .await
                 .map_err(|_| Error::internal_error().with_data("server shut down unexpectedly"))??
@@ -149,74 +804,134 @@ where
     }
 
     async fn handle_io(
-        incoming_tx: UnboundedSender<IncomingMessage<Local>>,
-        mut outgoing_rx: UnboundedReceiver<OutgoingMessage<Local, Remote>>,
+        transport: &Transport<Local, Remote>,
+        outgoing_rx: &mut UnboundedReceiver<OutgoingMessage<Local, Remote>>,
+        flush_rx: &mut UnboundedReceiver<()>,
+        fatal_rx: &mut UnboundedReceiver<Error>,
+        detach_rx: &mut oneshot::Receiver<()>,
         mut outgoing_bytes: impl Unpin + AsyncWrite,
         incoming_bytes: impl Unpin + AsyncRead,
-        pending_responses: Arc<Mutex<HashMap<i32, PendingResponse>>>,
-        broadcast: StreamSender,
-    ) -> Result<()> {
+        pending_responses: Arc<Mutex<HashMap<RequestId, PendingResponse>>>,
+    ) -> Result<IoExit> {
         // TODO: Create nicer abstraction for broadcast
+        let incoming_tx = &transport.incoming_tx;
+        let broadcast = &transport.broadcast_tx;
+        let strict_jsonrpc = &transport.strict_jsonrpc;
+        let redact = |json: &str| (transport.redactor.lock())(json);
         let mut input_reader = BufReader::new(incoming_bytes);
+        // Encoded messages that haven't been written yet.
         let mut outgoing_line = Vec::new();
-        let mut incoming_line = String::new();
-        loop {
+        let mut incoming_line = Vec::new();
+        // Reused across writes so that coalescing doesn't allocate each time.
+        let mut messages = Vec::new();
+        let exit = loop {
             select_biased! {
+                _ = detach_rx => break IoExit::Detached,
+                error = fatal_rx.next() => {
+                    if let Some(error) = error {
+                        break IoExit::Failed(error);
+                    }
+                }
                 message = outgoing_rx.next() => {
                     if let Some(message) = message {
-                        outgoing_line.clear();
-                        serde_json::to_writer(&mut outgoing_line, &JsonRpcMessage::wrap(&message)).map_err(Error::into_internal_error)?;
-                        log::trace!("send: {}", String::from_utf8_lossy(&outgoing_line));
-                        outgoing_line.push(b'\n');
-                        outgoing_bytes.write_all(&outgoing_line).await.ok();
-                        broadcast.outgoing(&message);
+                        // Coalesce any messages that are already queued into a
+                        // single write, the most urgent ones first.
+                        messages.push(message);
+                        while let Ok(Some(message)) = outgoing_rx.try_next() {
+                            messages.push(message);
+                        }
+                        let write_now = messages
+                            .iter()
+                            .any(|message| !matches!(message, OutgoingMessage::Notification { .. }));
+                        // Drop the oldest messages before reordering the rest.
+                        messages.retain(|message| Self::dequeue(&transport.outbound, message));
+                        messages.sort_by_key(|message| std::cmp::Reverse(message.priority()));
+                        for message in messages.drain(..) {
+                            Self::encode_message(&mut outgoing_line, &message, transport)?;
+                            broadcast.outgoing(&message);
+                        }
+                        if write_now || outgoing_line.len() >= transport.write_buffer.load(Ordering::Relaxed) {
+                            outgoing_bytes.write_all(&outgoing_line).await.ok();
+                            outgoing_line.clear();
+                        }
                     } else {
-                        break;
+                        break IoExit::Closed;
+                    }
+                }
+                _ = flush_rx.next() => {
+                    if !outgoing_line.is_empty() {
+                        outgoing_bytes.write_all(&outgoing_line).await.ok();
+                        outgoing_line.clear();
                     }
                 }
-                bytes_read = input_reader.read_line(&mut incoming_line).fuse() => {
+                bytes_read = input_reader.read_until(b'\n', &mut incoming_line).fuse() => {
                     if bytes_read.map_err(Error::into_internal_error)? == 0 {
-                        break
+                        break IoExit::Closed;
                     }
-                    log::trace!("recv: {}", &incoming_line);
+                    if incoming_line.first() == Some(&COMPRESSED_MESSAGE_PREFIX) {
+                        match decompress_message(&incoming_line) {
+                            Ok(line) => incoming_line = line,
+                            Err(error) => {
+                                log::error!("failed to decompress incoming message: {error}");
+                                incoming_line.clear();
+                                continue;
+                            }
+                        }
+                    }
+                    log::trace!("recv: {}", redact(trim_incoming_line(&String::from_utf8_lossy(&incoming_line))));
 
-                    match serde_json::from_str::<RawIncomingMessage>(&incoming_line) {
+                    match parse_message(&incoming_line) {
                         Ok(message) => {
+                            let method = message.method.as_deref();
+                            let version_error = (strict_jsonrpc.load(Ordering::Relaxed)
+                                && message.jsonrpc.as_deref() != Some(JsonRpcMessage::<()>::VERSION))
+                                .then(|| format!("unsupported jsonrpc version: {:?}", message.jsonrpc));
                             if let Some(id) = message.id {
-                                if let Some(method) = message.method {
+                                if let Some(method) = method {
                                     // Request
-                                    match Local::decode_request(method, message.params) {
+                                    let request = match &version_error {
+                                        Some(version_error) => Err(Error::invalid_request().with_data(version_error.clone())),
+                                        None => Local::decode_request(method, message.params).or_else(|error| {
+                                            if error.code == ErrorCode::METHOD_NOT_FOUND.code {
+                                                Local::decode_custom_request(method, message.params).ok_or(error)
+                                            } else {
+                                                Err(error)
+                                            }
+                                        }),
+                                    };
+                                    match request {
                                         Ok(request) => {
-                                            broadcast.incoming_request(id, method, &request);
+                                            broadcast.incoming_request(id.clone(), method, &request);
                                             incoming_tx.unbounded_send(IncomingMessage::Request { id, request }).ok();
                                         }
                                         Err(err) => {
-                                            outgoing_line.clear();
                                             let error_response = OutgoingMessage::<Local, Remote>::Response {
                                                 id,
                                                 result: ResponseResult::Error(err),
                                             };
 
-                                            serde_json::to_writer(&mut outgoing_line, &JsonRpcMessage::wrap(&error_response))?;
-                                            log::trace!("send: {}", String::from_utf8_lossy(&outgoing_line));
-                                            outgoing_line.push(b'\n');
+                                            Self::encode_message(&mut outgoing_line, &error_response, transport)?;
                                             outgoing_bytes.write_all(&outgoing_line).await.ok();
+                                            outgoing_line.clear();
                                             broadcast.outgoing(&error_response);
                                         }
                                     }
                                 } else if let Some(pending_response) = pending_responses.lock().remove(&id) {
                                     // Response
+                                    if let Some(version_error) = &version_error {
+                                        log::warn!("accepting response with {version_error}");
+                                    }
                                     if let Some(result_value) = message.result {
-                                        broadcast.incoming_response(id, Ok(Some(result_value)));
+                                        broadcast.incoming_response(id.clone(), Ok(Some(result_value)));
 
                                         let result = (pending_response.deserialize)(result_value);
                                         pending_response.respond.send(result).ok();
                                     } else if let Some(error) = message.error {
-                                        broadcast.incoming_response(id, Err(&error));
+                                        broadcast.incoming_response(id.clone(), Err(&error));
 
                                         pending_response.respond.send(Err(error)).ok();
                                     } else {
-                                        broadcast.incoming_response(id, Ok(None));
+                                        broadcast.incoming_response(id.clone(), Ok(None));
 
                                         let result = (pending_response.deserialize)(&RawValue::from_string("null".into()).unwrap());
                                         pending_response.respond.send(result).ok();
@@ -224,7 +939,11 @@ where
                                 } else {
                                     log::error!("received response for unknown request id: {id}");
                                 }
-                            } else if let Some(method) = message.method {
+                            } else if let Some(method) = method
+                                && let Some(version_error) = &version_error
+                            {
+                                log::warn!("dropping {method} notification with {version_error}");
+                            } else if let Some(method) = method {
                                 // Notification
                                 match Local::decode_notification(method, message.params) {
                                     Ok(notification) => {
@@ -232,27 +951,91 @@ where
                                         incoming_tx.unbounded_send(IncomingMessage::Notification { notification }).ok();
                                     }
                                     Err(err) => {
-                                        log::error!("failed to decode {:?}: {err}", message.params);
+                                        log::error!("failed to decode {:?}: {err}", message.params.map(|params| redact(params.get())));
                                     }
                                 }
                             } else {
                                 log::error!("received message with neither id nor method");
                             }
                         }
-                        Err(error) => {
-                            log::error!("failed to parse incoming message: {error}. Raw: {incoming_line}");
+                        Err(InvalidMessage { id, error }) => {
+                            log::error!(
+                                "failed to parse incoming message: {error}. Raw: {}",
+                                redact(trim_incoming_line(&String::from_utf8_lossy(&incoming_line)))
+                            );
+                            // Answer requests so that the peer doesn't wait forever.
+                            if let Some(id) = id {
+                                let error_response = OutgoingMessage::<Local, Remote>::Response {
+                                    id,
+                                    result: ResponseResult::Error(error),
+                                };
+
+                                Self::encode_message(&mut outgoing_line, &error_response, transport)?;
+                                outgoing_bytes.write_all(&outgoing_line).await.ok();
+                                outgoing_line.clear();
+                                broadcast.outgoing(&error_response);
+                            }
                         }
                     }
                     incoming_line.clear();
                 }
             }
+        };
+        // Don't lose notifications that were still buffered.
+        if !outgoing_line.is_empty() {
+            outgoing_bytes.write_all(&outgoing_line).await.ok();
+        }
+        Ok(exit)
+    }
+
+    /// Takes `message` off the outbound queue, returning whether it should be
+    /// written. Only notifications are ever dropped.
+    fn dequeue(outbound: &OutboundQueue, message: &OutgoingMessage<Local, Remote>) -> bool {
+        let OutgoingMessage::Notification { method, .. } = message else {
+            return true;
+        };
+        let keep = outbound.dequeue();
+        if !keep {
+            log::warn!("dropping {method} notification: the outbound queue is full");
+        }
+        keep
+    }
+
+    /// Appends a newline-delimited JSON-RPC encoding of `message` to `buffer`,
+    /// compressed if the transport has compression turned on.
+    fn encode_message(
+        buffer: &mut Vec<u8>,
+        message: &OutgoingMessage<Local, Remote>,
+        transport: &Transport<Local, Remote>,
+    ) -> Result<()> {
+        let start = buffer.len();
+        serde_json::to_writer(&mut *buffer, &JsonRpcMessage::wrap(message))
+            .map_err(Error::into_internal_error)?;
+        log::trace!(
+            "send: {}",
+            (transport.redactor.lock())(&String::from_utf8_lossy(&buffer[start..]))
+        );
+        let len = buffer.len() - start;
+        if len >= COMPRESSION_THRESHOLD && transport.compression.load(Ordering::Relaxed) {
+            let compressed = base64_encode(&miniz_oxide::deflate::compress_to_vec(
+                &buffer[start..],
+                COMPRESSION_LEVEL,
+            ));
+            if compressed.len() < len {
+                buffer.truncate(start);
+                buffer.push(COMPRESSED_MESSAGE_PREFIX);
+                buffer.extend_from_slice(compressed.as_bytes());
+            }
         }
+        buffer.push(b'\n');
         Ok(())
     }
 
     fn handle_incoming<Handler: MessageHandler<Local> + 'static>(
         outgoing_tx: UnboundedSender<OutgoingMessage<Local, Remote>>,
         mut incoming_rx: UnboundedReceiver<IncomingMessage<Local>>,
+        control: Arc<DispatchControl>,
+        fatal_tx: UnboundedSender<Error>,
         handler: Handler,
         spawn: impl Fn(LocalBoxFuture<'static, ()>) + 'static,
     ) {
@@ -261,33 +1044,79 @@ where
         spawn({
             let spawn = spawn.clone();
             async move {
-                while let Some(message) = incoming_rx.next().await {
-                    match message {
+                // Returns the handler's future in serial mode. Otherwise the
+                // handler is spawned, and the returned future is ready.
+                let dispatch = |message: IncomingMessage<Local>| {
+                    let task = match message {
                         IncomingMessage::Request { id, request } => {
                             let outgoing_tx = outgoing_tx.clone();
                             let handler = handler.clone();
-                            spawn(
-                                async move {
-                                    let result = handler.handle_request(request).await.into();
-                                    outgoing_tx
-                                        .unbounded_send(OutgoingMessage::Response { id, result })
-                                        .ok();
-                                }
-                                .boxed_local(),
-                            );
+                            async move {
+                                let result = with_inbound_request_id(
+                                    id.clone(),
+                                    handler.handle_request(request),
+                                )
+                                .await
+                                .into();
+                                outgoing_tx
+                                    .unbounded_send(OutgoingMessage::Response { id, result })
+                                    .ok();
+                            }
+                            .boxed_local()
                         }
                         IncomingMessage::Notification { notification } => {
                             let handler = handler.clone();
-                            spawn(
-                                async move {
-                                    if let Err(err) =
-                                        handler.handle_notification(notification).await
-                                    {
-                                        log::error!("failed to handle notification: {err:?}");
+                            let control = control.clone();
+                            let fatal_tx = fatal_tx.clone();
+                            async move {
+                                if let Err(err) = handler.handle_notification(notification).await {
+                                    log::error!("failed to handle notification: {err:?}");
+                                    if control.notification_error_fatal.load(Ordering::Relaxed) {
+                                        fatal_tx.unbounded_send(err).ok();
                                     }
                                 }
-                                .boxed_local(),
-                            );
+                            }
+                            .boxed_local()
+                        }
+                        IncomingMessage::Resume => return async {}.boxed_local(),
+                    };
+                    if control.serial.load(Ordering::Relaxed) {
+                        task
+                    } else {
+                        spawn(task);
+                        async {}.boxed_local()
+                    }
+                };
+
+                // Messages received while dispatch was paused.
+                let mut buffered = VecDeque::new();
+                while let Some(message) = incoming_rx.next().await {
+                    let paused = control.paused.load(Ordering::Relaxed);
+                    if matches!(message, IncomingMessage::Resume) {
+                        if !paused {
+                            while let Some(message) = buffered.pop_front() {
+                                dispatch(message).await;
+                            }
+                        }
+                    } else if !paused && buffered.is_empty() {
+                        dispatch(message).await;
+                    } else if buffered.len() < control.pause_buffer_limit.load(Ordering::Relaxed) {
+                        buffered.push_back(message);
+                    } else {
+                        match message {
+                            IncomingMessage::Request { id, .. } => {
+                                let error = Error::internal_error()
+                                    .with_data("dispatch is paused and its buffer is full");
+                                outgoing_tx
+                                    .unbounded_send(OutgoingMessage::Response {
+                                        id,
+                                        result: ResponseResult::Error(error),
+                                    })
+                                    .ok();
+                            }
+                            _ => log::warn!(
+                                "dropping notification: dispatch is paused and its buffer is full"
+                            ),
                         }
                     }
                 }
@@ -297,31 +1126,135 @@ where
     }
 }
 
+/// Strips what some peers, e.g. on Windows, wrap messages in: a UTF-8 byte
+/// order mark and CRLF line endings.
+/// Decodes a line written as [`COMPRESSED_MESSAGE_PREFIX`] followed by a
+/// base64 encoded, deflated message.
+fn decompress_message(line: &[u8]) -> Result<Vec<u8>, String> {
+    let encoded = std::str::from_utf8(&line[1..]).map_err(|error| error.to_string())?;
+    let compressed = base64_decode(trim_incoming_line(encoded)).ok_or("invalid base64")?;
+    miniz_oxide::inflate::decompress_to_vec_with_limit(&compressed, MAX_DECOMPRESSED_MESSAGE_SIZE)
+        .map_err(|error| error.to_string())
+}
+
+fn trim_incoming_line(line: &str) -> &str {
+    line.strip_prefix('\u{feff}')
+        .unwrap_or(line)
+        .trim_end_matches(['\r', '\n'])
+}
+
+thread_local! {
+    static INBOUND_REQUEST_ID: RefCell<Option<RequestId>> = const { RefCell::new(None) };
+}
+
+/// Returns the JSON-RPC id of the request whose handler is currently running.
+///
+/// This is the id assigned by the peer, which is useful for correlating logs
+/// and traces with the messages on the wire. Returns `None` when called
+/// outside of a request handler, e.g. from a notification handler or from a
+/// task spawned by the handler.
+pub fn inbound_request_id() -> Option<RequestId> {
+    INBOUND_REQUEST_ID.with_borrow(Clone::clone)
+}
+
+/// Makes `id` available through [`inbound_request_id`] whenever `future` is polled.
+async fn with_inbound_request_id<F: Future>(id: RequestId, future: F) -> F::Output {
+    struct Restore(Option<RequestId>);
+
+    impl Drop for Restore {
+        fn drop(&mut self) {
+            INBOUND_REQUEST_ID.set(self.0.take());
+        }
+    }
+
+    let mut future = std::pin::pin!(future);
+    futures::future::poll_fn(|cx| {
+        let _restore = Restore(INBOUND_REQUEST_ID.replace(Some(id.clone())));
+        future.as_mut().poll(cx)
+    })
+    .await
+}
+
 #[derive(Deserialize)]
 struct RawIncomingMessage<'a> {
-    id: Option<i32>,
-    method: Option<&'a str>,
+    // Owned, since strings with escape sequences can't be borrowed.
+    jsonrpc: Option<String>,
+    id: Option<RequestId>,
+    method: Option<String>,
     params: Option<&'a RawValue>,
     result: Option<&'a RawValue>,
     error: Option<Error>,
 }
 
+/// A line from the peer that isn't a valid JSON-RPC message.
+struct InvalidMessage {
+    /// The id of the request the line appears to be, so that it can still be
+    /// answered with `error`.
+    id: Option<RequestId>,
+    error: Error,
+}
+
+/// Parses a line received from the peer.
+///
+/// Peers may send anything, so this never panics. Lines that aren't UTF-8 or
+/// JSON fail with a `parse_error`, and JSON that isn't a message object, e.g.
+/// because of a duplicate key or an id that doesn't fit an `i64`, fails with
+/// an `invalid_request` error. Deeply nested input is bounded by serde_json's
+/// recursion limit.
+fn parse_message(line: &[u8]) -> Result<RawIncomingMessage<'_>, InvalidMessage> {
+    let line = std::str::from_utf8(line).map_err(|error| InvalidMessage {
+        id: None,
+        error: Error::parse_error().with_data(error.to_string()),
+    })?;
+    let line = trim_incoming_line(line);
+    serde_json::from_str(line).map_err(|error| {
+        if error.is_syntax() || error.is_eof() {
+            return InvalidMessage {
+                id: None,
+                error: Error::parse_error().with_data(error.to_string()),
+            };
+        }
+
+        /// The parts of a message needed to tell whether it is a request.
+        #[derive(Deserialize)]
+        struct RequestHeader {
+            id: Option<RequestId>,
+            method: Option<serde::de::IgnoredAny>,
+        }
+
+        let id = serde_json::from_str(line)
+            .ok()
+            .and_then(|header: RequestHeader| header.method.and(header.id));
+        InvalidMessage {
+            id,
+            error: Error::invalid_request().with_data(error.to_string()),
+        }
+    })
+}
+
 enum IncomingMessage<Local: Side> {
-    Request { id: i32, request: Local::InRequest },
-    Notification { notification: Local::InNotification },
+    Request {
+        id: RequestId,
+        request: Local::InRequest,
+    },
+    Notification {
+        notification: Local::InNotification,
+    },
+    /// Sent by [`RpcConnection::resume`] to dispatch buffered messages.
+    Resume,
 }
 
 #[derive(Serialize, Deserialize, Clone)]
 #[serde(untagged)]
 pub enum OutgoingMessage<Local: Side, Remote: Side> {
     Request {
-        id: i32,
+        id: RequestId,
         method: Arc<str>,
         #[serde(skip_serializing_if = "Option::is_none")]
         params: Option<Remote::InRequest>,
     },
     Response {
-        id: i32,
+        id: RequestId,
         #[serde(flatten)]
         result: ResponseResult<Local::OutResponse>,
     },
@@ -329,9 +1262,20 @@ pub enum OutgoingMessage<Local: Side, Remote: Side> {
         method: Arc<str>,
         #[serde(skip_serializing_if = "Option::is_none")]
         params: Option<Remote::InNotification>,
+        #[serde(skip)]
+        priority: NotificationPriority,
     },
 }
 
+impl<Local: Side, Remote: Side> OutgoingMessage<Local, Remote> {
+    fn priority(&self) -> NotificationPriority {
+        match self {
+            OutgoingMessage::Notification { priority, .. } => *priority,
+            _ => NotificationPriority::Normal,
+        }
+    }
+}
+
 /// Either [`OutgoingMessage`] or [`IncomingMessage`] with `"jsonrpc": "2.0"` specified as
 /// [required by JSON-RPC 2.0 Specification][1].
 ///
@@ -383,6 +1327,14 @@ pub trait Side: Clone {
 
     fn decode_request(method: &str, params: Option<&RawValue>) -> Result<Self::InRequest, Error>;
 
+    /// Decodes a request for a method that isn't part of the protocol, so that
+    /// it can reach methods registered at runtime.
+    ///
+    /// Returns `None` if this side doesn't support registering methods.
+    fn decode_custom_request(_method: &str, _params: Option<&RawValue>) -> Option<Self::InRequest> {
+        None
+    }
+
     fn decode_notification(
         method: &str,
         params: Option<&RawValue>,
@@ -400,3 +1352,127 @@ pub trait MessageHandler<Local: Side> {
         notification: Local::InNotification,
     ) -> impl Future<Output = Result<(), Error>>;
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{AgentSide, ClientSide};
+
+    #[test]
+    fn test_parse_message_rejects_malformed_input() {
+        let deeply_nested = format!(
+            r#"{{"jsonrpc":"2.0","id":1,"method":"session/new","params":{{"cwd":"/","mcpServers":[],"_meta":{}{}}}}}"#,
+            "[".repeat(100_000),
+            "]".repeat(100_000)
+        );
+        let cases: &[(&[u8], i32)] = &[
+            (b"\xff\xfe{}", ErrorCode::PARSE_ERROR.code),
+            (b"{\"id\":1,", ErrorCode::PARSE_ERROR.code),
+            (b"[1, 2, 3]", ErrorCode::INVALID_REQUEST.code),
+            (
+                br#"{"id":1,"id":2,"method":"session/new"}"#,
+                ErrorCode::INVALID_REQUEST.code,
+            ),
+            (
+                br#"{"id":123456789012345678901234567890,"method":"session/new"}"#,
+                ErrorCode::INVALID_REQUEST.code,
+            ),
+            (br#"{"id":1,"method":5}"#, ErrorCode::INVALID_REQUEST.code),
+        ];
+        for (line, code) in cases {
+            let Err(invalid) = parse_message(line) else {
+                panic!("accepted {}", String::from_utf8_lossy(line));
+            };
+            assert_eq!(
+                invalid.error.code,
+                *code,
+                "{}",
+                String::from_utf8_lossy(line)
+            );
+        }
+
+        // Requests with a usable id can still be answered.
+        let invalid = parse_message(br#"{"id":1,"method":5}"#).err().unwrap();
+        assert_eq!(invalid.id, Some(RequestId::Number(1)));
+
+        // Deep nesting is rejected at the latest when the params are decoded.
+        if let Ok(message) = parse_message(deeply_nested.as_bytes()) {
+            assert!(AgentSide::decode_request("session/new", message.params).is_err());
+        }
+    }
+
+    #[test]
+    fn test_parse_message_unescapes_strings() {
+        let message = parse_message(br#"{"jsonrpc":"2.0","method":"session\/cancel"}"#)
+            .ok()
+            .unwrap();
+        assert_eq!(message.method.as_deref(), Some("session/cancel"));
+    }
+
+    /// Mutates valid messages at random and checks that parsing and decoding
+    /// them never panics.
+    #[test]
+    fn test_parse_message_fuzz() {
+        let corpus: &[&[u8]] = &[
+            br#"{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":1}}"#,
+            br#"{"jsonrpc":"2.0","id":"a","method":"session/prompt","params":{"sessionId":"s","prompt":[{"type":"text","text":"hi"}]}}"#,
+            br#"{"jsonrpc":"2.0","method":"session/cancel","params":{"sessionId":"s"}}"#,
+            br#"{"jsonrpc":"2.0","id":2,"result":{"sessionId":"s"}}"#,
+            br#"{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"Method not found"}}"#,
+        ];
+        let mut state = 0x2545_f491_4f6c_dd1d_u64;
+        let mut next = move |bound: usize| {
+            // xorshift64, deterministic so that failures can be reproduced.
+            state ^= state << 13;
+            state ^= state >> 7;
+            state ^= state << 17;
+            (state % bound as u64) as usize
+        };
+        const INTERESTING: &[&[u8]] = &[
+            b"\"",
+            b"\\",
+            b"{",
+            b"}",
+            b"[",
+            b"]",
+            b",",
+            b":",
+            b"null",
+            b"-0",
+            b"1e999",
+            b"99999999999999999999",
+            b"\xff",
+            b"\\u0000",
+            b"\r\n",
+        ];
+
+        for _ in 0..20_000 {
+            let mut line = corpus[next(corpus.len())].to_vec();
+            for _ in 0..1 + next(4) {
+                let at = next(line.len() + 1);
+                match next(4) {
+                    0 => {
+                        line.insert(at.min(line.len()), next(256) as u8);
+                    }
+                    1 if at < line.len() => {
+                        line.remove(at);
+                    }
+                    2 => {
+                        let token = INTERESTING[next(INTERESTING.len())];
+                        line.splice(at..at, token.iter().copied());
+                    }
+                    _ => line.truncate(at),
+                }
+            }
+
+            if let Ok(message) = parse_message(&line)
+                && let Some(method) = message.method.as_deref()
+            {
+                AgentSide::decode_request(method, message.params).ok();
+                AgentSide::decode_notification(method, message.params).ok();
+                ClientSide::decode_request(method, message.params).ok();
+                ClientSide::decode_notification(method, message.params).ok();
+            }
+        }
+    }
+}
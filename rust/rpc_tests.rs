@@ -8,7 +8,7 @@ use crate::*;
 struct TestClient {
     permission_responses: Arc<Mutex<Vec<RequestPermissionOutcome>>>,
     file_contents: Arc<Mutex<std::collections::HashMap<std::path::PathBuf, String>>>,
-    written_files: Arc<Mutex<Vec<(std::path::PathBuf, String)>>>,
+    written_files: Arc<Mutex<Vec<WriteTextFileRequest>>>,
     session_notifications: Arc<Mutex<Vec<SessionNotification>>>,
     extension_notifications: Arc<Mutex<Vec<(String, ExtNotification)>>>,
 }
@@ -61,10 +61,7 @@ impl Client for TestClient {
         &self,
         arguments: WriteTextFileRequest,
     ) -> Result<WriteTextFileResponse, Error> {
-        self.written_files
-            .lock()
-            .unwrap()
-            .push((arguments.path, arguments.content));
+        self.written_files.lock().unwrap().push(arguments);
         Ok(WriteTextFileResponse::default())
     }
 
@@ -95,6 +92,44 @@ impl Client for TestClient {
         unimplemented!()
     }
 
+    #[cfg(feature = "unstable")]
+    async fn read_resource(
+        &self,
+        args: ReadResourceRequest,
+    ) -> Result<ReadResourceResponse, Error> {
+        if args.uri != "file:///notes.md" {
+            return Err(Error::resource_not_found(Some(args.uri)));
+        }
+        Ok(ReadResourceResponse {
+            resource: EmbeddedResourceResource::TextResourceContents(TextResourceContents {
+                mime_type: Some("text/markdown".to_string()),
+                text: "# Notes".to_string(),
+                uri: args.uri,
+                meta: None,
+            }),
+            meta: None,
+        })
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn open(&self, args: OpenRequest) -> Result<OpenResponse, Error> {
+        if args.column.is_some() && args.line.is_none() {
+            return Err(Error::invalid_params().with_data("column requires a line"));
+        }
+        Ok(OpenResponse::default())
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn request_input(
+        &self,
+        args: RequestInputRequest,
+    ) -> Result<RequestInputResponse, Error> {
+        if args.prompt.is_empty() {
+            return Ok(RequestInputResponse::cancelled());
+        }
+        Ok(RequestInputResponse::submitted("the blue one"))
+    }
+
     async fn terminal_output(
         &self,
         _args: TerminalOutputRequest,
@@ -147,6 +182,13 @@ struct TestAgent {
     sessions: Arc<Mutex<std::collections::HashSet<SessionId>>>,
     prompts_received: Arc<Mutex<Vec<PromptReceived>>>,
     cancellations_received: Arc<Mutex<Vec<SessionId>>>,
+    cancel_reasons_received: Arc<Mutex<Vec<Option<CancelReason>>>>,
+    #[cfg(feature = "unstable")]
+    tool_call_cancellations_received: Arc<Mutex<Vec<ToolCallId>>>,
+    #[cfg(feature = "unstable")]
+    terminal_output_received: Arc<Mutex<String>>,
+    #[cfg(feature = "unstable")]
+    session_flags: Arc<Mutex<Vec<SessionFlag>>>,
     extension_notifications: Arc<Mutex<Vec<(String, ExtNotification)>>>,
 }
 
@@ -158,6 +200,18 @@ impl TestAgent {
             sessions: Arc::new(Mutex::new(std::collections::HashSet::new())),
             prompts_received: Arc::new(Mutex::new(Vec::new())),
             cancellations_received: Arc::new(Mutex::new(Vec::new())),
+            cancel_reasons_received: Arc::new(Mutex::new(Vec::new())),
+            #[cfg(feature = "unstable")]
+            tool_call_cancellations_received: Arc::new(Mutex::new(Vec::new())),
+            #[cfg(feature = "unstable")]
+            terminal_output_received: Arc::new(Mutex::new(String::new())),
+            #[cfg(feature = "unstable")]
+            session_flags: Arc::new(Mutex::new(vec![SessionFlag {
+                name: "yolo".into(),
+                description: Some("Skip permission prompts".into()),
+                enabled: false,
+                meta: None,
+            }])),
             extension_notifications: Arc::new(Mutex::new(Vec::new())),
         }
     }
@@ -168,8 +222,11 @@ impl Agent for TestAgent {
     async fn initialize(&self, arguments: InitializeRequest) -> Result<InitializeResponse, Error> {
         Ok(InitializeResponse {
             protocol_version: arguments.protocol_version,
-            agent_capabilities: AgentCapabilities::default(),
+            agent_capabilities: AgentCapabilities::default()
+                .with_drain_updates(true)
+                .with_compression(true),
             auth_methods: vec![],
+            agent_info: Some(Implementation::new("test-agent", "1.0.0")),
             meta: None,
         })
     }
@@ -219,6 +276,7 @@ impl Agent for TestAgent {
             .push((arguments.session_id, arguments.prompt));
         Ok(PromptResponse {
             stop_reason: StopReason::EndTurn,
+            usage: None,
             meta: None,
         })
     }
@@ -228,6 +286,10 @@ impl Agent for TestAgent {
             .lock()
             .unwrap()
             .push(args.session_id);
+        self.cancel_reasons_received
+            .lock()
+            .unwrap()
+            .push(args.reason);
         Ok(())
     }
 
@@ -240,6 +302,66 @@ impl Agent for TestAgent {
         Ok(SetSessionModelResponse::default())
     }
 
+    #[cfg(feature = "unstable")]
+    async fn cancel_tool_call(
+        &self,
+        args: CancelToolCallRequest,
+    ) -> Result<CancelToolCallResponse, Error> {
+        self.tool_call_cancellations_received
+            .lock()
+            .unwrap()
+            .push(args.tool_call_id);
+        Ok(CancelToolCallResponse::default())
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn terminal_output_update(
+        &self,
+        args: TerminalOutputUpdateNotification,
+    ) -> Result<(), Error> {
+        self.terminal_output_received
+            .lock()
+            .unwrap()
+            .push_str(&args.output);
+        Ok(())
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn list_sessions(
+        &self,
+        _args: ListSessionsRequest,
+    ) -> Result<ListSessionsResponse, Error> {
+        Ok(ListSessionsResponse {
+            sessions: self.sessions.lock().unwrap().iter().cloned().collect(),
+            meta: None,
+        })
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn list_session_flags(
+        &self,
+        _args: ListSessionFlagsRequest,
+    ) -> Result<ListSessionFlagsResponse, Error> {
+        Ok(ListSessionFlagsResponse {
+            flags: self.session_flags.lock().unwrap().clone(),
+            meta: None,
+        })
+    }
+
+    #[cfg(feature = "unstable")]
+    async fn set_session_flag(
+        &self,
+        args: SetSessionFlagRequest,
+    ) -> Result<SetSessionFlagResponse, Error> {
+        let mut flags = self.session_flags.lock().unwrap();
+        let flag = flags
+            .iter_mut()
+            .find(|flag| flag.name == args.name)
+            .ok_or_else(Error::invalid_params)?;
+        flag.enabled = args.enabled;
+        Ok(SetSessionFlagResponse::default())
+    }
+
     async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
         dbg!();
         match dbg!(args.method.as_ref()) {
@@ -249,6 +371,14 @@ impl Agent for TestAgent {
                 });
                 Ok(serde_json::value::to_raw_value(&response)?.into())
             }
+            "example.com/request_id" => {
+                // The id must survive the handler being suspended and resumed.
+                tokio::task::yield_now().await;
+                let response = serde_json::json!({
+                    "id": inbound_request_id()
+                });
+                Ok(serde_json::value::to_raw_value(&response)?.into())
+            }
             _ => Err(Error::method_not_found()),
         }
     }
@@ -309,6 +439,7 @@ async fn test_initialize() {
                 .initialize(InitializeRequest {
                     protocol_version: VERSION,
                     client_capabilities: ClientCapabilities::default(),
+                    client_info: None,
                     meta: None,
                 })
                 .await;
@@ -321,577 +452,4696 @@ async fn test_initialize() {
 }
 
 #[tokio::test]
-async fn test_basic_session_creation() {
+async fn test_peer_info() {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async {
             let client = TestClient::new();
             let agent = TestAgent::new();
 
-            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            assert_eq!(agent_conn.peer_info(), None);
+            assert_eq!(client_conn.peer_info(), None);
 
             agent_conn
-                .new_session(NewSessionRequest {
-                    mcp_servers: vec![],
-                    cwd: std::path::PathBuf::from("/test"),
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default(),
+                    client_info: Some(Implementation::new("test-client", "2.0.0")),
                     meta: None,
                 })
                 .await
-                .expect("new_session failed");
+                .expect("initialize failed");
+
+            assert_eq!(
+                agent_conn.peer_info(),
+                Some(Implementation::new("test-agent", "1.0.0"))
+            );
+            assert_eq!(
+                client_conn.peer_info(),
+                Some(Implementation::new("test-client", "2.0.0"))
+            );
         })
         .await;
 }
 
 #[tokio::test]
-async fn test_bidirectional_file_operations() {
+async fn test_negotiated_protocol_version() {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async {
             let client = TestClient::new();
             let agent = TestAgent::new();
 
-            // Add test file content
-            let test_path = std::path::PathBuf::from("/test/file.txt");
-            client.add_file_content(test_path.clone(), "Hello, World!".to_string());
-
-            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            assert_eq!(agent_conn.negotiated_protocol_version(), None);
+            assert_eq!(client_conn.negotiated_protocol_version(), None);
 
-            // Test reading a file
-            let session_id = SessionId(Arc::from("test-session"));
-            let read_result = client_conn
-                .read_text_file(ReadTextFileRequest {
-                    session_id: session_id.clone(),
-                    path: test_path.clone(),
-                    line: None,
-                    limit: None,
+            let response = agent_conn
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default(),
+                    client_info: None,
                     meta: None,
                 })
                 .await
-                .expect("read_text_file failed");
+                .expect("initialize failed");
 
-            assert_eq!(read_result.content, "Hello, World!");
-
-            // Test writing a file
-            let write_result = client_conn
-                .write_text_file(WriteTextFileRequest {
-                    session_id: session_id.clone(),
-                    path: test_path.clone(),
-                    content: "Updated content".to_string(),
-                    meta: None,
-                })
-                .await;
-
-            assert!(write_result.is_ok());
+            assert_eq!(
+                agent_conn.negotiated_protocol_version(),
+                Some(response.protocol_version.clone())
+            );
+            assert_eq!(
+                client_conn.negotiated_protocol_version(),
+                Some(response.protocol_version)
+            );
         })
         .await;
 }
 
 #[tokio::test]
-async fn test_session_notifications() {
+async fn test_filter_prompt() {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async {
             let client = TestClient::new();
             let agent = TestAgent::new();
 
-            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+            assert!(agent_conn.agent_capabilities().is_none());
 
-            let session_id = SessionId(Arc::from("test-session"));
-            // Send various session updates
-            client_conn
-                .session_notification(SessionNotification {
-                    session_id: session_id.clone(),
-                    update: SessionUpdate::UserMessageChunk {
-                        content: ContentBlock::Text(TextContent {
-                            annotations: None,
-                            text: "Hello from user".to_string(),
-                            meta: None,
-                        }),
-                    },
+            agent_conn
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default(),
+                    client_info: None,
                     meta: None,
                 })
                 .await
-                .expect("session_notification failed");
+                .expect("initialize failed");
+            let capabilities = agent_conn
+                .agent_capabilities()
+                .expect("missing agent capabilities");
+            assert!(!capabilities.prompt_capabilities.image);
 
-            client_conn
-                .session_notification(SessionNotification {
-                    session_id: session_id.clone(),
-                    update: SessionUpdate::AgentMessageChunk {
-                        content: ContentBlock::Text(TextContent {
-                            annotations: None,
-                            text: "Hello from agent".to_string(),
-                            meta: None,
-                        }),
-                    },
-                    meta: None,
+            let session_id = SessionId("test-session".into());
+            let request = PromptBuilder::new(session_id.clone())
+                .text("What is in this picture?")
+                .image("iVBORw0KGgo=", "image/png")
+                .build(&PromptCapabilities {
+                    image: true,
+                    ..Default::default()
                 })
-                .await
-                .expect("session_notification failed");
+                .unwrap();
 
-            tokio::task::yield_now().await;
+            let request = agent_conn.filter_prompt(request);
+            agent_conn.prompt(request).await.expect("prompt failed");
 
-            let notifications = client.session_notifications.lock().unwrap();
-            assert_eq!(notifications.len(), 2);
-            assert_eq!(notifications[0].session_id, session_id);
-            assert_eq!(notifications[1].session_id, session_id);
+            let prompts = agent.prompts_received.lock().unwrap();
+            assert_eq!(prompts.len(), 1);
+            assert_eq!(prompts[0].0, session_id);
+            assert!(matches!(
+                prompts[0].1.as_slice(),
+                [ContentBlock::Text(text)] if text.text == "What is in this picture?"
+            ));
         })
         .await;
 }
 
+fn permission_request(kind: ToolKind) -> RequestPermissionRequest {
+    RequestPermissionRequest {
+        session_id: SessionId("test-session".into()),
+        tool_call: ToolCallUpdate {
+            id: ToolCallId("call_1".into()),
+            fields: ToolCallUpdateFields {
+                kind: Some(kind),
+                ..Default::default()
+            },
+            meta: None,
+        },
+        options: vec![
+            PermissionOption {
+                id: PermissionOptionId("allow".into()),
+                name: "Allow".to_string(),
+                kind: PermissionOptionKind::AllowOnce,
+                meta: None,
+            },
+            PermissionOption {
+                id: PermissionOptionId("reject".into()),
+                name: "Reject".to_string(),
+                kind: PermissionOptionKind::RejectOnce,
+                meta: None,
+            },
+        ],
+        tool_calls: vec![],
+        turn_id: None,
+        meta: None,
+    }
+}
+
+/// Approves reads without asking the user.
+fn allow_reads(request: &RequestPermissionRequest) -> Option<PermissionOptionId> {
+    if request.tool_call.fields.kind != Some(ToolKind::Read) {
+        return None;
+    }
+    request
+        .options
+        .iter()
+        .find(|option| option.kind == PermissionOptionKind::AllowOnce)
+        .map(|option| option.id.clone())
+}
+
 #[tokio::test]
-async fn test_cancel_notification() {
+async fn test_permission_policy_auto_allow() {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async {
             let client = TestClient::new();
             let agent = TestAgent::new();
 
-            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            agent_conn.set_permission_policy(allow_reads);
+            client.add_permission_response(RequestPermissionOutcome::Cancelled);
 
-            let session_id = SessionId(Arc::from("test-session"));
-            // Send cancel notification
-            agent_conn
-                .cancel(CancelNotification {
-                    session_id: session_id.clone(),
-                    meta: None,
-                })
+            let response = client_conn
+                .request_permission(permission_request(ToolKind::Read))
                 .await
-                .expect("cancel failed");
-
-            tokio::task::yield_now().await;
+                .expect("request_permission failed");
 
-            let cancelled = agent.cancellations_received.lock().unwrap();
-            assert_eq!(cancelled.len(), 1);
-            assert_eq!(cancelled[0], session_id);
+            match response.outcome {
+                RequestPermissionOutcome::Selected { option_id } => {
+                    assert_eq!(option_id, PermissionOptionId("allow".into()));
+                }
+                RequestPermissionOutcome::Cancelled => panic!("policy was not consulted"),
+            }
+            // The user was never asked.
+            assert_eq!(client.permission_responses.lock().unwrap().len(), 1);
         })
         .await;
 }
 
 #[tokio::test]
-async fn test_concurrent_operations() {
+async fn test_permission_policy_pass_through() {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async {
             let client = TestClient::new();
             let agent = TestAgent::new();
 
-            // Add multiple file contents
-            for i in 0..5 {
-                let path = std::path::PathBuf::from(format!("/test/file{i}.txt"));
-                client.add_file_content(path, format!("Content {i}"));
-            }
-
-            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            agent_conn.set_permission_policy(allow_reads);
+            client.add_permission_response(RequestPermissionOutcome::Selected {
+                option_id: PermissionOptionId("reject".into()),
+            });
 
-            let session_id = SessionId(Arc::from("test-session"));
+            let response = client_conn
+                .request_permission(permission_request(ToolKind::Edit))
+                .await
+                .expect("request_permission failed");
 
-            // Launch multiple concurrent read operations
-            let mut read_futures = vec![];
-            for i in 0..5 {
-                let path = std::path::PathBuf::from(format!("/test/file{i}.txt"));
-                let future = client_conn.read_text_file(ReadTextFileRequest {
-                    session_id: session_id.clone(),
-                    path,
-                    line: None,
-                    limit: None,
-                    meta: None,
-                });
-                read_futures.push(future);
+            match response.outcome {
+                RequestPermissionOutcome::Selected { option_id } => {
+                    assert_eq!(option_id, PermissionOptionId("reject".into()));
+                }
+                RequestPermissionOutcome::Cancelled => panic!("user was not asked"),
             }
+            assert!(client.permission_responses.lock().unwrap().is_empty());
 
-            // Wait for all reads to complete
-            let results = futures::future::join_all(read_futures).await;
-
-            // Verify all reads succeeded
-            for (i, result) in results.into_iter().enumerate() {
-                let output = result.expect("read failed");
-                assert_eq!(output.content, format!("Content {i}"));
-            }
+            // Options the request doesn't offer are ignored.
+            agent_conn.set_permission_policy(|_: &RequestPermissionRequest| {
+                Some(PermissionOptionId("allow-always".into()))
+            });
+            let response = client_conn
+                .request_permission(permission_request(ToolKind::Read))
+                .await
+                .expect("request_permission failed");
+            assert!(matches!(
+                response.outcome,
+                RequestPermissionOutcome::Cancelled
+            ));
         })
         .await;
 }
 
 #[tokio::test]
-async fn test_full_conversation_flow() {
+async fn test_prompt_with_policy() {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async {
             let client = TestClient::new();
-            let agent = TestAgent::new();
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                StalledPrompts::default(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+            let agent_conn = std::rc::Rc::new(agent_conn);
 
-            // Set up permission to approve the tool call
-            client.add_permission_response(RequestPermissionOutcome::Selected {
-                option_id: PermissionOptionId(Arc::from("allow-once")),
+            let turn = tokio::task::spawn_local({
+                let agent_conn = agent_conn.clone();
+                async move {
+                    let prompt = PromptRequest {
+                        session_id: SessionId("test-session".into()),
+                        prompt: vec!["Fix the build".into()],
+                        turn_id: None,
+                        meta: None,
+                    };
+                    let allow_all = |request: &RequestPermissionRequest| {
+                        Some(request.options[0].id.clone())
+                    };
+                    agent_conn.prompt_with_policy(prompt, allow_all).await
+                }
             });
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
 
-            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
-            // 1. Start new session
-            let new_session_result = agent_conn
-                .new_session(NewSessionRequest {
-                    mcp_servers: vec![],
-                    cwd: std::path::PathBuf::from("/test"),
-                    meta: None,
+            let response = client_conn
+                .request_permission(permission_request(ToolKind::Edit))
+                .await
+                .expect("request_permission failed");
+            assert!(matches!(
+                response.outcome,
+                RequestPermissionOutcome::Selected { option_id } if option_id == PermissionOptionId("allow".into())
+            ));
+
+            // Other sessions are still asked.
+            client.add_permission_response(RequestPermissionOutcome::Cancelled);
+            let response = client_conn
+                .request_permission(RequestPermissionRequest {
+                    session_id: SessionId("other-session".into()),
+                    ..permission_request(ToolKind::Edit)
                 })
                 .await
-                .expect("new_session failed");
+                .expect("request_permission failed");
+            assert!(matches!(
+                response.outcome,
+                RequestPermissionOutcome::Cancelled
+            ));
 
-            let session_id = new_session_result.session_id;
+            // So is the session once the turn is over.
+            turn.abort();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            client.add_permission_response(RequestPermissionOutcome::Cancelled);
+            let response = client_conn
+                .request_permission(permission_request(ToolKind::Edit))
+                .await
+                .expect("request_permission failed");
+            assert!(matches!(
+                response.outcome,
+                RequestPermissionOutcome::Cancelled
+            ));
+            assert!(client.permission_responses.lock().unwrap().is_empty());
+        })
+        .await;
+}
 
-            // 2. Send user message
-            let user_prompt = vec![ContentBlock::Text(TextContent {
-                annotations: None,
-                text: "Please analyze the file and summarize it".to_string(),
-                meta: None,
-            })];
+#[tokio::test]
+async fn test_prompt_with_policy_concurrent_turns() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                StalledPrompts::default(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+            let agent_conn = std::rc::Rc::new(agent_conn);
+
+            // The first turn allows everything, the second rejects everything.
+            let start_turn = |turn_id: &'static str, option: usize| {
+                let agent_conn = agent_conn.clone();
+                tokio::task::spawn_local(async move {
+                    let prompt = PromptRequest::new(
+                        SessionId("test-session".into()),
+                        vec!["Fix the build".into()],
+                    )
+                    .with_turn_id(TurnId(turn_id.into()));
+                    let policy = move |request: &RequestPermissionRequest| {
+                        Some(request.options[option].id.clone())
+                    };
+                    agent_conn.prompt_with_policy(prompt, policy).await
+                })
+            };
+            let first = start_turn("turn_1", 0);
+            let second = start_turn("turn_2", 1);
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            let ask = |turn_id: &'static str| {
+                client_conn.request_permission(
+                    permission_request(ToolKind::Edit).for_turn(TurnId(turn_id.into())),
+                )
+            };
+            let selected = |response: RequestPermissionResponse| match response.outcome {
+                RequestPermissionOutcome::Selected { option_id } => option_id,
+                outcome => panic!("unexpected outcome: {outcome:?}"),
+            };
+            assert_eq!(
+                selected(ask("turn_1").await.unwrap()),
+                PermissionOptionId("allow".into())
+            );
+            assert_eq!(
+                selected(ask("turn_2").await.unwrap()),
+                PermissionOptionId("reject".into())
+            );
+
+            // The first turn keeps its policy once the second one ends.
+            second.abort();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert_eq!(
+                selected(ask("turn_1").await.unwrap()),
+                PermissionOptionId("allow".into())
+            );
+            client.add_permission_response(RequestPermissionOutcome::Cancelled);
+            assert!(matches!(
+                ask("turn_2").await.unwrap().outcome,
+                RequestPermissionOutcome::Cancelled
+            ));
+            first.abort();
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_basic_session_creation() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
 
             agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed");
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_tcp_loopback() {
+    use tokio_util::compat::{TokioAsyncReadCompatExt as _, TokioAsyncWriteCompatExt as _};
+
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+            let addr = listener.local_addr().unwrap();
+
+            let (agent_stream, (client_stream, _)) =
+                tokio::try_join!(tokio::net::TcpStream::connect(addr), listener.accept()).unwrap();
+            let (agent_read, agent_write) = agent_stream.into_split();
+            let (client_read, client_write) = client_stream.into_split();
+
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                agent_write.compat_write(),
+                agent_read.compat(),
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (_client_conn, client_io_task) = AgentSideConnection::new(
+                agent.clone(),
+                client_write.compat_write(),
+                client_read.compat(),
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+
+            let response = agent_conn
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default(),
+                    client_info: None,
+                    meta: None,
+                })
+                .await
+                .expect("initialize failed");
+            assert_eq!(response.protocol_version, VERSION);
+
+            let session = agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed");
+            let response = agent_conn
                 .prompt(PromptRequest {
-                    session_id: session_id.clone(),
-                    prompt: user_prompt,
+                    session_id: session.session_id.clone(),
+                    prompt: vec!["Hello over TCP".into()],
+                    turn_id: None,
                     meta: None,
                 })
                 .await
                 .expect("prompt failed");
+            assert_eq!(response.stop_reason, StopReason::EndTurn);
+            assert_eq!(agent.prompts_received.lock().unwrap().len(), 1);
+        })
+        .await;
+}
 
-            // 3. Agent starts responding
+#[tokio::test]
+async fn test_bidirectional_file_operations() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            // Add test file content
+            let test_path = std::path::PathBuf::from("/test/file.txt");
+            client.add_file_content(test_path.clone(), "Hello, World!".to_string());
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            // Test reading a file
+            let session_id = SessionId(Arc::from("test-session"));
+            let read_result = client_conn
+                .read_text_file(ReadTextFileRequest {
+                    session_id: session_id.clone(),
+                    path: test_path.clone(),
+                    line: None,
+                    limit: None,
+                    meta: None,
+                })
+                .await
+                .expect("read_text_file failed");
+
+            assert_eq!(read_result.content, "Hello, World!");
+
+            // Test writing a file
+            let write_result = client_conn
+                .write_text_file(WriteTextFileRequest {
+                    session_id: session_id.clone(),
+                    path: test_path.clone(),
+                    content: "Updated content".to_string(),
+                    append: false,
+                    eof: false,
+                    meta: None,
+                })
+                .await;
+
+            assert!(write_result.is_ok());
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_write_text_file_chunked() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            // "é" takes 2 bytes, so 4-byte chunks can't always end on a
+            // character boundary.
+            let content = "0123é5678é\nabcdefghijklmnop".repeat(10);
+            client_conn
+                .write_text_file_chunked(
+                    SessionId(Arc::from("test-session")),
+                    std::path::PathBuf::from("/test/large.txt"),
+                    futures::io::Cursor::new(content.clone()),
+                    4,
+                )
+                .await
+                .expect("write_text_file_chunked failed");
+
+            let written = client.written_files.lock().unwrap();
+            assert!(written.len() > 1);
+            assert!(written.iter().all(|chunk| chunk.content.len() <= 4));
+            assert_eq!(
+                written
+                    .iter()
+                    .map(|chunk| chunk.content.as_str())
+                    .collect::<String>(),
+                content
+            );
+            assert!(!written[0].append);
+            assert!(written[1..].iter().all(|chunk| chunk.append));
+            let eofs: Vec<_> = written.iter().map(|chunk| chunk.eof).collect();
+            assert_eq!(eofs.iter().filter(|eof| **eof).count(), 1);
+            assert!(eofs.last().unwrap());
+        })
+        .await;
+
+    // Empty files are still written, in a single request.
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            client_conn
+                .write_text_file_chunked(
+                    SessionId(Arc::from("test-session")),
+                    std::path::PathBuf::from("/test/empty.txt"),
+                    futures::io::Cursor::new(Vec::new()),
+                    4,
+                )
+                .await
+                .expect("write_text_file_chunked failed");
+
+            let written = client.written_files.lock().unwrap();
+            assert_eq!(written.len(), 1);
+            assert_eq!(written[0].content, "");
+            assert!(!written[0].append);
+            assert!(written[0].eof);
+        })
+        .await;
+
+    // Chunks smaller than a character still hold whole characters.
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let error = client_conn
+                .write_text_file_chunked(
+                    SessionId(Arc::from("test-session")),
+                    std::path::PathBuf::from("/test/small.txt"),
+                    futures::io::Cursor::new("ab"),
+                    0,
+                )
+                .await
+                .expect_err("chunk_size 0 should be rejected");
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+            assert!(client.written_files.lock().unwrap().is_empty());
+
+            client_conn
+                .write_text_file_chunked(
+                    SessionId(Arc::from("test-session")),
+                    std::path::PathBuf::from("/test/small.txt"),
+                    futures::io::Cursor::new("aé€b"),
+                    1,
+                )
+                .await
+                .expect("write_text_file_chunked failed");
+
+            let written = client.written_files.lock().unwrap();
+            let chunks: Vec<_> = written.iter().map(|chunk| chunk.content.as_str()).collect();
+            assert_eq!(chunks, vec!["a", "é", "€", "b"]);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_enforce_absolute_paths() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let request = ReadTextFileRequest {
+                session_id: SessionId(Arc::from("test-session")),
+                path: std::path::PathBuf::from("relative/file.txt"),
+                line: None,
+                limit: None,
+                meta: None,
+            };
+
+            // Lenient by default
+            client_conn
+                .read_text_file(request.clone())
+                .await
+                .expect("read_text_file failed");
+
+            agent_conn.set_enforce_absolute_paths(true);
+            let error = client_conn
+                .read_text_file(request)
+                .await
+                .expect_err("relative path should be rejected");
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+
+            let error = client_conn
+                .write_text_file(WriteTextFileRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    path: std::path::PathBuf::from("relative/file.txt"),
+                    content: "content".to_string(),
+                    append: false,
+                    eof: false,
+                    meta: None,
+                })
+                .await
+                .expect_err("relative path should be rejected");
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+            assert!(client.written_files.lock().unwrap().is_empty());
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_session_notifications() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let session_id = SessionId(Arc::from("test-session"));
+            // Send various session updates
             client_conn
                 .session_notification(SessionNotification {
                     session_id: session_id.clone(),
-                    update: SessionUpdate::AgentMessageChunk {
+                    update: SessionUpdate::UserMessageChunk {
                         content: ContentBlock::Text(TextContent {
                             annotations: None,
-                            text: "I'll analyze the file for you. ".to_string(),
+                            text: "Hello from user".to_string(),
                             meta: None,
                         }),
                     },
+                    turn_id: None,
                     meta: None,
                 })
                 .await
                 .expect("session_notification failed");
 
-            // 4. Agent creates a tool call
-            let tool_call_id = ToolCallId(Arc::from("read-file-001"));
             client_conn
                 .session_notification(SessionNotification {
                     session_id: session_id.clone(),
-                    update: SessionUpdate::ToolCall(ToolCall {
-                        id: tool_call_id.clone(),
-                        title: "Reading file".to_string(),
-                        kind: ToolKind::Read,
-                        status: ToolCallStatus::Pending,
-                        content: vec![],
-                        locations: vec![ToolCallLocation {
-                            path: std::path::PathBuf::from("/test/data.txt"),
-                            line: None,
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: ContentBlock::Text(TextContent {
+                            annotations: None,
+                            text: "Hello from agent".to_string(),
                             meta: None,
-                        }],
-                        raw_input: None,
-                        raw_output: None,
-                        meta: None,
-                    }),
+                        }),
+                    },
+                    turn_id: None,
                     meta: None,
                 })
                 .await
                 .expect("session_notification failed");
 
-            // 5. Agent requests permission for the tool call
-            let permission_result = client_conn
-                .request_permission(RequestPermissionRequest {
-                    session_id: session_id.clone(),
-                    tool_call: ToolCallUpdate {
-                        id: tool_call_id.clone(),
-                        fields: ToolCallUpdateFields {
-                            title: Some("Read /test/data.txt".to_string()),
-                            locations: Some(vec![ToolCallLocation {
-                                path: std::path::PathBuf::from("/test/data.txt"),
-                                line: None,
-                                meta: None,
-                            }]),
-                            ..Default::default()
-                        },
-                        meta: None,
-                    },
-                    options: vec![
-                        PermissionOption {
-                            id: PermissionOptionId(Arc::from("allow-once")),
-                            name: "Allow once".to_string(),
-                            kind: PermissionOptionKind::AllowOnce,
-                            meta: None,
-                        },
-                        PermissionOption {
-                            id: PermissionOptionId(Arc::from("reject-once")),
-                            name: "Reject".to_string(),
-                            kind: PermissionOptionKind::RejectOnce,
-                            meta: None,
-                        },
-                    ],
-                    meta: None,
+            tokio::task::yield_now().await;
+
+            let notifications = client.session_notifications.lock().unwrap();
+            assert_eq!(notifications.len(), 2);
+            assert_eq!(notifications[0].session_id, session_id);
+            assert_eq!(notifications[1].session_id, session_id);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_session_update_batch() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let session_id = SessionId(Arc::from("test-session"));
+            client_conn
+                .session_update_batch(
+                    session_id.clone(),
+                    ["one", "two", "three"].map(|text| SessionUpdate::AgentMessageChunk {
+                        content: text.into(),
+                    }),
+                )
+                .await
+                .expect("session_update_batch failed");
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            let notifications = client.session_notifications.lock().unwrap();
+            let texts = notifications
+                .iter()
+                .map(|notification| {
+                    assert_eq!(notification.session_id, session_id);
+                    match &notification.update {
+                        SessionUpdate::AgentMessageChunk {
+                            content: ContentBlock::Text(text),
+                        } => text.text.clone(),
+                        update => panic!("unexpected update: {update:?}"),
+                    }
+                })
+                .collect::<Vec<_>>();
+            assert_eq!(texts, vec!["one", "two", "three"]);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_sequence_numbers() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let first = SessionId(Arc::from("first-session"));
+            let second = SessionId(Arc::from("second-session"));
+            let notify = |session_id: &SessionId, meta: Option<serde_json::Value>| {
+                client_conn.session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: "chunk".into(),
+                    },
+                    turn_id: None,
+                    meta,
                 })
+            };
+
+            notify(&first, None).await.unwrap();
+            client_conn.set_sequence_numbers(true);
+            notify(&first, None).await.unwrap();
+            notify(&first, Some(json!({ "source": "test" })))
                 .await
-                .expect("request_permission failed");
+                .unwrap();
+            notify(&second, None).await.unwrap();
+            client_conn
+                .session_update_batch(
+                    first.clone(),
+                    [SessionUpdate::AgentMessageChunk {
+                        content: "chunk".into(),
+                    }],
+                )
+                .await
+                .unwrap();
+            notify(&second, None).await.unwrap();
+            // Turning numbering off and on again starts every session over.
+            client_conn.set_sequence_numbers(false);
+            notify(&second, None).await.unwrap();
+            client_conn.set_sequence_numbers(true);
+            notify(&second, None).await.unwrap();
 
-            // Verify permission was granted
-            match permission_result.outcome {
-                RequestPermissionOutcome::Selected { option_id } => {
-                    assert_eq!(option_id.0.as_ref(), "allow-once");
-                }
-                RequestPermissionOutcome::Cancelled => panic!("Expected permission to be granted"),
-            }
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
 
-            // 6. Update tool call status
+            let notifications = client.session_notifications.lock().unwrap();
+            let numbers = notifications
+                .iter()
+                .map(|notification| {
+                    (
+                        notification.session_id.0.as_ref(),
+                        notification.sequence_number(),
+                    )
+                })
+                .collect::<Vec<_>>();
+            assert_eq!(
+                numbers,
+                vec![
+                    ("first-session", None),
+                    ("first-session", Some(1)),
+                    ("first-session", Some(2)),
+                    ("second-session", Some(1)),
+                    ("first-session", Some(3)),
+                    ("second-session", Some(2)),
+                    ("second-session", None),
+                    ("second-session", Some(1)),
+                ]
+            );
+            assert_eq!(
+                notifications[2].meta,
+                Some(json!({ "source": "test", "seq": 2 }))
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_greet_and_announce_plan() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let session_id = SessionId(Arc::from("test-session"));
+            let entry = PlanEntry {
+                id: None,
+                content: "Read the codebase".to_string(),
+                priority: PlanEntryPriority::High,
+                status: PlanEntryStatus::Pending,
+                meta: None,
+            };
             client_conn
-                .session_notification(SessionNotification {
-                    session_id: session_id.clone(),
-                    update: SessionUpdate::ToolCallUpdate(ToolCallUpdate {
-                        id: tool_call_id.clone(),
-                        fields: ToolCallUpdateFields {
-                            status: Some(ToolCallStatus::InProgress),
-                            ..Default::default()
-                        },
-                        meta: None,
+                .greet(session_id.clone(), "Hi! How can I help?")
+                .await
+                .expect("greet failed");
+            client_conn
+                .announce_plan(session_id.clone(), [entry])
+                .await
+                .expect("announce_plan failed");
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            let notifications = client.session_notifications.lock().unwrap();
+            let updates = notifications
+                .iter()
+                .map(|notification| {
+                    assert_eq!(notification.session_id, session_id);
+                    serde_json::to_value(&notification.update).unwrap()
+                })
+                .collect::<Vec<_>>();
+            assert_eq!(
+                updates,
+                vec![
+                    json!({
+                        "sessionUpdate": "agent_message_chunk",
+                        "content": { "type": "text", "text": "Hi! How can I help?" }
                     }),
+                    json!({
+                        "sessionUpdate": "plan",
+                        "entries": [{
+                            "content": "Read the codebase",
+                            "priority": "high",
+                            "status": "pending"
+                        }]
+                    }),
+                ]
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_session_notification_ordering() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let client_conn = std::rc::Rc::new(client_conn);
+            let submitted = Arc::new(Mutex::new(Vec::new()));
+
+            let session_id = SessionId(Arc::from("test-session"));
+            let tasks = (0..3)
+                .map(|task| {
+                    let client_conn = client_conn.clone();
+                    let submitted = submitted.clone();
+                    let session_id = session_id.clone();
+                    tokio::task::spawn_local(async move {
+                        for chunk in 0..5 {
+                            let text = format!("{task}-{chunk}");
+                            submitted.lock().unwrap().push(text.clone());
+                            client_conn
+                                .session_notification(SessionNotification {
+                                    session_id: session_id.clone(),
+                                    update: SessionUpdate::AgentMessageChunk {
+                                        content: text.into(),
+                                    },
+                                    turn_id: None,
+                                    meta: None,
+                                })
+                                .await
+                                .expect("session_notification failed");
+                            tokio::task::yield_now().await;
+                        }
+                    })
+                })
+                .collect::<Vec<_>>();
+            for task in tasks {
+                task.await.unwrap();
+            }
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            let received = client
+                .session_notifications
+                .lock()
+                .unwrap()
+                .iter()
+                .map(|notification| match &notification.update {
+                    SessionUpdate::AgentMessageChunk {
+                        content: ContentBlock::Text(text),
+                    } => text.text.clone(),
+                    update => panic!("unexpected update: {update:?}"),
+                })
+                .collect::<Vec<_>>();
+            assert_eq!(received, *submitted.lock().unwrap());
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_cancel_notification() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+
+            let session_id = SessionId(Arc::from("test-session"));
+            // Send cancel notification
+            agent_conn
+                .cancel(CancelNotification {
+                    session_id: session_id.clone(),
+                    reason: None,
+                    turn_id: None,
                     meta: None,
                 })
                 .await
-                .expect("session_notification failed");
+                .expect("cancel failed");
 
-            // 7. Tool call completes with content
-            client_conn
-                .session_notification(SessionNotification {
-                    session_id: session_id.clone(),
-                    update: SessionUpdate::ToolCallUpdate(ToolCallUpdate {
-                        id: tool_call_id.clone(),
-                        fields: ToolCallUpdateFields {
-                            status: Some(ToolCallStatus::Completed),
-                            content: Some(vec![ToolCallContent::Content {
-                                content: ContentBlock::Text(TextContent {
-                                    annotations: None,
-                                    text: "File contents: Lorem ipsum dolor sit amet".to_string(),
-                                    meta: None,
-                                }),
-                            }]),
-                            ..Default::default()
-                        },
+            tokio::task::yield_now().await;
+
+            let cancelled = agent.cancellations_received.lock().unwrap();
+            assert_eq!(cancelled.len(), 1);
+            assert_eq!(cancelled[0], session_id);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_cancel_notification_with_reason() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+
+            let session_id = SessionId(Arc::from("test-session"));
+            agent_conn
+                .cancel(CancelNotification::with_reason(
+                    session_id.clone(),
+                    CancelReason::UserRequested,
+                ))
+                .await
+                .expect("cancel failed");
+
+            tokio::task::yield_now().await;
+
+            assert_eq!(*agent.cancellations_received.lock().unwrap(), [session_id]);
+            assert_eq!(
+                *agent.cancel_reasons_received.lock().unwrap(),
+                [Some(CancelReason::UserRequested)]
+            );
+        })
+        .await;
+}
+
+#[cfg(feature = "unstable")]
+#[tokio::test]
+async fn test_cancel_tool_call() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+
+            agent_conn
+                .cancel_tool_call(CancelToolCallRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    tool_call_id: ToolCallId(Arc::from("call_1")),
+                    meta: None,
+                })
+                .await
+                .expect("cancel_tool_call failed");
+
+            let cancelled = agent.tool_call_cancellations_received.lock().unwrap();
+            assert_eq!(*cancelled, vec![ToolCallId(Arc::from("call_1"))]);
+        })
+        .await;
+}
+
+#[cfg(feature = "unstable")]
+#[tokio::test]
+async fn test_terminal_output_update() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+
+            for output in ["Compiling acp\n", "Finished dev profile\n"] {
+                agent_conn
+                    .terminal_output_update(TerminalOutputUpdateNotification {
+                        session_id: SessionId(Arc::from("test-session")),
+                        terminal_id: TerminalId(Arc::from("term_1")),
+                        output: output.to_string(),
                         meta: None,
-                    }),
+                    })
+                    .await
+                    .expect("terminal_output_update failed");
+            }
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            let output = agent.terminal_output_received.lock().unwrap();
+            assert_eq!(*output, "Compiling acp\nFinished dev profile\n");
+        })
+        .await;
+}
+
+#[cfg(feature = "unstable")]
+#[tokio::test]
+async fn test_list_sessions() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+
+            let response = agent_conn
+                .list_sessions(ListSessionsRequest::default())
+                .await
+                .expect("list_sessions failed");
+            assert!(response.sessions.is_empty());
+
+            let session = agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
                     meta: None,
                 })
                 .await
-                .expect("session_notification failed");
+                .expect("new_session failed");
 
-            // 8. Agent sends more text after tool completion
-            client_conn
-                .session_notification(SessionNotification {
-                    session_id: session_id.clone(),
-                    update: SessionUpdate::AgentMessageChunk {
+            let response = agent_conn
+                .list_sessions(ListSessionsRequest::default())
+                .await
+                .expect("list_sessions failed");
+            assert_eq!(response.sessions, vec![session.session_id]);
+        })
+        .await;
+}
+
+#[cfg(feature = "unstable")]
+#[tokio::test]
+async fn test_session_flags() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+            let session_id = SessionId(Arc::from("test-session"));
+            let list_flags = || {
+                agent_conn.list_session_flags(ListSessionFlagsRequest {
+                    session_id: session_id.clone(),
+                    meta: None,
+                })
+            };
+
+            let response = list_flags().await.expect("list_session_flags failed");
+            assert_eq!(response.flags.len(), 1);
+            assert_eq!(response.flags[0].name, "yolo");
+            assert!(!response.flags[0].enabled);
+
+            agent_conn
+                .set_session_flag(SetSessionFlagRequest {
+                    session_id: session_id.clone(),
+                    name: "yolo".into(),
+                    enabled: true,
+                    meta: None,
+                })
+                .await
+                .expect("set_session_flag failed");
+            let response = list_flags().await.expect("list_session_flags failed");
+            assert!(response.flags[0].enabled);
+
+            let error = agent_conn
+                .set_session_flag(SetSessionFlagRequest {
+                    session_id: session_id.clone(),
+                    name: "corgi".into(),
+                    enabled: true,
+                    meta: None,
+                })
+                .await
+                .expect_err("unknown flags are rejected");
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+        })
+        .await;
+}
+
+#[cfg(feature = "unstable")]
+#[tokio::test]
+async fn test_read_resource() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let response = client_conn
+                .read_resource(ReadResourceRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    uri: "file:///notes.md".to_string(),
+                    meta: None,
+                })
+                .await
+                .expect("read_resource failed");
+            assert_eq!(
+                serde_json::to_value(&response).unwrap(),
+                json!({
+                    "resource": {
+                        "mimeType": "text/markdown",
+                        "text": "# Notes",
+                        "uri": "file:///notes.md"
+                    }
+                })
+            );
+
+            let error = client_conn
+                .read_resource(ReadResourceRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    uri: "file:///missing.md".to_string(),
+                    meta: None,
+                })
+                .await
+                .expect_err("missing resource should fail");
+            assert_eq!(error.code, ErrorCode::RESOURCE_NOT_FOUND.code);
+        })
+        .await;
+}
+
+#[cfg(feature = "unstable")]
+#[tokio::test]
+async fn test_open() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let mut stream = client_conn.subscribe();
+
+            let response = client_conn
+                .open(OpenRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    uri: "file:///project/src/main.rs".to_string(),
+                    line: Some(42),
+                    column: Some(5),
+                    meta: None,
+                })
+                .await
+                .expect("open failed");
+            assert_eq!(serde_json::to_value(&response).unwrap(), json!({}));
+
+            let message = stream.recv().await.unwrap();
+            match message.message {
+                StreamMessageContent::Request { method, params, .. } => {
+                    assert_eq!(&*method, "client/open");
+                    assert_eq!(
+                        params,
+                        Some(json!({
+                            "sessionId": "test-session",
+                            "uri": "file:///project/src/main.rs",
+                            "line": 42,
+                            "column": 5
+                        }))
+                    );
+                }
+                _ => panic!("expected the client/open request first"),
+            }
+
+            let error = client_conn
+                .open(OpenRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    uri: "file:///project/src/main.rs".to_string(),
+                    line: None,
+                    column: Some(5),
+                    meta: None,
+                })
+                .await
+                .expect_err("column without a line should fail");
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+        })
+        .await;
+}
+
+#[cfg(feature = "unstable")]
+#[tokio::test]
+async fn test_request_input() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let mut stream = client_conn.subscribe();
+
+            let response = client_conn
+                .request_input(RequestInputRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    prompt: "Which button should I restyle?".to_string(),
+                    meta: None,
+                })
+                .await
+                .expect("request_input failed");
+            assert_eq!(
+                response.outcome,
+                RequestInputOutcome::Submitted {
+                    text: "the blue one".to_string()
+                }
+            );
+
+            match stream.recv().await.unwrap().message {
+                StreamMessageContent::Request { method, params, .. } => {
+                    assert_eq!(&*method, "session/request_input");
+                    assert_eq!(
+                        params,
+                        Some(json!({
+                            "sessionId": "test-session",
+                            "prompt": "Which button should I restyle?"
+                        }))
+                    );
+                }
+                _ => panic!("expected the session/request_input request first"),
+            }
+            match stream.recv().await.unwrap().message {
+                StreamMessageContent::Response { result, .. } => {
+                    assert_eq!(
+                        result.unwrap(),
+                        Some(json!({
+                            "outcome": { "outcome": "submitted", "text": "the blue one" }
+                        }))
+                    );
+                }
+                _ => panic!("expected the session/request_input response"),
+            }
+
+            let response = client_conn
+                .request_input(RequestInputRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    prompt: String::new(),
+                    meta: None,
+                })
+                .await
+                .expect("request_input failed");
+            assert_eq!(
+                serde_json::to_value(&response).unwrap(),
+                json!({ "outcome": { "outcome": "cancelled" } })
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_transcript_record_and_replay() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let session_id = SessionId(Arc::from("test-session"));
+            let recorded_client = TestClient::new();
+            recorded_client.add_permission_response(RequestPermissionOutcome::Selected {
+                option_id: PermissionOptionId("allow".into()),
+            });
+            let recorder = TranscriptRecorder::new(recorded_client.clone());
+
+            recorder
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: "Reading the file".into(),
+                    },
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .unwrap();
+            recorder
+                .request_permission(permission_request(ToolKind::Read))
+                .await
+                .unwrap();
+            recorder
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: "Done".into(),
+                    },
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .unwrap();
+            assert_eq!(
+                recorded_client.session_notifications.lock().unwrap().len(),
+                2
+            );
+
+            let json = serde_json::to_value(recorder.transcript()).unwrap();
+            assert_eq!(json[0]["type"], "session_notification");
+            assert_eq!(json[1]["type"], "request_permission");
+            assert_eq!(json[1]["response"]["outcome"]["optionId"], "allow");
+            let transcript: Vec<TranscriptEntry> = serde_json::from_value(json).unwrap();
+
+            // Replay against a fresh client over a real connection.
+            let client = TestClient::new();
+            client.add_permission_response(RequestPermissionOutcome::Selected {
+                option_id: PermissionOptionId("allow".into()),
+            });
+            let agent = TestAgent::new();
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let player = TranscriptPlayer::new(transcript);
+            player.replay(&client_conn).await.expect("replay failed");
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert_eq!(client.session_notifications.lock().unwrap().len(), 2);
+
+            // A client that answers differently makes the replay fail.
+            client.add_permission_response(RequestPermissionOutcome::Cancelled);
+            player
+                .replay(&client_conn)
+                .await
+                .expect_err("diverging permission outcome should fail");
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_prompt_queue_ordering() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+            let queue = PromptQueue::new(std::rc::Rc::new(agent_conn));
+            let session_id = SessionId("test-session".into());
+            let prompt = |text: &str| PromptRequest {
+                session_id: session_id.clone(),
+                prompt: vec![text.into()],
+                turn_id: None,
+                meta: None,
+            };
+
+            let first = queue.prompt(prompt("one"));
+            let second = queue.prompt(prompt("two"));
+            let third = queue.prompt(prompt("three"));
+            assert_eq!(queue.depth(&session_id), 3);
+            assert_eq!(queue.depth(&SessionId("other-session".into())), 0);
+
+            // Poll in reverse; the queue still sends them in the order they were queued.
+            let (third, second, first) = futures::join!(third, second, first);
+            for response in [first, second, third] {
+                assert!(matches!(response.unwrap().stop_reason, StopReason::EndTurn));
+            }
+            assert_eq!(queue.depth(&session_id), 0);
+
+            let prompts = agent.prompts_received.lock().unwrap();
+            let texts = prompts
+                .iter()
+                .map(|(_, prompt)| match &prompt[0] {
+                    ContentBlock::Text(text) => text.text.clone(),
+                    _ => panic!("expected text"),
+                })
+                .collect::<Vec<_>>();
+            assert_eq!(texts, ["one", "two", "three"]);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_wait_session_drained() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let session_id = SessionId("test-session".into());
+
+            // Until the agent advertises `drainUpdates`, nothing would ever resolve.
+            let err = agent_conn
+                .wait_session_drained(&session_id)
+                .await
+                .unwrap_err();
+            assert_eq!(err.code, ErrorCode::CAPABILITY_NOT_SUPPORTED.code);
+
+            agent_conn
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default(),
+                    client_info: None,
+                    meta: None,
+                })
+                .await
+                .expect("initialize failed");
+            agent_conn
+                .prompt(PromptRequest {
+                    session_id: session_id.clone(),
+                    prompt: vec!["Hello".into()],
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .unwrap();
+
+            let drained = agent_conn.wait_session_drained(&session_id);
+            futures::pin_mut!(drained);
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: "late".into(),
+                    },
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert!(futures::poll!(drained.as_mut()).is_pending());
+
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::Drained,
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .unwrap();
+            tokio::time::timeout(std::time::Duration::from_secs(1), drained)
+                .await
+                .expect("session was not drained")
+                .unwrap();
+
+            // Already drained sessions resolve right away, until the next prompt.
+            assert!(
+                futures::poll!(Box::pin(agent_conn.wait_session_drained(&session_id))).is_ready()
+            );
+            agent_conn
+                .prompt(PromptRequest {
+                    session_id: session_id.clone(),
+                    prompt: vec!["Again".into()],
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .unwrap();
+            assert!(
+                futures::poll!(Box::pin(agent_conn.wait_session_drained(&session_id))).is_pending()
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_late_drained_update_from_earlier_turn() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            agent_conn
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default(),
+                    client_info: None,
+                    meta: None,
+                })
+                .await
+                .expect("initialize failed");
+
+            let session_id = SessionId("test-session".into());
+            for turn in ["first", "second"] {
+                agent_conn
+                    .prompt(PromptRequest {
+                        session_id: session_id.clone(),
+                        prompt: vec![turn.into()],
+                        turn_id: Some(TurnId(turn.into())),
+                        meta: None,
+                    })
+                    .await
+                    .unwrap();
+            }
+
+            let drained = agent_conn.wait_session_drained(&session_id);
+            futures::pin_mut!(drained);
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::Drained,
+                    turn_id: Some(TurnId("first".into())),
+                    meta: None,
+                })
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert!(futures::poll!(drained.as_mut()).is_pending());
+
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::Drained,
+                    turn_id: Some(TurnId("second".into())),
+                    meta: None,
+                })
+                .await
+                .unwrap();
+            tokio::time::timeout(std::time::Duration::from_secs(1), drained)
+                .await
+                .expect("session was not drained")
+                .unwrap();
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_concurrent_operations() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            // Add multiple file contents
+            for i in 0..5 {
+                let path = std::path::PathBuf::from(format!("/test/file{i}.txt"));
+                client.add_file_content(path, format!("Content {i}"));
+            }
+
+            let (_agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let session_id = SessionId(Arc::from("test-session"));
+
+            // Launch multiple concurrent read operations
+            let mut read_futures = vec![];
+            for i in 0..5 {
+                let path = std::path::PathBuf::from(format!("/test/file{i}.txt"));
+                let future = client_conn.read_text_file(ReadTextFileRequest {
+                    session_id: session_id.clone(),
+                    path,
+                    line: None,
+                    limit: None,
+                    meta: None,
+                });
+                read_futures.push(future);
+            }
+
+            // Wait for all reads to complete
+            let results = futures::future::join_all(read_futures).await;
+
+            // Verify all reads succeeded
+            for (i, result) in results.into_iter().enumerate() {
+                let output = result.expect("read failed");
+                assert_eq!(output.content, format!("Content {i}"));
+            }
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_full_conversation_flow() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            // Set up permission to approve the tool call
+            client.add_permission_response(RequestPermissionOutcome::Selected {
+                option_id: PermissionOptionId(Arc::from("allow-once")),
+            });
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            // 1. Start new session
+            let new_session_result = agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed");
+
+            let session_id = new_session_result.session_id;
+
+            // 2. Send user message
+            let user_prompt = vec![ContentBlock::Text(TextContent {
+                annotations: None,
+                text: "Please analyze the file and summarize it".to_string(),
+                meta: None,
+            })];
+
+            agent_conn
+                .prompt(PromptRequest {
+                    session_id: session_id.clone(),
+                    prompt: user_prompt,
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("prompt failed");
+
+            // 3. Agent starts responding
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: ContentBlock::Text(TextContent {
+                            annotations: None,
+                            text: "I'll analyze the file for you. ".to_string(),
+                            meta: None,
+                        }),
+                    },
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("session_notification failed");
+
+            // 4. Agent creates a tool call
+            let tool_call_id = ToolCallId(Arc::from("read-file-001"));
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::ToolCall(ToolCall {
+                        id: tool_call_id.clone(),
+                        title: "Reading file".to_string(),
+                        kind: ToolKind::Read,
+                        status: ToolCallStatus::Pending,
+                        content: vec![],
+                        locations: vec![ToolCallLocation {
+                            path: std::path::PathBuf::from("/test/data.txt"),
+                            line: None,
+                            meta: None,
+                        }],
+                        raw_input: None,
+                        raw_output: None,
+                        meta: None,
+                    }),
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("session_notification failed");
+
+            // 5. Agent requests permission for the tool call
+            let permission_result = client_conn
+                .request_permission(RequestPermissionRequest {
+                    session_id: session_id.clone(),
+                    tool_call: ToolCallUpdate {
+                        id: tool_call_id.clone(),
+                        fields: ToolCallUpdateFields {
+                            title: Some("Read /test/data.txt".to_string()),
+                            locations: Some(vec![ToolCallLocation {
+                                path: std::path::PathBuf::from("/test/data.txt"),
+                                line: None,
+                                meta: None,
+                            }]),
+                            ..Default::default()
+                        },
+                        meta: None,
+                    },
+                    options: vec![
+                        PermissionOption {
+                            id: PermissionOptionId(Arc::from("allow-once")),
+                            name: "Allow once".to_string(),
+                            kind: PermissionOptionKind::AllowOnce,
+                            meta: None,
+                        },
+                        PermissionOption {
+                            id: PermissionOptionId(Arc::from("reject-once")),
+                            name: "Reject".to_string(),
+                            kind: PermissionOptionKind::RejectOnce,
+                            meta: None,
+                        },
+                    ],
+                    tool_calls: vec![],
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("request_permission failed");
+
+            // Verify permission was granted
+            match permission_result.outcome {
+                RequestPermissionOutcome::Selected { option_id } => {
+                    assert_eq!(option_id.0.as_ref(), "allow-once");
+                }
+                RequestPermissionOutcome::Cancelled => panic!("Expected permission to be granted"),
+            }
+
+            // 6. Update tool call status
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::ToolCallUpdate(ToolCallUpdate {
+                        id: tool_call_id.clone(),
+                        fields: ToolCallUpdateFields {
+                            status: Some(ToolCallStatus::InProgress),
+                            ..Default::default()
+                        },
+                        meta: None,
+                    }),
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("session_notification failed");
+
+            // 7. Tool call completes with content
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::ToolCallUpdate(ToolCallUpdate {
+                        id: tool_call_id.clone(),
+                        fields: ToolCallUpdateFields {
+                            status: Some(ToolCallStatus::Completed),
+                            content: Some(vec![ToolCallContent::Content {
+                                content: ContentBlock::Text(TextContent {
+                                    annotations: None,
+                                    text: "File contents: Lorem ipsum dolor sit amet".to_string(),
+                                    meta: None,
+                                }),
+                            }]),
+                            ..Default::default()
+                        },
+                        meta: None,
+                    }),
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("session_notification failed");
+
+            // 8. Agent sends more text after tool completion
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: session_id.clone(),
+                    update: SessionUpdate::AgentMessageChunk {
                         content: ContentBlock::Text(TextContent {
                             annotations: None,
                             text: "Based on the file contents, here's my summary: The file contains placeholder text commonly used in the printing industry.".to_string(),
                             meta: None,
-                        }),
-                    },
+                        }),
+                    },
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("session_notification failed");
+
+            for _ in 0..10 {
+                tokio::task::yield_now().await;
+            }
+
+            // Verify we received all the updates
+            let updates = client.session_notifications.lock().unwrap();
+            assert!(updates.len() >= 5); // At least 5 updates sent
+
+            // Verify the sequence of updates
+            let mut found_agent_message = false;
+            let mut found_tool_call = false;
+            let mut found_tool_update = false;
+            let mut found_final_message = false;
+
+            for notification in updates.iter() {
+                match &notification.update {
+                    SessionUpdate::AgentMessageChunk { content : ContentBlock::Text(text)} => {
+                        if text.text.contains("I'll analyze") {
+                            found_agent_message = true;
+                        } else if text.text.contains("Based on the file") {
+                            found_final_message = true;
+                        }
+                    }
+                    SessionUpdate::ToolCall(_) => {
+                        found_tool_call = true;
+                    }
+                    SessionUpdate::ToolCallUpdate(update) => {
+                        if let Some(ToolCallStatus::Completed) = update.fields.status {
+                            found_tool_update = true;
+                        }
+                    }
+                    _ => {}
+                }
+            }
+
+            assert!(found_agent_message, "Should have initial agent message");
+            assert!(found_tool_call, "Should have tool call");
+            assert!(found_tool_update, "Should have tool call completion");
+            assert!(found_final_message, "Should have final agent message");
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_notification_wire_format() {
+    use crate::{
+        AgentNotification, AgentSide, CancelNotification, ClientNotification, ClientSide,
+        ContentBlock, SessionNotification, SessionUpdate, TextContent,
+        rpc::{JsonRpcMessage, OutgoingMessage},
+    };
+    use serde_json::{Value, json};
+
+    // Test client -> agent notification wire format
+    let outgoing_msg =
+        JsonRpcMessage::wrap(OutgoingMessage::<ClientSide, AgentSide>::Notification {
+            method: "cancel".into(),
+            params: Some(ClientNotification::CancelNotification(CancelNotification {
+                session_id: SessionId("test-123".into()),
+                reason: None,
+                turn_id: None,
+                meta: None,
+            })),
+        });
+
+    let serialized: Value = serde_json::to_value(&outgoing_msg).unwrap();
+    assert_eq!(
+        serialized,
+        json!({
+            "jsonrpc": "2.0",
+            "method": "cancel",
+            "params": {
+                "sessionId": "test-123"
+            },
+        })
+    );
+
+    // Test agent -> client notification wire format
+    let outgoing_msg =
+        JsonRpcMessage::wrap(OutgoingMessage::<AgentSide, ClientSide>::Notification {
+            method: "sessionUpdate".into(),
+            params: Some(AgentNotification::SessionNotification(
+                SessionNotification {
+                    session_id: SessionId("test-456".into()),
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: ContentBlock::Text(TextContent {
+                            annotations: None,
+                            text: "Hello".to_string(),
+                            meta: None,
+                        }),
+                    },
+                    turn_id: None,
+                    meta: None,
+                },
+            )),
+        });
+
+    let serialized: Value = serde_json::to_value(&outgoing_msg).unwrap();
+    assert_eq!(
+        serialized,
+        json!({
+            "jsonrpc": "2.0",
+            "method": "sessionUpdate",
+            "params": {
+                "sessionId": "test-456",
+                "update": {
+                    "sessionUpdate": "agent_message_chunk",
+                    "content": {
+                        "type": "text",
+                        "text": "Hello"
+                    }
+                }
+            }
+        })
+    );
+}
+
+#[tokio::test]
+async fn test_inbound_request_id() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+
+            let mut ids = Vec::new();
+            for _ in 0..2 {
+                let response = agent_conn
+                    .ext_method(ExtRequest {
+                        method: "example.com/request_id".into(),
+                        params: raw_json!({}),
+                    })
+                    .await
+                    .unwrap();
+                let response: serde_json::Value = serde_json::to_value(response).unwrap();
+                ids.push(response["id"].as_i64().expect("missing request id"));
+            }
+
+            assert_eq!(ids[1], ids[0] + 1);
+            assert_eq!(inbound_request_id(), None);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_string_request_ids() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, _client_conn) = create_connection_pair(&client, &agent);
+            let next = std::sync::atomic::AtomicUsize::new(0);
+            agent_conn.set_id_generator(move || {
+                let n = next.fetch_add(1, std::sync::atomic::Ordering::SeqCst);
+                RequestId::from(format!("req-{n}"))
+            });
+
+            for expected in ["req-0", "req-1"] {
+                let response = agent_conn
+                    .ext_method(ExtRequest {
+                        method: "example.com/request_id".into(),
+                        params: raw_json!({}),
+                    })
+                    .await
+                    .unwrap();
+                let response: serde_json::Value = serde_json::to_value(response).unwrap();
+                assert_eq!(response["id"], expected);
+            }
+
+            // Typed requests resolve through the same pending map.
+            agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed");
+            assert_eq!(agent_conn.pending_request_count(), 0);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_typed_notify() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            agent_conn
+                .notify(
+                    AGENT_METHOD_NAMES.session_cancel,
+                    CancelNotification {
+                        session_id: SessionId("test-session".into()),
+                        reason: None,
+                        turn_id: None,
+                        meta: None,
+                    },
+                )
+                .await
+                .expect("notify failed");
+            client_conn
+                .notify("_example.com/ping", json!({ "count": 1 }))
+                .await
+                .expect("notify failed");
+
+            let error = agent_conn
+                .notify(
+                    AGENT_METHOD_NAMES.session_new,
+                    json!({ "cwd": "/test", "mcpServers": [] }),
+                )
+                .await
+                .expect_err("requests can't be sent as notifications");
+            assert_eq!(error.code, ErrorCode::INVALID_REQUEST.code);
+
+            let error = agent_conn
+                .notify(AGENT_METHOD_NAMES.session_cancel, json!({}))
+                .await
+                .expect_err("params must match the notification");
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+
+            let error = agent_conn
+                .notify("session/unknown", json!({}))
+                .await
+                .expect_err("unknown methods are rejected");
+            assert_eq!(error.code, ErrorCode::METHOD_NOT_FOUND.code);
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert_eq!(
+                *agent.cancellations_received.lock().unwrap(),
+                vec![SessionId("test-session".into())]
+            );
+            let notifications = client.extension_notifications.lock().unwrap();
+            assert_eq!(notifications.len(), 1);
+            assert_eq!(notifications[0].0, "example.com/ping");
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_register_method() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            #[derive(serde::Deserialize)]
+            struct FooParams {
+                name: String,
+            }
+
+            client_conn
+                .register_method("session/experimental_foo", |params: FooParams| async move {
+                    Ok(json!({ "greeting": format!("Hello, {}!", params.name) }))
+                })
+                .expect("register_method failed");
+
+            let response: serde_json::Value = agent_conn
+                .send_request("session/experimental_foo", json!({ "name": "Zed" }))
+                .await
+                .expect("send_request failed");
+            assert_eq!(response, json!({ "greeting": "Hello, Zed!" }));
+
+            let error = agent_conn
+                .send_request::<serde_json::Value>("session/experimental_foo", json!({}))
+                .await
+                .expect_err("params are checked");
+            assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+
+            let error = agent_conn
+                .send_request::<serde_json::Value>("session/experimental_bar", json!({}))
+                .await
+                .expect_err("unregistered methods are not found");
+            assert_eq!(error.code, ErrorCode::METHOD_NOT_FOUND.code);
+
+            for method in [AGENT_METHOD_NAMES.session_prompt, "_example.com/foo"] {
+                let error = client_conn
+                    .register_method(method, |_: serde_json::Value| async { Ok(()) })
+                    .expect_err("built-in methods can't be shadowed");
+                assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+            }
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_fallback_handler() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            client_conn
+                .register_method("session/experimental_foo", |_: serde_json::Value| async {
+                    Ok("registered")
+                })
+                .expect("register_method failed");
+            client_conn.set_fallback_handler(|request: ExtRequest| async move {
+                let response = json!({ "method": &*request.method, "params": request.params });
+                Ok(serde_json::value::to_raw_value(&response)?.into())
+            });
+
+            let response: serde_json::Value = agent_conn
+                .send_request("session/experimental_bar", json!({ "name": "Zed" }))
+                .await
+                .expect("send_request failed");
+            assert_eq!(
+                response,
+                json!({ "method": "session/experimental_bar", "params": { "name": "Zed" } })
+            );
+
+            // Registered and built-in methods take precedence.
+            let response: String = agent_conn
+                .send_request("session/experimental_foo", json!({}))
+                .await
+                .expect("send_request failed");
+            assert_eq!(response, "registered");
+
+            let response = agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed");
+            assert_eq!(response.session_id.0.as_ref(), "test-session-123");
+        })
+        .await;
+}
+
+#[cfg(unix)]
+#[tokio::test]
+async fn test_forward_stderr_as_thoughts() {
+    use tokio_util::compat::TokioAsyncReadCompatExt as _;
+
+    let client = TestClient::new();
+    let mut child = tokio::process::Command::new("sh")
+        .args([
+            "-c",
+            "echo 'loading config' >&2; echo 'panicked at main.rs' >&2",
+        ])
+        .stderr(std::process::Stdio::piped())
+        .spawn()
+        .unwrap();
+    let stderr = child.stderr.take().unwrap().compat();
+
+    forward_stderr_as_thoughts(stderr, SessionId("test-session".into()), &client)
+        .await
+        .unwrap();
+    child.wait().await.unwrap();
+
+    let notifications = client.session_notifications.lock().unwrap();
+    let thoughts: Vec<_> = notifications
+        .iter()
+        .map(|notification| {
+            assert_eq!(notification.session_id.0.as_ref(), "test-session");
+            match &notification.update {
+                SessionUpdate::AgentThoughtChunk {
+                    content: ContentBlock::Text(text),
+                } => text.text.clone(),
+                update => panic!("unexpected update: {update:?}"),
+            }
+        })
+        .collect();
+    assert_eq!(thoughts, ["loading config\n", "panicked at main.rs\n"]);
+}
+
+/// A client whose notification handlers always fail.
+struct FailingNotifications;
+
+impl crate::rpc::MessageHandler<ClientSide> for FailingNotifications {
+    async fn handle_request(&self, _request: AgentRequest) -> Result<ClientResponse, Error> {
+        Err(Error::method_not_found())
+    }
+
+    async fn handle_notification(&self, _notification: AgentNotification) -> Result<(), Error> {
+        Err(Error::internal_error().with_data("dropped update"))
+    }
+}
+
+#[tokio::test]
+async fn test_notification_error_fatal() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                FailingNotifications,
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let agent_io_task = tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+
+            let notification = SessionNotification {
+                session_id: SessionId("test-session".into()),
+                update: SessionUpdate::AgentMessageChunk {
+                    content: "Hello".into(),
+                },
+                turn_id: None,
+                meta: None,
+            };
+
+            // Failed notifications are only logged by default.
+            client_conn
+                .session_notification(notification.clone())
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert!(!agent_io_task.is_finished());
+
+            agent_conn.set_notification_error_fatal(true);
+            client_conn
+                .session_notification(notification)
+                .await
+                .unwrap();
+            let error = tokio::time::timeout(std::time::Duration::from_secs(1), agent_io_task)
+                .await
+                .expect("connection stayed open")
+                .unwrap()
+                .expect_err("the handler error closes the connection");
+            assert_eq!(
+                error
+                    .downcast_ref::<Error>()
+                    .and_then(|error| error.data.clone()),
+                Some(json!("dropped update"))
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_method_discovery() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let error = agent_conn
+                .list_peer_methods()
+                .await
+                .expect_err("discovery is off by default");
+            assert_eq!(error.code, ErrorCode::METHOD_NOT_FOUND.code);
+
+            client_conn.set_method_discovery(true);
+            client_conn
+                .register_method("session/experimental_foo", |_: serde_json::Value| async {
+                    Ok(())
+                })
+                .expect("register_method failed");
+
+            let methods = agent_conn
+                .list_peer_methods()
+                .await
+                .expect("list_peer_methods failed");
+            for method in [
+                AGENT_METHOD_NAMES.initialize,
+                AGENT_METHOD_NAMES.authenticate,
+                AGENT_METHOD_NAMES.session_new,
+                AGENT_METHOD_NAMES.session_load,
+                AGENT_METHOD_NAMES.session_set_mode,
+                AGENT_METHOD_NAMES.session_prompt,
+                AGENT_METHOD_NAMES.session_cancel,
+                "session/experimental_foo",
+            ] {
+                assert!(methods.iter().any(|m| m == method), "{method} not listed");
+            }
+            assert!(
+                !methods
+                    .iter()
+                    .any(|m| m == CLIENT_METHOD_NAMES.fs_read_text_file)
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_redactor_only_affects_logs() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let mut stream = client_conn.subscribe();
+
+            // Redaction runs lazily, only for messages that are actually logged.
+            log::set_max_level(log::LevelFilter::Trace);
+            let logged = Arc::new(Mutex::new(Vec::new()));
+            agent_conn.set_redactor({
+                let logged = logged.clone();
+                move |json| {
+                    let redacted = redact_secrets(json);
+                    logged.lock().unwrap().push(redacted.clone());
+                    redacted
+                }
+            });
+
+            agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![McpServer::Stdio {
+                        name: "github".to_string(),
+                        command: std::path::PathBuf::from("/usr/bin/github-mcp"),
+                        args: vec![],
+                        env: vec![EnvVariable {
+                            name: "GITHUB_TOKEN".to_string(),
+                            value: "ghp_secret".to_string(),
+                            meta: None,
+                        }],
+                    }],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed");
+
+            let message = stream.recv().await.unwrap();
+            match message.message {
+                StreamMessageContent::Request { params, .. } => {
+                    assert_eq!(
+                        params.unwrap()["mcpServers"][0]["env"][0]["value"],
+                        "ghp_secret"
+                    );
+                }
+                _ => panic!("Expected request"),
+            }
+
+            let logged = logged.lock().unwrap();
+            assert!(!logged.is_empty());
+            assert!(logged.iter().all(|line| !line.contains("ghp_secret")));
+            assert!(logged.iter().any(|line| line.contains(REDACTED)));
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_extension_methods_and_notifications() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            // Store references to the client and agent to check notifications later
+            let client_ref = client.clone();
+            let agent_ref = agent.clone();
+
+            let (client_conn, agent_conn) = create_connection_pair(&client, &agent);
+
+            // Test agent calling client extension method
+            let client_response = agent_conn
+                .ext_method(ExtRequest {
+                    method: "example.com/ping".into(),
+                    params: raw_json!({"data": "test"}),
+                })
+                .await
+                .unwrap();
+
+            assert_eq!(
+                serde_json::to_value(client_response).unwrap(),
+                serde_json::json!({
+                    "response": "pong",
+                    "params": {"data": "test"}
+                })
+            );
+
+            // Test client calling agent extension method
+            let agent_response = client_conn
+                .ext_method(ExtRequest {
+                    method: "example.com/echo".into(),
+                    params: raw_json!({"message": "hello"}),
+                })
+                .await
+                .unwrap();
+
+            assert_eq!(
+                serde_json::to_value(agent_response).unwrap(),
+                serde_json::json!({
+                    "echo": {"message": "hello"}
+                })
+            );
+
+            // Test extension notifications
+            agent_conn
+                .ext_notification(ExtNotification {
+                    method: "example.com/client/notify".into(),
+                    params: raw_json!({"info": "client notification"}),
+                })
+                .await
+                .unwrap();
+
+            client_conn
+                .ext_notification(ExtNotification {
+                    method: "example.com/agent/notify".into(),
+                    params: raw_json!({"info": "agent notification"}),
+                })
+                .await
+                .unwrap();
+
+            // Yield to allow notifications to be processed
+            tokio::task::yield_now().await;
+
+            // Verify client received the notification
+            let client_notifications = client_ref.extension_notifications.lock().unwrap();
+            assert_eq!(client_notifications.len(), 1);
+            assert_eq!(client_notifications[0].0, "example.com/client/notify");
+            assert_eq!(
+                serde_json::to_value(&client_notifications[0].1).unwrap(),
+                serde_json::json!({"info": "client notification"})
+            );
+
+            // Verify agent received the notification
+            let agent_notifications = agent_ref.extension_notifications.lock().unwrap();
+            assert_eq!(agent_notifications.len(), 1);
+            assert_eq!(agent_notifications[0].0, "example.com/agent/notify");
+            assert_eq!(
+                serde_json::to_value(&agent_notifications[0].1).unwrap(),
+                serde_json::json!({"info": "agent notification"})
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_initialize_with_timeout() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            // The agent never answers initialize.
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, _agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, io_task) = ClientSideConnection::new(
+                TestClient::new(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+
+            let error = agent_conn
+                .initialize_with_timeout(
+                    InitializeRequest {
+                        protocol_version: VERSION,
+                        client_capabilities: ClientCapabilities::default(),
+                        client_info: None,
+                        meta: None,
+                    },
+                    tokio::time::sleep(std::time::Duration::from_millis(10)),
+                )
+                .await
+                .expect_err("initialize should time out");
+            assert_eq!(error.code, ErrorCode::REQUEST_TIMEOUT.code);
+            assert_eq!(agent_conn.pending_request_count(), 0);
+
+            // The agent is told it can stop working on the request.
+            let messages = read_messages(client_to_agent_rx, 2).await;
+            assert_eq!(messages[0]["method"], "initialize");
+            assert_eq!(
+                messages[1],
+                json!({
+                    "jsonrpc": "2.0",
+                    "method": "_acp/cancel_request",
+                    "params": { "requestId": messages[0]["id"] }
+                })
+            );
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_request_permission_with_timeout() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let agent = TestAgent::new();
+
+            // The client never responds to the request.
+            let (client_rx, agent_to_client_tx) = piper::pipe(4096);
+            let (_client_tx, client_to_agent_rx) = piper::pipe(1024);
+
+            let (client_conn, io_task) =
+                AgentSideConnection::new(agent, agent_to_client_tx, client_to_agent_rx, |fut| {
+                    tokio::task::spawn_local(fut);
+                });
+            tokio::task::spawn_local(io_task);
+
+            let request = RequestPermissionRequest {
+                session_id: SessionId(Arc::from("test-session")),
+                tool_call: ToolCallUpdate {
+                    id: ToolCallId(Arc::from("call_1")),
+                    fields: ToolCallUpdateFields::default(),
+                    meta: None,
+                },
+                options: vec![],
+                tool_calls: vec![],
+                turn_id: None,
+                meta: None,
+            };
+
+            let response = client_conn
+                .request_permission_with_timeout(
+                    request.clone(),
+                    tokio::time::sleep(std::time::Duration::from_millis(10)),
+                    Some(PermissionOptionId(Arc::from("allow"))),
+                )
+                .await
+                .expect("request_permission_with_timeout failed");
+            assert!(matches!(
+                response.outcome,
+                RequestPermissionOutcome::Selected { option_id } if option_id == PermissionOptionId("allow".into())
+            ));
+
+            let response = client_conn
+                .request_permission_with_timeout(
+                    request,
+                    tokio::time::sleep(std::time::Duration::from_millis(10)),
+                    None,
+                )
+                .await
+                .expect("request_permission_with_timeout failed");
+            assert!(matches!(
+                response.outcome,
+                RequestPermissionOutcome::Cancelled
+            ));
+            assert_eq!(client_conn.pending_request_count(), 0);
+
+            let messages = read_messages(client_rx, 4).await;
+            for pair in messages.chunks(2) {
+                assert_eq!(pair[0]["method"], "session/request_permission");
+                assert_eq!(pair[1]["method"], "_acp/cancel_request");
+                assert_eq!(pair[1]["params"]["requestId"], pair[0]["id"]);
+            }
+        })
+        .await;
+}
+
+/// A client that never answers permission requests, and records the
+/// extension notifications it receives.
+#[derive(Clone, Default)]
+struct StalledPermissions {
+    ext_notifications: Arc<Mutex<Vec<ExtNotification>>>,
+}
+
+impl crate::rpc::MessageHandler<ClientSide> for StalledPermissions {
+    async fn handle_request(&self, request: AgentRequest) -> Result<ClientResponse, Error> {
+        match request {
+            AgentRequest::RequestPermissionRequest(_) => futures::future::pending().await,
+            _ => Err(Error::method_not_found()),
+        }
+    }
+
+    async fn handle_notification(&self, notification: AgentNotification) -> Result<(), Error> {
+        if let AgentNotification::ExtNotification(args) = notification {
+            self.ext_notifications.lock().unwrap().push(args);
+        }
+        Ok(())
+    }
+}
+
+#[tokio::test]
+async fn test_request_timeout_notifies_client() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = StalledPermissions::default();
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (_agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+
+            let response = client_conn
+                .request_permission_with_timeout(
+                    permission_request(ToolKind::Edit),
+                    tokio::time::sleep(std::time::Duration::from_millis(10)),
+                    None,
+                )
+                .await
+                .expect("request_permission_with_timeout failed");
+            assert!(matches!(
+                response.outcome,
+                RequestPermissionOutcome::Cancelled
+            ));
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            // The client learns which of its requests was abandoned.
+            let notifications = client.ext_notifications.lock().unwrap();
+            assert_eq!(notifications.len(), 1);
+            assert_eq!(notifications[0].method.as_ref(), CANCEL_REQUEST_METHOD_NAME);
+            let params: serde_json::Value =
+                serde_json::from_str(notifications[0].params.get()).unwrap();
+            assert!(params["requestId"].is_number());
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_compression() {
+    use futures::{AsyncBufReadExt as _, AsyncWriteExt as _};
+
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+            let (client_out, client_to_agent_tx) = piper::pipe(1024);
+            let (client_to_agent_rx, mut agent_in) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+
+            // Pass on what the client sends, keeping each line as written.
+            let lines = Arc::new(Mutex::new(Vec::new()));
+            tokio::task::spawn_local({
+                let lines = lines.clone();
+                async move {
+                    let mut reader = futures::io::BufReader::new(client_out);
+                    let mut line = String::new();
+                    while reader.read_line(&mut line).await.unwrap_or(0) > 0 {
+                        agent_in.write_all(line.as_bytes()).await.unwrap();
+                        lines.lock().unwrap().push(std::mem::take(&mut line));
+                    }
+                }
+            });
+
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                agent.clone(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+
+            agent_conn
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default().with_compression(true),
+                    client_info: None,
+                    meta: None,
+                })
+                .await
+                .expect("initialize failed");
+
+            let text = (0..1000)
+                .map(|i| format!("fn line_{i}() {{}}\n"))
+                .collect::<String>();
+            let prompt = vec![ContentBlock::Resource(EmbeddedResource {
+                annotations: None,
+                resource: EmbeddedResourceResource::TextResourceContents(TextResourceContents {
+                    mime_type: Some("text/x-rust".to_string()),
+                    text: text.clone(),
+                    uri: "file:///src/lib.rs".to_string(),
+                    meta: None,
+                }),
+                meta: None,
+            })];
+            agent_conn
+                .prompt(PromptRequest {
+                    session_id: SessionId("test-session".into()),
+                    prompt: prompt.clone(),
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("prompt failed");
+
+            {
+                let prompts = agent.prompts_received.lock().unwrap();
+                assert_eq!(prompts.len(), 1);
+                assert_eq!(prompts[0].1, prompt);
+
+                // Only the prompt was large enough to be compressed.
+                let lines = lines.lock().unwrap();
+                assert_eq!(lines.len(), 2);
+                assert!(lines[0].starts_with('{'));
+                assert!(lines[1].starts_with('~'));
+                assert!(lines[1].len() < text.len());
+            }
+
+            // The agent compresses what it sends as well.
+            let content = ContentBlock::Text(TextContent {
+                annotations: None,
+                text,
+                meta: None,
+            });
+            client_conn
+                .session_notification(SessionNotification {
+                    session_id: SessionId("test-session".into()),
+                    update: SessionUpdate::AgentMessageChunk {
+                        content: content.clone(),
+                    },
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("session_notification failed");
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            let notifications = client.session_notifications.lock().unwrap();
+            assert_eq!(notifications.len(), 1);
+            assert!(matches!(
+                &notifications[0].update,
+                SessionUpdate::AgentMessageChunk { content: received } if *received == content
+            ));
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_reattach() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            // The first agent never reads the request or responds to it.
+            let (_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (_agent_tx, agent_to_client_rx) = piper::pipe(1024);
+
+            let (agent_conn, io_task) = ClientSideConnection::new(
+                TestClient::new(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let io_task = tokio::task::spawn_local(io_task);
+            let agent_conn = std::rc::Rc::new(agent_conn);
+
+            let new_session_request = NewSessionRequest {
+                mcp_servers: vec![],
+                instructions: vec![],
+                cwd: std::path::PathBuf::from("/test"),
+                meta: None,
+            };
+            let pending = tokio::task::spawn_local({
+                let agent_conn = agent_conn.clone();
+                let request = new_session_request.clone();
+                async move { agent_conn.new_session(request).await }
+            });
+            tokio::task::yield_now().await;
+
+            // Relaunch the agent and move the connection over to it.
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (_client_conn, agent_io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(agent_conn.reattach(client_to_agent_tx, agent_to_client_rx));
+
+            let error = pending
+                .await
+                .unwrap()
+                .expect_err("pending request should fail when reattaching");
+            assert_eq!(error.code, ErrorCode::CONNECTION_RESET.code);
+            io_task
+                .await
+                .unwrap()
+                .expect("previous io task should stop when reattaching");
+
+            let response = agent_conn
+                .new_session(new_session_request)
+                .await
+                .expect("new_session failed after reattaching");
+            assert_eq!(response.session_id.0.as_ref(), "test-session-123");
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_expire_pending_requests() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            // The client never reads the request or responds to it.
+            let (_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (_client_tx, client_to_agent_rx) = piper::pipe(1024);
+
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+            let client_conn = std::rc::Rc::new(client_conn);
+
+            let abandoned = tokio::task::spawn_local({
+                let client_conn = client_conn.clone();
+                async move {
+                    client_conn
+                        .read_text_file(ReadTextFileRequest {
+                            session_id: SessionId(Arc::from("test-session")),
+                            path: std::path::PathBuf::from("/test/file.txt"),
+                            line: None,
+                            limit: None,
+                            meta: None,
+                        })
+                        .await
+                }
+            });
+            tokio::task::yield_now().await;
+            assert_eq!(client_conn.pending_request_count(), 1);
+
+            // Requests younger than the limit are left alone.
+            assert_eq!(
+                client_conn.expire_pending_requests(std::time::Duration::from_secs(60)),
+                0
+            );
+            assert_eq!(client_conn.pending_request_count(), 1);
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert_eq!(
+                client_conn.expire_pending_requests(std::time::Duration::from_millis(1)),
+                1
+            );
+            assert_eq!(client_conn.pending_request_count(), 0);
+
+            let error = abandoned
+                .await
+                .unwrap()
+                .expect_err("abandoned request should fail once expired");
+            assert_eq!(error.code, ErrorCode::REQUEST_TIMEOUT.code);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_sweep_pending_requests() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            // The client never reads the request or responds to it.
+            let (_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (_client_tx, client_to_agent_rx) = piper::pipe(1024);
+
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+            tokio::task::spawn_local(
+                client_conn.sweep_pending_requests(std::time::Duration::from_millis(5), || {
+                    tokio::time::sleep(std::time::Duration::from_millis(5))
+                }),
+            );
+
+            let error = tokio::time::timeout(
+                std::time::Duration::from_secs(1),
+                client_conn.read_text_file(ReadTextFileRequest {
+                    session_id: SessionId(Arc::from("test-session")),
+                    path: std::path::PathBuf::from("/test/file.txt"),
+                    line: None,
+                    limit: None,
+                    meta: None,
+                }),
+            )
+            .await
+            .expect("abandoned request was never swept")
+            .expect_err("abandoned request should fail once swept");
+            assert_eq!(error.code, ErrorCode::REQUEST_TIMEOUT.code);
+            assert_eq!(client_conn.pending_request_count(), 0);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_pending_requests() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            // The client never reads the request or responds to it.
+            let (_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (_client_tx, client_to_agent_rx) = piper::pipe(1024);
+
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+            let client_conn = std::rc::Rc::new(client_conn);
+            assert_eq!(client_conn.pending_requests(), vec![]);
+
+            let slow = tokio::task::spawn_local({
+                let client_conn = client_conn.clone();
+                async move {
+                    client_conn
+                        .read_text_file(ReadTextFileRequest {
+                            session_id: SessionId(Arc::from("test-session")),
+                            path: std::path::PathBuf::from("/test/file.txt"),
+                            line: None,
+                            limit: None,
+                            meta: None,
+                        })
+                        .await
+                }
+            });
+            tokio::task::yield_now().await;
+
+            let pending = client_conn.pending_requests();
+            assert_eq!(pending.len(), 1);
+            assert_eq!(pending[0].id, RequestId::Number(0));
+            assert_eq!(pending[0].method.as_ref(), "fs/read_text_file");
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            let later = client_conn.pending_requests();
+            assert_eq!(later.len(), 1);
+            assert_eq!(later[0].id, pending[0].id);
+            assert!(later[0].age >= pending[0].age + std::time::Duration::from_millis(10));
+
+            // Abandoned requests are no longer pending.
+            slow.abort();
+            tokio::task::yield_now().await;
+            assert_eq!(client_conn.pending_requests(), vec![]);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_proxy_forwards_prompt() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (client_to_proxy_rx, client_to_proxy_tx) = piper::pipe(1024);
+            let (proxy_to_client_rx, proxy_to_client_tx) = piper::pipe(1024);
+            let (proxy_to_agent_rx, proxy_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_proxy_rx, agent_to_proxy_tx) = piper::pipe(1024);
+
+            let (agent_conn, client_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_proxy_tx,
+                proxy_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (_proxy, proxy_io_task) = ProxyConnection::new(
+                |upstream| upstream,
+                |downstream| downstream,
+                proxy_to_agent_tx,
+                agent_to_proxy_rx,
+                proxy_to_client_tx,
+                client_to_proxy_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (_client_conn, agent_io_task) = AgentSideConnection::new(
+                agent.clone(),
+                agent_to_proxy_tx,
+                proxy_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(client_io_task);
+            tokio::task::spawn_local(proxy_io_task);
+            tokio::task::spawn_local(agent_io_task);
+
+            let session_id = agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed")
+                .session_id;
+
+            let response = agent_conn
+                .prompt(PromptRequest {
+                    session_id: session_id.clone(),
+                    prompt: vec![ContentBlock::from("Hello through the proxy")],
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("prompt failed");
+            assert!(matches!(response.stop_reason, StopReason::EndTurn));
+
+            let prompts = agent.prompts_received.lock().unwrap();
+            assert_eq!(prompts.len(), 1);
+            assert_eq!(prompts[0].0, session_id);
+        })
+        .await;
+}
+
+/// An agent that streams a couple of message chunks during every prompt turn,
+/// and replays them when a session is loaded.
+struct StreamingAgent {
+    conn: std::rc::Rc<std::cell::OnceCell<std::rc::Rc<AgentSideConnection>>>,
+}
+
+impl StreamingAgent {
+    async fn stream_chunks(&self, session_id: &SessionId) -> Result<(), Error> {
+        let conn = self.conn.get().unwrap();
+        for chunk in ["Hello", ", world"] {
+            conn.session_notification(SessionNotification {
+                session_id: session_id.clone(),
+                update: SessionUpdate::AgentMessageChunk {
+                    content: chunk.into(),
+                },
+                turn_id: None,
+                meta: None,
+            })
+            .await?;
+        }
+        Ok(())
+    }
+}
+
+#[async_trait::async_trait(?Send)]
+impl Agent for StreamingAgent {
+    async fn initialize(&self, _args: InitializeRequest) -> Result<InitializeResponse, Error> {
+        Err(Error::method_not_found())
+    }
+
+    async fn authenticate(
+        &self,
+        _args: AuthenticateRequest,
+    ) -> Result<AuthenticateResponse, Error> {
+        Err(Error::method_not_found())
+    }
+
+    async fn new_session(&self, _args: NewSessionRequest) -> Result<NewSessionResponse, Error> {
+        Err(Error::method_not_found())
+    }
+
+    async fn load_session(&self, args: LoadSessionRequest) -> Result<LoadSessionResponse, Error> {
+        self.stream_chunks(&args.session_id).await?;
+        Ok(LoadSessionResponse {
+            modes: None,
+            #[cfg(feature = "unstable")]
+            models: None,
+            meta: None,
+        })
+    }
+
+    async fn prompt(&self, args: PromptRequest) -> Result<PromptResponse, Error> {
+        self.stream_chunks(&args.session_id).await?;
+        Ok(PromptResponse {
+            stop_reason: StopReason::EndTurn,
+            usage: None,
+            meta: None,
+        })
+    }
+
+    async fn cancel(&self, _args: CancelNotification) -> Result<(), Error> {
+        Ok(())
+    }
+}
+
+#[tokio::test]
+async fn test_on_turn_complete() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                TestClient::new(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let conn = std::rc::Rc::new(std::cell::OnceCell::new());
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                StreamingAgent { conn: conn.clone() },
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+
+            let turns = Arc::new(Mutex::new(Vec::new()));
+            client_conn.on_turn_complete({
+                let turns = turns.clone();
+                move |stats| turns.lock().unwrap().push(stats)
+            });
+            conn.set(std::rc::Rc::new(client_conn)).ok();
+
+            let session_id = SessionId(Arc::from("test-session"));
+            agent_conn
+                .prompt(PromptRequest {
+                    session_id: session_id.clone(),
+                    prompt: vec!["Hi".into()],
+                    turn_id: None,
+                    meta: None,
+                })
+                .await
+                .expect("prompt failed");
+
+            let turns = turns.lock().unwrap();
+            assert_eq!(turns.len(), 1);
+            assert_eq!(turns[0].session_id, session_id);
+            assert_eq!(turns[0].stop_reason, StopReason::EndTurn);
+            assert_eq!(turns[0].update_count, 2);
+        })
+        .await;
+}
+
+/// Sends raw lines to an agent connection and returns its responses.
+async fn send_raw_lines(strict: bool, lines: &[&str]) -> (TestAgent, Vec<serde_json::Value>) {
+    use futures::{AsyncBufReadExt as _, AsyncWriteExt as _};
+
+    let (client_to_agent_rx, mut client_to_agent_tx) = piper::pipe(1024);
+    let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+
+    let agent = TestAgent::new();
+    let (client_conn, io_task) = AgentSideConnection::new(
+        agent.clone(),
+        agent_to_client_tx,
+        client_to_agent_rx,
+        |fut| {
+            tokio::task::spawn_local(fut);
+        },
+    );
+    client_conn.set_strict_jsonrpc(strict);
+    tokio::task::spawn_local(io_task);
+
+    for line in lines {
+        client_to_agent_tx.write_all(line.as_bytes()).await.unwrap();
+        client_to_agent_tx.write_all(b"\n").await.unwrap();
+    }
+    tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+    let mut responses = Vec::new();
+    let mut reader = futures::io::BufReader::new(agent_to_client_rx);
+    let mut line = String::new();
+    while tokio::time::timeout(
+        std::time::Duration::from_millis(10),
+        reader.read_line(&mut line),
+    )
+    .await
+    .is_ok_and(|read| read.unwrap() > 0)
+    {
+        responses.push(serde_json::from_str(&line).unwrap());
+        line.clear();
+    }
+    (agent, responses)
+}
+
+/// An output stream that records each write it receives.
+#[derive(Clone, Default)]
+struct WriteLog(std::rc::Rc<std::cell::RefCell<Vec<Vec<u8>>>>);
+
+impl WriteLog {
+    /// The lines of each write so far.
+    fn writes(&self) -> Vec<Vec<serde_json::Value>> {
+        self.0
+            .borrow()
+            .iter()
+            .map(|write| {
+                std::str::from_utf8(write)
+                    .unwrap()
+                    .lines()
+                    .map(|line| serde_json::from_str(line).unwrap())
+                    .collect()
+            })
+            .collect()
+    }
+}
+
+impl futures::AsyncWrite for WriteLog {
+    fn poll_write(
+        self: std::pin::Pin<&mut Self>,
+        _cx: &mut std::task::Context<'_>,
+        buf: &[u8],
+    ) -> std::task::Poll<std::io::Result<usize>> {
+        self.0.borrow_mut().push(buf.to_vec());
+        std::task::Poll::Ready(Ok(buf.len()))
+    }
+
+    fn poll_flush(
+        self: std::pin::Pin<&mut Self>,
+        _cx: &mut std::task::Context<'_>,
+    ) -> std::task::Poll<std::io::Result<()>> {
+        std::task::Poll::Ready(Ok(()))
+    }
+
+    fn poll_close(
+        self: std::pin::Pin<&mut Self>,
+        _cx: &mut std::task::Context<'_>,
+    ) -> std::task::Poll<std::io::Result<()>> {
+        std::task::Poll::Ready(Ok(()))
+    }
+}
+
+async fn send_chunks(conn: &AgentSideConnection, texts: &[&str]) {
+    for text in texts {
+        conn.session_notification(SessionNotification {
+            session_id: SessionId(Arc::from("test-session")),
+            update: SessionUpdate::AgentMessageChunk {
+                content: (*text).into(),
+            },
+            turn_id: None,
+            meta: None,
+        })
+        .await
+        .expect("session_notification failed");
+        // Let the I/O task pick up each notification on its own.
+        tokio::time::sleep(std::time::Duration::from_millis(1)).await;
+    }
+}
+
+/// An output stream that never accepts any data, like a peer that stopped
+/// reading.
+struct StalledWriter;
+
+impl futures::AsyncWrite for StalledWriter {
+    fn poll_write(
+        self: std::pin::Pin<&mut Self>,
+        _cx: &mut std::task::Context<'_>,
+        _buf: &[u8],
+    ) -> std::task::Poll<std::io::Result<usize>> {
+        std::task::Poll::Pending
+    }
+
+    fn poll_flush(
+        self: std::pin::Pin<&mut Self>,
+        _cx: &mut std::task::Context<'_>,
+    ) -> std::task::Poll<std::io::Result<()>> {
+        std::task::Poll::Pending
+    }
+
+    fn poll_close(
+        self: std::pin::Pin<&mut Self>,
+        _cx: &mut std::task::Context<'_>,
+    ) -> std::task::Poll<std::io::Result<()>> {
+        std::task::Poll::Pending
+    }
+}
+
+#[tokio::test]
+async fn test_session_notification_does_not_block_on_stalled_writer() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, _client_to_agent_tx) = piper::pipe(1024);
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                StalledWriter,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+
+            // The first update gets stuck in the writer, the rest queue up
+            // behind it without blocking the sender.
+            let updates = async {
+                for i in 0..100 {
+                    client_conn
+                        .session_notification(SessionNotification {
+                            session_id: SessionId("test-session".into()),
+                            update: SessionUpdate::AgentMessageChunk {
+                                content: format!("chunk {i}").into(),
+                            },
+                            turn_id: None,
+                            meta: None,
+                        })
+                        .await?;
+                }
+                Ok::<_, Error>(())
+            };
+            tokio::time::timeout(std::time::Duration::from_secs(1), updates)
+                .await
+                .expect("session updates blocked on the stalled writer")
+                .unwrap();
+        })
+        .await;
+}
+
+fn long_chunk(i: usize) -> SessionNotification {
+    SessionNotification {
+        session_id: SessionId("test-session".into()),
+        update: SessionUpdate::AgentMessageChunk {
+            content: format!("{i}{}", "x".repeat(300)).into(),
+        },
+        turn_id: None,
+        meta: None,
+    }
+}
+
+/// Reads the first `count` messages written to `reader`.
+async fn read_messages(reader: piper::Reader, count: usize) -> Vec<serde_json::Value> {
+    use futures::{AsyncBufReadExt, StreamExt};
+
+    futures::io::BufReader::new(reader)
+        .lines()
+        .take(count)
+        .map(|line| serde_json::from_str(&line.unwrap()).unwrap())
+        .collect()
+        .await
+}
+
+/// Reads notifications written to `reader` and returns the index each chunk
+/// was created with by [`long_chunk`].
+async fn read_chunk_indices(reader: piper::Reader, count: usize) -> Vec<usize> {
+    use futures::{AsyncBufReadExt, StreamExt};
+
+    futures::io::BufReader::new(reader)
+        .lines()
+        .take(count)
+        .map(|line| {
+            let message: serde_json::Value = serde_json::from_str(&line.unwrap()).unwrap();
+            let text = message["params"]["update"]["content"]["text"]
+                .as_str()
+                .unwrap()
+                .trim_end_matches('x')
+                .to_string();
+            text.parse().unwrap()
+        })
+        .collect()
+        .await
+}
+
+#[tokio::test]
+async fn test_outbound_queue_backpressure() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, _client_to_agent_tx) = piper::pipe(1024);
+            // Each notification is larger than the pipe, so a write stalls
+            // until the client reads.
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(256);
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+            let client_conn = std::rc::Rc::new(client_conn);
+            client_conn.set_outbound_queue_limit(Some((2, OutboundQueuePolicy::Block)));
+
+            // The first notification gets stuck in the writer, the next two
+            // fill the queue.
+            client_conn
+                .session_notification(long_chunk(0))
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            for i in 1..3 {
+                client_conn
+                    .session_notification(long_chunk(i))
+                    .await
+                    .unwrap();
+            }
+
+            let blocked = tokio::task::spawn_local({
+                let client_conn = client_conn.clone();
+                async move { client_conn.session_notification(long_chunk(3)).await }
+            });
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert!(!blocked.is_finished());
+
+            // Once the client reads, the queue drains and the sender resumes.
+            let indices = tokio::time::timeout(
+                std::time::Duration::from_secs(1),
+                read_chunk_indices(agent_to_client_rx, 4),
+            )
+            .await
+            .expect("queued notifications were not written");
+            assert_eq!(indices, vec![0, 1, 2, 3]);
+            blocked.await.unwrap().unwrap();
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_outbound_queue_backpressure_batch() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, _client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(256);
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+            let client_conn = std::rc::Rc::new(client_conn);
+            client_conn.set_outbound_queue_limit(Some((2, OutboundQueuePolicy::Block)));
+
+            client_conn
+                .session_notification(long_chunk(0))
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            // Only two of the four updates fit into the queue.
+            let batch = tokio::task::spawn_local({
+                let client_conn = client_conn.clone();
+                async move {
+                    client_conn
+                        .session_update_batch(
+                            SessionId("test-session".into()),
+                            (1..5).map(|i| long_chunk(i).update),
+                        )
+                        .await
+                }
+            });
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert!(!batch.is_finished());
+
+            let indices = tokio::time::timeout(
+                std::time::Duration::from_secs(1),
+                read_chunk_indices(agent_to_client_rx, 5),
+            )
+            .await
+            .expect("queued notifications were not written");
+            assert_eq!(indices, vec![0, 1, 2, 3, 4]);
+            batch.await.unwrap().unwrap();
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_outbound_queue_drop_oldest() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, _client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(256);
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+            client_conn.set_outbound_queue_limit(Some((1, OutboundQueuePolicy::DropOldest)));
+
+            client_conn
+                .session_notification(long_chunk(0))
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            // None of these wait, and only the most recent one is kept.
+            for i in 1..4 {
+                client_conn
+                    .session_notification(long_chunk(i))
+                    .await
+                    .unwrap();
+            }
+
+            let indices = tokio::time::timeout(
+                std::time::Duration::from_secs(1),
+                read_chunk_indices(agent_to_client_rx, 2),
+            )
+            .await
+            .expect("queued notifications were not written");
+            assert_eq!(indices, vec![0, 3]);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_notification_priority() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, _client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(256);
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+
+            // The first notification gets stuck in the writer, so the rest
+            // are queued.
+            client_conn
+                .session_notification(long_chunk(0))
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            for (i, priority) in [
+                NotificationPriority::Low,
+                NotificationPriority::Low,
+                NotificationPriority::High,
+                NotificationPriority::Normal,
+                NotificationPriority::High,
+            ]
+            .into_iter()
+            .enumerate()
+            {
+                client_conn
+                    .session_notification_with_priority(long_chunk(i + 1), priority)
+                    .await
+                    .unwrap();
+            }
+
+            let indices = tokio::time::timeout(
+                std::time::Duration::from_secs(1),
+                read_chunk_indices(agent_to_client_rx, 6),
+            )
+            .await
+            .expect("queued notifications were not written");
+            assert_eq!(indices, vec![0, 3, 5, 4, 1, 2]);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_write_buffer() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, _client_to_agent_tx) = piper::pipe(1024);
+            let output = WriteLog::default();
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                output.clone(),
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(io_task);
+
+            send_chunks(&client_conn, &["one", "two", "three"]).await;
+            assert_eq!(output.writes().len(), 3);
+
+            client_conn.set_write_buffer(4096);
+            send_chunks(&client_conn, &["four", "five", "six", "seven"]).await;
+            assert_eq!(output.writes().len(), 3);
+
+            client_conn.flush();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            let writes = output.writes();
+            assert_eq!(writes.len(), 4);
+            let texts: Vec<_> = writes[3]
+                .iter()
+                .map(|line| line["params"]["update"]["content"]["text"].clone())
+                .collect();
+            assert_eq!(
+                texts,
+                [json!("four"), "five".into(), "six".into(), "seven".into()]
+            );
+
+            client_conn.flush();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert_eq!(output.writes().len(), 4);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_write_buffer_does_not_delay_responses() {
+    use futures::AsyncWriteExt as _;
+
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, mut client_to_agent_tx) = piper::pipe(1024);
+            let output = WriteLog::default();
+            let (client_conn, io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                output.clone(),
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            client_conn.set_write_buffer(4096);
+            tokio::task::spawn_local(io_task);
+
+            send_chunks(&client_conn, &["one", "two"]).await;
+            assert!(output.writes().is_empty());
+
+            client_to_agent_tx
+                .write_all(format!("{VALID_REQUEST}\n").as_bytes())
+                .await
+                .unwrap();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            // The response is written right away, after the notifications
+            // that were sent before it.
+            let writes = output.writes();
+            assert_eq!(writes.len(), 1);
+            let methods: Vec<_> = writes[0]
+                .iter()
+                .map(|line| line.get("method").cloned())
+                .collect();
+            assert_eq!(
+                methods,
+                [
+                    Some(json!("session/update")),
+                    Some(json!("session/update")),
+                    None
+                ]
+            );
+            assert_eq!(writes[0][2]["id"], 2);
+        })
+        .await;
+}
+
+const OUTDATED_REQUEST: &str =
+    r#"{"jsonrpc":"1.0","id":1,"method":"session/new","params":{"cwd":"/test","mcpServers":[]}}"#;
+const UNVERSIONED_NOTIFICATION: &str =
+    r#"{"method":"session/cancel","params":{"sessionId":"test-session"}}"#;
+const VALID_REQUEST: &str =
+    r#"{"jsonrpc":"2.0","id":2,"method":"session/new","params":{"cwd":"/test","mcpServers":[]}}"#;
+
+#[tokio::test]
+async fn test_strict_jsonrpc() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (agent, responses) = send_raw_lines(
+                true,
+                &[OUTDATED_REQUEST, UNVERSIONED_NOTIFICATION, VALID_REQUEST],
+            )
+            .await;
+
+            assert_eq!(responses.len(), 2);
+            let rejected = responses.iter().find(|r| r["id"] == 1).unwrap();
+            assert_eq!(rejected["error"]["code"], ErrorCode::INVALID_REQUEST.code);
+            let accepted = responses.iter().find(|r| r["id"] == 2).unwrap();
+            assert_eq!(accepted["result"]["sessionId"], "test-session-123");
+            assert!(agent.cancellations_received.lock().unwrap().is_empty());
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_bom_and_crlf() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let initialize = "\u{feff}{\"jsonrpc\":\"2.0\",\"id\":0,\"method\":\"initialize\",\"params\":{\"protocolVersion\":1}}\r";
+            let (_, responses) = send_raw_lines(true, &[initialize]).await;
+
+            assert_eq!(responses.len(), 1);
+            assert_eq!(responses[0]["id"], 0);
+            assert_eq!(responses[0]["result"]["protocolVersion"], 1);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_malformed_messages() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (_, responses) = send_raw_lines(
+                false,
+                &[
+                    "not json",
+                    r#"{"jsonrpc":"2.0","id":1,"method":5}"#,
+                    r#"{"jsonrpc":"2.0","id":2,"id":3,"method":"session/new"}"#,
+                    r#"{"jsonrpc":"2.0","id":4,"method":"session\/new","params":{"cwd":"/test","mcpServers":[]}}"#,
+                ],
+            )
+            .await;
+
+            // Malformed requests are answered if their id can be read, and
+            // the connection keeps working.
+            assert_eq!(responses.len(), 2);
+            assert_eq!(responses[0]["id"], 1);
+            assert_eq!(
+                responses[0]["error"]["code"],
+                ErrorCode::INVALID_REQUEST.code
+            );
+            assert_eq!(responses[1]["id"], 4);
+            assert_eq!(responses[1]["result"]["sessionId"], "test-session-123");
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_empty_responses_are_objects() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            // Handlers return empty responses for these, which must still be
+            // written as objects rather than `null`, as the schema requires.
+            let (_, responses) = send_raw_lines(
+                true,
+                &[
+                    r#"{"jsonrpc":"2.0","id":1,"method":"authenticate","params":{"methodId":"test"}}"#,
+                    r#"{"jsonrpc":"2.0","id":2,"method":"session/set_mode","params":{"sessionId":"test-session","modeId":"code"}}"#,
+                ],
+            )
+            .await;
+
+            assert_eq!(responses.len(), 2);
+            for response in responses {
+                assert_eq!(response["result"], json!({}), "{response}");
+            }
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_lenient_jsonrpc() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (agent, responses) =
+                send_raw_lines(false, &[OUTDATED_REQUEST, UNVERSIONED_NOTIFICATION]).await;
+
+            assert_eq!(responses.len(), 1);
+            assert_eq!(responses[0]["id"], 1);
+            assert_eq!(responses[0]["result"]["sessionId"], "test-session-123");
+            assert_eq!(agent.cancellations_received.lock().unwrap().len(), 1);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_load_session_streams_history() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+
+            let client = TestClient::new();
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let conn = std::rc::Rc::new(std::cell::OnceCell::new());
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                StreamingAgent { conn: conn.clone() },
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+            conn.set(std::rc::Rc::new(client_conn)).ok();
+
+            // The agent notifies the client while the client is still awaiting
+            // the response to `session/load`, over the same connection.
+            let session_id = SessionId(Arc::from("test-session"));
+            agent_conn
+                .load_session(LoadSessionRequest {
+                    session_id: session_id.clone(),
+                    mcp_servers: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("load_session failed");
+
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+
+            let notifications = client.session_notifications.lock().unwrap();
+            assert_eq!(notifications.len(), 2);
+            assert!(
+                notifications
+                    .iter()
+                    .all(|notification| notification.session_id == session_id)
+            );
+        })
+        .await;
+}
+
+/// An agent whose prompt turns never end.
+#[derive(Clone, Default)]
+struct StalledPrompts {
+    cancellations: Arc<Mutex<Vec<CancelNotification>>>,
+}
+
+impl crate::rpc::MessageHandler<AgentSide> for StalledPrompts {
+    async fn handle_request(&self, request: ClientRequest) -> Result<AgentResponse, Error> {
+        match request {
+            ClientRequest::PromptRequest(_) => futures::future::pending().await,
+            _ => Err(Error::method_not_found()),
+        }
+    }
+
+    async fn handle_notification(&self, notification: ClientNotification) -> Result<(), Error> {
+        if let ClientNotification::CancelNotification(cancel) = notification {
+            self.cancellations.lock().unwrap().push(cancel);
+        }
+        Ok(())
+    }
+}
+
+#[tokio::test]
+async fn test_session_deadline() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let agent = StalledPrompts::default();
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                TestClient::new(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                agent.clone(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+
+            let session_id = SessionId("test-session".into());
+            tokio::task::spawn_local(client_conn.set_session_deadline(
+                session_id.clone(),
+                tokio::time::sleep(std::time::Duration::from_millis(20)),
+            ));
+
+            let prompt = PromptRequest {
+                session_id: session_id.clone(),
+                prompt: vec!["Hello".into()],
+                turn_id: None,
+                meta: None,
+            };
+            let error = tokio::time::timeout(
+                std::time::Duration::from_secs(1),
+                agent_conn.prompt(prompt.clone()),
+            )
+            .await
+            .expect("the deadline did not end the turn")
+            .expect_err("the turn was cancelled");
+            assert_eq!(error.code, ErrorCode::REQUEST_TIMEOUT.code);
+
+            let cancellations = agent.cancellations.lock().unwrap().clone();
+            assert_eq!(cancellations.len(), 1);
+            assert_eq!(cancellations[0].session_id, session_id);
+            assert_eq!(cancellations[0].reason, Some(CancelReason::Timeout));
+
+            // Later prompts fail right away.
+            let error = agent_conn.prompt(prompt).await.unwrap_err();
+            assert_eq!(error.code, ErrorCode::REQUEST_TIMEOUT.code);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_begin_turn_cancellation() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+
+            let session_id = SessionId(Arc::from("test-session"));
+            let other_session_id = SessionId(Arc::from("other-session"));
+            let turn = client_conn.begin_turn(session_id.clone());
+            let other_turn = client_conn.begin_turn(other_session_id.clone());
+            let cancelled = turn.cancelled();
+            assert!(!turn.is_cancelled());
+
+            agent_conn
+                .cancel(CancelNotification::with_reason(
+                    session_id.clone(),
+                    CancelReason::UserRequested,
+                ))
+                .await
+                .expect("cancel failed");
+
+            tokio::time::timeout(std::time::Duration::from_secs(1), cancelled)
+                .await
+                .expect("session/cancel did not cancel the turn");
+            assert!(turn.is_cancelled());
+            // The agent still hears about the cancellation.
+            tokio::task::yield_now().await;
+            assert_eq!(
+                *agent.cancellations_received.lock().unwrap(),
+                [session_id.clone()]
+            );
+
+            // Other sessions keep running.
+            assert!(!other_turn.is_cancelled());
+            assert!(
+                futures::poll!(Box::pin(other_turn.cancelled())).is_pending(),
+                "a turn of another session was cancelled"
+            );
+
+            // A turn that began after the cancellation isn't affected by it.
+            drop(turn);
+            let turn = client_conn.begin_turn(session_id);
+            assert!(!turn.is_cancelled());
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_connection_events() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                TestClient::new(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let events = Arc::new(Mutex::new(Vec::new()));
+            client_conn.on_event({
+                let events = events.clone();
+                move |event| events.lock().unwrap().push(event)
+            });
+            let agent_io_task = tokio::task::spawn_local(agent_io_task);
+            let client_io_task = tokio::task::spawn_local(client_io_task);
+
+            agent_conn
+                .initialize(InitializeRequest {
+                    protocol_version: VERSION,
+                    client_capabilities: ClientCapabilities::default(),
+                    client_info: None,
+                    meta: None,
+                })
+                .await
+                .expect("initialize failed");
+            let session_id = agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
+                    meta: None,
+                })
+                .await
+                .expect("new_session failed")
+                .session_id;
+            agent_conn
+                .cancel(CancelNotification::with_reason(
+                    session_id.clone(),
+                    CancelReason::UserRequested,
+                ))
+                .await
+                .expect("cancel failed");
+
+            // Closing the client's end of the connection disconnects the agent.
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            agent_io_task.abort();
+            tokio::time::timeout(std::time::Duration::from_secs(1), client_io_task)
+                .await
+                .expect("connection stayed open")
+                .unwrap()
+                .expect("connection failed");
+
+            assert_eq!(
+                *events.lock().unwrap(),
+                [
+                    ConnectionEvent::Initialized {
+                        protocol_version: VERSION
+                    },
+                    ConnectionEvent::SessionCreated {
+                        session_id: session_id.clone()
+                    },
+                    ConnectionEvent::SessionCancelled {
+                        session_id,
+                        turn_id: None,
+                        reason: Some(CancelReason::UserRequested),
+                    },
+                    ConnectionEvent::Disconnected,
+                ]
+            );
+        })
+        .await;
+}
+
+/// An agent that runs every prompt as a concurrent turn until it is cancelled.
+#[derive(Clone, Default)]
+struct ConcurrentTurns {
+    conn: std::rc::Rc<std::cell::OnceCell<AgentSideConnection>>,
+}
+
+impl crate::rpc::MessageHandler<AgentSide> for ConcurrentTurns {
+    async fn handle_request(&self, request: ClientRequest) -> Result<AgentResponse, Error> {
+        let ClientRequest::PromptRequest(args) = request else {
+            return Err(Error::method_not_found());
+        };
+        let conn = self.conn.get().expect("connection not set");
+        let turn = match args.turn_id.clone() {
+            Some(turn_id) => conn.begin_turn_with_id(args.session_id.clone(), turn_id),
+            None => conn.begin_turn(args.session_id.clone()),
+        };
+        conn.session_notification(SessionNotification {
+            session_id: args.session_id,
+            update: SessionUpdate::AgentMessageChunk {
+                content: "Working".into(),
+            },
+            turn_id: args.turn_id,
+            meta: None,
+        })
+        .await?;
+        turn.cancelled().await;
+        Ok(AgentResponse::PromptResponse(PromptResponse {
+            stop_reason: StopReason::Cancelled,
+            usage: None,
+            meta: None,
+        }))
+    }
+
+    async fn handle_notification(&self, _notification: ClientNotification) -> Result<(), Error> {
+        Ok(())
+    }
+}
+
+#[tokio::test]
+async fn test_concurrent_turns() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = ConcurrentTurns::default();
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                agent.clone(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            agent.conn.set(client_conn).ok();
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+
+            let agent_conn = std::rc::Rc::new(agent_conn);
+            let session_id = SessionId(Arc::from("test-session"));
+            let first = TurnId(Arc::from("turn_1"));
+            let second = TurnId(Arc::from("turn_2"));
+            let start_turn = |turn_id: &TurnId| {
+                let agent_conn = agent_conn.clone();
+                let request = PromptRequest {
+                    session_id: session_id.clone(),
+                    prompt: vec!["Hello".into()],
+                    turn_id: Some(turn_id.clone()),
+                    meta: None,
+                };
+                tokio::task::spawn_local(async move { agent_conn.prompt(request).await })
+            };
+            let first_turn = start_turn(&first);
+            let second_turn = start_turn(&second);
+
+            // Both turns run at the same time.
+            while client.session_notifications.lock().unwrap().len() < 2 {
+                tokio::task::yield_now().await;
+            }
+            let mut turn_ids = client
+                .session_notifications
+                .lock()
+                .unwrap()
+                .iter()
+                .map(|notification| notification.turn_id.clone())
+                .collect::<Vec<_>>();
+            turn_ids.sort_by_key(|turn_id| turn_id.as_ref().map(|id| id.0.clone()));
+            assert_eq!(turn_ids, [Some(first.clone()), Some(second.clone())]);
+
+            // Cancelling one turn leaves the other running.
+            agent_conn
+                .cancel(
+                    CancelNotification::with_reason(
+                        session_id.clone(),
+                        CancelReason::UserRequested,
+                    )
+                    .for_turn(first),
+                )
+                .await
+                .expect("cancel failed");
+            let response = tokio::time::timeout(std::time::Duration::from_secs(1), first_turn)
+                .await
+                .expect("the first turn was not cancelled")
+                .unwrap()
+                .expect("prompt failed");
+            assert_eq!(response.stop_reason, StopReason::Cancelled);
+            for _ in 0..10 {
+                tokio::task::yield_now().await;
+            }
+            assert!(!second_turn.is_finished(), "the second turn was cancelled");
+
+            // Cancelling without a turn id cancels the rest.
+            agent_conn
+                .cancel(CancelNotification::with_reason(
+                    session_id,
+                    CancelReason::UserRequested,
+                ))
+                .await
+                .expect("cancel failed");
+            let response = tokio::time::timeout(std::time::Duration::from_secs(1), second_turn)
+                .await
+                .expect("the second turn was not cancelled")
+                .unwrap()
+                .expect("prompt failed");
+            assert_eq!(response.stop_reason, StopReason::Cancelled);
+        })
+        .await;
+}
+
+#[tokio::test]
+async fn test_pause_and_resume_dispatch() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let client_conn = std::rc::Rc::new(client_conn);
+            let session_id = SessionId("test-session".into());
+
+            agent_conn.pause();
+            for text in ["one", "two", "three"] {
+                client_conn
+                    .session_notification(SessionNotification {
+                        session_id: session_id.clone(),
+                        update: SessionUpdate::AgentMessageChunk {
+                            content: text.into(),
+                        },
+                        turn_id: None,
+                        meta: None,
+                    })
+                    .await
+                    .unwrap();
+            }
+            let read = tokio::task::spawn_local({
+                let client_conn = client_conn.clone();
+                let session_id = session_id.clone();
+                async move {
+                    client_conn
+                        .read_text_file(ReadTextFileRequest {
+                            session_id,
+                            path: std::path::PathBuf::from("/test/file.txt"),
+                            line: None,
+                            limit: None,
+                            meta: None,
+                        })
+                        .await
+                }
+            });
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            assert!(client.session_notifications.lock().unwrap().is_empty());
+            assert!(!read.is_finished());
+
+            // Requests to the paused side still get their responses.
+            agent_conn
+                .new_session(NewSessionRequest {
+                    mcp_servers: vec![],
+                    instructions: vec![],
+                    cwd: std::path::PathBuf::from("/test"),
                     meta: None,
                 })
                 .await
-                .expect("session_notification failed");
+                .unwrap();
 
-            for _ in 0..10 {
-                tokio::task::yield_now().await;
-            }
+            agent_conn.resume();
+            let response = tokio::time::timeout(std::time::Duration::from_secs(1), read)
+                .await
+                .expect("the buffered request was not handled")
+                .unwrap()
+                .unwrap();
+            assert_eq!(response.content, "default content");
 
-            // Verify we received all the updates
-            let updates = client.session_notifications.lock().unwrap();
-            assert!(updates.len() >= 5); // At least 5 updates sent
+            let texts: Vec<_> = client
+                .session_notifications
+                .lock()
+                .unwrap()
+                .iter()
+                .map(|notification| match &notification.update {
+                    SessionUpdate::AgentMessageChunk {
+                        content: ContentBlock::Text(text),
+                    } => text.text.clone(),
+                    update => panic!("unexpected update: {update:?}"),
+                })
+                .collect();
+            assert_eq!(texts, ["one", "two", "three"]);
+        })
+        .await;
+}
 
-            // Verify the sequence of updates
-            let mut found_agent_message = false;
-            let mut found_tool_call = false;
-            let mut found_tool_update = false;
-            let mut found_final_message = false;
+/// A client that takes longer to read earlier files, logging when each read
+/// starts and ends.
+#[derive(Clone, Default)]
+struct SlowReads {
+    log: std::rc::Rc<std::cell::RefCell<Vec<String>>>,
+}
 
-            for notification in updates.iter() {
-                match &notification.update {
-                    SessionUpdate::AgentMessageChunk { content : ContentBlock::Text(text)} => {
-                        if text.text.contains("I'll analyze") {
-                            found_agent_message = true;
-                        } else if text.text.contains("Based on the file") {
-                            found_final_message = true;
-                        }
-                    }
-                    SessionUpdate::ToolCall(_) => {
-                        found_tool_call = true;
-                    }
-                    SessionUpdate::ToolCallUpdate(update) => {
-                        if let Some(ToolCallStatus::Completed) = update.fields.status {
-                            found_tool_update = true;
-                        }
-                    }
-                    _ => {}
-                }
-            }
+impl crate::rpc::MessageHandler<ClientSide> for SlowReads {
+    async fn handle_request(&self, request: AgentRequest) -> Result<ClientResponse, Error> {
+        let AgentRequest::ReadTextFileRequest(args) = request else {
+            return Err(Error::method_not_found());
+        };
+        let name = args.path.display().to_string();
+        let delay = match name.as_str() {
+            "/a" => 30,
+            "/b" => 20,
+            _ => 10,
+        };
+        self.log.borrow_mut().push(format!("start {name}"));
+        tokio::time::sleep(std::time::Duration::from_millis(delay)).await;
+        self.log.borrow_mut().push(format!("end {name}"));
+        Ok(ClientResponse::ReadTextFileResponse(ReadTextFileResponse {
+            content: name,
+            meta: None,
+        }))
+    }
 
-            assert!(found_agent_message, "Should have initial agent message");
-            assert!(found_tool_call, "Should have tool call");
-            assert!(found_tool_update, "Should have tool call completion");
-            assert!(found_final_message, "Should have final agent message");
-        })
-        .await;
+    async fn handle_notification(&self, _notification: AgentNotification) -> Result<(), Error> {
+        Ok(())
+    }
 }
 
 #[tokio::test]
-async fn test_notification_wire_format() {
-    use crate::{
-        AgentNotification, AgentSide, CancelNotification, ClientNotification, ClientSide,
-        ContentBlock, SessionNotification, SessionUpdate, TextContent,
-        rpc::{JsonRpcMessage, OutgoingMessage},
-    };
-    use serde_json::{Value, json};
+async fn test_serial_dispatch() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = SlowReads::default();
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (agent_conn, agent_io_task) = ClientSideConnection::new(
+                client.clone(),
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
+            agent_conn.set_serial_dispatch(true);
 
-    // Test client -> agent notification wire format
-    let outgoing_msg =
-        JsonRpcMessage::wrap(OutgoingMessage::<ClientSide, AgentSide>::Notification {
-            method: "cancel".into(),
-            params: Some(ClientNotification::CancelNotification(CancelNotification {
-                session_id: SessionId("test-123".into()),
-                meta: None,
-            })),
-        });
+            let reads = ["/a", "/b", "/c"].map(|path| {
+                client_conn.read_text_file(ReadTextFileRequest {
+                    session_id: SessionId("test-session".into()),
+                    path: std::path::PathBuf::from(path),
+                    line: None,
+                    limit: None,
+                    meta: None,
+                })
+            });
+            let contents: Vec<_> = futures::future::join_all(reads)
+                .await
+                .into_iter()
+                .map(|response| response.expect("read_text_file failed").content)
+                .collect();
 
-    let serialized: Value = serde_json::to_value(&outgoing_msg).unwrap();
-    assert_eq!(
-        serialized,
-        json!({
-            "jsonrpc": "2.0",
-            "method": "cancel",
-            "params": {
-                "sessionId": "test-123"
-            },
+            // Each response still answers its own request.
+            assert_eq!(contents, ["/a", "/b", "/c"]);
+            // Although later reads are faster, each one waited for the previous.
+            assert_eq!(
+                *client.log.borrow(),
+                [
+                    "start /a", "end /a", "start /b", "end /b", "start /c", "end /c"
+                ]
+            );
         })
-    );
+        .await;
+}
 
-    // Test agent -> client notification wire format
-    let outgoing_msg =
-        JsonRpcMessage::wrap(OutgoingMessage::<AgentSide, ClientSide>::Notification {
-            method: "sessionUpdate".into(),
-            params: Some(AgentNotification::SessionNotification(
-                SessionNotification {
-                    session_id: SessionId("test-456".into()),
-                    update: SessionUpdate::AgentMessageChunk {
-                        content: ContentBlock::Text(TextContent {
-                            annotations: None,
-                            text: "Hello".to_string(),
-                            meta: None,
-                        }),
-                    },
-                    meta: None,
-                },
-            )),
-        });
+#[tokio::test]
+async fn test_pause_buffer_overflow() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let client = TestClient::new();
+            let agent = TestAgent::new();
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
+            let session_id = SessionId("test-session".into());
 
-    let serialized: Value = serde_json::to_value(&outgoing_msg).unwrap();
-    assert_eq!(
-        serialized,
-        json!({
-            "jsonrpc": "2.0",
-            "method": "sessionUpdate",
-            "params": {
-                "sessionId": "test-456",
-                "update": {
-                    "sessionUpdate": "agent_message_chunk",
-                    "content": {
-                        "type": "text",
-                        "text": "Hello"
-                    }
-                }
+            agent_conn.set_pause_buffer_limit(1);
+            agent_conn.pause();
+            for text in ["kept", "dropped"] {
+                client_conn
+                    .session_notification(SessionNotification {
+                        session_id: session_id.clone(),
+                        update: SessionUpdate::AgentMessageChunk {
+                            content: text.into(),
+                        },
+                        turn_id: None,
+                        meta: None,
+                    })
+                    .await
+                    .unwrap();
             }
+
+            // Requests that don't fit are answered while still paused.
+            let error = tokio::time::timeout(
+                std::time::Duration::from_secs(1),
+                client_conn.read_text_file(ReadTextFileRequest {
+                    session_id: session_id.clone(),
+                    path: std::path::PathBuf::from("/test/file.txt"),
+                    line: None,
+                    limit: None,
+                    meta: None,
+                }),
+            )
+            .await
+            .expect("the overflowing request was not answered")
+            .unwrap_err();
+            assert_eq!(error.code, ErrorCode::INTERNAL_ERROR.code);
+
+            agent_conn.resume();
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            let notifications = client.session_notifications.lock().unwrap();
+            assert_eq!(notifications.len(), 1);
+            assert!(matches!(
+                &notifications[0].update,
+                SessionUpdate::AgentMessageChunk { content: ContentBlock::Text(text) } if text.text == "kept"
+            ));
         })
-    );
+        .await;
 }
 
 #[tokio::test]
-async fn test_extension_methods_and_notifications() {
+async fn test_validate_session_on_load() {
     let local_set = tokio::task::LocalSet::new();
     local_set
         .run_until(async {
             let client = TestClient::new();
             let agent = TestAgent::new();
+            let (agent_conn, client_conn) = create_connection_pair(&client, &agent);
 
-            // Store references to the client and agent to check notifications later
-            let client_ref = client.clone();
-            let agent_ref = agent.clone();
+            let sessions = Arc::new(Mutex::new(SessionIdSet::new()));
+            let known = sessions.lock().unwrap().generate("sess_");
+            client_conn.validate_session_on_load({
+                let sessions = sessions.clone();
+                move |session_id| sessions.lock().unwrap().contains(session_id)
+            });
 
-            let (client_conn, agent_conn) = create_connection_pair(&client, &agent);
+            let load = |session_id: SessionId| LoadSessionRequest {
+                session_id,
+                mcp_servers: vec![],
+                cwd: std::path::PathBuf::from("/test"),
+                meta: None,
+            };
+            agent_conn.load_session(load(known)).await.unwrap();
 
-            // Test agent calling client extension method
-            let client_response = agent_conn
-                .ext_method(ExtRequest {
-                    method: "example.com/ping".into(),
-                    params: raw_json!({"data": "test"}),
-                })
+            let error = agent_conn
+                .load_session(load(SessionId("sess_expired".into())))
                 .await
-                .unwrap();
+                .unwrap_err();
+            assert_eq!(error.code, ErrorCode::UNKNOWN_SESSION.code);
+            assert_eq!(error.data, Some(json!({ "sessionId": "sess_expired" })));
+        })
+        .await;
+}
 
-            assert_eq!(
-                serde_json::to_value(client_response).unwrap(),
-                serde_json::json!({
-                    "response": "pong",
-                    "params": {"data": "test"}
-                })
-            );
+/// A client that only implements the baseline methods.
+struct BaselineClient;
 
-            // Test client calling agent extension method
-            let agent_response = client_conn
-                .ext_method(ExtRequest {
-                    method: "example.com/echo".into(),
-                    params: raw_json!({"message": "hello"}),
-                })
-                .await
-                .unwrap();
+#[async_trait::async_trait(?Send)]
+impl Client for BaselineClient {
+    async fn request_permission(
+        &self,
+        _args: RequestPermissionRequest,
+    ) -> Result<RequestPermissionResponse, Error> {
+        Ok(RequestPermissionResponse {
+            outcome: RequestPermissionOutcome::Cancelled,
+            meta: None,
+        })
+    }
 
-            assert_eq!(
-                serde_json::to_value(agent_response).unwrap(),
-                serde_json::json!({
-                    "echo": {"message": "hello"}
-                })
+    async fn session_notification(&self, _args: SessionNotification) -> Result<(), Error> {
+        Ok(())
+    }
+}
+
+#[tokio::test]
+async fn test_capability_not_supported() {
+    let local_set = tokio::task::LocalSet::new();
+    local_set
+        .run_until(async {
+            let (client_to_agent_rx, client_to_agent_tx) = piper::pipe(1024);
+            let (agent_to_client_rx, agent_to_client_tx) = piper::pipe(1024);
+            let (_agent_conn, agent_io_task) = ClientSideConnection::new(
+                BaselineClient,
+                client_to_agent_tx,
+                agent_to_client_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
             );
+            let (client_conn, client_io_task) = AgentSideConnection::new(
+                TestAgent::new(),
+                agent_to_client_tx,
+                client_to_agent_rx,
+                |fut| {
+                    tokio::task::spawn_local(fut);
+                },
+            );
+            tokio::task::spawn_local(agent_io_task);
+            tokio::task::spawn_local(client_io_task);
 
-            // Test extension notifications
-            agent_conn
-                .ext_notification(ExtNotification {
-                    method: "example.com/client/notify".into(),
-                    params: raw_json!({"info": "client notification"}),
+            let error = client_conn
+                .terminal_output(TerminalOutputRequest {
+                    session_id: SessionId("test-session".into()),
+                    terminal_id: TerminalId("term_1".into()),
+                    output_byte_limit: None,
+                    meta: None,
                 })
                 .await
-                .unwrap();
+                .expect_err("the client has no terminal support");
+            assert_eq!(error.code, ErrorCode::CAPABILITY_NOT_SUPPORTED.code);
+            assert_eq!(error.data, Some(json!({ "capability": "terminal" })));
 
-            client_conn
-                .ext_notification(ExtNotification {
-                    method: "example.com/agent/notify".into(),
-                    params: raw_json!({"info": "agent notification"}),
+            let error = client_conn
+                .write_text_file(WriteTextFileRequest {
+                    session_id: SessionId("test-session".into()),
+                    path: "/test/file.txt".into(),
+                    content: "Hello".into(),
+                    append: false,
+                    eof: false,
+                    meta: None,
                 })
                 .await
-                .unwrap();
-
-            // Yield to allow notifications to be processed
-            tokio::task::yield_now().await;
-
-            // Verify client received the notification
-            let client_notifications = client_ref.extension_notifications.lock().unwrap();
-            assert_eq!(client_notifications.len(), 1);
-            assert_eq!(client_notifications[0].0, "example.com/client/notify");
+                .expect_err("the client can't write files");
             assert_eq!(
-                serde_json::to_value(&client_notifications[0].1).unwrap(),
-                serde_json::json!({"info": "client notification"})
+                error.data,
+                Some(json!({ "capability": "fs.writeTextFile" }))
             );
 
-            // Verify agent received the notification
-            let agent_notifications = agent_ref.extension_notifications.lock().unwrap();
-            assert_eq!(agent_notifications.len(), 1);
-            assert_eq!(agent_notifications[0].0, "example.com/agent/notify");
-            assert_eq!(
-                serde_json::to_value(&agent_notifications[0].1).unwrap(),
-                serde_json::json!({"info": "agent notification"})
-            );
+            // Methods the client doesn't know at all are still not found.
+            let error = client_conn
+                .send_request::<serde_json::Value>("terminal/resize", json!({}))
+                .await
+                .expect_err("unknown methods are rejected");
+            assert_eq!(error.code, ErrorCode::METHOD_NOT_FOUND.code);
         })
         .await;
 }
+
+#[test]
+fn test_parse_messages() {
+    let notification = parse_session_notification(
+        r#"{
+            "sessionId": "sess_abc123def456",
+            "update": {
+                "sessionUpdate": "agent_message_chunk",
+                "content": { "type": "text", "text": "I'll analyze your code for potential issues." }
+            }
+        }"#,
+    )
+    .unwrap();
+    assert_eq!(notification.session_id.0.as_ref(), "sess_abc123def456");
+    assert!(matches!(
+        notification.update,
+        SessionUpdate::AgentMessageChunk {
+            content: ContentBlock::Text(_)
+        }
+    ));
+
+    let request = parse_agent_request(
+        "fs/read_text_file",
+        r#"{ "sessionId": "sess_abc123def456", "path": "/home/user/project/src/main.py", "line": 10, "limit": 50 }"#,
+    )
+    .unwrap();
+    assert!(matches!(
+        request,
+        AgentRequest::ReadTextFileRequest(ReadTextFileRequest {
+            line: Some(10),
+            limit: Some(50),
+            ..
+        })
+    ));
+
+    let request = parse_client_request(
+        "session/prompt",
+        r#"{ "sessionId": "sess_abc123def456", "prompt": [{ "type": "text", "text": "Hello" }] }"#,
+    )
+    .unwrap();
+    assert!(matches!(request, ClientRequest::PromptRequest(_)));
+
+    let notification =
+        parse_client_notification("session/cancel", r#"{ "sessionId": "sess_abc123def456" }"#)
+            .unwrap();
+    assert!(matches!(
+        notification,
+        ClientNotification::CancelNotification(_)
+    ));
+
+    let notification =
+        parse_agent_notification("_example.com/progress", r#"{ "done": 3 }"#).unwrap();
+    assert!(matches!(
+        notification,
+        AgentNotification::ExtNotification(ExtNotification { ref method, .. }) if &**method == "example.com/progress"
+    ));
+}
+
+#[test]
+fn test_parse_messages_errors() {
+    let error =
+        parse_session_notification(r#"{ "update": { "sessionUpdate": "plan", "entries": [] } }"#)
+            .unwrap_err();
+    assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+
+    // Requests are only decoded for the side that sends them.
+    let error = parse_client_request("fs/read_text_file", r#"{ "sessionId": "s", "path": "/a" }"#)
+        .unwrap_err();
+    assert_eq!(error.code, ErrorCode::METHOD_NOT_FOUND.code);
+
+    let error = parse_agent_notification("session/update", "not json").unwrap_err();
+    assert_eq!(error.code, ErrorCode::INVALID_PARAMS.code);
+}
@@ -0,0 +1,125 @@
+//! Generating session ids.
+//!
+//! Agents choose the id of every session they create. [`SessionId::generate`]
+//! picks a random one, and a [`SessionIdSet`] keeps track of the ids in use so
+//! that a new id never collides with an existing session.
+
+use std::collections::HashSet;
+use std::fmt::Write as _;
+
+use crate::SessionId;
+
+/// Random bytes in a generated session id, i.e. 128 bits of entropy.
+const RANDOM_BYTES: usize = 16;
+
+impl SessionId {
+    /// Creates a random session id starting with `prefix`, e.g. `"sess_"`.
+    ///
+    /// The prefix is followed by 128 bits read from the operating system's
+    /// secure random number generator, encoded as 32 lowercase hex digits.
+    /// That is enough to make collisions practically impossible and ids hard
+    /// to guess, but use a [`SessionIdSet`] to rule collisions out entirely.
+    ///
+    /// # Panics
+    ///
+    /// Panics if the operating system fails to provide random bytes.
+    pub fn generate(prefix: &str) -> Self {
+        let mut bytes = [0; RANDOM_BYTES];
+        getrandom::fill(&mut bytes).expect("failed to read random bytes for a session id");
+
+        let mut id = String::with_capacity(prefix.len() + 2 * RANDOM_BYTES);
+        id.push_str(prefix);
+        for byte in bytes {
+            write!(id, "{byte:02x}").ok();
+        }
+        SessionId(id.into())
+    }
+}
+
+/// The session ids in use by an agent.
+///
+/// Generating ids through the set guarantees that they are unique among the
+/// ids it contains. Remove ids once their sessions are gone so they don't
+/// accumulate.
+#[derive(Debug, Default, Clone)]
+pub struct SessionIdSet {
+    ids: HashSet<SessionId>,
+}
+
+impl SessionIdSet {
+    /// Creates an empty set.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Generates a session id with [`SessionId::generate`] that isn't in the
+    /// set yet, and adds it to the set.
+    pub fn generate(&mut self, prefix: &str) -> SessionId {
+        loop {
+            let id = SessionId::generate(prefix);
+            if self.ids.insert(id.clone()) {
+                return id;
+            }
+            log::warn!("generated session id {id} collides with an existing session");
+        }
+    }
+
+    /// Adds an id chosen elsewhere, e.g. one restored by `session/load`.
+    ///
+    /// Returns `false` if the id was already in the set.
+    pub fn insert(&mut self, id: SessionId) -> bool {
+        self.ids.insert(id)
+    }
+
+    /// Returns whether the id is in the set.
+    pub fn contains(&self, id: &SessionId) -> bool {
+        self.ids.contains(id)
+    }
+
+    /// Removes an id, returning whether it was in the set.
+    pub fn remove(&mut self, id: &SessionId) -> bool {
+        self.ids.remove(id)
+    }
+
+    /// Returns how many ids are in the set.
+    pub fn len(&self) -> usize {
+        self.ids.len()
+    }
+
+    /// Returns whether the set is empty.
+    pub fn is_empty(&self) -> bool {
+        self.ids.is_empty()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_generate_session_id() {
+        let ids: HashSet<_> = (0..10_000).map(|_| SessionId::generate("sess_")).collect();
+        assert_eq!(ids.len(), 10_000);
+        for id in &ids {
+            let random = id.0.strip_prefix("sess_").expect("missing prefix");
+            assert_eq!(random.len(), 2 * RANDOM_BYTES);
+            assert!(random.chars().all(|c| matches!(c, '0'..='9' | 'a'..='f')));
+        }
+    }
+
+    #[test]
+    fn test_session_id_set() {
+        let mut set = SessionIdSet::new();
+        let id = set.generate("sess_");
+        assert!(set.contains(&id));
+        assert!(!set.insert(id.clone()));
+
+        let other = set.generate("sess_");
+        assert_ne!(id, other);
+        assert_eq!(set.len(), 2);
+
+        assert!(set.remove(&id));
+        assert!(!set.contains(&id));
+        assert!(set.insert(id));
+    }
+}
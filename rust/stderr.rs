@@ -0,0 +1,51 @@
+//! Surfacing an agent's stderr in a session.
+//!
+//! Agents started as subprocesses often report problems, and crashes in
+//! particular, only on stderr, which the user never sees. A client can pipe the
+//! subprocess's stderr into [`forward_stderr_as_thoughts`] to show it in the
+//! session like the agent's own reasoning.
+
+use futures::{AsyncBufReadExt as _, AsyncRead, io::BufReader};
+
+use crate::{Client, Error, SessionId, SessionNotification, SessionUpdate};
+
+/// Reads lines from `stderr` and delivers each one to `client` as an
+/// [`SessionUpdate::AgentThoughtChunk`] for `session_id`, until the stream
+/// ends.
+///
+/// This is opt-in and meant for debugging: spawn the agent with a piped
+/// stderr and run this next to the connection's I/O task, passing the same
+/// client handler that was given to [`crate::ClientSideConnection::new`]. The
+/// updates never go over the wire. Each chunk keeps its trailing newline, and
+/// output that isn't valid UTF-8 is converted lossily.
+///
+/// Returns an error if reading fails or the client fails to handle an update.
+pub async fn forward_stderr_as_thoughts(
+    stderr: impl AsyncRead + Unpin,
+    session_id: SessionId,
+    client: &impl Client,
+) -> Result<(), Error> {
+    let mut stderr = BufReader::new(stderr);
+    let mut line = Vec::new();
+    loop {
+        line.clear();
+        if stderr
+            .read_until(b'\n', &mut line)
+            .await
+            .map_err(Error::into_internal_error)?
+            == 0
+        {
+            return Ok(());
+        }
+        client
+            .session_notification(SessionNotification {
+                session_id: session_id.clone(),
+                update: SessionUpdate::AgentThoughtChunk {
+                    content: String::from_utf8_lossy(&line).into_owned().into(),
+                },
+                turn_id: None,
+                meta: None,
+            })
+            .await?;
+    }
+}
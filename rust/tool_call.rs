@@ -4,12 +4,12 @@
 //! running code, or fetching data—it generates tool calls that the agent executes on its behalf.
 //!
 /// See protocol docs: [Tool Calls](https://agentclientprotocol.com/protocol/tool-calls)
-use std::{path::PathBuf, sync::Arc};
+use std::{collections::HashMap, path::PathBuf, sync::Arc};
 
 use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
 
-use crate::{ContentBlock, Error};
+use crate::{ContentBlock, EmbeddedResourceResource, Error, SessionUpdate, ValidationErrorData};
 
 /// Represents a tool call that the language model has requested.
 ///
@@ -130,6 +130,43 @@ pub struct ToolCallUpdateFields {
     pub raw_output: Option<serde_json::Value>,
 }
 
+impl ToolCallUpdate {
+    /// Converts this update into a full tool call, e.g. to restart or mirror
+    /// a tool call that is only known through its updates.
+    ///
+    /// Unlike the [`TryFrom`] conversion, this never fails: fields that aren't
+    /// set in the update fall back to their defaults, including an empty title.
+    #[must_use]
+    pub fn into_tool_call(self) -> ToolCall {
+        let ToolCallUpdate {
+            id,
+            fields:
+                ToolCallUpdateFields {
+                    kind,
+                    status,
+                    title,
+                    content,
+                    locations,
+                    raw_input,
+                    raw_output,
+                },
+            meta,
+        } = self;
+
+        ToolCall {
+            id,
+            title: title.unwrap_or_default(),
+            kind: kind.unwrap_or_default(),
+            status: status.unwrap_or_default(),
+            content: content.unwrap_or_default(),
+            locations: locations.unwrap_or_default(),
+            raw_input,
+            raw_output,
+            meta,
+        }
+    }
+}
+
 /// If a given tool call doesn't exist yet, allows for attempting to construct
 /// one from a tool call update if possible.
 impl TryFrom<ToolCallUpdate> for ToolCall {
@@ -154,8 +191,10 @@ impl TryFrom<ToolCallUpdate> for ToolCall {
         Ok(Self {
             id,
             title: title.ok_or_else(|| {
-                Error::invalid_params()
-                    .with_data(serde_json::json!("title is required for a tool call"))
+                Error::invalid_fields([ValidationErrorData::new(
+                    "title",
+                    "title is required for a tool call",
+                )])
             })?,
             kind: kind.unwrap_or_default(),
             status: status.unwrap_or_default(),
@@ -265,6 +304,87 @@ impl ToolCallStatus {
     fn is_default(&self) -> bool {
         matches!(self, ToolCallStatus::Pending)
     }
+
+    /// Returns whether this is a final status, i.e. the tool call has ended.
+    pub fn is_finished(self) -> bool {
+        matches!(self, ToolCallStatus::Completed | ToolCallStatus::Failed)
+    }
+
+    /// Returns whether a tool call with this status may move to `next`.
+    ///
+    /// Tool calls only move forward: a pending tool call can start running
+    /// or end, a running one can end, and an ended one can't change anymore.
+    /// Repeating the current status is always allowed.
+    pub fn can_transition_to(self, next: ToolCallStatus) -> bool {
+        self == next
+            || match self {
+                ToolCallStatus::Pending => true,
+                ToolCallStatus::InProgress => next.is_finished(),
+                ToolCallStatus::Completed | ToolCallStatus::Failed => false,
+            }
+    }
+}
+
+/// Tracks the status of an agent's tool calls to catch illegal transitions,
+/// e.g. reporting a completed tool call as pending again.
+///
+/// Pass every update to [`ToolCallTracker::track`] before sending it. The
+/// returned error is meant to be logged; it doesn't need to stop the turn.
+#[derive(Debug, Default, Clone)]
+pub struct ToolCallTracker {
+    statuses: HashMap<ToolCallId, ToolCallStatus>,
+}
+
+impl ToolCallTracker {
+    /// Creates a tracker that hasn't seen any tool calls.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns the last status recorded for the tool call.
+    pub fn status(&self, id: &ToolCallId) -> Option<ToolCallStatus> {
+        self.statuses.get(id).copied()
+    }
+
+    /// Records that the tool call moved to `status`.
+    ///
+    /// Tool calls that haven't been seen yet start out as pending. Returns an
+    /// `invalid_params` error, and keeps the previous status, if the
+    /// transition isn't allowed by [`ToolCallStatus::can_transition_to`].
+    pub fn set_status(&mut self, id: &ToolCallId, status: ToolCallStatus) -> Result<(), Error> {
+        let current = self.status(id).unwrap_or_default();
+        if !current.can_transition_to(status) {
+            return Err(Error::invalid_params().with_data(format!(
+                "tool call {} can't move from {current:?} to {status:?}",
+                id.0
+            )));
+        }
+        self.statuses.insert(id.clone(), status);
+        Ok(())
+    }
+
+    /// Records the status reported by a session update, if it is a tool call
+    /// or a tool call update that sets the status. Other updates are ignored.
+    pub fn track(&mut self, update: &SessionUpdate) -> Result<(), Error> {
+        match update {
+            SessionUpdate::ToolCall(tool_call) => self.set_status(&tool_call.id, tool_call.status),
+            SessionUpdate::ToolCallUpdate(ToolCallUpdate {
+                id,
+                fields:
+                    ToolCallUpdateFields {
+                        status: Some(status),
+                        ..
+                    },
+                ..
+            }) => self.set_status(id, *status),
+            _ => Ok(()),
+        }
+    }
+
+    /// Forgets a tool call, e.g. once it has ended and won't be updated again.
+    pub fn remove(&mut self, id: &ToolCallId) -> Option<ToolCallStatus> {
+        self.statuses.remove(id)
+    }
 }
 
 /// Content produced by a tool call.
@@ -304,6 +424,48 @@ impl<T: Into<ContentBlock>> From<T> for ToolCallContent {
     }
 }
 
+impl ToolCallContent {
+    /// Creates one [`ToolCallContent::Diff`] per file for a tool call that
+    /// changes several files at once.
+    ///
+    /// Clients present the diffs of a tool call together as a single review,
+    /// so a permission request for the tool call covers all of the changes.
+    pub fn diffs(diffs: impl IntoIterator<Item = Diff>) -> Vec<Self> {
+        diffs.into_iter().map(Self::from).collect()
+    }
+
+    /// A one-line, human-readable description of the content, for logs and
+    /// simple UIs.
+    ///
+    /// Text is summarized by its first line, other content blocks by their
+    /// kind and MIME type or URI, diffs by their path and line counts, e.g.
+    /// `src/main.rs (+3 -1)`, and terminals by their id.
+    pub fn summary(&self) -> String {
+        match self {
+            ToolCallContent::Content { content } => match content {
+                ContentBlock::Text(text) => {
+                    text.text.lines().next().unwrap_or_default().to_string()
+                }
+                ContentBlock::Image(image) => format!("image ({})", image.mime_type),
+                ContentBlock::Audio(audio) => format!("audio ({})", audio.mime_type),
+                ContentBlock::ResourceLink(link) => format!("resource_link ({})", link.uri),
+                ContentBlock::Resource(resource) => {
+                    let uri = match &resource.resource {
+                        EmbeddedResourceResource::TextResourceContents(text) => &text.uri,
+                        EmbeddedResourceResource::BlobResourceContents(blob) => &blob.uri,
+                    };
+                    format!("resource ({uri})")
+                }
+            },
+            ToolCallContent::Diff { diff } => {
+                let (added, removed) = diff.line_changes();
+                format!("{} (+{added} -{removed})", diff.path.display())
+            }
+            ToolCallContent::Terminal { terminal_id } => format!("terminal {terminal_id}"),
+        }
+    }
+}
+
 impl From<Diff> for ToolCallContent {
     fn from(diff: Diff) -> Self {
         ToolCallContent::Diff { diff }
@@ -329,6 +491,113 @@ pub struct Diff {
     pub meta: Option<serde_json::Value>,
 }
 
+impl Diff {
+    /// Returns how many lines were added and removed, in that order.
+    ///
+    /// Lines are matched regardless of where they appear, so a line that
+    /// only moved isn't counted. All lines of a new file count as added.
+    pub fn line_changes(&self) -> (usize, usize) {
+        let mut old_lines = HashMap::<&str, usize>::new();
+        for line in self.old_text.as_deref().unwrap_or_default().lines() {
+            *old_lines.entry(line).or_default() += 1;
+        }
+        let mut added = 0;
+        for line in self.new_text.lines() {
+            match old_lines.get_mut(line) {
+                Some(count) if *count > 0 => *count -= 1,
+                _ => added += 1,
+            }
+        }
+        (added, old_lines.into_values().sum())
+    }
+}
+
+/// The result of a shell command that the agent ran itself.
+///
+/// Unlike [`ToolCallContent::Terminal`], which embeds a live terminal that the
+/// client created with `terminal/create`, this reports output the agent has
+/// already captured. It is sent as a markdown code block that any client can
+/// display, alongside a structured copy in the tool call's `rawOutput`:
+///
+/// ```json
+/// { "command": "cargo test", "stdout": "...", "stderr": "...", "exitCode": 0 }
+/// ```
+///
+/// `stdout` and `stderr` are omitted when empty, and `exitCode` is `null` if
+/// the command was terminated before it could exit, e.g. by a signal.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct CommandOutput {
+    /// The command line that was run.
+    pub command: String,
+    /// Everything the command wrote to its standard output.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub stdout: String,
+    /// Everything the command wrote to its standard error.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub stderr: String,
+    /// The exit code, or `None` if the command didn't exit normally.
+    pub exit_code: Option<i32>,
+}
+
+impl CommandOutput {
+    /// Formats the command and its output as a markdown code block, followed
+    /// by the exit code.
+    pub fn to_content(&self) -> ToolCallContent {
+        let mut body = format!("$ {}\n", self.command);
+        for output in [&self.stdout, &self.stderr] {
+            if !output.is_empty() {
+                body.push_str(output);
+                if !output.ends_with('\n') {
+                    body.push('\n');
+                }
+            }
+        }
+
+        // The fence must be longer than any run of backticks in the output.
+        let mut longest_run = 0;
+        let mut run = 0;
+        for c in body.chars() {
+            run = if c == '`' { run + 1 } else { 0 };
+            longest_run = longest_run.max(run);
+        }
+        let fence = "`".repeat(longest_run.max(2) + 1);
+
+        let mut text = format!("{fence}console\n{body}{fence}");
+        if let Some(exit_code) = self.exit_code {
+            text.push_str(&format!("\n\nExit code: {exit_code}"));
+        }
+        text.into()
+    }
+
+    /// Returns the structured form of the output, for a tool call's `rawOutput`.
+    pub fn to_raw_output(&self) -> serde_json::Value {
+        serde_json::to_value(self).unwrap_or_default()
+    }
+
+    /// Builds the fields for a tool call update that reports this output,
+    /// marking the tool call as completed if the command exited with `0`
+    /// and as failed otherwise.
+    pub fn into_update_fields(self) -> ToolCallUpdateFields {
+        ToolCallUpdateFields {
+            status: Some(if self.exit_code == Some(0) {
+                ToolCallStatus::Completed
+            } else {
+                ToolCallStatus::Failed
+            }),
+            content: Some(vec![self.to_content()]),
+            raw_output: Some(self.to_raw_output()),
+            ..Default::default()
+        }
+    }
+}
+
+impl From<CommandOutput> for ToolCallContent {
+    fn from(output: CommandOutput) -> Self {
+        output.to_content()
+    }
+}
+
 /// A file location being accessed or modified by a tool.
 ///
 /// Enables clients to implement "follow-along" features that track
@@ -347,3 +616,335 @@ pub struct ToolCallLocation {
     #[serde(skip_serializing_if = "Option::is_none", rename = "_meta")]
     pub meta: Option<serde_json::Value>,
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_tool_call_content_summary() {
+        let diff = |old_text: Option<&str>, new_text: &str| {
+            ToolCallContent::from(Diff {
+                path: PathBuf::from("src/main.rs"),
+                old_text: old_text.map(Into::into),
+                new_text: new_text.into(),
+                meta: None,
+            })
+        };
+        assert_eq!(
+            diff(Some("a\nb\nc\n"), "a\nB\nc\nd\n").summary(),
+            "src/main.rs (+2 -1)"
+        );
+        assert_eq!(diff(None, "a\nb\n").summary(), "src/main.rs (+2 -0)");
+        assert_eq!(
+            diff(Some("a\nb\n"), "b\na\n").summary(),
+            "src/main.rs (+0 -0)"
+        );
+
+        assert_eq!(
+            ToolCallContent::from("Found 3 matches\nsrc/main.rs:1").summary(),
+            "Found 3 matches"
+        );
+        assert_eq!(ToolCallContent::from("").summary(), "");
+        assert_eq!(
+            ToolCallContent::from(ContentBlock::Image(crate::ImageContent {
+                annotations: None,
+                data: String::new(),
+                mime_type: "image/png".into(),
+                uri: None,
+                meta: None,
+            }))
+            .summary(),
+            "image (image/png)"
+        );
+        assert_eq!(
+            ToolCallContent::from(ContentBlock::Audio(crate::AudioContent {
+                annotations: None,
+                data: String::new(),
+                mime_type: "audio/wav".into(),
+                meta: None,
+            }))
+            .summary(),
+            "audio (audio/wav)"
+        );
+        assert_eq!(
+            ToolCallContent::from(ContentBlock::image_link(
+                "https://example.com/chart.png",
+                "image/png"
+            ))
+            .summary(),
+            "resource_link (https://example.com/chart.png)"
+        );
+        assert_eq!(
+            ToolCallContent::from(ContentBlock::Resource(crate::EmbeddedResource {
+                annotations: None,
+                resource: EmbeddedResourceResource::TextResourceContents(
+                    crate::TextResourceContents {
+                        mime_type: None,
+                        text: "notes".into(),
+                        uri: "file:///notes.md".into(),
+                        meta: None,
+                    }
+                ),
+                meta: None,
+            }))
+            .summary(),
+            "resource (file:///notes.md)"
+        );
+        assert_eq!(
+            ToolCallContent::Terminal {
+                terminal_id: crate::TerminalId("term_1".into()),
+            }
+            .summary(),
+            "terminal term_1"
+        );
+    }
+
+    #[test]
+    fn test_tool_call_tracker_valid_transitions() {
+        let mut tracker = ToolCallTracker::new();
+        let id = ToolCallId("call_1".into());
+
+        tracker
+            .track(&SessionUpdate::ToolCall(ToolCall {
+                id: id.clone(),
+                title: "Reading file".to_string(),
+                kind: ToolKind::Read,
+                status: ToolCallStatus::Pending,
+                content: vec![],
+                locations: vec![],
+                raw_input: None,
+                raw_output: None,
+                meta: None,
+            }))
+            .unwrap();
+        assert_eq!(tracker.status(&id), Some(ToolCallStatus::Pending));
+
+        for status in [
+            ToolCallStatus::InProgress,
+            ToolCallStatus::InProgress,
+            ToolCallStatus::Completed,
+        ] {
+            tracker
+                .track(&SessionUpdate::tool_call_status(id.0.clone(), status))
+                .unwrap();
+            assert_eq!(tracker.status(&id), Some(status));
+        }
+
+        // Updates that don't set the status are ignored.
+        tracker
+            .track(&SessionUpdate::ToolCallUpdate(ToolCallUpdate {
+                id: id.clone(),
+                fields: ToolCallUpdateFields {
+                    title: Some("Read file".to_string()),
+                    ..Default::default()
+                },
+                meta: None,
+            }))
+            .unwrap();
+        assert_eq!(tracker.status(&id), Some(ToolCallStatus::Completed));
+
+        // Unknown tool calls start out as pending.
+        let other = ToolCallId("call_2".into());
+        tracker.set_status(&other, ToolCallStatus::Failed).unwrap();
+        assert_eq!(tracker.status(&other), Some(ToolCallStatus::Failed));
+    }
+
+    #[test]
+    fn test_tool_call_tracker_invalid_transitions() {
+        let mut tracker = ToolCallTracker::new();
+        let id = ToolCallId("call_1".into());
+
+        tracker.set_status(&id, ToolCallStatus::InProgress).unwrap();
+        let error = tracker
+            .set_status(&id, ToolCallStatus::Pending)
+            .expect_err("running tool calls can't become pending");
+        assert_eq!(error.code, crate::ErrorCode::INVALID_PARAMS.code);
+        assert_eq!(tracker.status(&id), Some(ToolCallStatus::InProgress));
+
+        tracker.set_status(&id, ToolCallStatus::Completed).unwrap();
+        for status in [
+            ToolCallStatus::Pending,
+            ToolCallStatus::InProgress,
+            ToolCallStatus::Failed,
+        ] {
+            assert!(
+                tracker
+                    .track(&SessionUpdate::tool_call_status(id.0.clone(), status))
+                    .is_err()
+            );
+        }
+        assert_eq!(tracker.status(&id), Some(ToolCallStatus::Completed));
+
+        assert_eq!(tracker.remove(&id), Some(ToolCallStatus::Completed));
+        tracker.set_status(&id, ToolCallStatus::Pending).unwrap();
+    }
+
+    #[test]
+    fn test_multi_file_diff_serialization() {
+        let tool_call = ToolCall {
+            id: ToolCallId("call_1".into()),
+            title: "Rename Config to Settings".to_string(),
+            kind: ToolKind::Edit,
+            status: ToolCallStatus::Pending,
+            content: ToolCallContent::diffs([
+                Diff {
+                    path: PathBuf::from("/project/src/config.rs"),
+                    old_text: Some("pub struct Config;\n".to_string()),
+                    new_text: "pub struct Settings;\n".to_string(),
+                    meta: None,
+                },
+                Diff {
+                    path: PathBuf::from("/project/src/settings.md"),
+                    old_text: None,
+                    new_text: "# Settings\n".to_string(),
+                    meta: None,
+                },
+            ]),
+            locations: vec![],
+            raw_input: None,
+            raw_output: None,
+            meta: None,
+        };
+
+        let value = serde_json::to_value(&tool_call).unwrap();
+        assert_eq!(
+            value,
+            json!({
+                "toolCallId": "call_1",
+                "title": "Rename Config to Settings",
+                "kind": "edit",
+                "content": [
+                    {
+                        "type": "diff",
+                        "path": "/project/src/config.rs",
+                        "oldText": "pub struct Config;\n",
+                        "newText": "pub struct Settings;\n"
+                    },
+                    {
+                        "type": "diff",
+                        "path": "/project/src/settings.md",
+                        "oldText": null,
+                        "newText": "# Settings\n"
+                    }
+                ]
+            })
+        );
+        assert_eq!(
+            serde_json::from_value::<ToolCall>(value).unwrap(),
+            tool_call
+        );
+    }
+
+    #[test]
+    fn test_update_into_tool_call() {
+        let update = ToolCallUpdate {
+            id: ToolCallId("call_1".into()),
+            fields: ToolCallUpdateFields {
+                kind: Some(ToolKind::Edit),
+                status: Some(ToolCallStatus::InProgress),
+                title: Some("Editing main.rs".to_string()),
+                content: Some(vec!["Applying changes".into()]),
+                locations: Some(vec![ToolCallLocation {
+                    path: PathBuf::from("/project/src/main.rs"),
+                    line: Some(12),
+                    meta: None,
+                }]),
+                raw_input: Some(json!({"path": "/project/src/main.rs"})),
+                raw_output: Some(json!({"ok": true})),
+            },
+            meta: Some(json!({"source": "test"})),
+        };
+
+        let tool_call = update.clone().into_tool_call();
+        assert_eq!(tool_call.id, update.id);
+        assert_eq!(tool_call.title, "Editing main.rs");
+        assert_eq!(tool_call.kind, ToolKind::Edit);
+        assert_eq!(tool_call.status, ToolCallStatus::InProgress);
+        assert_eq!(Some(tool_call.content), update.fields.content);
+        assert_eq!(Some(tool_call.locations), update.fields.locations);
+        assert_eq!(tool_call.raw_input, update.fields.raw_input);
+        assert_eq!(tool_call.raw_output, update.fields.raw_output);
+        assert_eq!(tool_call.meta, update.meta);
+    }
+
+    #[test]
+    fn test_empty_update_into_tool_call() {
+        let tool_call = ToolCallUpdate {
+            id: ToolCallId("call_1".into()),
+            fields: ToolCallUpdateFields::default(),
+            meta: None,
+        }
+        .into_tool_call();
+
+        assert_eq!(tool_call.title, "");
+        assert_eq!(tool_call.kind, ToolKind::Other);
+        assert_eq!(tool_call.status, ToolCallStatus::Pending);
+        assert!(tool_call.content.is_empty());
+        assert!(tool_call.locations.is_empty());
+    }
+
+    #[test]
+    fn test_command_output() {
+        let output = CommandOutput {
+            command: "cargo test".to_string(),
+            stdout: "running 1 test\ntest ok ... ok".to_string(),
+            stderr: "warning: unused import\n".to_string(),
+            exit_code: Some(0),
+        };
+
+        assert_eq!(
+            serde_json::to_value(output.to_content()).unwrap(),
+            json!({
+                "type": "content",
+                "content": {
+                    "type": "text",
+                    "text": "```console\n$ cargo test\nrunning 1 test\ntest ok ... ok\nwarning: unused import\n```\n\nExit code: 0"
+                }
+            })
+        );
+        assert_eq!(
+            output.to_raw_output(),
+            json!({
+                "command": "cargo test",
+                "stdout": "running 1 test\ntest ok ... ok",
+                "stderr": "warning: unused import\n",
+                "exitCode": 0
+            })
+        );
+        assert_eq!(
+            output.into_update_fields().status,
+            Some(ToolCallStatus::Completed)
+        );
+    }
+
+    #[test]
+    fn test_command_output_without_exit_code() {
+        let output = CommandOutput {
+            command: "cat notes.md".to_string(),
+            stdout: "```rust\nfn main() {}\n```".to_string(),
+            stderr: String::new(),
+            exit_code: None,
+        };
+
+        let ToolCallContent::Content {
+            content: ContentBlock::Text(text),
+        } = output.to_content()
+        else {
+            panic!("expected text content");
+        };
+        assert_eq!(
+            text.text,
+            "````console\n$ cat notes.md\n```rust\nfn main() {}\n```\n````"
+        );
+        assert_eq!(
+            output.to_raw_output(),
+            json!({ "command": "cat notes.md", "stdout": "```rust\nfn main() {}\n```", "exitCode": null })
+        );
+        assert_eq!(
+            output.into_update_fields().status,
+            Some(ToolCallStatus::Failed)
+        );
+    }
+}
@@ -0,0 +1,199 @@
+//! Recording and replaying what an agent sends to a client.
+//!
+//! A [`TranscriptRecorder`] wraps a [`Client`] and logs the session updates and
+//! permission exchanges it sees, in order. The resulting transcript serializes
+//! to JSON, so a turn captured against a real agent can be checked in and later
+//! replayed against a client with a [`TranscriptPlayer`], e.g. in golden tests.
+
+use std::cell::RefCell;
+
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    Client, CreateTerminalRequest, CreateTerminalResponse, Error, ExtNotification, ExtRequest,
+    ExtResponse, KillTerminalCommandRequest, KillTerminalCommandResponse, ReadTextFileRequest,
+    ReadTextFileResponse, ReleaseTerminalRequest, ReleaseTerminalResponse,
+    RequestPermissionRequest, RequestPermissionResponse, SessionNotification,
+    TerminalOutputRequest, TerminalOutputResponse, WaitForTerminalExitRequest,
+    WaitForTerminalExitResponse, WriteTextFileRequest, WriteTextFileResponse,
+};
+#[cfg(feature = "unstable")]
+use crate::{
+    OpenRequest, OpenResponse, ReadResourceRequest, ReadResourceResponse, RequestInputRequest,
+    RequestInputResponse,
+};
+
+/// A single message in a transcript.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum TranscriptEntry {
+    /// A `session/update` notification sent by the agent.
+    SessionNotification(SessionNotification),
+    /// A `session/request_permission` request and the client's answer.
+    RequestPermission {
+        request: RequestPermissionRequest,
+        response: RequestPermissionResponse,
+    },
+}
+
+/// A [`Client`] that records the session updates and permission exchanges
+/// passing through it.
+///
+/// All calls are forwarded to the wrapped client. Only exchanges the client
+/// handled successfully are recorded.
+pub struct TranscriptRecorder<C> {
+    client: C,
+    entries: RefCell<Vec<TranscriptEntry>>,
+}
+
+impl<C: Client> TranscriptRecorder<C> {
+    /// Wraps `client`, starting with an empty transcript.
+    pub fn new(client: C) -> Self {
+        Self {
+            client,
+            entries: RefCell::new(Vec::new()),
+        }
+    }
+
+    /// Returns the entries recorded so far, in the order they were received.
+    pub fn transcript(&self) -> Vec<TranscriptEntry> {
+        self.entries.borrow().clone()
+    }
+
+    /// Removes and returns the entries recorded so far.
+    pub fn take_transcript(&self) -> Vec<TranscriptEntry> {
+        self.entries.take()
+    }
+
+    fn record(&self, entry: TranscriptEntry) {
+        self.entries.borrow_mut().push(entry);
+    }
+}
+
+#[async_trait::async_trait(?Send)]
+impl<C: Client> Client for TranscriptRecorder<C> {
+    async fn request_permission(
+        &self,
+        args: RequestPermissionRequest,
+    ) -> Result<RequestPermissionResponse, Error> {
+        let response = self.client.request_permission(args.clone()).await?;
+        self.record(TranscriptEntry::RequestPermission {
+            request: args,
+            response: response.clone(),
+        });
+        Ok(response)
+    }
+    async fn write_text_file(
+        &self,
+        args: WriteTextFileRequest,
+    ) -> Result<WriteTextFileResponse, Error> {
+        self.client.write_text_file(args).await
+    }
+    async fn read_text_file(
+        &self,
+        args: ReadTextFileRequest,
+    ) -> Result<ReadTextFileResponse, Error> {
+        self.client.read_text_file(args).await
+    }
+    async fn session_notification(&self, args: SessionNotification) -> Result<(), Error> {
+        self.client.session_notification(args.clone()).await?;
+        self.record(TranscriptEntry::SessionNotification(args));
+        Ok(())
+    }
+    async fn create_terminal(
+        &self,
+        args: CreateTerminalRequest,
+    ) -> Result<CreateTerminalResponse, Error> {
+        self.client.create_terminal(args).await
+    }
+    async fn terminal_output(
+        &self,
+        args: TerminalOutputRequest,
+    ) -> Result<TerminalOutputResponse, Error> {
+        self.client.terminal_output(args).await
+    }
+    async fn release_terminal(
+        &self,
+        args: ReleaseTerminalRequest,
+    ) -> Result<ReleaseTerminalResponse, Error> {
+        self.client.release_terminal(args).await
+    }
+    async fn wait_for_terminal_exit(
+        &self,
+        args: WaitForTerminalExitRequest,
+    ) -> Result<WaitForTerminalExitResponse, Error> {
+        self.client.wait_for_terminal_exit(args).await
+    }
+    async fn kill_terminal_command(
+        &self,
+        args: KillTerminalCommandRequest,
+    ) -> Result<KillTerminalCommandResponse, Error> {
+        self.client.kill_terminal_command(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn read_resource(
+        &self,
+        args: ReadResourceRequest,
+    ) -> Result<ReadResourceResponse, Error> {
+        self.client.read_resource(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn open(&self, args: OpenRequest) -> Result<OpenResponse, Error> {
+        self.client.open(args).await
+    }
+    #[cfg(feature = "unstable")]
+    async fn request_input(
+        &self,
+        args: RequestInputRequest,
+    ) -> Result<RequestInputResponse, Error> {
+        self.client.request_input(args).await
+    }
+    async fn ext_method(&self, args: ExtRequest) -> Result<ExtResponse, Error> {
+        self.client.ext_method(args).await
+    }
+    async fn ext_notification(&self, args: ExtNotification) -> Result<(), Error> {
+        self.client.ext_notification(args).await
+    }
+}
+
+/// Replays a recorded transcript against a [`Client`], playing the part of
+/// the agent.
+///
+/// Pass an [`crate::AgentSideConnection`] to drive a client over a real
+/// connection, or a client implementation to call it directly.
+#[derive(Debug, Clone)]
+pub struct TranscriptPlayer {
+    entries: Vec<TranscriptEntry>,
+}
+
+impl TranscriptPlayer {
+    /// Creates a player for the given transcript.
+    pub fn new(entries: Vec<TranscriptEntry>) -> Self {
+        Self { entries }
+    }
+
+    /// Sends every entry to `client` in order.
+    ///
+    /// Returns an error if the client fails to handle an entry, or if it
+    /// answers a permission request differently than recorded.
+    pub async fn replay(&self, client: &impl Client) -> Result<(), Error> {
+        for entry in &self.entries {
+            match entry {
+                TranscriptEntry::SessionNotification(notification) => {
+                    client.session_notification(notification.clone()).await?;
+                }
+                TranscriptEntry::RequestPermission { request, response } => {
+                    let actual = client.request_permission(request.clone()).await?;
+                    let expected = serde_json::to_value(&response.outcome)?;
+                    let actual = serde_json::to_value(&actual.outcome)?;
+                    if actual != expected {
+                        return Err(Error::internal_error().with_data(format!(
+                            "permission outcome diverged from transcript: expected {expected}, got {actual}"
+                        )));
+                    }
+                }
+            }
+        }
+        Ok(())
+    }
+}
@@ -5,6 +5,11 @@ pub const V0: ProtocolVersion = ProtocolVersion(0);
 pub const V1: ProtocolVersion = ProtocolVersion(1);
 pub const VERSION: ProtocolVersion = V1;
 
+/// The oldest protocol version this crate can negotiate.
+pub const MIN_VERSION: ProtocolVersion = V1;
+/// The newest protocol version this crate can negotiate.
+pub const MAX_VERSION: ProtocolVersion = VERSION;
+
 /// Protocol version identifier.
 ///
 /// This version is only bumped for breaking changes.
@@ -18,6 +23,15 @@ impl ProtocolVersion {
     pub const fn new(version: u16) -> Self {
         Self(version)
     }
+
+    /// Whether this version is within [`MIN_VERSION`] and [`MAX_VERSION`].
+    ///
+    /// Use this during initialization to decide whether to accept the version
+    /// proposed by the other side, rather than assuming it matches [`VERSION`].
+    #[must_use]
+    pub fn is_supported(&self) -> bool {
+        (MIN_VERSION..=MAX_VERSION).contains(self)
+    }
 }
 
 use serde::{Deserialize, Deserializer};
@@ -102,6 +116,22 @@ mod tests {
         assert_eq!(version, ProtocolVersion::new(0));
     }
 
+    #[test]
+    fn test_is_supported() {
+        assert!(!V0.is_supported());
+        assert!(V1.is_supported());
+        assert!(VERSION.is_supported());
+        assert!(!ProtocolVersion::new(MAX_VERSION.0 + 1).is_supported());
+    }
+
+    #[test]
+    fn test_version_range_matches_meta() {
+        let meta: serde_json::Value =
+            serde_json::from_str(include_str!("../schema/meta.json")).unwrap();
+        assert_eq!(meta["version"], MAX_VERSION.0);
+        assert_eq!(meta["minVersion"], MIN_VERSION.0);
+    }
+
     #[test]
     fn test_deserialize_max_u16() {
         let json = "65535";
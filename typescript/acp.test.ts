@@ -758,6 +758,75 @@ describe("Connection", () => {
     });
   });
 
+  it("reports unsupported capabilities", async () => {
+    // Create client WITHOUT terminal support
+    class TestClientWithoutTerminals implements Client {
+      async requestPermission(
+        _: RequestPermissionRequest,
+      ): Promise<RequestPermissionResponse> {
+        return { outcome: { outcome: "cancelled" } };
+      }
+      async sessionUpdate(_: SessionNotification): Promise<void> {
+        // no-op
+      }
+    }
+
+    // Create agent WITHOUT loadSession
+    class TestAgentWithoutLoadSession implements Agent {
+      async initialize(_: InitializeRequest): Promise<InitializeResponse> {
+        return {
+          protocolVersion: PROTOCOL_VERSION,
+          agentCapabilities: { loadSession: false },
+        };
+      }
+      async newSession(_: NewSessionRequest): Promise<NewSessionResponse> {
+        return { sessionId: "test-session" };
+      }
+      async authenticate(_: AuthenticateRequest): Promise<void> {
+        // no-op
+      }
+      async prompt(_: PromptRequest): Promise<PromptResponse> {
+        return { stopReason: "end_turn" };
+      }
+      async cancel(_: CancelNotification): Promise<void> {
+        // no-op
+      }
+    }
+
+    const agentConnection = new ClientSideConnection(
+      () => new TestClientWithoutTerminals(),
+      ndJsonStream(clientToAgent.writable, agentToClient.readable),
+    );
+
+    const clientConnection = new AgentSideConnection(
+      () => new TestAgentWithoutLoadSession(),
+      ndJsonStream(agentToClient.writable, clientToAgent.readable),
+    );
+
+    try {
+      await clientConnection.createTerminal({
+        sessionId: "test-session",
+        command: "ls",
+      });
+      expect.fail("Should have thrown capability not supported error");
+    } catch (error: any) {
+      expect(error.code).toBe(-32004); // Capability not supported
+      expect(error.data.capability).toBe("terminal");
+    }
+
+    try {
+      await agentConnection.loadSession({
+        sessionId: "test-session",
+        cwd: "/test",
+        mcpServers: [],
+      });
+      expect.fail("Should have thrown capability not supported error");
+    } catch (error: any) {
+      expect(error.code).toBe(-32004); // Capability not supported
+      expect(error.data.capability).toBe("loadSession");
+    }
+  });
+
   it("handles methods returning response objects with _meta or void", async () => {
     // Create client that returns both response objects and void
     class TestClient implements Client {
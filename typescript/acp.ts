@@ -57,7 +57,7 @@ export class AgentSideConnection {
         }
         case schema.AGENT_METHODS.session_load: {
           if (!agent.loadSession) {
-            throw RequestError.methodNotFound(method);
+            throw RequestError.capabilityNotSupported("loadSession");
           }
           const validatedParams = schema.loadSessionRequestSchema.parse(params);
           return agent.loadSession(validatedParams);
@@ -89,6 +89,40 @@ export class AgentSideConnection {
             schema.setSessionModelRequestSchema.parse(params);
           return agent.setSessionModel(validatedParams);
         }
+        case schema.AGENT_METHODS.session_cancel_tool_call: {
+          if (!agent.cancelToolCall) {
+            throw RequestError.capabilityNotSupported("cancelToolCall");
+          }
+          const validatedParams =
+            schema.cancelToolCallRequestSchema.parse(params);
+          const result = await agent.cancelToolCall(validatedParams);
+          return result ?? {};
+        }
+        case schema.AGENT_METHODS.session_list: {
+          if (!agent.listSessions) {
+            throw RequestError.capabilityNotSupported("listSessions");
+          }
+          const validatedParams =
+            schema.listSessionsRequestSchema.parse(params);
+          return agent.listSessions(validatedParams);
+        }
+        case schema.AGENT_METHODS.session_list_flags: {
+          if (!agent.listSessionFlags) {
+            throw RequestError.capabilityNotSupported("sessionFlags");
+          }
+          const validatedParams =
+            schema.listSessionFlagsRequestSchema.parse(params);
+          return agent.listSessionFlags(validatedParams);
+        }
+        case schema.AGENT_METHODS.session_set_flag: {
+          if (!agent.setSessionFlag) {
+            throw RequestError.capabilityNotSupported("sessionFlags");
+          }
+          const validatedParams =
+            schema.setSessionFlagRequestSchema.parse(params);
+          const result = await agent.setSessionFlag(validatedParams);
+          return result ?? {};
+        }
         default:
           if (method.startsWith("_")) {
             if (!agent.extMethod) {
@@ -112,6 +146,14 @@ export class AgentSideConnection {
           const validatedParams = schema.cancelNotificationSchema.parse(params);
           return agent.cancel(validatedParams);
         }
+        case schema.AGENT_METHODS.terminal_output_update: {
+          if (!agent.terminalOutputUpdate) {
+            return;
+          }
+          const validatedParams =
+            schema.terminalOutputUpdateNotificationSchema.parse(params);
+          return agent.terminalOutputUpdate(validatedParams);
+        }
         default:
           if (method.startsWith("_")) {
             if (!agent.extNotification) {
@@ -237,6 +279,60 @@ export class AgentSideConnection {
     );
   }
 
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Reads the contents of a resource by its URI.
+   *
+   * Only available if the Client supports the `readResource` capability.
+   */
+  async readResource(
+    params: schema.ReadResourceRequest,
+  ): Promise<schema.ReadResourceResponse> {
+    return await this.#connection.sendRequest(
+      schema.CLIENT_METHODS.resource_read,
+      params,
+    );
+  }
+
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Opens a file or URI in the Client's editor, optionally at a given position.
+   *
+   * Only available if the Client supports the `open` capability.
+   */
+  async open(params: schema.OpenRequest): Promise<schema.OpenResponse> {
+    return (
+      (await this.#connection.sendRequest(
+        schema.CLIENT_METHODS.client_open,
+        params,
+      )) ?? {}
+    );
+  }
+
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Asks the user a question and returns their free-form answer.
+   *
+   * Only available if the Client supports the `requestInput` capability.
+   */
+  async requestInput(
+    params: schema.RequestInputRequest,
+  ): Promise<schema.RequestInputResponse> {
+    return await this.#connection.sendRequest(
+      schema.CLIENT_METHODS.session_request_input,
+      params,
+    );
+  }
+
   /**
    * Extension method
    *
@@ -399,14 +495,20 @@ export class ClientSideConnection implements Agent {
     ): Promise<unknown> => {
       switch (method) {
         case schema.CLIENT_METHODS.fs_write_text_file: {
+          if (!client.writeTextFile) {
+            throw RequestError.capabilityNotSupported("fs.writeTextFile");
+          }
           const validatedParams =
             schema.writeTextFileRequestSchema.parse(params);
-          return client.writeTextFile?.(validatedParams);
+          return client.writeTextFile(validatedParams);
         }
         case schema.CLIENT_METHODS.fs_read_text_file: {
+          if (!client.readTextFile) {
+            throw RequestError.capabilityNotSupported("fs.readTextFile");
+          }
           const validatedParams =
             schema.readTextFileRequestSchema.parse(params);
-          return client.readTextFile?.(validatedParams);
+          return client.readTextFile(validatedParams);
         }
         case schema.CLIENT_METHODS.session_request_permission: {
           const validatedParams =
@@ -414,32 +516,71 @@ export class ClientSideConnection implements Agent {
           return client.requestPermission(validatedParams);
         }
         case schema.CLIENT_METHODS.terminal_create: {
+          if (!client.createTerminal) {
+            throw RequestError.capabilityNotSupported("terminal");
+          }
           const validatedParams =
             schema.createTerminalRequestSchema.parse(params);
-          return client.createTerminal?.(validatedParams);
+          return client.createTerminal(validatedParams);
         }
         case schema.CLIENT_METHODS.terminal_output: {
+          if (!client.terminalOutput) {
+            throw RequestError.capabilityNotSupported("terminal");
+          }
           const validatedParams =
             schema.terminalOutputRequestSchema.parse(params);
-          return client.terminalOutput?.(validatedParams);
+          return client.terminalOutput(validatedParams);
         }
         case schema.CLIENT_METHODS.terminal_release: {
+          if (!client.releaseTerminal) {
+            throw RequestError.capabilityNotSupported("terminal");
+          }
           const validatedParams =
             schema.releaseTerminalRequestSchema.parse(params);
-          const result = await client.releaseTerminal?.(validatedParams);
+          const result = await client.releaseTerminal(validatedParams);
           return result ?? {};
         }
         case schema.CLIENT_METHODS.terminal_wait_for_exit: {
+          if (!client.waitForTerminalExit) {
+            throw RequestError.capabilityNotSupported("terminal");
+          }
           const validatedParams =
             schema.waitForTerminalExitRequestSchema.parse(params);
-          return client.waitForTerminalExit?.(validatedParams);
+          return client.waitForTerminalExit(validatedParams);
         }
         case schema.CLIENT_METHODS.terminal_kill: {
+          if (!client.killTerminal) {
+            throw RequestError.capabilityNotSupported("terminal");
+          }
           const validatedParams =
             schema.killTerminalCommandRequestSchema.parse(params);
-          const result = await client.killTerminal?.(validatedParams);
+          const result = await client.killTerminal(validatedParams);
+          return result ?? {};
+        }
+        case schema.CLIENT_METHODS.resource_read: {
+          if (!client.readResource) {
+            throw RequestError.capabilityNotSupported("readResource");
+          }
+          const validatedParams =
+            schema.readResourceRequestSchema.parse(params);
+          return client.readResource(validatedParams);
+        }
+        case schema.CLIENT_METHODS.client_open: {
+          if (!client.open) {
+            throw RequestError.capabilityNotSupported("open");
+          }
+          const validatedParams = schema.openRequestSchema.parse(params);
+          const result = await client.open(validatedParams);
           return result ?? {};
         }
+        case schema.CLIENT_METHODS.session_request_input: {
+          if (!client.requestInput) {
+            throw RequestError.capabilityNotSupported("requestInput");
+          }
+          const validatedParams =
+            schema.requestInputRequestSchema.parse(params);
+          return client.requestInput(validatedParams);
+        }
         default:
           // Handle extension methods (any method starting with '_')
           if (method.startsWith("_")) {
@@ -600,6 +741,82 @@ export class ClientSideConnection implements Agent {
     );
   }
 
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Cancels a single tool call while letting the rest of the prompt turn continue.
+   *
+   * Only available if the Agent supports the `cancelToolCall` capability.
+   */
+  async cancelToolCall(
+    params: schema.CancelToolCallRequest,
+  ): Promise<schema.CancelToolCallResponse> {
+    return (
+      (await this.#connection.sendRequest(
+        schema.AGENT_METHODS.session_cancel_tool_call,
+        params,
+      )) ?? {}
+    );
+  }
+
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Lists the sessions the Agent currently holds.
+   *
+   * Only available if the Agent supports the `listSessions` capability.
+   */
+  async listSessions(
+    params: schema.ListSessionsRequest,
+  ): Promise<schema.ListSessionsResponse> {
+    return await this.#connection.sendRequest(
+      schema.AGENT_METHODS.session_list,
+      params,
+    );
+  }
+
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Lists the quick toggles a session offers.
+   *
+   * Only available if the Agent supports the `sessionFlags` capability.
+   */
+  async listSessionFlags(
+    params: schema.ListSessionFlagsRequest,
+  ): Promise<schema.ListSessionFlagsResponse> {
+    return await this.#connection.sendRequest(
+      schema.AGENT_METHODS.session_list_flags,
+      params,
+    );
+  }
+
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Turns one of the session's flags on or off.
+   *
+   * Only available if the Agent supports the `sessionFlags` capability.
+   */
+  async setSessionFlag(
+    params: schema.SetSessionFlagRequest,
+  ): Promise<schema.SetSessionFlagResponse> {
+    return (
+      (await this.#connection.sendRequest(
+        schema.AGENT_METHODS.session_set_flag,
+        params,
+      )) ?? {}
+    );
+  }
+
   /**
    * Authenticates the client using the specified authentication method.
    *
@@ -662,6 +879,24 @@ export class ClientSideConnection implements Agent {
     );
   }
 
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Sends output produced by a terminal since the previous update.
+   *
+   * Only send this if the Agent supports the `terminalOutputUpdates` capability.
+   */
+  async terminalOutputUpdate(
+    params: schema.TerminalOutputUpdateNotification,
+  ): Promise<void> {
+    return await this.#connection.sendNotification(
+      schema.AGENT_METHODS.terminal_output_update,
+      params,
+    );
+  }
+
   /**
    * Extension method
    *
@@ -902,6 +1137,27 @@ class Connection {
   }
 }
 
+/**
+ * Describes a parameter that failed validation, sent as
+ * `{ "errors": [...] }` in the data of an invalid params error.
+ */
+export type ValidationErrorData = {
+  /**
+   * The path to the rejected field, e.g. `mcpServers[0].command`.
+   *
+   * Empty if the problem isn't tied to a single field.
+   */
+  field: string;
+  /**
+   * Why the field was rejected.
+   */
+  reason: string;
+  /**
+   * The rejected value, if it helps to show it.
+   */
+  got?: unknown;
+};
+
 /**
  * JSON-RPC error object.
  *
@@ -951,6 +1207,13 @@ export class RequestError extends Error {
     return new RequestError(-32602, "Invalid params", data);
   }
 
+  /**
+   * Invalid method parameter(s), with details about each rejected field.
+   */
+  static invalidFields(errors: ValidationErrorData[]): RequestError {
+    return RequestError.invalidParams({ errors });
+  }
+
   /**
    * Internal JSON-RPC error.
    */
@@ -972,6 +1235,23 @@ export class RequestError extends Error {
     return new RequestError(-32002, "Resource not found", uri && { uri });
   }
 
+  /**
+   * The session doesn't exist, e.g. because it expired.
+   */
+  static unknownSession(sessionId: string): RequestError {
+    return new RequestError(-32003, "Unknown session", { sessionId });
+  }
+
+  /**
+   * The method belongs to an optional capability that isn't supported, e.g.
+   * `terminal` for `terminal/create`.
+   */
+  static capabilityNotSupported(capability: string): RequestError {
+    return new RequestError(-32004, "Capability not supported", {
+      capability,
+    });
+  }
+
   toResult<T>(): Result<T> {
     return {
       error: {
@@ -1121,6 +1401,54 @@ export interface Client {
     params: schema.KillTerminalCommandRequest,
   ): Promise<schema.KillTerminalResponse | void>;
 
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Reads the contents of a resource by its URI.
+   *
+   * Only available if the Client supports the `readResource` capability.
+   *
+   * This allows the Agent to dereference `resource_link` content blocks, including
+   * resources provided by MCP servers connected to the Client.
+   */
+  readResource?(
+    params: schema.ReadResourceRequest,
+  ): Promise<schema.ReadResourceResponse>;
+
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Opens a file or URI in the Client's editor, optionally at a given position.
+   *
+   * Only available if the Client supports the `open` capability.
+   *
+   * This lets the Agent direct the user's attention to a location it refers to,
+   * such as the definition it just explained.
+   */
+  open?(params: schema.OpenRequest): Promise<schema.OpenResponse | void>;
+
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Asks the user a question and returns their free-form answer.
+   *
+   * Only available if the Client supports the `requestInput` capability.
+   *
+   * Unlike `requestPermission`, the user answers with text rather than by
+   * picking an option, e.g. to clarify an ambiguous request in the middle of
+   * a prompt turn. If the turn is cancelled, the Client MUST respond with the
+   * `cancelled` outcome.
+   */
+  requestInput?(
+    params: schema.RequestInputRequest,
+  ): Promise<schema.RequestInputResponse>;
+
   /**
    * Extension method
    *
@@ -1227,6 +1555,67 @@ export interface Agent {
   setSessionModel?(
     params: schema.SetSessionModelRequest,
   ): Promise<schema.SetSessionModelResponse | void>;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Cancels a single tool call while letting the rest of the prompt turn continue.
+   *
+   * Only available if the Agent supports the `cancelToolCall` capability.
+   * The Agent SHOULD stop the operation as soon as possible and report it to the
+   * Client with a `tool_call_update` whose status is `failed`.
+   */
+  cancelToolCall?(
+    params: schema.CancelToolCallRequest,
+  ): Promise<schema.CancelToolCallResponse | void>;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Lists the sessions the Agent currently holds.
+   *
+   * Only available if the Agent supports the `listSessions` capability.
+   *
+   * Clients can use this to reattach to existing sessions, for example after
+   * reconnecting or when opening another window, instead of always creating new ones.
+   */
+  listSessions?(
+    params: schema.ListSessionsRequest,
+  ): Promise<schema.ListSessionsResponse>;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Lists the quick toggles a session offers, such as a mode that skips
+   * permission prompts.
+   *
+   * Only available if the Agent supports the `sessionFlags` capability.
+   *
+   * Unlike session modes, any number of flags can be enabled at once.
+   * Clients use this to discover the flags they can offer in their UI.
+   */
+  listSessionFlags?(
+    params: schema.ListSessionFlagsRequest,
+  ): Promise<schema.ListSessionFlagsResponse>;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Turns one of the session's flags on or off.
+   *
+   * Only available if the Agent supports the `sessionFlags` capability.
+   *
+   * The flag must be one of those returned by `session/list_flags`. Like
+   * `session/set_mode`, this can be called whether the Agent is idle or
+   * actively generating a response.
+   */
+  setSessionFlag?(
+    params: schema.SetSessionFlagRequest,
+  ): Promise<schema.SetSessionFlagResponse | void>;
   /**
    * Authenticates the client using the specified authentication method.
    *
@@ -1269,6 +1658,19 @@ export interface Agent {
    * See protocol docs: [Cancellation](https://agentclientprotocol.com/protocol/prompt-turn#cancellation)
    */
   cancel(params: schema.CancelNotification): Promise<void>;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Receives output produced by a terminal since the previous update.
+   *
+   * Only sent by the Client if the Agent supports the `terminalOutputUpdates` capability.
+   * This lets the Agent follow a running command live instead of polling `terminal/output`.
+   */
+  terminalOutputUpdate?(
+    params: schema.TerminalOutputUpdateNotification,
+  ): Promise<void>;
 
   /**
    * Extension method
@@ -61,6 +61,9 @@ class ExampleClient implements acp.Client {
           `\n🔧 Tool call \`${update.toolCallId}\` updated: ${update.status}\n`,
         );
         break;
+      case "warning":
+        console.log(`\n⚠️  ${update.message}`);
+        break;
       case "plan":
       case "agent_thought_chunk":
       case "user_message_chunk":
@@ -125,6 +128,7 @@ async function main() {
           readTextFile: true,
           writeTextFile: true,
         },
+        warningUpdates: true,
       },
     });
 
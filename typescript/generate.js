@@ -26,6 +26,8 @@ export const CLIENT_METHODS = ${JSON.stringify(metadata.clientMethods, null, 2)}
 
 export const PROTOCOL_VERSION = ${metadata.version};
 
+export const MIN_PROTOCOL_VERSION = ${metadata.minVersion};
+
 import { z } from "zod";
 
 ${markSpecificTypesAsInternal(tsSrc)}
@@ -2,16 +2,24 @@ export const AGENT_METHODS = {
   authenticate: "authenticate",
   initialize: "initialize",
   session_cancel: "session/cancel",
+  session_cancel_tool_call: "session/cancel_tool_call",
+  session_list: "session/list",
+  session_list_flags: "session/list_flags",
   session_load: "session/load",
   session_new: "session/new",
   session_prompt: "session/prompt",
+  session_set_flag: "session/set_flag",
   session_set_mode: "session/set_mode",
   session_set_model: "session/set_model",
+  terminal_output_update: "terminal/output_update",
 } as const;
 
 export const CLIENT_METHODS = {
+  client_open: "client/open",
   fs_read_text_file: "fs/read_text_file",
   fs_write_text_file: "fs/write_text_file",
+  resource_read: "resource/read",
+  session_request_input: "session/request_input",
   session_request_permission: "session/request_permission",
   session_update: "session/update",
   terminal_create: "terminal/create",
@@ -23,6 +31,8 @@ export const CLIENT_METHODS = {
 
 export const PROTOCOL_VERSION = 1;
 
+export const MIN_PROTOCOL_VERSION = 1;
+
 import { z } from "zod";
 
 export type AgentClientProtocol =
@@ -50,6 +60,9 @@ export type ClientRequest =
   | ReleaseTerminalRequest
   | WaitForTerminalExitRequest
   | KillTerminalCommandRequest
+  | ReadResourceRequest
+  | OpenRequest
+  | RequestInputRequest
   | ExtMethodRequest;
 /**
  * Content produced by a tool call.
@@ -123,9 +136,20 @@ export type ToolCallContent =
             };
             annotations?: Annotations | null;
             description?: string | null;
+            /**
+             * The last line of the referenced range, 1-based and inclusive.
+             */
+            endLine?: number | null;
             mimeType?: string | null;
             name: string;
             size?: number | null;
+            /**
+             * The first line of the referenced range, 1-based.
+             *
+             * Lets clients highlight the part of the resource the link refers to,
+             * or open it at that location.
+             */
+            startLine?: number | null;
             title?: string | null;
             type: "resource_link";
             uri: string;
@@ -223,6 +247,9 @@ export type ClientResponse =
   | ReleaseTerminalResponse
   | WaitForTerminalExitResponse
   | KillTerminalResponse
+  | ReadResourceResponse
+  | OpenResponse
+  | RequestInputResponse
   | ExtMethodResponse;
 /**
  * All possible notifications that a client can send to an agent.
@@ -233,7 +260,10 @@ export type ClientResponse =
  * Notifications do not expect a response.
  */
 /** @internal */
-export type ClientNotification = CancelNotification | ExtNotification;
+export type ClientNotification =
+  | CancelNotification
+  | TerminalOutputUpdateNotification
+  | ExtNotification;
 /**
  * All possible requests that a client can send to an agent.
  *
@@ -251,6 +281,10 @@ export type AgentRequest =
   | SetSessionModeRequest
   | PromptRequest
   | SetSessionModelRequest
+  | CancelToolCallRequest
+  | ListSessionsRequest
+  | ListSessionFlagsRequest
+  | SetSessionFlagRequest
   | ExtMethodRequest1;
 /**
  * Configuration for connecting to an MCP (Model Context Protocol) server.
@@ -354,9 +388,20 @@ export type ContentBlock =
       };
       annotations?: Annotations | null;
       description?: string | null;
+      /**
+       * The last line of the referenced range, 1-based and inclusive.
+       */
+      endLine?: number | null;
       mimeType?: string | null;
       name: string;
       size?: number | null;
+      /**
+       * The first line of the referenced range, 1-based.
+       *
+       * Lets clients highlight the part of the resource the link refers to,
+       * or open it at that location.
+       */
+      startLine?: number | null;
       title?: string | null;
       type: "resource_link";
       uri: string;
@@ -389,6 +434,10 @@ export type AgentResponse =
   | SetSessionModeResponse
   | PromptResponse
   | SetSessionModelResponse
+  | CancelToolCallResponse
+  | ListSessionsResponse
+  | ListSessionFlagsResponse
+  | SetSessionFlagResponse
   | ExtMethodResponse1;
 /**
  * Unique identifier for a Session Mode.
@@ -421,10 +470,23 @@ export interface WriteTextFileRequest {
   _meta?: {
     [k: string]: unknown;
   };
+  /**
+   * Whether to append the content to the file instead of replacing it.
+   *
+   * Only allowed if the client supports the `fs.appendTextFile` capability.
+   */
+  append?: boolean;
   /**
    * The text content to write to the file.
    */
   content: string;
+  /**
+   * Whether this is the last chunk of a file written in several requests.
+   *
+   * Clients MAY wait for it before e.g. formatting or saving the file.
+   * Only allowed if the client supports the `fs.appendTextFile` capability.
+   */
+  eof?: boolean;
   /**
    * Absolute path to the file to write.
    */
@@ -486,6 +548,26 @@ export interface RequestPermissionRequest {
    */
   sessionId: string;
   toolCall: ToolCallUpdate;
+  /**
+   * Further tool calls covered by the same request, e.g. when the agent
+   * plans several file edits at once.
+   *
+   * The Client SHOULD present them together with `tool_call` as a
+   * single prompt, and the selected option applies to all of them. Only
+   * sent to clients that advertise the `permissionBatches` capability,
+   * since other clients would only show the first tool call.
+   *
+   * See protocol docs: [Requesting Permission](https://agentclientprotocol.com/protocol/tool-calls#requesting-permission)
+   */
+  toolCalls?: ToolCallUpdate[];
+  /**
+   * The turn this request belongs to, if the turn was started with a
+   * [`PromptRequest::turn_id`](crate::PromptRequest::turn_id).
+   *
+   * Agents running concurrent turns SHOULD set this so that clients can
+   * tell which turn is asking.
+   */
+  turnId?: string | null;
 }
 /**
  * An option presented to the user when requesting permission.
@@ -694,6 +776,14 @@ export interface TerminalOutputRequest {
   _meta?: {
     [k: string]: unknown;
   };
+  /**
+   * Maximum number of output bytes to return.
+   *
+   * If the output is longer, the Client returns only its last bytes, truncated at a
+   * character boundary, and sets `truncated`. This doesn't affect the output the
+   * Client retains for later requests.
+   */
+  outputByteLimit?: number | null;
   /**
    * The session ID for this request.
    */
@@ -760,6 +850,89 @@ export interface KillTerminalCommandRequest {
    */
   terminalId: string;
 }
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Request to read the contents of a resource.
+ *
+ * Only available if the Client supports the `readResource` capability.
+ */
+export interface ReadResourceRequest {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The session ID for this request.
+   */
+  sessionId: string;
+  /**
+   * The URI of the resource to read.
+   */
+  uri: string;
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Request to open a location in the Client's editor.
+ *
+ * Only available if the Client supports the `open` capability.
+ */
+export interface OpenRequest {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * Column to place the cursor at (1-based). Ignored without a `line`.
+   */
+  column?: number | null;
+  /**
+   * Line to reveal (1-based).
+   */
+  line?: number | null;
+  /**
+   * The session ID for this request.
+   */
+  sessionId: string;
+  /**
+   * The URI of the file or resource to open.
+   */
+  uri: string;
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Request for a free-form answer from the user.
+ *
+ * Only available if the Client supports the `requestInput` capability.
+ */
+export interface RequestInputRequest {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The question to show the user.
+   */
+  prompt: string;
+  /**
+   * The session ID for this request.
+   */
+  sessionId: string;
+}
 export interface ExtMethodRequest {
   [k: string]: unknown;
 }
@@ -909,6 +1082,69 @@ export interface KillTerminalResponse {
     [k: string]: unknown;
   };
 }
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Response containing the contents of a resource.
+ */
+export interface ReadResourceResponse {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The contents of the resource.
+   */
+  resource: EmbeddedResourceResource;
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Response to `client/open`.
+ */
+export interface OpenResponse {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Response to `session/request_input`.
+ */
+export interface RequestInputResponse {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The user's answer.
+   */
+  outcome:
+    | {
+        outcome: "cancelled";
+      }
+    | {
+        outcome: "submitted";
+        /**
+         * The text the user entered.
+         */
+        text: string;
+      };
+}
 export interface ExtMethodResponse {
   [k: string]: unknown;
 }
@@ -924,10 +1160,59 @@ export interface CancelNotification {
   _meta?: {
     [k: string]: unknown;
   };
+  /**
+   * Why the turn is being cancelled, if the client knows.
+   *
+   * Agents may use this for logging or to adapt their cleanup, but MUST handle
+   * the cancellation the same way whether or not a reason is given.
+   */
+  reason?: CancelReason | null;
   /**
    * The ID of the session to cancel operations for.
    */
   sessionId: string;
+  /**
+   * The turn to cancel, for agents that support
+   * [`AgentCapabilities::concurrent_turns`].
+   *
+   * When omitted, every running turn of the session is cancelled.
+   */
+  turnId?: string | null;
+}
+/**
+ * Why a client cancelled a prompt turn.
+ *
+ * See protocol docs: [Cancellation](https://agentclientprotocol.com/protocol/prompt-turn#cancellation)
+ */
+export type CancelReason = "user_requested" | "client_closing" | "timeout";
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Notification carrying output a terminal produced since the previous update.
+ *
+ * Only sent if the Agent supports the `terminalOutputUpdates` capability.
+ */
+export interface TerminalOutputUpdateNotification {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * Output produced since the previous update, to be appended to it.
+   */
+  output: string;
+  /**
+   * The session ID the terminal belongs to.
+   */
+  sessionId: string;
+  /**
+   * The ID of the terminal that produced the output.
+   */
+  terminalId: string;
 }
 export interface ExtNotification {
   [k: string]: unknown;
@@ -947,6 +1232,12 @@ export interface InitializeRequest {
     [k: string]: unknown;
   };
   clientCapabilities?: ClientCapabilities;
+  /**
+   * Information about the client's implementation.
+   *
+   * Older clients don't send this, so Agents should not rely on it.
+   */
+  clientInfo?: Implementation | null;
   /**
    * The latest protocol version supported by the client.
    */
@@ -962,11 +1253,76 @@ export interface ClientCapabilities {
   _meta?: {
     [k: string]: unknown;
   };
+  /**
+   * Whether the Client can read compressed messages.
+   *
+   * Messages are only compressed once both sides advertise this.
+   *
+   * See protocol docs: [Compression](https://agentclientprotocol.com/protocol/initialization#compression)
+   */
+  compression?: boolean;
   fs?: FileSystemCapability;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Whether the Client supports `client/open`.
+   */
+  open?: boolean;
+  /**
+   * Whether the Client shows every tool call of a `session/request_permission`
+   * request that lists further calls in `toolCalls`.
+   *
+   * Agents must ask for permission for each tool call separately when this is
+   * `false`, since the user would only see the first one.
+   */
+  permissionBatches?: boolean;
+  /**
+   * Whether the Client can apply `plan_entry_update` session updates.
+   *
+   * Agents must fall back to sending the full plan when this is `false`.
+   */
+  planEntryUpdates?: boolean;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Whether the Client supports `resource/read`.
+   */
+  readResource?: boolean;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Whether the Client supports `session/request_input`.
+   */
+  requestInput?: boolean;
   /**
    * Whether the Client support all `terminal/*` methods.
    */
   terminal?: boolean;
+  /**
+   * Whether the Client can display `turn_status` session updates.
+   *
+   * Agents must not send them when this is `false`.
+   */
+  turnStatusUpdates?: boolean;
+  /**
+   * Whether the Client can display `usage_update` session updates.
+   *
+   * Agents must not send them when this is `false`. Usage reported in the
+   * `session/prompt` response is optional and may always be sent.
+   */
+  usageUpdates?: boolean;
+  /**
+   * Whether the Client can display `warning` session updates.
+   *
+   * Agents must not send them when this is `false`.
+   */
+  warningUpdates?: boolean;
 }
 /**
  * File system capabilities supported by the client.
@@ -979,6 +1335,11 @@ export interface FileSystemCapability {
   _meta?: {
     [k: string]: unknown;
   };
+  /**
+   * Whether the Client supports the `append` and `eof` fields of
+   * `fs/write_text_file`, letting agents write large files in chunks.
+   */
+  appendTextFile?: boolean;
   /**
    * Whether the Client supports `fs/read_text_file` requests.
    */
@@ -988,6 +1349,30 @@ export interface FileSystemCapability {
    */
   writeTextFile?: boolean;
 }
+/**
+ * The name and version of a Client or Agent implementation.
+ *
+ * Exchanged during initialization so each side can identify its peer,
+ * e.g. for logging, telemetry, or working around issues in specific versions.
+ *
+ * See protocol docs: [Implementation Information](https://agentclientprotocol.com/protocol/initialization#implementation-information)
+ */
+export interface Implementation {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The name of the implementation, e.g. `zed` or `claude-code`.
+   */
+  name: string;
+  /**
+   * The version of the implementation, e.g. `0.207.0`.
+   */
+  version: string;
+}
 /**
  * Request parameters for the authenticate method.
  *
@@ -1022,6 +1407,14 @@ export interface NewSessionRequest {
    * The working directory for this session. Must be an absolute path.
    */
   cwd: string;
+  /**
+   * Instructions the Agent applies to every prompt turn of the session, like a system prompt.
+   *
+   * They are sent once instead of being prepended to each prompt. When a prompt conflicts with them, the prompt takes precedence for that turn. Instructions follow the same content rules as prompts, see [`PromptCapabilities`].
+   *
+   * See protocol docs: [Session Instructions](https://agentclientprotocol.com/protocol/session-setup#session-instructions)
+   */
+  instructions?: ContentBlock[];
   /**
    * List of MCP (Model Context Protocol) servers the agent should connect to.
    */
@@ -1149,6 +1542,17 @@ export interface PromptRequest {
    * The ID of the session to send this user message to
    */
   sessionId: string;
+  /**
+   * Identifies this turn among the session's running turns.
+   *
+   * Only sent to agents that advertise [`AgentCapabilities::concurrent_turns`],
+   * which then run the turn alongside the other turns of the session
+   * instead of cancelling them. The id MUST be unique among the session's
+   * running turns.
+   *
+   * See protocol docs: [Concurrent Turns](https://agentclientprotocol.com/protocol/prompt-turn#concurrent-turns)
+   */
+  turnId?: string | null;
 }
 /**
  * **UNSTABLE**
@@ -1173,6 +1577,98 @@ export interface SetSessionModelRequest {
    */
   sessionId: string;
 }
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Request parameters for cancelling a single tool call.
+ *
+ * Only available if the Agent supports the `cancelToolCall` capability.
+ */
+export interface CancelToolCallRequest {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The ID of the session the tool call belongs to.
+   */
+  sessionId: string;
+  /**
+   * The ID of the tool call to cancel.
+   */
+  toolCallId: string;
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Request parameters for listing the sessions an Agent holds.
+ *
+ * Only available if the Agent supports the `listSessions` capability.
+ */
+export interface ListSessionsRequest {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Request parameters for listing the flags of a session.
+ *
+ * Only available if the Agent supports the `sessionFlags` capability.
+ */
+export interface ListSessionFlagsRequest {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The ID of the session to list the flags of.
+   */
+  sessionId: string;
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Request parameters for turning a session flag on or off.
+ *
+ * Only available if the Agent supports the `sessionFlags` capability.
+ */
+export interface SetSessionFlagRequest {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * Whether to turn the flag on or off.
+   */
+  enabled: boolean;
+  /**
+   * The name of the flag, as returned by `session/list_flags`.
+   */
+  name: string;
+  /**
+   * The ID of the session to set the flag for.
+   */
+  sessionId: string;
+}
 export interface ExtMethodRequest1 {
   [k: string]: unknown;
 }
@@ -1191,6 +1687,12 @@ export interface InitializeResponse {
     [k: string]: unknown;
   };
   agentCapabilities?: AgentCapabilities;
+  /**
+   * Information about the agent's implementation.
+   *
+   * Older agents don't send this, so Clients should not rely on it.
+   */
+  agentInfo?: Implementation | null;
   /**
    * Authentication methods supported by the agent.
    */
@@ -1210,15 +1712,71 @@ export interface AgentCapabilities {
   /**
    * Extension point for implementations
    */
-  _meta?: {
-    [k: string]: unknown;
-  };
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Whether the agent supports `session/cancel_tool_call`.
+   */
+  cancelToolCall?: boolean;
+  /**
+   * Whether the agent can read compressed messages.
+   *
+   * Messages are only compressed once both sides advertise this.
+   *
+   * See protocol docs: [Compression](https://agentclientprotocol.com/protocol/initialization#compression)
+   */
+  compression?: boolean;
+  /**
+   * Whether the agent can run several prompt turns of a session at once.
+   *
+   * When enabled, the Client may identify turns with
+   * [`PromptRequest::turn_id`] and cancel them one at a time.
+   *
+   * See protocol docs: [Concurrent Turns](https://agentclientprotocol.com/protocol/prompt-turn#concurrent-turns)
+   */
+  concurrentTurns?: boolean;
+  /**
+   * Whether the agent sends a `drained` session update once it has stopped
+   * all work for a prompt turn.
+   *
+   * Clients can only wait for a turn to drain when this is `true`.
+   */
+  drainUpdates?: boolean;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Whether the agent supports `session/list`.
+   */
+  listSessions?: boolean;
   /**
    * Whether the agent supports `session/load`.
    */
   loadSession?: boolean;
   mcpCapabilities?: McpCapabilities;
   promptCapabilities?: PromptCapabilities;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Whether the agent supports `session/list_flags` and `session/set_flag`.
+   */
+  sessionFlags?: boolean;
+  /**
+   * **UNSTABLE**
+   *
+   * This capability is not part of the spec yet, and may be removed or changed at any point.
+   *
+   * Whether the agent wants to receive `terminal/output_update` notifications.
+   */
+  terminalOutputUpdates?: boolean;
 }
 /**
  * MCP capabilities supported by the agent.
@@ -1264,6 +1822,15 @@ export interface PromptCapabilities {
    * Agent supports [`ContentBlock::Image`].
    */
   image?: boolean;
+  /**
+   * Agent can fetch images and audio referenced by URI.
+   *
+   * When enabled, the Client is allowed to send media as a
+   * [`ContentBlock::ResourceLink`] with an `image/*` or `audio/*` MIME type
+   * instead of embedding base64 data. Otherwise, the Client MUST inline the
+   * media as [`ContentBlock::Image`] or [`ContentBlock::Audio`].
+   */
+  mediaLinks?: boolean;
 }
 /**
  * Describes an available authentication method.
@@ -1469,6 +2036,30 @@ export interface PromptResponse {
     | "max_turn_requests"
     | "refusal"
     | "cancelled";
+  /**
+   * Tokens used during the turn, if the agent tracks them.
+   */
+  usage?: TokenUsage | null;
+}
+/**
+ * Tokens used by the language model behind the agent.
+ *
+ * See protocol docs: [Token Usage](https://agentclientprotocol.com/protocol/prompt-turn#token-usage)
+ */
+export interface TokenUsage {
+  /**
+   * Tokens sent to the model, including the prompt and any context.
+   */
+  inputTokens: number;
+  /**
+   * Tokens generated by the model.
+   */
+  outputTokens: number;
+  /**
+   * All tokens used. Usually the sum of input and output tokens, but may
+   * include others the agent is billed for, such as reasoning tokens.
+   */
+  totalTokens: number;
 }
 /**
  * **UNSTABLE**
@@ -1485,6 +2076,102 @@ export interface SetSessionModelResponse {
     [k: string]: unknown;
   };
 }
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Response to `session/cancel_tool_call` method.
+ */
+export interface CancelToolCallResponse {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Response from listing sessions.
+ */
+export interface ListSessionsResponse {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The IDs of the sessions the Agent currently holds.
+   */
+  sessions: string[];
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Response from listing the flags of a session.
+ */
+export interface ListSessionFlagsResponse {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * The flags the session offers, with their current state.
+   */
+  flags: SessionFlag[];
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * A quick toggle offered by a session, such as a mode that skips permission
+ * prompts.
+ */
+export interface SessionFlag {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+  /**
+   * Human-readable description of what the flag does.
+   */
+  description?: string | null;
+  /**
+   * Whether the flag is currently on.
+   */
+  enabled: boolean;
+  /**
+   * Identifies the flag in `session/set_flag` requests.
+   */
+  name: string;
+}
+/**
+ * **UNSTABLE**
+ *
+ * This capability is not part of the spec yet, and may be removed or changed at any point.
+ *
+ * Response to `session/set_flag` method.
+ */
+export interface SetSessionFlagResponse {
+  /**
+   * Extension point for implementations
+   */
+  _meta?: {
+    [k: string]: unknown;
+  };
+}
 export interface ExtMethodResponse1 {
   [k: string]: unknown;
 }
@@ -1506,6 +2193,14 @@ export interface SessionNotification {
    * The ID of the session this update pertains to.
    */
   sessionId: string;
+  /**
+   * The turn this update belongs to, if the turn was started with a
+   * [`PromptRequest::turn_id`](crate::PromptRequest::turn_id).
+   *
+   * Agents running concurrent turns SHOULD set this so that clients can
+   * tell the turns' output apart.
+   */
+  turnId?: string | null;
   /**
    * The actual update content.
    */
@@ -1640,6 +2335,23 @@ export interface SessionNotification {
         entries: PlanEntry[];
         sessionUpdate: "plan";
       }
+    | {
+        /**
+         * Extension point for implementations
+         */
+        _meta?: {
+          [k: string]: unknown;
+        };
+        /**
+         * The id of the plan entry being updated.
+         */
+        entryId: string;
+        sessionUpdate: "plan_entry_update";
+        /**
+         * The new execution status of the entry.
+         */
+        status: "pending" | "in_progress" | "completed";
+      }
     | {
         availableCommands: AvailableCommand[];
         sessionUpdate: "available_commands_update";
@@ -1647,6 +2359,39 @@ export interface SessionNotification {
     | {
         currentModeId: SessionModeId;
         sessionUpdate: "current_mode_update";
+      }
+    | {
+        /**
+         * Human-readable description of the problem.
+         */
+        message: string;
+        sessionUpdate: "warning";
+      }
+    | {
+        sessionUpdate: "turn_status";
+        /**
+         * Number of tool calls completed so far in this turn.
+         */
+        toolCallsCompleted: number;
+      }
+    | {
+        /**
+         * Tokens sent to the model, including the prompt and any context.
+         */
+        inputTokens: number;
+        /**
+         * Tokens generated by the model.
+         */
+        outputTokens: number;
+        sessionUpdate: "usage_update";
+        /**
+         * All tokens used. Usually the sum of input and output tokens, but may
+         * include others the agent is billed for, such as reasoning tokens.
+         */
+        totalTokens: number;
+      }
+    | {
+        sessionUpdate: "drained";
       };
 }
 /**
@@ -1667,6 +2412,12 @@ export interface PlanEntry {
    * Human-readable description of what this task aims to accomplish.
    */
   content: string;
+  /**
+   * Stable identifier for this entry within the plan.
+   *
+   * Required for the entry to be targeted by a [`PlanEntryUpdate`].
+   */
+  id?: string | null;
   /**
    * The relative importance of this task.
    * Used to indicate which tasks are most critical to the overall goal.
@@ -1716,7 +2467,9 @@ export interface ExtNotification1 {
 /** @internal */
 export const writeTextFileRequestSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
+  append: z.boolean().optional(),
   content: z.string(),
+  eof: z.boolean().optional(),
   path: z.string(),
   sessionId: z.string(),
 });
@@ -1733,6 +2486,7 @@ export const readTextFileRequestSchema = z.object({
 /** @internal */
 export const terminalOutputRequestSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
+  outputByteLimit: z.number().optional().nullable(),
   sessionId: z.string(),
   terminalId: z.string(),
 });
@@ -1758,6 +2512,29 @@ export const killTerminalCommandRequestSchema = z.object({
   terminalId: z.string(),
 });
 
+/** @internal */
+export const readResourceRequestSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  sessionId: z.string(),
+  uri: z.string(),
+});
+
+/** @internal */
+export const openRequestSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  column: z.number().optional().nullable(),
+  line: z.number().optional().nullable(),
+  sessionId: z.string(),
+  uri: z.string(),
+});
+
+/** @internal */
+export const requestInputRequestSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  prompt: z.string(),
+  sessionId: z.string(),
+});
+
 /** @internal */
 export const extMethodRequestSchema = z.record(z.unknown());
 
@@ -1850,13 +2627,49 @@ export const killTerminalResponseSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
 });
 
+/** @internal */
+export const openResponseSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+});
+
+/** @internal */
+export const requestInputResponseSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  outcome: z.union([
+    z.object({
+      outcome: z.literal("cancelled"),
+    }),
+    z.object({
+      outcome: z.literal("submitted"),
+      text: z.string(),
+    }),
+  ]),
+});
+
 /** @internal */
 export const extMethodResponseSchema = z.record(z.unknown());
 
+/** @internal */
+export const cancelReasonSchema = z.union([
+  z.literal("user_requested"),
+  z.literal("client_closing"),
+  z.literal("timeout"),
+]);
+
 /** @internal */
 export const cancelNotificationSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
+  reason: cancelReasonSchema.optional().nullable(),
+  sessionId: z.string(),
+  turnId: z.string().optional().nullable(),
+});
+
+/** @internal */
+export const terminalOutputUpdateNotificationSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  output: z.string(),
   sessionId: z.string(),
+  terminalId: z.string(),
 });
 
 /** @internal */
@@ -1882,6 +2695,32 @@ export const setSessionModelRequestSchema = z.object({
   sessionId: z.string(),
 });
 
+/** @internal */
+export const cancelToolCallRequestSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  sessionId: z.string(),
+  toolCallId: z.string(),
+});
+
+/** @internal */
+export const listSessionsRequestSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+});
+
+/** @internal */
+export const listSessionFlagsRequestSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  sessionId: z.string(),
+});
+
+/** @internal */
+export const setSessionFlagRequestSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  enabled: z.boolean(),
+  name: z.string(),
+  sessionId: z.string(),
+});
+
 /** @internal */
 export const extMethodRequest1Schema = z.record(z.unknown());
 
@@ -1906,6 +2745,12 @@ export const embeddedResourceResourceSchema = z.union([
   blobResourceContentsSchema,
 ]);
 
+/** @internal */
+export const readResourceResponseSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  resource: embeddedResourceResourceSchema,
+});
+
 /** @internal */
 export const authenticateResponseSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
@@ -1916,6 +2761,13 @@ export const setSessionModeResponseSchema = z.object({
   meta: z.unknown().optional(),
 });
 
+/** @internal */
+export const tokenUsageSchema = z.object({
+  inputTokens: z.number(),
+  outputTokens: z.number(),
+  totalTokens: z.number(),
+});
+
 /** @internal */
 export const promptResponseSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
@@ -1926,6 +2778,7 @@ export const promptResponseSchema = z.object({
     z.literal("refusal"),
     z.literal("cancelled"),
   ]),
+  usage: tokenUsageSchema.optional().nullable(),
 });
 
 /** @internal */
@@ -1933,6 +2786,36 @@ export const setSessionModelResponseSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
 });
 
+/** @internal */
+export const cancelToolCallResponseSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+});
+
+/** @internal */
+export const listSessionsResponseSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  sessions: z.array(z.string()),
+});
+
+/** @internal */
+export const sessionFlagSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  description: z.string().optional().nullable(),
+  enabled: z.boolean(),
+  name: z.string(),
+});
+
+/** @internal */
+export const listSessionFlagsResponseSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  flags: z.array(sessionFlagSchema),
+});
+
+/** @internal */
+export const setSessionFlagResponseSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+});
+
 /** @internal */
 export const extMethodResponse1Schema = z.record(z.unknown());
 
@@ -1989,9 +2872,11 @@ export const toolCallContentSchema = z.union([
         _meta: z.record(z.unknown()).optional(),
         annotations: annotationsSchema.optional().nullable(),
         description: z.string().optional().nullable(),
+        endLine: z.number().optional().nullable(),
         mimeType: z.string().optional().nullable(),
         name: z.string(),
         size: z.number().optional().nullable(),
+        startLine: z.number().optional().nullable(),
         title: z.string().optional().nullable(),
         type: z.literal("resource_link"),
         uri: z.string(),
@@ -2042,6 +2927,7 @@ export const terminalExitStatusSchema = z.object({
 /** @internal */
 export const fileSystemCapabilitySchema = z.object({
   _meta: z.record(z.unknown()).optional(),
+  appendTextFile: z.boolean().optional(),
   readTextFile: z.boolean().optional(),
   writeTextFile: z.boolean().optional(),
 });
@@ -2098,9 +2984,11 @@ export const contentBlockSchema = z.union([
     _meta: z.record(z.unknown()).optional(),
     annotations: annotationsSchema.optional().nullable(),
     description: z.string().optional().nullable(),
+    endLine: z.number().optional().nullable(),
     mimeType: z.string().optional().nullable(),
     name: z.string(),
     size: z.number().optional().nullable(),
+    startLine: z.number().optional().nullable(),
     title: z.string().optional().nullable(),
     type: z.literal("resource_link"),
     uri: z.string(),
@@ -2134,6 +3022,7 @@ export const promptCapabilitiesSchema = z.object({
   audio: z.boolean().optional(),
   embeddedContext: z.boolean().optional(),
   image: z.boolean().optional(),
+  mediaLinks: z.boolean().optional(),
 });
 
 /** @internal */
@@ -2170,6 +3059,7 @@ export const sessionModeStateSchema = z.object({
 export const planEntrySchema = z.object({
   _meta: z.record(z.unknown()).optional(),
   content: z.string(),
+  id: z.string().optional().nullable(),
   priority: z.union([z.literal("high"), z.literal("medium"), z.literal("low")]),
   status: z.union([
     z.literal("pending"),
@@ -2184,6 +3074,7 @@ export const availableCommandInputSchema = unstructuredCommandInputSchema;
 /** @internal */
 export const clientNotificationSchema = z.union([
   cancelNotificationSchema,
+  terminalOutputUpdateNotificationSchema,
   extNotificationSchema,
 ]);
 
@@ -2210,6 +3101,7 @@ export const terminalOutputResponseSchema = z.object({
 export const newSessionRequestSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
   cwd: z.string(),
+  instructions: z.array(contentBlockSchema).optional(),
   mcpServers: z.array(mcpServerSchema),
 });
 
@@ -2226,6 +3118,7 @@ export const promptRequestSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
   prompt: z.array(contentBlockSchema),
   sessionId: z.string(),
+  turnId: z.string().optional().nullable(),
 });
 
 /** @internal */
@@ -2259,16 +3152,32 @@ export const toolCallUpdateSchema = z.object({
 /** @internal */
 export const clientCapabilitiesSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
+  compression: z.boolean().optional(),
   fs: fileSystemCapabilitySchema.optional(),
+  open: z.boolean().optional(),
+  permissionBatches: z.boolean().optional(),
+  planEntryUpdates: z.boolean().optional(),
+  readResource: z.boolean().optional(),
+  requestInput: z.boolean().optional(),
   terminal: z.boolean().optional(),
+  turnStatusUpdates: z.boolean().optional(),
+  usageUpdates: z.boolean().optional(),
+  warningUpdates: z.boolean().optional(),
 });
 
 /** @internal */
 export const agentCapabilitiesSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
+  cancelToolCall: z.boolean().optional(),
+  compression: z.boolean().optional(),
+  concurrentTurns: z.boolean().optional(),
+  drainUpdates: z.boolean().optional(),
+  listSessions: z.boolean().optional(),
   loadSession: z.boolean().optional(),
   mcpCapabilities: mcpCapabilitiesSchema.optional(),
   promptCapabilities: promptCapabilitiesSchema.optional(),
+  sessionFlags: z.boolean().optional(),
+  terminalOutputUpdates: z.boolean().optional(),
 });
 
 /** @internal */
@@ -2289,6 +3198,9 @@ export const clientResponseSchema = z.union([
   releaseTerminalResponseSchema,
   waitForTerminalExitResponseSchema,
   killTerminalResponseSchema,
+  readResourceResponseSchema,
+  openResponseSchema,
+  requestInputResponseSchema,
   extMethodResponseSchema,
 ]);
 
@@ -2298,12 +3210,22 @@ export const requestPermissionRequestSchema = z.object({
   options: z.array(permissionOptionSchema),
   sessionId: z.string(),
   toolCall: toolCallUpdateSchema,
+  toolCalls: z.array(toolCallUpdateSchema).optional(),
+  turnId: z.string().optional().nullable(),
+});
+
+/** @internal */
+export const implementationSchema = z.object({
+  _meta: z.record(z.unknown()).optional(),
+  name: z.string(),
+  version: z.string(),
 });
 
 /** @internal */
 export const initializeRequestSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
   clientCapabilities: clientCapabilitiesSchema.optional(),
+  clientInfo: implementationSchema.optional().nullable(),
   protocolVersion: z.number(),
 });
 
@@ -2311,6 +3233,7 @@ export const initializeRequestSchema = z.object({
 export const initializeResponseSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
   agentCapabilities: agentCapabilitiesSchema.optional(),
+  agentInfo: implementationSchema.optional().nullable(),
   authMethods: z.array(authMethodSchema).optional(),
   protocolVersion: z.number(),
 });
@@ -2319,6 +3242,7 @@ export const initializeResponseSchema = z.object({
 export const sessionNotificationSchema = z.object({
   _meta: z.record(z.unknown()).optional(),
   sessionId: z.string(),
+  turnId: z.string().optional().nullable(),
   update: z.union([
     z.object({
       content: contentBlockSchema,
@@ -2381,6 +3305,16 @@ export const sessionNotificationSchema = z.object({
       entries: z.array(planEntrySchema),
       sessionUpdate: z.literal("plan"),
     }),
+    z.object({
+      _meta: z.record(z.unknown()).optional(),
+      entryId: z.string(),
+      sessionUpdate: z.literal("plan_entry_update"),
+      status: z.union([
+        z.literal("pending"),
+        z.literal("in_progress"),
+        z.literal("completed"),
+      ]),
+    }),
     z.object({
       availableCommands: z.array(availableCommandSchema),
       sessionUpdate: z.literal("available_commands_update"),
@@ -2389,6 +3323,23 @@ export const sessionNotificationSchema = z.object({
       currentModeId: sessionModeIdSchema,
       sessionUpdate: z.literal("current_mode_update"),
     }),
+    z.object({
+      message: z.string(),
+      sessionUpdate: z.literal("warning"),
+    }),
+    z.object({
+      sessionUpdate: z.literal("turn_status"),
+      toolCallsCompleted: z.number(),
+    }),
+    z.object({
+      inputTokens: z.number(),
+      outputTokens: z.number(),
+      sessionUpdate: z.literal("usage_update"),
+      totalTokens: z.number(),
+    }),
+    z.object({
+      sessionUpdate: z.literal("drained"),
+    }),
   ]),
 });
 
@@ -2402,6 +3353,9 @@ export const clientRequestSchema = z.union([
   releaseTerminalRequestSchema,
   waitForTerminalExitRequestSchema,
   killTerminalCommandRequestSchema,
+  readResourceRequestSchema,
+  openRequestSchema,
+  requestInputRequestSchema,
   extMethodRequestSchema,
 ]);
 
@@ -2414,6 +3368,10 @@ export const agentRequestSchema = z.union([
   setSessionModeRequestSchema,
   promptRequestSchema,
   setSessionModelRequestSchema,
+  cancelToolCallRequestSchema,
+  listSessionsRequestSchema,
+  listSessionFlagsRequestSchema,
+  setSessionFlagRequestSchema,
   extMethodRequest1Schema,
 ]);
 
@@ -2426,6 +3384,10 @@ export const agentResponseSchema = z.union([
   setSessionModeResponseSchema,
   promptResponseSchema,
   setSessionModelResponseSchema,
+  cancelToolCallResponseSchema,
+  listSessionsResponseSchema,
+  listSessionFlagsResponseSchema,
+  setSessionFlagResponseSchema,
   extMethodResponse1Schema,
 ]);
 